@@ -0,0 +1,48 @@
+package schemaless
+
+import "context"
+
+// AuditSink records the mutations made through a DataStore, for a durable
+// record of who changed what. Record is called after a mutation succeeds,
+// with the context of the call, from which ActorFromContext recovers the
+// actor. It must be safe for concurrent use, and should not block for long:
+// it is called before the mutation returns.
+type AuditSink interface {
+	Record(ctx context.Context, op string, rowKey string, columnKey string, refKey int64)
+}
+
+// WithAuditSink records every PutCell, PutRow and DeleteRow, and the writes
+// of a Session, to sink. A cell written by PutCell through the batch writer
+// is recorded when it is flushed, with the actor of the PutCell that
+// buffered it.
+//
+// The other mutations are recorded too: CopyRow as "CopyRow" for every cell
+// copied, under the destination row key; MoveRow as "MoveRow" for both its
+// source and destination row keys, with no column; Repair as "Repair" for
+// the cell it re-sequenced, if it moved any version; and Import as "Import"
+// for every cell imported.
+func (ds *DataStore) WithAuditSink(sink AuditSink) *DataStore {
+	ds.auditSink = sink
+	return ds
+}
+
+func (ds *DataStore) audit(ctx context.Context, op string, rowKey string, columnKey string, refKey int64) {
+	if ds.auditSink != nil {
+		ds.auditSink.Record(ctx, op, rowKey, columnKey, refKey)
+	}
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx naming the user or service on whose
+// behalf the DataStore is called, for the AuditSink.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor named by WithActor, or "" if ctx names
+// none.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
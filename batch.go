@@ -0,0 +1,258 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"github.com/rbastic/go-schemaless/core"
+	"github.com/rbastic/go-schemaless/models"
+	"sync"
+	"time"
+)
+
+// batchBacklog is how many times maxItems cells the batch writer buffers
+// before PutCell waits for a flush.
+const batchBacklog = 4
+
+type pendingCell struct {
+	// ctx is the context of the PutCell, without its cancellation, so that
+	// the cell is written with its values: the actor, the tenant of a
+	// table resolver, the trace id, ...
+	ctx context.Context
+	// origin is the context the PutCell was called with, which cells are
+	// grouped by
+	origin context.Context
+	cell   models.Cell
+}
+
+// batchWriter buffers PutCell calls and writes them from a background
+// goroutine every interval, or as soon as maxItems are waiting. The cells of
+// a row put with the same context are written together.
+type batchWriter struct {
+	maxItems int
+	interval time.Duration
+	// write writes cells, all of rowKey
+	write func(ctx context.Context, rowKey string, cells []models.Cell) error
+
+	mu      sync.Mutex
+	pending []pendingCell
+	// err is the first error of a background flush, reported by the next
+	// call to flush.
+	err error
+
+	// slots holds a token for every buffered cell, bounding the buffer.
+	slots chan struct{}
+
+	// flushMu serializes flushes so that the cells of a row are written in
+	// the order they were put.
+	flushMu sync.Mutex
+
+	kick     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newBatchWriter(maxItems int, interval time.Duration, write func(ctx context.Context, rowKey string, cells []models.Cell) error) *batchWriter {
+	if maxItems < 1 {
+		maxItems = 1
+	}
+	b := &batchWriter{
+		maxItems: maxItems,
+		interval: interval,
+		write:    write,
+		slots:    make(chan struct{}, batchBacklog*maxItems),
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batchWriter) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		case <-b.kick:
+		}
+
+		err := b.flushPending()
+		if err != nil {
+			b.mu.Lock()
+			if b.err == nil {
+				b.err = err
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+// add buffers cell, whose RowKey, ColumnName and RefKey are set, waiting
+// for room while the buffer is full, unless ctx is done first.
+func (b *batchWriter) add(ctx context.Context, cell models.Cell) error {
+	select {
+	case b.slots <- struct{}{}:
+	default:
+		b.kickFlush()
+		select {
+		case b.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, pendingCell{ctx: context.WithoutCancel(ctx), origin: ctx, cell: cell})
+	full := len(b.pending) >= b.maxItems
+	b.mu.Unlock()
+
+	if full {
+		b.kickFlush()
+	}
+	return nil
+}
+
+func (b *batchWriter) kickFlush() {
+	select {
+	case b.kick <- struct{}{}:
+	default:
+	}
+}
+
+// sameContext reports whether a and b are the same context. Contexts of a
+// type that cannot be compared are never the same.
+func sameContext(a, b context.Context) (same bool) {
+	defer func() { recover() }()
+	return a == b
+}
+
+// flushPending writes everything buffered so far, a row and context at a
+// time. A cell that fails to write is dropped, and the first such error
+// returned.
+func (b *batchWriter) flushPending() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	var firstErr error
+	written := make([]bool, len(batch))
+	for i, p := range batch {
+		if written[i] {
+			continue
+		}
+		cells := []models.Cell{p.cell}
+		for j := i + 1; j < len(batch); j++ {
+			q := batch[j]
+			if !written[j] && q.cell.RowKey == p.cell.RowKey && sameContext(q.origin, p.origin) {
+				cells = append(cells, q.cell)
+				written[j] = true
+			}
+		}
+		err := b.write(p.ctx, p.cell.RowKey, cells)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for range batch {
+		<-b.slots
+	}
+	return firstErr
+}
+
+// flush writes everything buffered so far, and returns its own error or
+// else the first error of a background flush since the last call.
+func (b *batchWriter) flush(ctx context.Context) error {
+	err := b.flushPending()
+
+	b.mu.Lock()
+	if err == nil {
+		err = b.err
+	}
+	b.err = nil
+	b.mu.Unlock()
+
+	return err
+}
+
+// close stops the background goroutine and flushes what is left. It may be
+// called more than once.
+func (b *batchWriter) close(ctx context.Context) error {
+	b.stopOnce.Do(func() { close(b.stop) })
+	<-b.done
+	return b.flush(ctx)
+}
+
+// putBatch writes cells of rowKey flushed together by the batch writer: in
+// a single PutCells if there are several, none of them in a column whose
+// WritePolicy is Replace, and the storage can. Otherwise, or if one of them
+// already exists, it writes them one at a time, so that only the cells that
+// fail are dropped.
+func (ds *DataStore) putBatch(ctx context.Context, rowKey string, cells []models.Cell) error {
+	if len(cells) > 1 {
+		err := ds.putCells(ctx, rowKey, cells)
+		if err != errFallback {
+			return err
+		}
+	}
+
+	var firstErr error
+	for _, cell := range cells {
+		err := ds.putCell(ctx, rowKey, cell.ColumnName, cell.RefKey, cell)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// errFallback is returned by putCells when the cells must be written one at
+// a time instead.
+var errFallback = errors.New("write the cells one at a time")
+
+func (ds *DataStore) putCells(ctx context.Context, rowKey string, cells []models.Cell) error {
+	defer ds.observeSlow("PutCell", rowKey, time.Now())
+	row := make([]models.Cell, 0, len(cells))
+	for _, cell := range cells {
+		if ds.policy(cell.ColumnName) == Replace {
+			return errFallback
+		}
+		err := ds.checkColumn(cell.ColumnName)
+		if err != nil {
+			return errFallback
+		}
+		if cell.SchemaVersion == 0 {
+			cell.SchemaVersion = ds.schemaVersion
+		}
+		cell, err = ds.offloadBlob(ctx, lineage(ctx, cell))
+		if err != nil {
+			return err
+		}
+		row = append(row, cell)
+	}
+
+	err := ds.source.PutCells(ctx, ds.physicalKey(rowKey), row, false)
+	if err == core.ErrNotSupported || errors.Is(err, models.ErrCellExists) {
+		return errFallback
+	}
+	if err != nil {
+		return err
+	}
+	for _, cell := range cells {
+		ds.audit(ctx, "PutCell", rowKey, cell.ColumnName, cell.RefKey)
+		if ds.hotRows != nil {
+			ds.hotRows.add(rowKey, cell.ColumnName)
+		}
+	}
+	return nil
+}
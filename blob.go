@@ -0,0 +1,108 @@
+package schemaless
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+)
+
+// BlobStore keeps the bodies of cells too large to keep in the storage
+// itself, e.g. an object store; see WithBlobStore. PutBlob may be called
+// again with a key it already holds, with the same body. Both must be safe
+// for concurrent use.
+type BlobStore interface {
+	PutBlob(ctx context.Context, key string, body []byte) error
+	GetBlob(ctx context.Context, key string) ([]byte, error)
+}
+
+// BlobMetadataKey is the metadata key under which a cell whose body was
+// offloaded to the BlobStore keeps the key of its blob. Reads through the
+// DataStore remove it again.
+const BlobMetadataKey = "schemaless.blob"
+
+// WithBlobStore offloads the body of every cell written with more than
+// threshold bytes of body to blobs. The storage keeps the cell with a null
+// body and the key of the blob in its metadata, so it must be one that keeps
+// metadata (see models.Cell). Reads fetch the body back, so that the cell
+// reads as written. Blobs are keyed by the SHA-256 of the body, so a retried
+// write stores the same blob. Projected partition reads (see
+// PartitionReadProjected) project what the storage has, not the blob.
+func (ds *DataStore) WithBlobStore(blobs BlobStore, threshold int) *DataStore {
+	ds.blobs = blobs
+	ds.blobThreshold = threshold
+	return ds
+}
+
+// offloadBlob returns cell with its body stored in the BlobStore, if there
+// is one and the body is over the threshold.
+func (ds *DataStore) offloadBlob(ctx context.Context, cell models.Cell) (models.Cell, error) {
+	if ds.blobs == nil || len(cell.Body) <= ds.blobThreshold {
+		return cell, nil
+	}
+	sum := sha256.Sum256([]byte(cell.Body))
+	key := hex.EncodeToString(sum[:])
+	err := ds.blobs.PutBlob(ctx, key, []byte(cell.Body))
+	if err != nil {
+		return cell, err
+	}
+
+	// The caller's map is left alone.
+	metadata := make(map[string]string, len(cell.Metadata)+1)
+	for k, v := range cell.Metadata {
+		metadata[k] = v
+	}
+	metadata[BlobMetadataKey] = key
+	cell.Metadata = metadata
+	cell.Body, cell.NullBody = "", true
+	return cell, nil
+}
+
+// fetchBlob returns cell with the body it offloaded to the BlobStore, if it
+// did. It returns readErr, the error of the read that returned cell, if
+// there was one.
+func (ds *DataStore) fetchBlob(ctx context.Context, cell models.Cell, readErr error) (models.Cell, error) {
+	key, ok := cell.Metadata[BlobMetadataKey]
+	if readErr != nil || !ok || ds.blobs == nil {
+		return cell, readErr
+	}
+	body, err := ds.blobs.GetBlob(ctx, key)
+	if err != nil {
+		return cell, fmt.Errorf("fetching the body of %s/%s/%d: %w", cell.RowKey, cell.ColumnName, cell.RefKey, err)
+	}
+
+	var metadata map[string]string
+	for k, v := range cell.Metadata {
+		if k == BlobMetadataKey {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string, len(cell.Metadata)-1)
+		}
+		metadata[k] = v
+	}
+	cell.Metadata = metadata
+	cell.Body, cell.NullBody = string(body), false
+	return cell, nil
+}
+
+// fetchBlobs is fetchBlob for each of cells, in place. Cells returned along
+// with readErr, e.g. those a read continuing on error did scan, get their
+// bodies too, but readErr is the error returned.
+func (ds *DataStore) fetchBlobs(ctx context.Context, cells []models.Cell, readErr error) error {
+	if ds.blobs == nil {
+		return readErr
+	}
+	for i := range cells {
+		cell, err := ds.fetchBlob(ctx, cells[i], nil)
+		if err != nil {
+			if readErr == nil {
+				return err
+			}
+			continue
+		}
+		cells[i] = cell
+	}
+	return readErr
+}
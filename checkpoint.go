@@ -0,0 +1,23 @@
+package schemaless
+
+import (
+	"context"
+	"time"
+)
+
+// SetCheckpoint records value as the progress of the job jobName through a
+// partition, e.g. the checkpoint Tail returned, so that the job can resume
+// from it after a restart. The checkpoint is kept in the partition's own
+// storage, next to its cells. It fails with core.ErrNotSupported if the
+// shard's storage cannot keep checkpoints.
+func (ds *DataStore) SetCheckpoint(ctx context.Context, partitionNumber int, jobName string, value int64) error {
+	defer ds.observeSlow("SetCheckpoint", "", time.Now())
+	return ds.source.SetCheckpoint(ctx, partitionNumber, jobName, value)
+}
+
+// GetCheckpoint returns the progress last recorded by SetCheckpoint for the
+// job jobName through a partition, and whether there is any.
+func (ds *DataStore) GetCheckpoint(ctx context.Context, partitionNumber int, jobName string) (value int64, found bool, err error) {
+	defer ds.observeSlow("GetCheckpoint", "", time.Now())
+	return ds.source.GetCheckpoint(ctx, partitionNumber, jobName)
+}
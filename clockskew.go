@@ -0,0 +1,48 @@
+package schemaless
+
+import (
+	"fmt"
+	"time"
+)
+
+// ClockSkewError is returned by PutCell for a cell whose CreatedAt is too far
+// from the time on the DataStore's clock, see WithMaxClockSkew.
+type ClockSkewError struct {
+	CreatedAt time.Time
+	Now       time.Time
+}
+
+func (e *ClockSkewError) Error() string {
+	return fmt.Sprintf("created_at %s is %s away from the current time %s", e.CreatedAt.Format(time.RFC3339), e.CreatedAt.Sub(e.Now), e.Now.Format(time.RFC3339))
+}
+
+// WithMaxClockSkew makes PutCell reject, with a *ClockSkewError, cells whose
+// CreatedAt is more than past before or future after the current time. A
+// writer with a skewed clock would otherwise place its cells out of order
+// for PartitionRead by created_at. Zero disables the check in that
+// direction. Cells with no CreatedAt are stamped by the storage, and are
+// not checked.
+func (ds *DataStore) WithMaxClockSkew(past time.Duration, future time.Duration) *DataStore {
+	ds.skew = &skewCheck{past: past, future: future, now: time.Now}
+	return ds
+}
+
+type skewCheck struct {
+	past   time.Duration
+	future time.Duration
+	now    func() time.Time
+}
+
+// check returns a *ClockSkewError if createdAt is outside the window.
+func (c *skewCheck) check(createdAt *time.Time) error {
+	if createdAt == nil {
+		return nil
+	}
+	now := c.now()
+	tooOld := c.past > 0 && createdAt.Before(now.Add(-c.past))
+	tooNew := c.future > 0 && createdAt.After(now.Add(c.future))
+	if tooOld || tooNew {
+		return &ClockSkewError{CreatedAt: *createdAt, Now: now}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+)
+
+// ColumnNotAllowedError is returned by PutCell, and the other writes, for a
+// column that is not in the DataStore's allowlist, see WithColumnAllowlist.
+type ColumnNotAllowedError struct {
+	Column string
+}
+
+func (e *ColumnNotAllowedError) Error() string {
+	return fmt.Sprintf("column %q is not in the column allowlist", e.Column)
+}
+
+// WithColumnAllowlist makes writes to any column but those listed fail with
+// a *ColumnNotAllowedError, so that a misspelt column name is caught rather
+// than written as a new column. Reads are not restricted. A nil list, the
+// default, allows every column, for stores whose columns are dynamic.
+func (ds *DataStore) WithColumnAllowlist(columns []string) *DataStore {
+	if columns == nil {
+		ds.columns = nil
+		return ds
+	}
+	ds.columns = make(map[string]bool, len(columns))
+	for _, column := range columns {
+		ds.columns[column] = true
+	}
+	return ds
+}
+
+// checkColumn returns a *ColumnNotAllowedError if columnKey may not be
+// written.
+func (ds *DataStore) checkColumn(columnKey string) error {
+	if ds.columns != nil && !ds.columns[columnKey] {
+		return &ColumnNotAllowedError{Column: columnKey}
+	}
+	return nil
+}
+
+// ErrNoDefaultColumn is returned by GetLatest and Put on a DataStore without
+// a default column, see WithDefaultColumn.
+var ErrNoDefaultColumn = errors.New("no default column")
+
+// WithDefaultColumn sets the column that GetLatest and Put read and write,
+// for stores whose rows only ever have the one column, e.g. "data".
+func (ds *DataStore) WithDefaultColumn(columnKey string) *DataStore {
+	ds.defaultColumn = columnKey
+	return ds
+}
+
+// GetLatest is GetCellLatest of the default column.
+func (ds *DataStore) GetLatest(ctx context.Context, rowKey string) (cell models.Cell, found bool, err error) {
+	if ds.defaultColumn == "" {
+		return models.Cell{}, false, ErrNoDefaultColumn
+	}
+	return ds.GetCellLatest(ctx, rowKey, ds.defaultColumn)
+}
+
+// Put is PutCell to the default column.
+func (ds *DataStore) Put(ctx context.Context, rowKey string, refKey int64, cell models.Cell) error {
+	if ds.defaultColumn == "" {
+		return ErrNoDefaultColumn
+	}
+	return ds.PutCell(ctx, rowKey, ds.defaultColumn, refKey, cell)
+}
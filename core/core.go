@@ -2,11 +2,26 @@ package core
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/rbastic/go-schemaless/internal/teardown"
 	"github.com/rbastic/go-schemaless/models"
+	"sort"
 	"sync"
 )
 
+// ErrNotSupported is returned when an operation needs a capability that a
+// shard's storage does not implement.
+var ErrNotSupported = errors.New("operation not supported by storage")
+
 // Storage is a key-value storage backend
+//
+// The storages also have a Raw method returning their underlying client,
+// for queries they do not offer. Use it at your own risk: what runs through
+// it bypasses the Storage, e.g. its table resolver, column mapping, index
+// tables, circuit breaker and logging, and nothing stops it from leaving
+// cells the Storage cannot read back. The client belongs to the Storage, so
+// do not close it; Close does.
 type Storage interface {
 	// GetCell the cell designated (row key, column key, ref key)
 	GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error)
@@ -25,6 +40,216 @@ type Storage interface {
 
 	// Cleans up any resources, etc.
 	Destroy(ctx context.Context) error
+
+	// Close is Destroy as an io.Closer. Calling it again does nothing.
+	Close() error
+}
+
+// Indexer is implemented by storages that maintain secondary indexes (see
+// models.Index) as they write cells.
+type Indexer interface {
+	// LookupByIndex returns the row keys whose indexed value is value
+	LookupByIndex(ctx context.Context, indexName string, value string) (rowKeys []string, err error)
+}
+
+// RangeReader is implemented by storages that can read a range of versions
+// of a cell in one query.
+type RangeReader interface {
+	// GetCellRange returns the versions of a cell with a ref key between
+	// minRefKey and maxRefKey inclusive, in ref key order, and versions that
+	// share a ref key in the order they were added. A maxRefKey of 0 means
+	// no upper bound.
+	GetCellRange(ctx context.Context, rowKey string, columnKey string, minRefKey int64, maxRefKey int64, limit int) (cells []models.Cell, err error)
+}
+
+// PreviousReader is implemented by storages that can find the version of a
+// cell preceding a given ref key in one query.
+type PreviousReader interface {
+	// GetCellBefore returns the version of a cell with the highest ref key
+	// lower than refKey
+	GetCellBefore(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error)
+}
+
+// FeedReader is implemented by storages that can page backwards through the
+// versions of a row in one query.
+type FeedReader interface {
+	// FeedRead returns the versions of every column of a row with a ref
+	// key lower than beforeRefKey, ordered by descending ref key, then
+	// column name, then descending added_at. A beforeRefKey of 0 means no
+	// upper bound.
+	FeedRead(ctx context.Context, rowKey string, beforeRefKey int64, limit int) (cells []models.Cell, err error)
+}
+
+// RowReader is implemented by storages that can read every cell of a row in
+// one query.
+type RowReader interface {
+	// GetRow returns every version of every column of a row, ordered by
+	// column name and then ref key.
+	GetRow(ctx context.Context, rowKey string) (cells []models.Cell, err error)
+}
+
+// CellInserter is implemented by storages that can write a cell only if it
+// does not exist yet, so that a retried write is a no-op.
+type CellInserter interface {
+	// PutCellIfAbsent is PutCell doing nothing, rather than failing with
+	// models.ErrCellExists, if a cell is already at (rowKey, columnKey,
+	// refKey). It reports whether it wrote cell.
+	PutCellIfAbsent(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) (inserted bool, err error)
+}
+
+// RowWriter is implemented by storages that can write several cells of a
+// row in one transaction.
+type RowWriter interface {
+	// PutCells writes cells under rowKey, keeping their column names and ref
+	// keys: either all of them are written or none is. If replace is set,
+	// every cell already under rowKey is deleted first, in the same
+	// transaction.
+	PutCells(ctx context.Context, rowKey string, cells []models.Cell, replace bool) (err error)
+}
+
+// CellReplacer is implemented by storages that can overwrite a cell.
+type CellReplacer interface {
+	// ReplaceCell writes cell, deleting any cell already at (rowKey,
+	// columnKey, refKey) in the same transaction.
+	ReplaceCell(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) (err error)
+}
+
+// RowMover is implemented by storages that can move every cell of a row to
+// another row key in one transaction.
+type RowMover interface {
+	// MoveRow changes the row key of every cell of srcRowKey to dstRowKey,
+	// keeping their ref keys. It fails with models.ErrRowExists if
+	// dstRowKey already has cells.
+	MoveRow(ctx context.Context, srcRowKey string, dstRowKey string) (err error)
+}
+
+// RowDeleter is implemented by storages that can delete every cell of a row
+// in one transaction.
+type RowDeleter interface {
+	// DeleteRow deletes every version of every column of rowKey, along with
+	// its index entries, and returns the number of cells deleted.
+	DeleteRow(ctx context.Context, rowKey string) (deleted int64, err error)
+}
+
+// CellResequencer is implemented by storages that can give the versions of
+// a cell that share a ref key ref keys of their own in one transaction.
+type CellResequencer interface {
+	// ResequenceCell moves each version of a cell that shares its ref key
+	// with one added before it to a ref key after the highest, in the order
+	// they were added, changing nothing else about it. It returns the
+	// number of versions moved.
+	ResequenceCell(ctx context.Context, rowKey string, columnKey string) (moved int, err error)
+}
+
+// ColumnLister is implemented by storages that can list the columns of a
+// row without reading its cells.
+type ColumnLister interface {
+	// ListColumns returns the distinct column names of a row, sorted
+	ListColumns(ctx context.Context, rowKey string) (columns []string, err error)
+}
+
+// ColumnCounter is implemented by storages that can count the versions of
+// each column of a row without reading its cells.
+type ColumnCounter interface {
+	// CountByColumn returns the number of versions of each column of a row
+	CountByColumn(ctx context.Context, rowKey string) (counts map[string]int64, err error)
+}
+
+// ExistenceChecker is implemented by storages that can tell which columns
+// of rows have cells without reading them.
+type ExistenceChecker interface {
+	// Exists reports, for each of keys, whether it has at least one cell
+	Exists(ctx context.Context, keys []models.CellKey) (exists map[models.CellKey]bool, err error)
+}
+
+// SnapshotReader is implemented by storages that can read several cells
+// from the same committed state.
+type SnapshotReader interface {
+	// GetCellsSnapshot reads the cells of refs in one read-only transaction,
+	// returning those that were found
+	GetCellsSnapshot(ctx context.Context, refs []models.CellRef) (cells map[models.CellRef]models.Cell, err error)
+}
+
+// SchemaVersionReader is implemented by storages that can filter a
+// partition read by the schema version cells were written with (see
+// models.Cell).
+type SchemaVersionReader interface {
+	// PartitionReadSchemaVersion is PartitionRead returning only the cells
+	// with the given schema version
+	PartitionReadSchemaVersion(ctx context.Context, partitionNumber int, schemaVersion int64, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error)
+}
+
+// PartitionScanner is implemented by storages that can hand over the cells
+// of a partition read one at a time, as they are scanned, rather than
+// collecting them first.
+type PartitionScanner interface {
+	// PartitionScan is PartitionRead calling fn with each cell in turn. It
+	// stops at, and returns, the first error fn returns.
+	PartitionScan(ctx context.Context, partitionNumber int, location string, value interface{}, limit int, fn func(models.Cell) error) error
+}
+
+// TagReader is implemented by storages that can filter a partition read by
+// a tag of the metadata cells were written with (see models.Cell).
+type TagReader interface {
+	// PartitionReadTag is PartitionRead returning only the cells whose
+	// metadata holds tagKey=tagValue
+	PartitionReadTag(ctx context.Context, partitionNumber int, tagKey string, tagValue string, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error)
+}
+
+// CorrelationReader is implemented by storages that keep the correlation id
+// of cells in a column of its own (see models.Cell), and can filter a
+// partition read by it.
+type CorrelationReader interface {
+	// PartitionReadCorrelation is PartitionRead returning only the cells
+	// whose correlation id is correlationID
+	PartitionReadCorrelation(ctx context.Context, partitionNumber int, correlationID string, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error)
+}
+
+// ColumnFilter is implemented by storages that can filter a partition read
+// by a field of the body promoted to a column of its own (see
+// models.PromotedColumn).
+type ColumnFilter interface {
+	// PartitionReadWhere is PartitionRead returning only the cells whose
+	// promoted column holds columnValue. It fails with
+	// models.ErrNotPromoted if the storage has not promoted column.
+	PartitionReadWhere(ctx context.Context, partitionNumber int, column string, columnValue interface{}, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error)
+}
+
+// Projector is implemented by storages that can extract fields of the
+// bodies of a partition read server-side.
+type Projector interface {
+	// PartitionReadProjected is PartitionRead with each body replaced by a
+	// JSON object mapping each of paths (see models.SplitPath) to the value
+	// at that path, null if there is none
+	PartitionReadProjected(ctx context.Context, partitionNumber int, location string, value interface{}, limit int, paths []string) (cells []models.Cell, found bool, err error)
+}
+
+// LatestPerRowReader is implemented by storages that can read the latest
+// versions of every row of a partition in one scan.
+type LatestPerRowReader interface {
+	// PartitionLatestPerRow returns the n versions of each row with the
+	// highest ref keys, across its columns, newest first, with rows in row
+	// key order. It returns at most limit cells.
+	PartitionLatestPerRow(ctx context.Context, partitionNumber int, n int, limit int) (cells []models.Cell, err error)
+}
+
+// TableDescriber is implemented by storages that can list the columns of
+// their cell table from the database's catalog.
+type TableDescriber interface {
+	// DescribeTable returns the columns of the cell table, in order, under
+	// the names of the cell columns they hold
+	DescribeTable(ctx context.Context) (columns []models.ColumnInfo, err error)
+}
+
+// Checkpointer is implemented by storages that can keep the progress of
+// jobs reading their partition, e.g. the last added_at a Tail poller saw,
+// next to the cells.
+type Checkpointer interface {
+	// SetCheckpoint sets the checkpoint of jobName to value
+	SetCheckpoint(ctx context.Context, jobName string, value int64) (err error)
+	// GetCheckpoint returns the checkpoint of jobName, and a bool indicating
+	// if it was set
+	GetCheckpoint(ctx context.Context, jobName string) (value int64, found bool, err error)
 }
 
 // KVStore is a sharded key-value store
@@ -35,10 +260,22 @@ type KVStore struct {
 	migration Chooser
 	mstorages map[string]Storage
 
+	// onPanic, if set, makes calls recover from panics, see WithRecover
+	onPanic PanicFunc
+
+	// sampleEvery is the n of WithSampling, and sampled counts the calls
+	// sampled in turn
+	sampleEvery uint64
+	sampled     uint64
+
 	// we avoid holding the lock during a call to a storage engine, which may block
 	mu sync.Mutex
+
+	closer teardown.Once
 }
 
+var _ Storage = (*KVStore)(nil)
+
 // Chooser maps keys to shards
 type Chooser interface {
 	// SetBuckets sets the list of known buckets from which the chooser should select
@@ -72,43 +309,47 @@ func New(chooser Chooser, shards []Shard) *KVStore {
 }
 
 func (kv *KVStore) GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	defer kv.recoverPanic("GetCell", &err)
 	var storage Storage
 	var migStorage Storage
+	var migShard string
 
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
 	if kv.migration != nil {
-		shard := kv.migration.Choose(rowKey)
-		migStorage = kv.mstorages[shard]
+		migShard = kv.migration.Choose(rowKey)
+		migStorage = kv.mstorages[migShard]
 	}
 	shard := kv.continuum.Choose(rowKey)
 	storage = kv.storages[shard]
 
 	if migStorage != nil {
-		val, ok, err := migStorage.GetCell(ctx, rowKey, columnKey, refKey)
+		val, ok, err := migStorage.GetCell(kv.shardContext(ctx, migShard), rowKey, columnKey, refKey)
 		if ok {
 			return val, ok, err
 		}
 	}
 
-	return storage.GetCell(ctx, rowKey, columnKey, refKey)
+	return storage.GetCell(kv.shardContext(ctx, shard), rowKey, columnKey, refKey)
 }
 
 func (kv *KVStore) GetCellLatest(ctx context.Context, rowKey string, columnKey string) (cell models.Cell, found bool, err error) {
+	defer kv.recoverPanic("GetCellLatest", &err)
 	var storage Storage
 	var migStorage Storage
+	var migShard string
 
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
 	if kv.migration != nil {
-		shard := kv.migration.Choose(rowKey)
-		migStorage = kv.mstorages[shard]
+		migShard = kv.migration.Choose(rowKey)
+		migStorage = kv.mstorages[migShard]
 	}
 
 	if migStorage != nil {
-		val, ok, err := migStorage.GetCellLatest(ctx, rowKey, columnKey)
+		val, ok, err := migStorage.GetCellLatest(kv.shardContext(ctx, migShard), rowKey, columnKey)
 		if err != nil {
 			return val, ok, err
 		}
@@ -120,11 +361,12 @@ func (kv *KVStore) GetCellLatest(ctx context.Context, rowKey string, columnKey s
 	shard := kv.continuum.Choose(rowKey)
 	storage = kv.storages[shard]
 
-	return storage.GetCellLatest(ctx, rowKey, columnKey)
+	return storage.GetCellLatest(kv.shardContext(ctx, shard), rowKey, columnKey)
 }
 
 // PutCell
-func (kv *KVStore) PutCell(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) error {
+func (kv *KVStore) PutCell(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) (err error) {
+	defer kv.recoverPanic("PutCell", &err)
 	var storage Storage
 
 	kv.mu.Lock()
@@ -134,16 +376,469 @@ func (kv *KVStore) PutCell(ctx context.Context, rowKey string, columnKey string,
 		shard := kv.migration.Choose(rowKey)
 		storage = kv.mstorages[shard]
 
-		return storage.PutCell(ctx, rowKey, columnKey, refKey, cell)
+		return storage.PutCell(kv.shardContext(ctx, shard), rowKey, columnKey, refKey, cell)
 	}
 
 	shard := kv.continuum.Choose(rowKey)
 	storage = kv.storages[shard]
 
-	return storage.PutCell(ctx, rowKey, columnKey, refKey, cell)
+	return storage.PutCell(kv.shardContext(ctx, shard), rowKey, columnKey, refKey, cell)
+}
+
+// GetCellRange implements RangeReader on the shard responsible for rowKey,
+// returning ErrNotSupported if its storage does not.
+func (kv *KVStore) GetCellRange(ctx context.Context, rowKey string, columnKey string, minRefKey int64, maxRefKey int64, limit int) (cells []models.Cell, err error) {
+	defer kv.recoverPanic("GetCellRange", &err)
+	var migStorage Storage
+	var migShard string
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.migration != nil {
+		migShard = kv.migration.Choose(rowKey)
+		migStorage = kv.mstorages[migShard]
+	}
+
+	if migStorage != nil {
+		reader, ok := capability[RangeReader](migStorage)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		cells, err := reader.GetCellRange(kv.shardContext(ctx, migShard), rowKey, columnKey, minRefKey, maxRefKey, limit)
+		if err != nil || len(cells) > 0 {
+			return cells, err
+		}
+	}
+
+	shard := kv.continuum.Choose(rowKey)
+	reader, ok := capability[RangeReader](kv.storages[shard])
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return reader.GetCellRange(kv.shardContext(ctx, shard), rowKey, columnKey, minRefKey, maxRefKey, limit)
+}
+
+// FeedRead implements FeedReader on the shard responsible for rowKey,
+// returning ErrNotSupported if its storage does not.
+func (kv *KVStore) FeedRead(ctx context.Context, rowKey string, beforeRefKey int64, limit int) (cells []models.Cell, err error) {
+	defer kv.recoverPanic("FeedRead", &err)
+	var migStorage Storage
+	var migShard string
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.migration != nil {
+		migShard = kv.migration.Choose(rowKey)
+		migStorage = kv.mstorages[migShard]
+	}
+
+	if migStorage != nil {
+		reader, ok := capability[FeedReader](migStorage)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		cells, err := reader.FeedRead(kv.shardContext(ctx, migShard), rowKey, beforeRefKey, limit)
+		if err != nil || len(cells) > 0 {
+			return cells, err
+		}
+	}
+
+	shard := kv.continuum.Choose(rowKey)
+	reader, ok := capability[FeedReader](kv.storages[shard])
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return reader.FeedRead(kv.shardContext(ctx, shard), rowKey, beforeRefKey, limit)
+}
+
+// GetCellBefore implements PreviousReader on the shard responsible for
+// rowKey, returning ErrNotSupported if its storage does not.
+func (kv *KVStore) GetCellBefore(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	defer kv.recoverPanic("GetCellBefore", &err)
+	var migStorage Storage
+	var migShard string
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.migration != nil {
+		migShard = kv.migration.Choose(rowKey)
+		migStorage = kv.mstorages[migShard]
+	}
+	if migStorage != nil {
+		reader, ok := capability[PreviousReader](migStorage)
+		if !ok {
+			return cell, false, ErrNotSupported
+		}
+		cell, found, err = reader.GetCellBefore(kv.shardContext(ctx, migShard), rowKey, columnKey, refKey)
+		if err != nil || found {
+			return
+		}
+	}
+	shard := kv.continuum.Choose(rowKey)
+	reader, ok := capability[PreviousReader](kv.storages[shard])
+	if !ok {
+		return cell, false, ErrNotSupported
+	}
+	return reader.GetCellBefore(kv.shardContext(ctx, shard), rowKey, columnKey, refKey)
+}
+
+// GetRow implements RowReader on the shard responsible for rowKey, returning
+// ErrNotSupported if its storage does not.
+func (kv *KVStore) GetRow(ctx context.Context, rowKey string) (cells []models.Cell, err error) {
+	defer kv.recoverPanic("GetRow", &err)
+	var migStorage Storage
+	var migShard string
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.migration != nil {
+		migShard = kv.migration.Choose(rowKey)
+		migStorage = kv.mstorages[migShard]
+	}
+	if migStorage != nil {
+		reader, ok := capability[RowReader](migStorage)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		cells, err := reader.GetRow(kv.shardContext(ctx, migShard), rowKey)
+		if err != nil || len(cells) > 0 {
+			return cells, err
+		}
+	}
+	shard := kv.continuum.Choose(rowKey)
+	reader, ok := capability[RowReader](kv.storages[shard])
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return reader.GetRow(kv.shardContext(ctx, shard), rowKey)
+}
+
+// ListColumns implements ColumnLister on the shard responsible for rowKey,
+// returning ErrNotSupported if its storage does not.
+func (kv *KVStore) ListColumns(ctx context.Context, rowKey string) (columns []string, err error) {
+	defer kv.recoverPanic("ListColumns", &err)
+	var migStorage Storage
+	var migShard string
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.migration != nil {
+		migShard = kv.migration.Choose(rowKey)
+		migStorage = kv.mstorages[migShard]
+	}
+	if migStorage != nil {
+		lister, ok := capability[ColumnLister](migStorage)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		columns, err := lister.ListColumns(kv.shardContext(ctx, migShard), rowKey)
+		if err != nil || len(columns) > 0 {
+			return columns, err
+		}
+	}
+	shard := kv.continuum.Choose(rowKey)
+	lister, ok := capability[ColumnLister](kv.storages[shard])
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return lister.ListColumns(kv.shardContext(ctx, shard), rowKey)
+}
+
+// CountByColumn implements ColumnCounter on the shard responsible for
+// rowKey, returning ErrNotSupported if its storage does not.
+func (kv *KVStore) CountByColumn(ctx context.Context, rowKey string) (counts map[string]int64, err error) {
+	defer kv.recoverPanic("CountByColumn", &err)
+	var migStorage Storage
+	var migShard string
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.migration != nil {
+		migShard = kv.migration.Choose(rowKey)
+		migStorage = kv.mstorages[migShard]
+	}
+	if migStorage != nil {
+		counter, ok := capability[ColumnCounter](migStorage)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		counts, err := counter.CountByColumn(kv.shardContext(ctx, migShard), rowKey)
+		if err != nil || len(counts) > 0 {
+			return counts, err
+		}
+	}
+	shard := kv.continuum.Choose(rowKey)
+	counter, ok := capability[ColumnCounter](kv.storages[shard])
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return counter.CountByColumn(kv.shardContext(ctx, shard), rowKey)
+}
+
+// Exists implements ExistenceChecker, asking the shard responsible for each
+// row key about its keys, returning ErrNotSupported if a storage asked does
+// not implement it. During a migration, keys absent from the new shard are
+// looked up on the old one.
+func (kv *KVStore) Exists(ctx context.Context, keys []models.CellKey) (exists map[models.CellKey]bool, err error) {
+	defer kv.recoverPanic("Exists", &err)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	exists = make(map[models.CellKey]bool, len(keys))
+	for _, key := range keys {
+		exists[key] = false
+	}
+
+	check := func(choose Chooser, storages map[string]Storage, keys []models.CellKey) error {
+		byShard := make(map[string][]models.CellKey)
+		for _, key := range keys {
+			shard := choose.Choose(key.RowKey)
+			byShard[shard] = append(byShard[shard], key)
+		}
+		for shard, keys := range byShard {
+			if storages[shard] == nil {
+				continue
+			}
+			checker, ok := capability[ExistenceChecker](storages[shard])
+			if !ok {
+				return ErrNotSupported
+			}
+			found, err := checker.Exists(kv.shardContext(ctx, shard), keys)
+			if err != nil {
+				return err
+			}
+			for key, ok := range found {
+				if ok {
+					exists[key] = true
+				}
+			}
+		}
+		return nil
+	}
+
+	if kv.migration != nil {
+		err := check(kv.migration, kv.mstorages, keys)
+		if err != nil {
+			return nil, err
+		}
+		var absent []models.CellKey
+		for _, key := range keys {
+			if !exists[key] {
+				absent = append(absent, key)
+			}
+		}
+		keys = absent
+	}
+	err = check(kv.continuum, kv.storages, keys)
+	if err != nil {
+		return nil, err
+	}
+	return exists, nil
+}
+
+// GetCellsSnapshot implements SnapshotReader, reading the cells of each
+// shard in one transaction, and returns ErrNotSupported if a storage asked
+// does not implement it. Reads on different shards do not share a snapshot.
+// During a migration, cells absent from the new shard are read from the old
+// one, in a later transaction.
+func (kv *KVStore) GetCellsSnapshot(ctx context.Context, refs []models.CellRef) (cells map[models.CellRef]models.Cell, err error) {
+	defer kv.recoverPanic("GetCellsSnapshot", &err)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	cells = make(map[models.CellRef]models.Cell, len(refs))
+	read := func(choose Chooser, storages map[string]Storage, refs []models.CellRef) error {
+		byShard := make(map[string][]models.CellRef)
+		for _, ref := range refs {
+			shard := choose.Choose(ref.RowKey)
+			byShard[shard] = append(byShard[shard], ref)
+		}
+		for shard, refs := range byShard {
+			if storages[shard] == nil {
+				continue
+			}
+			reader, ok := capability[SnapshotReader](storages[shard])
+			if !ok {
+				return ErrNotSupported
+			}
+			found, err := reader.GetCellsSnapshot(kv.shardContext(ctx, shard), refs)
+			if err != nil {
+				return err
+			}
+			for ref, cell := range found {
+				cells[ref] = cell
+			}
+		}
+		return nil
+	}
+
+	if kv.migration != nil {
+		err := read(kv.migration, kv.mstorages, refs)
+		if err != nil {
+			return nil, err
+		}
+		var absent []models.CellRef
+		for _, ref := range refs {
+			if _, ok := cells[ref]; !ok {
+				absent = append(absent, ref)
+			}
+		}
+		refs = absent
+	}
+	err = read(kv.continuum, kv.storages, refs)
+	if err != nil {
+		return nil, err
+	}
+	return cells, nil
+}
+
+// PutCellIfAbsent implements CellInserter on the shard responsible for
+// rowKey, returning ErrNotSupported if its storage does not.
+func (kv *KVStore) PutCellIfAbsent(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) (written bool, err error) {
+	defer kv.recoverPanic("PutCellIfAbsent", &err)
+	var storage Storage
+	var shard string
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.migration != nil {
+		shard = kv.migration.Choose(rowKey)
+		storage = kv.mstorages[shard]
+	} else {
+		shard = kv.continuum.Choose(rowKey)
+		storage = kv.storages[shard]
+	}
+	inserter, ok := capability[CellInserter](storage)
+	if !ok {
+		return false, ErrNotSupported
+	}
+	return inserter.PutCellIfAbsent(kv.shardContext(ctx, shard), rowKey, columnKey, refKey, cell)
+}
+
+// PutCells implements RowWriter on the shard responsible for rowKey,
+// returning ErrNotSupported if its storage does not.
+func (kv *KVStore) PutCells(ctx context.Context, rowKey string, cells []models.Cell, replace bool) (err error) {
+	defer kv.recoverPanic("PutCells", &err)
+	var storage Storage
+	var shard string
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.migration != nil {
+		shard = kv.migration.Choose(rowKey)
+		storage = kv.mstorages[shard]
+	} else {
+		shard = kv.continuum.Choose(rowKey)
+		storage = kv.storages[shard]
+	}
+	writer, ok := capability[RowWriter](storage)
+	if !ok {
+		return ErrNotSupported
+	}
+	return writer.PutCells(kv.shardContext(ctx, shard), rowKey, cells, replace)
+}
+
+// ReplaceCell implements CellReplacer on the shard responsible for rowKey,
+// returning ErrNotSupported if its storage does not.
+func (kv *KVStore) ReplaceCell(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) (err error) {
+	defer kv.recoverPanic("ReplaceCell", &err)
+	var storage Storage
+	var shard string
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.migration != nil {
+		shard = kv.migration.Choose(rowKey)
+		storage = kv.mstorages[shard]
+	} else {
+		shard = kv.continuum.Choose(rowKey)
+		storage = kv.storages[shard]
+	}
+	replacer, ok := capability[CellReplacer](storage)
+	if !ok {
+		return ErrNotSupported
+	}
+	return replacer.ReplaceCell(kv.shardContext(ctx, shard), rowKey, columnKey, refKey, cell)
+}
+
+// ResequenceCell implements CellResequencer. It returns ErrNotSupported if
+// the shard's storage does not.
+func (kv *KVStore) ResequenceCell(ctx context.Context, rowKey string, columnKey string) (moved int, err error) {
+	defer kv.recoverPanic("ResequenceCell", &err)
+	var storage Storage
+	var shard string
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.migration != nil {
+		shard = kv.migration.Choose(rowKey)
+		storage = kv.mstorages[shard]
+	} else {
+		shard = kv.continuum.Choose(rowKey)
+		storage = kv.storages[shard]
+	}
+	resequencer, ok := capability[CellResequencer](storage)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	return resequencer.ResequenceCell(kv.shardContext(ctx, shard), rowKey, columnKey)
+}
+
+// MoveRow implements RowMover when both row keys belong to the same shard.
+// It returns ErrNotSupported if they do not, if that shard's storage does not
+// implement RowMover, or during a migration.
+func (kv *KVStore) MoveRow(ctx context.Context, srcRowKey string, dstRowKey string) (err error) {
+	defer kv.recoverPanic("MoveRow", &err)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.migration != nil {
+		return ErrNotSupported
+	}
+	shard := kv.continuum.Choose(srcRowKey)
+	if kv.continuum.Choose(dstRowKey) != shard {
+		return ErrNotSupported
+	}
+	mover, ok := capability[RowMover](kv.storages[shard])
+	if !ok {
+		return ErrNotSupported
+	}
+	return mover.MoveRow(kv.shardContext(ctx, shard), srcRowKey, dstRowKey)
+}
+
+// DeleteRow implements RowDeleter on the shard responsible for rowKey and,
+// during a migration, on the shard it is migrating to as well, so that no
+// copy of the row is left behind. It returns ErrNotSupported, having deleted
+// nothing, if any of those storages does not implement RowDeleter.
+func (kv *KVStore) DeleteRow(ctx context.Context, rowKey string) (deleted int64, err error) {
+	defer kv.recoverPanic("DeleteRow", &err)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	shards := []string{kv.continuum.Choose(rowKey)}
+	deleters := []RowDeleter{nil}
+	if kv.migration != nil {
+		migShard := kv.migration.Choose(rowKey)
+		if migStorage := kv.mstorages[migShard]; migStorage != nil {
+			deleter, ok := capability[RowDeleter](migStorage)
+			if !ok {
+				return 0, ErrNotSupported
+			}
+			shards = append(shards, migShard)
+			deleters = append(deleters, deleter)
+		}
+	}
+	deleter, ok := capability[RowDeleter](kv.storages[shards[0]])
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	deleters[0] = deleter
+
+	var total int64
+	for i, deleter := range deleters {
+		n, err := deleter.DeleteRow(kv.shardContext(ctx, shards[i]), rowKey)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
 }
 
 func (kv *KVStore) PartitionRead(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	defer kv.recoverPanic("PartitionRead", &err)
 
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
@@ -154,19 +849,296 @@ func (kv *KVStore) PartitionRead(ctx context.Context, partitionNumber int, locat
 		migStorage := kv.mstorages[shard]
 
 		if migStorage != nil {
-			return migStorage.PartitionRead(ctx, partitionNumber, location, value, limit)
+			return migStorage.PartitionRead(kv.shardContext(ctx, shard), partitionNumber, location, value, limit)
+		}
+	}
+
+	buckets := kv.continuum.Buckets()
+	shard := buckets[partitionNumber]
+	storage := kv.storages[shard]
+
+	return storage.PartitionRead(kv.shardContext(ctx, shard), partitionNumber, location, value, limit)
+}
+
+// PartitionScan implements PartitionScanner on the shard numbered
+// partitionNumber. If its storage does not, the cells are read with
+// PartitionRead and then passed to fn. Unlike the other calls, the lock is
+// not held while the storage runs, since fn may block for as long as the
+// caller likes.
+func (kv *KVStore) PartitionScan(ctx context.Context, partitionNumber int, location string, value interface{}, limit int, fn func(models.Cell) error) (err error) {
+	defer kv.recoverPanic("PartitionScan", &err)
+	storage, shard, err := kv.partitionStorage(partitionNumber)
+	if err != nil {
+		return err
+	}
+
+	ctx = kv.shardContext(ctx, shard)
+	if scanner, ok := capability[PartitionScanner](storage); ok {
+		return scanner.PartitionScan(ctx, partitionNumber, location, value, limit, fn)
+	}
+	cells, _, err := storage.PartitionRead(ctx, partitionNumber, location, value, limit)
+	if err != nil {
+		return err
+	}
+	for _, cell := range cells {
+		err = fn(cell)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PartitionReadSchemaVersion implements SchemaVersionReader on the shard
+// numbered partitionNumber, returning ErrNotSupported if its storage does
+// not.
+func (kv *KVStore) PartitionReadSchemaVersion(ctx context.Context, partitionNumber int, schemaVersion int64, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	defer kv.recoverPanic("PartitionReadSchemaVersion", &err)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	shard := kv.continuum.Buckets()[partitionNumber]
+	storage := kv.storages[shard]
+	if kv.migration != nil {
+		migShard := kv.migration.Buckets()[partitionNumber]
+		if migStorage := kv.mstorages[migShard]; migStorage != nil {
+			shard, storage = migShard, migStorage
+		}
+	}
+
+	reader, ok := capability[SchemaVersionReader](storage)
+	if !ok {
+		return nil, false, ErrNotSupported
+	}
+	return reader.PartitionReadSchemaVersion(kv.shardContext(ctx, shard), partitionNumber, schemaVersion, location, value, limit)
+}
+
+// PartitionReadTag implements TagReader on the shard numbered
+// partitionNumber, returning ErrNotSupported if its storage does not.
+func (kv *KVStore) PartitionReadTag(ctx context.Context, partitionNumber int, tagKey string, tagValue string, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	defer kv.recoverPanic("PartitionReadTag", &err)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	shard := kv.continuum.Buckets()[partitionNumber]
+	storage := kv.storages[shard]
+	if kv.migration != nil {
+		migShard := kv.migration.Buckets()[partitionNumber]
+		if migStorage := kv.mstorages[migShard]; migStorage != nil {
+			shard, storage = migShard, migStorage
+		}
+	}
+
+	reader, ok := capability[TagReader](storage)
+	if !ok {
+		return nil, false, ErrNotSupported
+	}
+	return reader.PartitionReadTag(kv.shardContext(ctx, shard), partitionNumber, tagKey, tagValue, location, value, limit)
+}
+
+// PartitionReadCorrelation implements CorrelationReader on the shard
+// numbered partitionNumber, returning ErrNotSupported if its storage does
+// not.
+func (kv *KVStore) PartitionReadCorrelation(ctx context.Context, partitionNumber int, correlationID string, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	defer kv.recoverPanic("PartitionReadCorrelation", &err)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	shard := kv.continuum.Buckets()[partitionNumber]
+	storage := kv.storages[shard]
+	if kv.migration != nil {
+		migShard := kv.migration.Buckets()[partitionNumber]
+		if migStorage := kv.mstorages[migShard]; migStorage != nil {
+			shard, storage = migShard, migStorage
 		}
 	}
 
+	reader, ok := capability[CorrelationReader](storage)
+	if !ok {
+		return nil, false, ErrNotSupported
+	}
+	return reader.PartitionReadCorrelation(kv.shardContext(ctx, shard), partitionNumber, correlationID, location, value, limit)
+}
+
+// PartitionReadWhere implements ColumnFilter on the shard numbered
+// partitionNumber, returning ErrNotSupported if its storage does not.
+func (kv *KVStore) PartitionReadWhere(ctx context.Context, partitionNumber int, column string, columnValue interface{}, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	defer kv.recoverPanic("PartitionReadWhere", &err)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	shard := kv.continuum.Buckets()[partitionNumber]
+	storage := kv.storages[shard]
+	if kv.migration != nil {
+		migShard := kv.migration.Buckets()[partitionNumber]
+		if migStorage := kv.mstorages[migShard]; migStorage != nil {
+			shard, storage = migShard, migStorage
+		}
+	}
+
+	reader, ok := capability[ColumnFilter](storage)
+	if !ok {
+		return nil, false, ErrNotSupported
+	}
+	return reader.PartitionReadWhere(kv.shardContext(ctx, shard), partitionNumber, column, columnValue, location, value, limit)
+}
+
+// PartitionReadProjected implements Projector on the shard numbered
+// partitionNumber, returning ErrNotSupported if its storage does not.
+func (kv *KVStore) PartitionReadProjected(ctx context.Context, partitionNumber int, location string, value interface{}, limit int, paths []string) (cells []models.Cell, found bool, err error) {
+	defer kv.recoverPanic("PartitionReadProjected", &err)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	shard := kv.continuum.Buckets()[partitionNumber]
+	storage := kv.storages[shard]
+	if kv.migration != nil {
+		migShard := kv.migration.Buckets()[partitionNumber]
+		if migStorage := kv.mstorages[migShard]; migStorage != nil {
+			shard, storage = migShard, migStorage
+		}
+	}
+
+	projector, ok := capability[Projector](storage)
+	if !ok {
+		return nil, false, ErrNotSupported
+	}
+	return projector.PartitionReadProjected(kv.shardContext(ctx, shard), partitionNumber, location, value, limit, paths)
+}
+
+// PartitionLatestPerRow implements LatestPerRowReader on the shard numbered
+// partitionNumber, returning ErrNotSupported if its storage does not.
+func (kv *KVStore) PartitionLatestPerRow(ctx context.Context, partitionNumber int, n int, limit int) (cells []models.Cell, err error) {
+	defer kv.recoverPanic("PartitionLatestPerRow", &err)
+	storage, shard, err := kv.partitionStorage(partitionNumber)
+	if err != nil {
+		return nil, err
+	}
+	reader, ok := capability[LatestPerRowReader](storage)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return reader.PartitionLatestPerRow(kv.shardContext(ctx, shard), partitionNumber, n, limit)
+}
+
+// partitionStorage returns the storage of the shard numbered
+// partitionNumber, and its name: the new shard during a migration, if it
+// has one. It fails if there is no such shard.
+func (kv *KVStore) partitionStorage(partitionNumber int) (Storage, string, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
 	buckets := kv.continuum.Buckets()
+	if partitionNumber < 0 || partitionNumber >= len(buckets) {
+		return nil, "", fmt.Errorf("partition %d out of range [0, %d)", partitionNumber, len(buckets))
+	}
 	shard := buckets[partitionNumber]
 	storage := kv.storages[shard]
+	if kv.migration != nil {
+		migBuckets := kv.migration.Buckets()
+		if partitionNumber < len(migBuckets) {
+			migShard := migBuckets[partitionNumber]
+			if migStorage := kv.mstorages[migShard]; migStorage != nil {
+				shard, storage = migShard, migStorage
+			}
+		}
+	}
+	return storage, shard, nil
+}
+
+// partitionCheckpointer returns the Checkpointer of the shard numbered
+// partitionNumber, and the shard's name.
+func (kv *KVStore) partitionCheckpointer(partitionNumber int) (Checkpointer, string, error) {
+	storage, shard, err := kv.partitionStorage(partitionNumber)
+	if err != nil {
+		return nil, "", err
+	}
+	checkpointer, ok := capability[Checkpointer](storage)
+	if !ok {
+		return nil, "", ErrNotSupported
+	}
+	return checkpointer, shard, nil
+}
+
+// SetCheckpoint implements Checkpointer on the shard numbered
+// partitionNumber, returning ErrNotSupported if its storage does not.
+func (kv *KVStore) SetCheckpoint(ctx context.Context, partitionNumber int, jobName string, value int64) (err error) {
+	defer kv.recoverPanic("SetCheckpoint", &err)
+	checkpointer, shard, err := kv.partitionCheckpointer(partitionNumber)
+	if err != nil {
+		return err
+	}
+	return checkpointer.SetCheckpoint(kv.shardContext(ctx, shard), jobName, value)
+}
+
+// GetCheckpoint implements Checkpointer on the shard numbered
+// partitionNumber, returning ErrNotSupported if its storage does not.
+func (kv *KVStore) GetCheckpoint(ctx context.Context, partitionNumber int, jobName string) (value int64, found bool, err error) {
+	defer kv.recoverPanic("GetCheckpoint", &err)
+	checkpointer, shard, err := kv.partitionCheckpointer(partitionNumber)
+	if err != nil {
+		return 0, false, err
+	}
+	return checkpointer.GetCheckpoint(kv.shardContext(ctx, shard), jobName)
+}
 
-	return storage.PartitionRead(ctx, partitionNumber, location, value, limit)
+// DescribeTable implements TableDescriber on the shard numbered
+// partitionNumber, returning ErrNotSupported if its storage does not.
+func (kv *KVStore) DescribeTable(ctx context.Context, partitionNumber int) (columns []models.ColumnInfo, err error) {
+	defer kv.recoverPanic("DescribeTable", &err)
+	storage, shard, err := kv.partitionStorage(partitionNumber)
+	if err != nil {
+		return nil, err
+	}
+	describer, ok := capability[TableDescriber](storage)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return describer.DescribeTable(kv.shardContext(ctx, shard))
+}
+
+// LookupByIndex asks every shard for row keys with the indexed value, since
+// index entries live on the shard of the row they point to. Every shard must
+// implement Indexer.
+func (kv *KVStore) LookupByIndex(ctx context.Context, indexName string, value string) (rowKeys []string, err error) {
+	defer kv.recoverPanic("LookupByIndex", &err)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var shards []Shard
+	for name, storage := range kv.storages {
+		shards = append(shards, Shard{Name: name, Backend: storage})
+	}
+	if kv.migration != nil {
+		for name, migStorage := range kv.mstorages {
+			shards = append(shards, Shard{Name: name, Backend: migStorage})
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, shard := range shards {
+		indexer, ok := capability[Indexer](shard.Backend)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		keys, err := indexer.LookupByIndex(kv.shardContext(ctx, shard.Name), indexName, value)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				rowKeys = append(rowKeys, key)
+			}
+		}
+	}
+	sort.Strings(rowKeys)
+	return rowKeys, nil
 }
 
 // ResetConnection implements Storage.ResetConnection()
-func (kv *KVStore) ResetConnection(ctx context.Context, key string) error {
+func (kv *KVStore) ResetConnection(ctx context.Context, key string) (err error) {
+	defer kv.recoverPanic("ResetConnection", &err)
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
@@ -175,7 +1147,7 @@ func (kv *KVStore) ResetConnection(ctx context.Context, key string) error {
 		migStorage := kv.mstorages[shard]
 
 		if migStorage != nil {
-			err := migStorage.ResetConnection(ctx, key)
+			err := migStorage.ResetConnection(kv.shardContext(ctx, shard), key)
 			if err != nil {
 				return err
 			}
@@ -184,11 +1156,12 @@ func (kv *KVStore) ResetConnection(ctx context.Context, key string) error {
 	shard := kv.continuum.Choose(key)
 	storage := kv.storages[shard]
 
-	return storage.ResetConnection(ctx, key)
+	return storage.ResetConnection(kv.shardContext(ctx, shard), key)
 }
 
 // Destroy implements Storage.Destroy()
-func (kv *KVStore) Destroy(ctx context.Context) error {
+func (kv *KVStore) Destroy(ctx context.Context) (err error) {
+	defer kv.recoverPanic("Destroy", &err)
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
@@ -210,6 +1183,39 @@ func (kv *KVStore) Destroy(ctx context.Context) error {
 	return nil
 }
 
+// Close implements io.Closer. It destroys the storages as Destroy does, and
+// is safe to call more than once.
+func (kv *KVStore) Close() error {
+	return kv.closer.Close(kv.Destroy)
+}
+
+// Partitions returns the number of partitions, one per shard.
+func (kv *KVStore) Partitions() int {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return len(kv.continuum.Buckets())
+}
+
+// Locate returns the shard that PutCell writes rowKey to, which is that of
+// the migration continuum during a migration, and its position in that
+// continuum's buckets.
+func (kv *KVStore) Locate(rowKey string) (shard string, index int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	continuum := kv.continuum
+	if kv.migration != nil {
+		continuum = kv.migration
+	}
+	shard = continuum.Choose(rowKey)
+	for i, bucket := range continuum.Buckets() {
+		if bucket == shard {
+			return shard, i
+		}
+	}
+	return shard, -1
+}
+
 // AddShard adds a shard from the list of known shards
 func (kv *KVStore) AddShard(shard string, storage Storage) {
 	kv.mu.Lock()
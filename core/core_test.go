@@ -2,6 +2,8 @@ package core
 
 import (
 	"context"
+	"errors"
+	"reflect"
 	"strconv"
 	"testing"
 
@@ -132,3 +134,240 @@ func TestShardedkv(t *testing.T) {
 	}
 
 }
+
+// tracingStorage records the order in which GetCell enters and leaves each
+// middleware.
+type tracingStorage struct {
+	Storage
+	name  string
+	trace *[]string
+}
+
+func (s tracingStorage) GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (models.Cell, bool, error) {
+	*s.trace = append(*s.trace, s.name+" before")
+	defer func() { *s.trace = append(*s.trace, s.name+" after") }()
+	return s.Storage.GetCell(ctx, rowKey, columnKey, refKey)
+}
+
+func TestWrap(t *testing.T) {
+	var trace []string
+	tracing := func(name string) Middleware {
+		return func(next Storage) Storage {
+			return tracingStorage{Storage: next, name: name, trace: &trace}
+		}
+	}
+
+	base := st.New()
+	defer base.Destroy(context.TODO())
+	err := base.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := Wrap(base, tracing("outer"), tracing("inner"))
+	_, found, err := storage.GetCell(context.TODO(), "row", "BASE", 1)
+	if err != nil || !found {
+		t.Fatalf("expected the cell through the middlewares, got found=%v err=%v", found, err)
+	}
+	expected := []string{"outer before", "inner before", "inner after", "outer after"}
+	if !reflect.DeepEqual(trace, expected) {
+		t.Errorf("expected %v, got %v", expected, trace)
+	}
+
+	if Wrap(base) != Storage(base) {
+		t.Error("expected Wrap without middlewares to return base")
+	}
+}
+
+// unwrappingStorage is a tracingStorage that lets its capabilities reach
+// the storage it wraps.
+type unwrappingStorage struct {
+	tracingStorage
+}
+
+func (s unwrappingStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	var trace []string
+	base := st.New()
+	defer base.Destroy(context.TODO())
+	err := base.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A decorator hides the capabilities of base...
+	hiding := Wrap(base, func(next Storage) Storage {
+		return tracingStorage{Storage: next, name: "hiding", trace: &trace}
+	})
+	kv := New(ch.New(), []Shard{{Name: "test_shard0", Backend: hiding}})
+	_, err = kv.GetRow(context.TODO(), "row")
+	if err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported through a decorator, got %v", err)
+	}
+	_, err = kv.ResequenceCell(context.TODO(), "row", "BASE")
+	if err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported through a decorator, got %v", err)
+	}
+
+	// ...unless it unwraps, however deep base is.
+	unwrapping := func(next Storage) Storage {
+		return unwrappingStorage{tracingStorage{Storage: next, name: "unwrapping", trace: &trace}}
+	}
+	kv = New(ch.New(), []Shard{{Name: "test_shard0", Backend: Wrap(base, unwrapping, unwrapping)}})
+	cells, err := kv.GetRow(context.TODO(), "row")
+	if err != nil || len(cells) != 1 {
+		t.Fatalf("expected the row of base, got %v, %v", cells, err)
+	}
+	moved, err := kv.ResequenceCell(context.TODO(), "row", "BASE")
+	if err != nil || moved != 0 {
+		t.Fatalf("expected nothing to resequence, got %d, %v", moved, err)
+	}
+
+	// The decorator still sees the calls it implements.
+	_, _, err = kv.GetCell(context.TODO(), "row", "BASE", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"unwrapping before", "unwrapping before", "unwrapping after", "unwrapping after"}
+	if !reflect.DeepEqual(trace, expected) {
+		t.Errorf("expected %v, got %v", expected, trace)
+	}
+}
+
+// panickingStorage panics in PartitionRead, as a driver bug scanning a
+// malformed row would.
+type panickingStorage struct {
+	Storage
+}
+
+func (s panickingStorage) PartitionRead(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) ([]models.Cell, bool, error) {
+	panic("malformed row")
+}
+
+func TestRecover(t *testing.T) {
+	base := st.New()
+	defer base.Destroy(context.TODO())
+	kv := New(ch.New(), []Shard{{Name: "test_shard0", Backend: panickingStorage{base}}})
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the panic to propagate without WithRecover")
+			}
+		}()
+		kv.PartitionRead(context.TODO(), 0, "added_at", 0, 10)
+	}()
+
+	var ops []string
+	kv.WithRecover(func(op string, recovered interface{}, stack []byte) {
+		ops = append(ops, op)
+		if recovered != "malformed row" || len(stack) == 0 {
+			t.Errorf("unexpected panic %v with stack %q", recovered, stack)
+		}
+	})
+	_, _, err := kv.PartitionRead(context.TODO(), 0, "added_at", 0, 10)
+	if !errors.Is(err, ErrPanic) {
+		t.Fatalf("expected ErrPanic, got %v", err)
+	}
+	if !reflect.DeepEqual(ops, []string{"PartitionRead"}) {
+		t.Fatalf("expected the panic of PartitionRead to be reported, got %v", ops)
+	}
+
+	// The lock was released, and calls that do not panic are unaffected.
+	err = kv.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// PartitionScan rejects a partition that does not exist, and recovers
+	// from a panic of the storage's PartitionRead without keeping the lock.
+	noop := func(models.Cell) error { return nil }
+	err = kv.PartitionScan(context.TODO(), 5, "added_at", 0, 10, noop)
+	if err == nil || errors.Is(err, ErrPanic) {
+		t.Fatalf("expected an out of range error, got %v", err)
+	}
+	err = kv.PartitionScan(context.TODO(), 0, "added_at", 0, 10, noop)
+	if !errors.Is(err, ErrPanic) {
+		t.Fatalf("expected ErrPanic, got %v", err)
+	}
+	_, _, err = kv.GetCell(context.TODO(), "row", "BASE", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// samplingStorage counts the GetCell calls whose context is sampled.
+type samplingStorage struct {
+	Storage
+	calls, sampled int
+}
+
+func (s *samplingStorage) GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (models.Cell, bool, error) {
+	s.calls++
+	if sampled, ok := models.SampledFromContext(ctx); !ok || sampled {
+		s.sampled++
+	}
+	return models.Cell{}, false, nil
+}
+
+func TestSampling(t *testing.T) {
+	storage := &samplingStorage{}
+	kv := New(ch.New(), []Shard{{Name: "test_shard0", Backend: storage}})
+
+	for i := 0; i < 100; i++ {
+		kv.GetCell(context.TODO(), "row", "BASE", 1)
+	}
+	if storage.sampled != 100 {
+		t.Fatalf("expected every call sampled by default, got %d", storage.sampled)
+	}
+
+	kv.WithSampling(10)
+	storage.sampled = 0
+	for i := 0; i < 1000; i++ {
+		kv.GetCell(context.TODO(), "row", "BASE", 1)
+	}
+	if storage.sampled != 100 {
+		t.Fatalf("expected 1 in 10 calls sampled, got %d of 1000", storage.sampled)
+	}
+
+	// Traces are sampled by their id: roughly 1 in 10 of them, each in
+	// full or not at all.
+	storage.sampled = 0
+	for i := 0; i < 1000; i++ {
+		ctx := models.WithTraceID(context.TODO(), "trace"+strconv.Itoa(i))
+		before := storage.sampled
+		for j := 0; j < 3; j++ {
+			kv.GetCell(ctx, "row", "BASE", 1)
+		}
+		if n := storage.sampled - before; n != 0 && n != 3 {
+			t.Fatalf("expected a trace sampled in full or not at all, got %d of 3 calls", n)
+		}
+	}
+	if traces := storage.sampled / 3; traces < 60 || traces > 140 {
+		t.Fatalf("expected about 100 of 1000 traces sampled, got %d", traces)
+	}
+
+	// A decision already made is kept.
+	storage.sampled = 0
+	for i := 0; i < 10; i++ {
+		kv.GetCell(models.WithSampled(context.TODO(), true), "row", "BASE", 1)
+	}
+	if storage.sampled != 10 {
+		t.Fatalf("expected calls marked sampled to stay sampled, got %d of 10", storage.sampled)
+	}
+
+	// An n of 1 or less, negative included, samples every call.
+	for _, n := range []int{1, 0, -1} {
+		kv.WithSampling(n)
+		storage.sampled = 0
+		for i := 0; i < 10; i++ {
+			kv.GetCell(context.TODO(), "row", "BASE", 1)
+		}
+		if storage.sampled != 10 {
+			t.Fatalf("expected every call sampled with n %d, got %d of 10", n, storage.sampled)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package core
+
+// Middleware decorates a Storage, e.g. with a cache, retries, metrics,
+// tracing or rate limiting, returning a Storage that calls the one it was
+// given.
+//
+// A decorator only has the methods it defines: one that embeds Storage
+// hides the optional capabilities of the storage it wraps, such as
+// RowReader, and the operations that need them fail with ErrNotSupported.
+// A middleware that must keep a capability has to implement it and pass it
+// through, or implement Unwrapper.
+type Middleware func(Storage) Storage
+
+// Unwrapper is implemented by decorators whose wrapped storage may be
+// called directly for the optional capabilities they do not implement
+// themselves. KVStore looks for a capability on the storage of a shard,
+// then on the storage it unwraps to, and so on, and calls the first that
+// has it. Those calls bypass the decorator, so a metrics or tracing
+// middleware may implement Unwrapper, but a cache must not, or writes such
+// as a RowWriter's would skip its invalidation.
+type Unwrapper interface {
+	// Unwrap returns the storage the decorator wraps
+	Unwrap() Storage
+}
+
+// Wrap decorates base with mws, the first of which is the outermost: with
+// Wrap(base, a, b), a call enters a, then b, then reaches base, and returns
+// through b and then a. So list the middlewares in the order a call should
+// meet them, e.g. metrics before a retry that should count as a single
+// call, or a cache before the rate limit that a hit should not consume.
+func Wrap(base Storage, mws ...Middleware) Storage {
+	storage := base
+	for i := len(mws) - 1; i >= 0; i-- {
+		storage = mws[i](storage)
+	}
+	return storage
+}
+
+// capability returns storage as a T, an optional capability, or else the
+// first storage it unwraps to that is one, see Unwrapper.
+func capability[T any](storage Storage) (T, bool) {
+	for storage != nil {
+		if c, ok := storage.(T); ok {
+			return c, true
+		}
+		unwrapper, ok := storage.(Unwrapper)
+		if !ok {
+			break
+		}
+		storage = unwrapper.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
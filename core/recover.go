@@ -0,0 +1,42 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// ErrPanic is wrapped by the error a KVStore with WithRecover returns for a
+// call in which a storage panicked.
+var ErrPanic = errors.New("storage panicked")
+
+// PanicFunc is told of a panic recovered by a KVStore: the operation, the
+// value it panicked with, and the stack of the panicking goroutine.
+type PanicFunc func(op string, recovered interface{}, stack []byte)
+
+// WithRecover makes every call that returns an error recover from a panic of
+// the storage it calls, e.g. a driver bug while scanning a malformed row,
+// and return an error wrapping ErrPanic instead, so that a single bad row
+// cannot crash the process. fn, if not nil, is called first, e.g. to log the
+// stack. Whatever the call had done before panicking is not undone.
+func (kv *KVStore) WithRecover(fn PanicFunc) *KVStore {
+	if fn == nil {
+		fn = func(string, interface{}, []byte) {}
+	}
+	kv.onPanic = fn
+	return kv
+}
+
+// recoverPanic is deferred by every call returning an error, with the
+// address of that error, to recover from a panic if WithRecover was called.
+func (kv *KVStore) recoverPanic(op string, err *error) {
+	if kv.onPanic == nil {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	kv.onPanic(op, r, debug.Stack())
+	*err = fmt.Errorf("%w in %s: %v", ErrPanic, op, r)
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"context"
+	"github.com/rbastic/go-schemaless/models"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// WithSampling makes 1 in n storage calls log their details, such as the
+// statements they run, so that the cost of logging stays bounded at high
+// volume; the others only log warnings and errors. Calls whose context
+// carries a trace id (see models.WithTraceID) are sampled by a hash of it,
+// so that a trace is logged in full or not at all; the others are sampled
+// in turn. A context that already says whether it is sampled (see
+// models.WithSampled) is left alone. An n of 1 or less samples every call,
+// as without WithSampling.
+func (kv *KVStore) WithSampling(n int) *KVStore {
+	if n <= 1 {
+		n = 1
+	}
+	kv.sampleEvery = uint64(n)
+	return kv
+}
+
+// shardContext returns ctx for a call dispatched to shard, with its sampling
+// decision.
+func (kv *KVStore) shardContext(ctx context.Context, shard string) context.Context {
+	ctx = models.WithShard(ctx, shard)
+	if kv.sampleEvery <= 1 {
+		return ctx
+	}
+	if _, ok := models.SampledFromContext(ctx); ok {
+		return ctx
+	}
+	return models.WithSampled(ctx, kv.sample(models.TraceIDFromContext(ctx)))
+}
+
+// sample decides whether a call of the trace traceID, if any, is sampled.
+func (kv *KVStore) sample(traceID string) bool {
+	if traceID != "" {
+		h := fnv.New64a()
+		h.Write([]byte(traceID))
+		return h.Sum64()%kv.sampleEvery == 0
+	}
+	return atomic.AddUint64(&kv.sampled, 1)%kv.sampleEvery == 0
+}
@@ -0,0 +1,122 @@
+package schemaless
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+	"io"
+	"strconv"
+	"time"
+)
+
+// exportPageSize is the number of cells ExportCSV reads at a time.
+const exportPageSize = 1000
+
+// csvColumns are the cell columns ExportCSV can write, by name.
+var csvColumns = map[string]func(models.Cell) string{
+	"added_at":    func(c models.Cell) string { return strconv.FormatInt(c.AddedAt, 10) },
+	"row_key":     func(c models.Cell) string { return c.RowKey },
+	"column_name": func(c models.Cell) string { return c.ColumnName },
+	"ref_key":     func(c models.Cell) string { return strconv.FormatInt(c.RefKey, 10) },
+	"body":        func(c models.Cell) string { return c.Body },
+	"created_at": func(c models.Cell) string {
+		if c.CreatedAt == nil {
+			return ""
+		}
+		return c.CreatedAt.Format(time.RFC3339)
+	},
+	"schema_version": func(c models.Cell) string { return strconv.FormatInt(c.SchemaVersion, 10) },
+	"metadata": func(c models.Cell) string {
+		if len(c.Metadata) == 0 {
+			return ""
+		}
+		b, _ := json.Marshal(c.Metadata)
+		return string(b)
+	},
+}
+
+// ExportCSV writes every cell of a partition to w as CSV, in added_at order:
+// a header row of columns then bodyFields, then a row for each cell. columns
+// name cell columns, e.g. "row_key" or "created_at"; checksum, which cells
+// do not carry, is not one of them. bodyFields are paths into the JSON body
+// (see models.SplitPath). A path the body does not have, or a body that is
+// not JSON, gives an empty field; a string is written as is, and any other
+// value as JSON.
+//
+// Cells are written as they are read, so an error may leave w with part of
+// the partition.
+func (ds *DataStore) ExportCSV(ctx context.Context, partitionNumber int, w io.Writer, columns []string, bodyFields []string) error {
+	defer ds.observeSlow("ExportCSV", "", time.Now())
+	for _, column := range columns {
+		if _, ok := csvColumns[column]; !ok {
+			return fmt.Errorf("cannot export column %q", column)
+		}
+	}
+	keys := make([][]string, len(bodyFields))
+	for i, path := range bodyFields {
+		var err error
+		keys[i], err = models.SplitPath(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	cw := csv.NewWriter(w)
+	err := cw.Write(append(append([]string{}, columns...), bodyFields...))
+	if err != nil {
+		return err
+	}
+
+	record := make([]string, len(columns)+len(bodyFields))
+	var after int64
+	for {
+		n := 0
+		err = ds.source.PartitionScan(ctx, partitionNumber, "added_at", after, exportPageSize, func(cell models.Cell) error {
+			n++
+			after = cell.AddedAt
+			cell, err := ds.fetchBlob(ctx, cell, nil)
+			if err != nil {
+				return err
+			}
+			cell = ds.logicalCell(cell)
+
+			for i, column := range columns {
+				record[i] = csvColumns[column](cell)
+			}
+			if len(bodyFields) > 0 {
+				doc, err := decodeJSON([]byte(cell.Body))
+				if err != nil {
+					doc = nil
+				}
+				for i := range bodyFields {
+					record[len(columns)+i] = csvField(lookupPath(doc, keys[i]))
+				}
+			}
+			return cw.Write(record)
+		})
+		if err != nil {
+			return err
+		}
+		if n < exportPageSize {
+			break
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvField formats a value of a JSON body for ExportCSV.
+func csvField(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
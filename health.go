@@ -0,0 +1,103 @@
+package schemaless
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rbastic/go-schemaless/models"
+	"sort"
+	"time"
+)
+
+// RowHealth is what CheckRow found wrong with the versions of a cell. Each
+// list holds ref keys in increasing order.
+type RowHealth struct {
+	RowKey     string
+	ColumnName string
+	// Versions is the number of versions read.
+	Versions int
+	// DuplicateRefKeys are ref keys held by more than one version.
+	DuplicateRefKeys []int64
+	// MissingCreatedAt are ref keys of versions without a created_at.
+	MissingCreatedAt []int64
+	// UnparsableBodies are ref keys of versions whose body is not JSON,
+	// other than those without a body at all.
+	UnparsableBodies []int64
+}
+
+// Healthy reports whether CheckRow found nothing wrong.
+func (h RowHealth) Healthy() bool {
+	return len(h.DuplicateRefKeys) == 0 && len(h.MissingCreatedAt) == 0 && len(h.UnparsableBodies) == 0
+}
+
+// CheckRow reads every version of a cell and reports those that a bug may
+// have left behind: ref keys held by several versions, versions without a
+// created_at and bodies that are not JSON, other than the versions without
+// a body at all (see models.Cell.NullBody). It fails with
+// core.ErrNotSupported if the shard's storage cannot read whole rows.
+func (ds *DataStore) CheckRow(ctx context.Context, rowKey string, columnKey string) (RowHealth, error) {
+	defer ds.observeSlow("CheckRow", rowKey, time.Now())
+	versions, _, err := ds.readVersions(ctx, rowKey, columnKey)
+	if err != nil {
+		return RowHealth{}, err
+	}
+
+	health := RowHealth{RowKey: rowKey, ColumnName: columnKey, Versions: len(versions)}
+	for i, cell := range versions {
+		if i > 0 && versions[i-1].RefKey == cell.RefKey {
+			if n := len(health.DuplicateRefKeys); n == 0 || health.DuplicateRefKeys[n-1] != cell.RefKey {
+				health.DuplicateRefKeys = append(health.DuplicateRefKeys, cell.RefKey)
+			}
+		}
+		if cell.CreatedAt == nil || cell.CreatedAt.IsZero() {
+			health.MissingCreatedAt = append(health.MissingCreatedAt, cell.RefKey)
+		}
+		if !cell.NullBody && !json.Valid([]byte(cell.Body)) {
+			health.UnparsableBodies = append(health.UnparsableBodies, cell.RefKey)
+		}
+	}
+	return health, nil
+}
+
+// Repair re-sequences the versions of a cell that share a ref key: the
+// first one written keeps it, and the others are given the ref keys after
+// the highest one, in the order they were written. It returns the number of
+// versions moved. Other problems CheckRow reports are left alone.
+//
+// The moved versions are updated in place, in a single transaction of the
+// storage, so they keep their created_at and added_at, and the rest of the
+// row is not touched. It fails with core.ErrNotSupported if the shard's
+// storage cannot, see core.CellResequencer.
+func (ds *DataStore) Repair(ctx context.Context, rowKey string, columnKey string) (int, error) {
+	defer ds.observeSlow("Repair", rowKey, time.Now())
+	moved, err := ds.source.ResequenceCell(ctx, ds.physicalKey(rowKey), columnKey)
+	if err != nil {
+		return moved, err
+	}
+	if moved > 0 {
+		ds.audit(ctx, "Repair", rowKey, columnKey, 0)
+	}
+	return moved, nil
+}
+
+// readVersions reads a row, returning the versions of columnKey ordered by
+// ref key and then added_at, and the cells of its other columns.
+func (ds *DataStore) readVersions(ctx context.Context, rowKey string, columnKey string) (versions []models.Cell, others []models.Cell, err error) {
+	cells, err := ds.source.GetRow(ctx, ds.physicalKey(rowKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, cell := range ds.logicalCells(cells) {
+		if cell.ColumnName == columnKey {
+			versions = append(versions, cell)
+		} else {
+			others = append(others, cell)
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].RefKey != versions[j].RefKey {
+			return versions[i].RefKey < versions[j].RefKey
+		}
+		return versions[i].AddedAt < versions[j].AddedAt
+	})
+	return versions, others, nil
+}
@@ -0,0 +1,104 @@
+package schemaless
+
+import (
+	"github.com/dgryski/go-metro"
+	"math"
+	"sync"
+)
+
+// HotRowFunc is called the first time a cell is seen to exceed the hot row
+// threshold. versions is an estimate, see WithHotRowThreshold.
+type HotRowFunc func(rowKey string, columnKey string, versions int64)
+
+const (
+	hotRowDepth = 4
+	hotRowWidth = 4096
+	// hotRowDecay is the number of writes after which every count is halved
+	hotRowDecay = 16 * hotRowWidth
+)
+
+// hotRows estimates the number of versions written per (row key, column
+// key) with a count-min sketch, so memory use stays fixed no matter how many
+// cells are written. The counts are halved every decayEvery writes, so that
+// they follow recent writes rather than every write since the start.
+type hotRows struct {
+	mu         sync.Mutex
+	threshold  int64
+	counts     [hotRowDepth][hotRowWidth]int64
+	writes     int64
+	decayEvery int64
+	// warned holds the cells over the threshold that fn was called for.
+	// Those that fall back under it are dropped at each decay, which keeps
+	// it no larger than the number of cells the counts can hold over it.
+	warned map[string]struct{}
+	fn     HotRowFunc
+}
+
+func newHotRows(threshold int64, fn HotRowFunc) *hotRows {
+	return &hotRows{
+		threshold:  threshold,
+		decayEvery: hotRowDecay,
+		warned:     make(map[string]struct{}),
+		fn:         fn,
+	}
+}
+
+// add records a version written to the cell, calling fn if this is the
+// write that takes the cell over the threshold.
+func (h *hotRows) add(rowKey string, columnKey string) {
+	key := rowKey + "\x00" + columnKey
+
+	h.mu.Lock()
+	h.writes++
+	if h.writes%h.decayEvery == 0 {
+		h.decay()
+	}
+	for i := 0; i < hotRowDepth; i++ {
+		h.counts[i][hotRowIndex(key, i)]++
+	}
+	estimate := h.estimate(key)
+
+	if estimate <= h.threshold {
+		h.mu.Unlock()
+		return
+	}
+	if _, ok := h.warned[key]; ok {
+		h.mu.Unlock()
+		return
+	}
+	h.warned[key] = struct{}{}
+	h.mu.Unlock()
+
+	h.fn(rowKey, columnKey, estimate)
+}
+
+func hotRowIndex(key string, i int) uint64 {
+	return metro.Hash64([]byte(key), uint64(i)) % hotRowWidth
+}
+
+// estimate returns the estimated count of key. Called with mu held.
+func (h *hotRows) estimate(key string) int64 {
+	estimate := int64(math.MaxInt64)
+	for i := 0; i < hotRowDepth; i++ {
+		if c := h.counts[i][hotRowIndex(key, i)]; c < estimate {
+			estimate = c
+		}
+	}
+	return estimate
+}
+
+// decay halves every count, and forgets the cells warned about that are no
+// longer over the threshold, so that fn is called again if they heat up
+// again. Called with mu held.
+func (h *hotRows) decay() {
+	for i := range h.counts {
+		for j := range h.counts[i] {
+			h.counts[i][j] /= 2
+		}
+	}
+	for key := range h.warned {
+		if h.estimate(key) <= h.threshold {
+			delete(h.warned, key)
+		}
+	}
+}
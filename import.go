@@ -0,0 +1,84 @@
+package schemaless
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+	"io"
+)
+
+// defaultImportBatchSize is the ImportOptions.BatchSize used when none is
+// given.
+const defaultImportBatchSize = 1000
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	// BatchSize is the number of cells written between two progress
+	// reports and context checks. It defaults to 1000.
+	BatchSize int
+	// OnProgress, if set, is called after each batch with the total number
+	// of cells written so far. Import does not read ahead while it runs, so
+	// a slow OnProgress throttles the import.
+	OnProgress func(count int64)
+}
+
+// Import writes the cells read from r, one JSON-encoded models.Cell per line
+// with at least RowKey, ColumnName, RefKey and Body set, and returns how many
+// it wrote. Cells are written synchronously, bypassing the batch writer if
+// there is one, so a reported count is durable.
+//
+// ctx is checked between batches: once it is done, Import stops and returns
+// ctx.Err() along with the cells written so far. It also stops at the first
+// cell that fails to decode or write, e.g. with models.ErrCellExists.
+func (ds *DataStore) Import(ctx context.Context, r io.Reader, opts ImportOptions) (int64, error) {
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	scanner := bufio.NewScanner(r)
+	// Cell bodies can be far larger than a default scanner token.
+	scanner.Buffer(nil, 64<<20)
+
+	var count int64
+	var line int
+	batch := make([]models.Cell, 0, batchSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+
+		batch = batch[:0]
+		for len(batch) < batchSize && scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var cell models.Cell
+			err := json.Unmarshal(scanner.Bytes(), &cell)
+			if err != nil {
+				return count, fmt.Errorf("import line %d: %s", line, err)
+			}
+			batch = append(batch, cell)
+		}
+		if err := scanner.Err(); err != nil {
+			return count, err
+		}
+		if len(batch) == 0 {
+			return count, nil
+		}
+
+		for _, cell := range batch {
+			err := ds.writeCell(ctx, "Import", cell.RowKey, cell.ColumnName, cell.RefKey, cell, ds.policy(cell.ColumnName) == Replace)
+			if err != nil {
+				return count, fmt.Errorf("import %s/%s/%d: %w", cell.RowKey, cell.ColumnName, cell.RefKey, err)
+			}
+			count++
+		}
+		if opts.OnProgress != nil {
+			opts.OnProgress(count)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Package teardown implements the part of Destroy that every storage shares:
+// flushing the logger and closing the connection, bounded by a context. Once
+// turns a Destroy into an idempotent Close, for the storages and for the
+// KVStore and DataStore that hold them.
+package teardown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"sync"
+	"syscall"
+)
+
+// Run syncs sugar and then calls closeFn, returning as soon as ctx is done
+// if that happens first. closeFn is called even when the sync fails, and
+// both errors are reported. Either argument may be nil.
+func Run(ctx context.Context, sugar *zap.SugaredLogger, closeFn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- run(sugar, closeFn)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("destroy: %w", ctx.Err())
+	}
+}
+
+// Once backs the Close method of a storage, a KVStore or a DataStore.
+type Once struct {
+	once sync.Once
+	err  error
+}
+
+// Close calls destroy, without a deadline, the first time it is called. It
+// returns what that call returned every time.
+func (o *Once) Close(destroy func(ctx context.Context) error) error {
+	o.once.Do(func() {
+		o.err = destroy(context.Background())
+	})
+	return o.err
+}
+
+func run(sugar *zap.SugaredLogger, closeFn func() error) error {
+	var syncErr, closeErr error
+	if sugar != nil {
+		syncErr = sugar.Sync()
+		if isUnsyncable(syncErr) {
+			syncErr = nil
+		}
+	}
+	if closeFn != nil {
+		closeErr = closeFn()
+	}
+
+	switch {
+	case syncErr != nil && closeErr != nil:
+		return fmt.Errorf("destroy: syncing logger: %v; closing connection: %w", syncErr, closeErr)
+	case syncErr != nil:
+		return fmt.Errorf("destroy: syncing logger: %w", syncErr)
+	case closeErr != nil:
+		return fmt.Errorf("destroy: closing connection: %w", closeErr)
+	}
+	return nil
+}
+
+// isUnsyncable reports whether err is what fsync returns for a terminal or a
+// pipe, which is where zap.NewProduction() logs by default. Nothing was lost
+// in that case.
+func isUnsyncable(err error) bool {
+	return errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTTY)
+}
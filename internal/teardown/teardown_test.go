@@ -0,0 +1,81 @@
+package teardown
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"testing"
+	"time"
+)
+
+// syncer is a zapcore.WriteSyncer with a configurable Sync.
+type syncer struct {
+	sync func() error
+}
+
+func (s syncer) Write(p []byte) (int, error) { return len(p), nil }
+func (s syncer) Sync() error                 { return s.sync() }
+
+func newSugar(sync func() error) *zap.SugaredLogger {
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), syncer{sync}, zap.InfoLevel)
+	return zap.New(core).Sugar()
+}
+
+func TestSyncError(t *testing.T) {
+	errSync := errors.New("disk on fire")
+	closed := false
+
+	err := Run(context.TODO(), newSugar(func() error { return errSync }), func() error {
+		closed = true
+		return nil
+	})
+	if !errors.Is(err, errSync) {
+		t.Fatalf("expected the sync error to be surfaced, got %v", err)
+	}
+	if !closed {
+		t.Error("expected the connection to be closed despite the sync error")
+	}
+}
+
+func TestCloseError(t *testing.T) {
+	errClose := errors.New("connection reset")
+
+	err := Run(context.TODO(), newSugar(func() error { return nil }), func() error { return errClose })
+	if !errors.Is(err, errClose) {
+		t.Fatalf("expected the close error to be surfaced, got %v", err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	err := Run(ctx, newSugar(func() error { <-block; return nil }), nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error from a hung sync, got %v", err)
+	}
+}
+
+func TestOnce(t *testing.T) {
+	errClose := errors.New("connection reset")
+	calls := 0
+	destroy := func(ctx context.Context) error {
+		calls++
+		return errClose
+	}
+
+	var o Once
+	for i := 0; i < 3; i++ {
+		err := o.Close(destroy)
+		if err != errClose {
+			t.Fatalf("close %d: expected %v, got %v", i, errClose, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected destroy to be called once, got %d", calls)
+	}
+}
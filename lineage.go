@@ -0,0 +1,37 @@
+package schemaless
+
+import (
+	"context"
+	"github.com/rbastic/go-schemaless/models"
+	"time"
+)
+
+// lineage returns cell with the causation and correlation ids of ctx (see
+// models.WithCausationID and models.WithCorrelationID) for those it does not
+// carry already.
+func lineage(ctx context.Context, cell models.Cell) models.Cell {
+	if cell.CausationID == "" {
+		cell.CausationID = models.CausationIDFromContext(ctx)
+	}
+	if cell.CorrelationID == "" {
+		cell.CorrelationID = models.CorrelationIDFromContext(ctx)
+	}
+	return cell
+}
+
+// PartitionReadCorrelation is PartitionRead returning only the cells whose
+// correlation id is correlationID, e.g. every event written on behalf of one
+// request. It fails with core.ErrNotSupported if the shard's storage cannot
+// filter by correlation id, see core.CorrelationReader. A table without the
+// correlation_id column, see WithDetectedColumns on the SQL storages, holds
+// no such cells.
+func (ds *DataStore) PartitionReadCorrelation(ctx context.Context, partitionNumber int, correlationID string, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	defer ds.observeSlow("PartitionReadCorrelation", "", time.Now())
+	value, err = ds.physicalValue(location, value)
+	if err != nil {
+		return nil, false, err
+	}
+	cells, found, err = ds.source.PartitionReadCorrelation(ctx, partitionNumber, correlationID, location, value, limit)
+	err = ds.fetchBlobs(ctx, cells, err)
+	return ds.logicalCells(cells), found, err
+}
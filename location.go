@@ -0,0 +1,62 @@
+package schemaless
+
+import (
+	"context"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+	"time"
+)
+
+// PartitionLocation is the column a partition read pages by. Unlike the
+// location strings PartitionRead takes, a misspelt PartitionLocation does
+// not compile.
+type PartitionLocation int
+
+const (
+	// CreatedAt pages by created_at, after a time.Time, *time.Time or
+	// time string, which is taken to be in UTC.
+	CreatedAt PartitionLocation = iota + 1
+	// AddedAt pages by added_at, after an int or int64.
+	AddedAt
+	// Cursor pages by created_at and then the cell's key, after a cursor
+	// token from models.CursorAfter. Not every storage supports it.
+	Cursor
+)
+
+var locationNames = map[PartitionLocation]string{
+	CreatedAt: "created_at",
+	AddedAt:   "added_at",
+	Cursor:    "cursor",
+}
+
+// String returns the location string storages take for l.
+func (l PartitionLocation) String() string {
+	name, ok := locationNames[l]
+	if !ok {
+		return fmt.Sprintf("PartitionLocation(%d)", int(l))
+	}
+	return name
+}
+
+// ParsePartitionLocation returns the PartitionLocation of a location string,
+// accepting "timestamp" for CreatedAt as the storages do.
+func ParsePartitionLocation(s string) (PartitionLocation, error) {
+	if s == "timestamp" {
+		return CreatedAt, nil
+	}
+	for l, name := range locationNames {
+		if name == s {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unrecognized partition location %q", s)
+}
+
+// PartitionReadAt is PartitionRead with a typed location.
+func (ds *DataStore) PartitionReadAt(ctx context.Context, partitionNumber int, location PartitionLocation, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	if _, ok := locationNames[location]; !ok {
+		return nil, false, fmt.Errorf("unrecognized partition location %s", location)
+	}
+	defer ds.observeSlow("PartitionRead", "", time.Now())
+	return ds.partitionRead(ctx, partitionNumber, location.String(), value, limit)
+}
@@ -0,0 +1,84 @@
+package schemaless
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+	"math"
+)
+
+// MergeStrategy folds a version of a cell into the result of merging the
+// versions before it. Both are decoded JSON; merged is nil for the first
+// version. It may modify merged.
+type MergeStrategy func(merged interface{}, version interface{}) interface{}
+
+// LastWriteWins discards merged, so that merging a cell reads its latest
+// version.
+func LastWriteWins(merged interface{}, version interface{}) interface{} {
+	return version
+}
+
+// DeepMerge applies each version to the ones before it as an RFC 7396 JSON
+// merge patch: objects are merged recursively, a null member deletes the
+// member, and any other value replaces what was there.
+func DeepMerge(merged interface{}, version interface{}) interface{} {
+	return mergePatch(merged, version)
+}
+
+// mergePageSize is how many versions GetCellMerged reads per query.
+const mergePageSize = 1000
+
+// WithMergeStrategy sets how GetCellMerged combines versions. It defaults
+// to DeepMerge.
+func (ds *DataStore) WithMergeStrategy(strategy MergeStrategy) *DataStore {
+	ds.merge = strategy
+	return ds
+}
+
+// GetCellMerged reads every version of a cell, in ref key order, and returns
+// the latest one with its body replaced by the merge of all of their bodies,
+// which must be JSON. It is meant for columns whose versions are patches to
+// the ones before.
+func (ds *DataStore) GetCellMerged(ctx context.Context, rowKey string, columnKey string) (models.Cell, bool, error) {
+	strategy := ds.merge
+	if strategy == nil {
+		strategy = DeepMerge
+	}
+
+	var (
+		latest models.Cell
+		found  bool
+		merged interface{}
+	)
+	minRefKey := int64(math.MinInt64)
+	for {
+		cells, err := ds.GetCellRange(ctx, rowKey, columnKey, minRefKey, 0, mergePageSize)
+		if err != nil {
+			return models.Cell{}, false, err
+		}
+		for _, cell := range cells {
+			version, err := decodeJSON([]byte(cell.Body))
+			if err != nil {
+				return models.Cell{}, false, fmt.Errorf("cell %s/%s version %d is not JSON: %s", rowKey, columnKey, cell.RefKey, err)
+			}
+			merged = strategy(merged, version)
+			latest = cell
+			found = true
+		}
+		if len(cells) < mergePageSize || latest.RefKey == math.MaxInt64 {
+			break
+		}
+		minRefKey = latest.RefKey + 1
+	}
+	if !found {
+		return models.Cell{}, false, nil
+	}
+
+	body, err := json.Marshal(merged)
+	if err != nil {
+		return models.Cell{}, false, err
+	}
+	latest.Body = string(body)
+	return latest, true, nil
+}
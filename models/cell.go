@@ -1,8 +1,7 @@
 package models
 
 import (
-	"bytes"
-	"strconv"
+	"encoding/json"
 	"time"
 )
 
@@ -34,12 +33,48 @@ type Cell struct {
 	// case of a catastrophic data center outage." -- [2] 'Storage Nodes',
 	// https://eng.uber.com/schemaless-part-two/
 
+	// AddedAt is the position of the cell in the append sequence of its
+	// shard, assigned by the storage when the cell is written and never
+	// changed; it is ignored on write. It is what partition reads should
+	// page by: unlike CreatedAt, a cell written later never sorts before a
+	// position already read.
+	//
+	// CreatedAt is the logical time of the event the cell records, for
+	// filtering a partition by time window. The writer may set it, e.g. to
+	// back-date an imported event; a cell written without one is stamped
+	// with the write time. Storages keep it in UTC, to the second, and
+	// return it in UTC, whatever the time zone it was written in.
 	AddedAt    int64      `json:"omitempty"`
 	RowKey     string     // UUID
 	ColumnName string     // The actual column name for the individual Body blob
 	RefKey     int64      // for versioning or sorting cells in a list
 	Body       string     // Uber chose JSON inside MessagePack'd LZ4 blobs
 	CreatedAt  *time.Time `json:"omitempty"`
+
+	// SchemaVersion is the application's version of the format of Body, so
+	// that readers can migrate old cells as they read them. Storages that
+	// do not keep it return 0.
+	SchemaVersion int64
+
+	// Metadata are small key/value tags kept alongside Body, such as the
+	// source or author of a write. Storages that do not keep them return
+	// nil.
+	Metadata map[string]string
+
+	// CausationID is the id of the event or command that caused the cell
+	// to be written, and CorrelationID the id shared by all the cells
+	// written, directly or not, on behalf of the same request; see
+	// WithCausationID and WithCorrelationID. The memory, fs, MySQL,
+	// Postgres and rqlite storages keep them in columns of their own.
+	// Other storages return "".
+	CausationID   string `json:",omitempty"`
+	CorrelationID string `json:",omitempty"`
+
+	// NullBody is set for a cell that has no body at all, as opposed to an
+	// empty one; its Body is "". The memory, fs, MySQL and Postgres
+	// storages keep it as a NULL body. Other storages do not keep it, and
+	// return cells without a body as empty ones.
+	NullBody bool `json:",omitempty"`
 }
 
 // NewCell constructs a Cell structure with the minimum parameters necessary:
@@ -49,30 +84,51 @@ func NewCell(rowKey string, columnName string, refKey int64, body string) Cell {
 	return Cell{RowKey: rowKey, ColumnName: columnName, RefKey: refKey, Body: body}
 }
 
-// String returns formatted JSON representing a Cell.
-func (c *Cell) String() string {
-	// TODO: Support timestamps.
-	addedAtStr := strconv.FormatInt(c.AddedAt, 10)
-	refKeyStr := strconv.FormatInt(c.RefKey, 10)
-	//createdStr := strconv.FormatUint( c.CreatedAt, 10) // TODO(rbastic): was thinking epochs before
-	body := string(c.Body)
+// String returns formatted JSON representing a Cell, for logs, test failures
+// and the lines of DataStore.PartitionReadJSONL.
+func (c Cell) String() string {
+	var createdAt *string
+	if c.CreatedAt != nil {
+		t := c.CreatedAt.Format(time.RFC3339)
+		createdAt = &t
+	}
+	// Marshaling strings and numbers cannot fail.
+	b, _ := json.Marshal(struct {
+		AddedAt       int64
+		RowKey        string
+		ColumnName    string
+		RefKey        int64
+		Body          string
+		CreatedAt     *string
+		SchemaVersion int64
+		Metadata      map[string]string `json:",omitempty"`
+		CausationID   string            `json:",omitempty"`
+		CorrelationID string            `json:",omitempty"`
+		NullBody      bool              `json:",omitempty"`
+	}{c.AddedAt, c.RowKey, c.ColumnName, c.RefKey, c.Body, createdAt, c.SchemaVersion, c.Metadata, c.CausationID, c.CorrelationID, c.NullBody})
+	return string(b)
+}
 
-	var buf []byte
-	buffer := bytes.NewBuffer(buf)
-	buffer.WriteString("{\"AddedAt\":")
-	buffer.WriteString(addedAtStr)
-	buffer.WriteString("\", \"RowKey\":'")
-	buffer.WriteString(c.RowKey)
-	buffer.WriteString("\", \"ColumnName\":'")
-	buffer.WriteString(c.ColumnName)
-	buffer.WriteString("\", \"RefKey\":")
-	buffer.WriteString(refKeyStr)
-	buffer.WriteString("\", \"Body\":'")
-	buffer.WriteString(body)
-	//	buffer.WriteString("\", \"Created\":" )
-	//	buffer.WriteString( createdStr )
-	//	buffer.WriteString("\"}")
-	return buffer.String()
+// Equal reports whether c and other hold the same values. CreatedAt is
+// compared as an instant truncated to the second, which is all the storages
+// keep, regardless of location. Two nil CreatedAt are equal; a nil and a
+// non-nil one are not. A nil and an empty Metadata are equal.
+func (c Cell) Equal(other Cell) bool {
+	if c.AddedAt != other.AddedAt || c.RowKey != other.RowKey || c.ColumnName != other.ColumnName || c.RefKey != other.RefKey || c.Body != other.Body || c.NullBody != other.NullBody || c.SchemaVersion != other.SchemaVersion || c.CausationID != other.CausationID || c.CorrelationID != other.CorrelationID {
+		return false
+	}
+	if len(c.Metadata) != len(other.Metadata) {
+		return false
+	}
+	for key, value := range c.Metadata {
+		if otherValue, ok := other.Metadata[key]; !ok || otherValue != value {
+			return false
+		}
+	}
+	if c.CreatedAt == nil || other.CreatedAt == nil {
+		return c.CreatedAt == nil && other.CreatedAt == nil
+	}
+	return c.CreatedAt.Truncate(time.Second).Equal(other.CreatedAt.Truncate(time.Second))
 }
 
 // 'Applications typically group related data into the same column, and then
@@ -80,3 +136,12 @@ func (c *Cell) String() string {
 // This grouping is a great way to bundle data that changes together, and it
 // allows the application to rapidly change the schema without downtime on
 // the database side.  The example below elaborates more on this.' [1]
+
+// CreatedAtOr returns the CreatedAt of c, or now if it has none: the
+// created_at a storage writes c with.
+func (c Cell) CreatedAtOr(now time.Time) time.Time {
+	if c.CreatedAt == nil {
+		return now
+	}
+	return *c.CreatedAt
+}
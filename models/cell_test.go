@@ -0,0 +1,72 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCellEqual(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	sameSecond := created.Add(600 * time.Millisecond).In(time.FixedZone("UTC+2", 2*60*60))
+	nextSecond := created.Add(time.Second)
+
+	base := Cell{AddedAt: 1, RowKey: "row", ColumnName: "BASE", RefKey: 1, Body: `{"a":1}`, CreatedAt: &created}
+	with := func(fn func(c *Cell)) Cell {
+		c := base
+		fn(&c)
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		other Cell
+		equal bool
+	}{
+		{"identical", base, true},
+		{"same instant, other pointer", with(func(c *Cell) { t := created; c.CreatedAt = &t }), true},
+		{"same second, other zone", with(func(c *Cell) { c.CreatedAt = &sameSecond }), true},
+		{"next second", with(func(c *Cell) { c.CreatedAt = &nextSecond }), false},
+		{"nil CreatedAt", with(func(c *Cell) { c.CreatedAt = nil }), false},
+		{"body", with(func(c *Cell) { c.Body = `{"a":2}` }), false},
+		{"body whitespace", with(func(c *Cell) { c.Body = `{"a": 1}` }), false},
+		{"ref key", with(func(c *Cell) { c.RefKey = 2 }), false},
+		{"added at", with(func(c *Cell) { c.AddedAt = 2 }), false},
+		{"schema version", with(func(c *Cell) { c.SchemaVersion = 2 }), false},
+		{"empty metadata", with(func(c *Cell) { c.Metadata = map[string]string{} }), true},
+		{"metadata", with(func(c *Cell) { c.Metadata = map[string]string{"source": "api"} }), false},
+	}
+	for _, test := range tests {
+		if got := base.Equal(test.other); got != test.equal {
+			t.Errorf("%s: expected Equal %v, got %v", test.name, test.equal, got)
+		}
+		if got := test.other.Equal(base); got != test.equal {
+			t.Errorf("%s: Equal is not symmetric", test.name)
+		}
+	}
+
+	bothNil := with(func(c *Cell) { c.CreatedAt = nil })
+	if !bothNil.Equal(bothNil) {
+		t.Error("expected cells with nil CreatedAt to be equal")
+	}
+}
+
+func TestCellString(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	cell := Cell{AddedAt: 7, RowKey: "row", ColumnName: "BASE", RefKey: 1, Body: `{"a":"b"}`, CreatedAt: &created}
+	want := `{"AddedAt":7,"RowKey":"row","ColumnName":"BASE","RefKey":1,"Body":"{\"a\":\"b\"}","CreatedAt":"2020-01-02T03:04:05Z","SchemaVersion":0}`
+	if got := cell.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	cell.CreatedAt = nil
+	want = `{"AddedAt":7,"RowKey":"row","ColumnName":"BASE","RefKey":1,"Body":"{\"a\":\"b\"}","CreatedAt":null,"SchemaVersion":0}`
+	if got := cell.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	cell.Metadata = map[string]string{"source": "api"}
+	want = `{"AddedAt":7,"RowKey":"row","ColumnName":"BASE","RefKey":1,"Body":"{\"a\":\"b\"}","CreatedAt":null,"SchemaVersion":0,"Metadata":{"source":"api"}}`
+	if got := cell.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
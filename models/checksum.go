@@ -0,0 +1,26 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// ErrChecksumMismatch is returned when a cell read back from storage does not
+// match the checksum written with it.
+var ErrChecksumMismatch = errors.New("cell body does not match its checksum")
+
+// Checksum returns the CRC-32 (IEEE) of body, as stored alongside a cell.
+func Checksum(body string) int64 {
+	return int64(crc32.ChecksumIEEE([]byte(body)))
+}
+
+// VerifyChecksum checks cell.Body against checksum. Cells written before
+// checksums were introduced have none, which storages report as a negative
+// checksum; those are not checked.
+func VerifyChecksum(cell Cell, checksum int64) error {
+	if checksum < 0 || Checksum(cell.Body) == checksum {
+		return nil
+	}
+	return fmt.Errorf("%w: %s/%s/%d", ErrChecksumMismatch, cell.RowKey, cell.ColumnName, cell.RefKey)
+}
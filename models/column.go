@@ -0,0 +1,9 @@
+package models
+
+// ColumnInfo describes a column of the cell table, as the database's catalog
+// has it.
+type ColumnInfo struct {
+	Name    string // row_key
+	Type    string // VARCHAR(36), as the database spells it
+	NotNull bool
+}
@@ -0,0 +1,69 @@
+package models
+
+import "context"
+
+type shardKey struct{}
+
+// WithShard returns a copy of ctx naming the shard a storage call is
+// dispatched to, so that the storage can include it in its logs.
+func WithShard(ctx context.Context, shard string) context.Context {
+	return context.WithValue(ctx, shardKey{}, shard)
+}
+
+// ShardFromContext returns the shard named by WithShard, or "" if ctx names
+// none.
+func ShardFromContext(ctx context.Context) string {
+	shard, _ := ctx.Value(shardKey{}).(string)
+	return shard
+}
+
+type inclusiveKey struct{}
+
+// WithInclusive returns a copy of ctx whose partition reads by value return
+// the cells at the value too, rather than only those after it. Inclusive
+// suits the first read of a scan, from a value the caller picked; the reads
+// that resume it should stay exclusive, or they return the last cell of the
+// previous page again. Reads from a cursor always resume after it. Only the
+// SQL storages support it.
+func WithInclusive(ctx context.Context, inclusive bool) context.Context {
+	return context.WithValue(ctx, inclusiveKey{}, inclusive)
+}
+
+// InclusiveFromContext reports whether ctx asks for an inclusive lower bound,
+// see WithInclusive.
+func InclusiveFromContext(ctx context.Context) bool {
+	inclusive, _ := ctx.Value(inclusiveKey{}).(bool)
+	return inclusive
+}
+
+type traceIDKey struct{}
+
+// WithTraceID returns a copy of ctx carrying the id of the trace its call
+// belongs to, e.g. that of the span of the request being served, so that
+// sampling (see core.KVStore.WithSampling) decides the same way for every
+// call of the trace.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// TraceIDFromContext returns the trace id set by WithTraceID, or "" if ctx
+// carries none.
+func TraceIDFromContext(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	return traceID
+}
+
+type sampledKey struct{}
+
+// WithSampled returns a copy of ctx whose storage calls log their details
+// only if sampled is set. Warnings and errors are logged either way.
+func WithSampled(ctx context.Context, sampled bool) context.Context {
+	return context.WithValue(ctx, sampledKey{}, sampled)
+}
+
+// SampledFromContext returns the sampling decision set by WithSampled, and
+// whether ctx carries one. Calls without one log their details.
+func SampledFromContext(ctx context.Context) (sampled bool, ok bool) {
+	sampled, ok = ctx.Value(sampledKey{}).(bool)
+	return
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// cursorTimeFormat is how created_at is compared in SQL. Storages keep
+// created_at as a wall clock time in UTC, which is what is kept here.
+const cursorTimeFormat = "2006-01-02 15:04:05"
+
+// Cursor is a position in a partition ordered by
+// (created_at, row_key, column_name, ref_key). The ref key is part of it
+// because several versions of a cell can share a created_at.
+type Cursor struct {
+	CreatedAt  string `json:"c"`
+	RowKey     string `json:"r"`
+	ColumnName string `json:"k"`
+	RefKey     int64  `json:"v"`
+}
+
+// CursorAfter returns the token that makes PartitionRead's "cursor" location
+// resume right after cell.
+func CursorAfter(cell Cell) string {
+	c := Cursor{RowKey: cell.RowKey, ColumnName: cell.ColumnName, RefKey: cell.RefKey}
+	if cell.CreatedAt != nil {
+		c.CreatedAt = cell.CreatedAt.UTC().Format(cursorTimeFormat)
+	}
+	return c.Encode()
+}
+
+// Encode returns the token of c.
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor decodes a token from CursorAfter. The empty token is the
+// start of the partition.
+func DecodeCursor(token string) (Cursor, error) {
+	if token == "" {
+		return Cursor{CreatedAt: "0001-01-01 00:00:00", RefKey: math.MinInt64}, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor: %s", err)
+	}
+	var c Cursor
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor: %s", err)
+	}
+	return c, nil
+}
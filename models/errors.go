@@ -0,0 +1,43 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrCellExists is returned by PutCell when a cell has already been written
+// at the same (row key, column name, ref key). Cells are immutable, so this
+// is also what makes "write the next ref key" a compare-and-swap.
+var ErrCellExists = errors.New("cell already exists")
+
+// ErrDuplicateCell is returned by GetCell when more than one cell matches a
+// (row key, column name, ref key). The schemas forbid this with a unique
+// index, so it means the index is missing or the data is corrupt.
+var ErrDuplicateCell = errors.New("more than one cell with the same row key, column name and ref key")
+
+// ErrTableNotAllowed is returned when a storage's table resolver picks a
+// table that is not on its allowlist.
+var ErrTableNotAllowed = errors.New("table not allowed")
+
+// ErrRowExists is returned when an operation that creates a row finds that
+// the row key already has cells.
+var ErrRowExists = errors.New("row already exists")
+
+// ScanErrors are the errors of the rows a partition read skipped because
+// they failed to scan, in the order it read them. Storages only skip rows
+// if asked to continue on error.
+type ScanErrors []error
+
+func (e ScanErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d rows failed to scan: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Unwrap lets errors.Is and errors.As match the error of any row.
+func (e ScanErrors) Unwrap() []error {
+	return e
+}
@@ -1,5 +1,10 @@
 package models
 
+import (
+	"github.com/tidwall/gjson"
+	"strings"
+)
+
 type Index struct {
 	Name   string   // CLIENT_INDEX
 	Column string   // BASE
@@ -24,3 +29,30 @@ func (idx Index) AppendField(f string) Index {
 	idx.Fields = append(idx.Fields, f)
 	return idx
 }
+
+// IndexColumn returns an index named name on the value found at jsonPath
+// (gjson syntax, e.g. "user.email") in the body of cells of any column.
+func IndexColumn(name string, jsonPath string) Index {
+	return NewIndex().WithName(name).AppendField(jsonPath)
+}
+
+// Covers reports whether the index applies to cells of columnName. An index
+// without a Column covers every column.
+func (idx Index) Covers(columnName string) bool {
+	return idx.Column == "" || idx.Column == columnName
+}
+
+// Value extracts the indexed value from a JSON body. The values of a
+// multi-field index are joined with ":". ok is false if any field is
+// missing from the body.
+func (idx Index) Value(body string) (value string, ok bool) {
+	var values []string
+	for _, field := range idx.Fields {
+		res := gjson.Get(body, field)
+		if !res.Exists() {
+			return "", false
+		}
+		values = append(values, res.String())
+	}
+	return strings.Join(values, ":"), len(values) > 0
+}
@@ -0,0 +1,14 @@
+package models
+
+// CellKey names a column of a row, whatever the ref keys of its versions.
+type CellKey struct {
+	RowKey     string
+	ColumnName string
+}
+
+// CellRef names a version of a cell.
+type CellRef struct {
+	RowKey     string
+	ColumnName string
+	RefKey     int64
+}
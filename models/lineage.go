@@ -0,0 +1,45 @@
+package models
+
+import "context"
+
+// WithLineage returns a copy of c with the given causation and correlation
+// ids. An empty id is not set.
+func (c Cell) WithLineage(causationID string, correlationID string) Cell {
+	if causationID != "" {
+		c.CausationID = causationID
+	}
+	if correlationID != "" {
+		c.CorrelationID = correlationID
+	}
+	return c
+}
+
+type causationIDKey struct{}
+
+// WithCausationID returns a copy of ctx whose writes record causationID as
+// the causation id of the cells that do not carry one.
+func WithCausationID(ctx context.Context, causationID string) context.Context {
+	return context.WithValue(ctx, causationIDKey{}, causationID)
+}
+
+// CausationIDFromContext returns the causation id set by WithCausationID, or
+// "" if ctx carries none.
+func CausationIDFromContext(ctx context.Context) string {
+	causationID, _ := ctx.Value(causationIDKey{}).(string)
+	return causationID
+}
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of ctx whose writes record correlationID
+// as the correlation id of the cells that do not carry one.
+func WithCorrelationID(ctx context.Context, correlationID string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, correlationID)
+}
+
+// CorrelationIDFromContext returns the correlation id set by
+// WithCorrelationID, or "" if ctx carries none.
+func CorrelationIDFromContext(ctx context.Context) string {
+	correlationID, _ := ctx.Value(correlationIDKey{}).(string)
+	return correlationID
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrLocationValueType is returned by PartitionRead when its value is not of
+// a type its location can compare with, e.g. a string for "added_at".
+var ErrLocationValueType = errors.New("PartitionRead value does not match its location")
+
+// AddedAtValue returns the value of a PartitionRead at location "added_at",
+// which must be an integer that fits an int64.
+func AddedAtValue(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint:
+		if uint64(v) <= math.MaxInt64 {
+			return int64(v), nil
+		}
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: added_at needs an integer, got %T %v", ErrLocationValueType, value, value)
+}
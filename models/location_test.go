@@ -0,0 +1,22 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestAddedAtValue(t *testing.T) {
+	for _, value := range []interface{}{7, int32(7), int64(7), uint8(7), uint64(7)} {
+		got, err := AddedAtValue(value)
+		if err != nil || got != 7 {
+			t.Errorf("AddedAtValue(%T 7) = %d, %v", value, got, err)
+		}
+	}
+	for _, value := range []interface{}{"7", 7.0, nil, uint64(math.MaxInt64) + 1} {
+		_, err := AddedAtValue(value)
+		if !errors.Is(err, ErrLocationValueType) {
+			t.Errorf("AddedAtValue(%T %v): expected ErrLocationValueType, got %v", value, value, err)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MarshalMetadata encodes m as a JSON object for the metadata column of the
+// SQL storages. An empty m is stored as NULL, so MarshalMetadata returns nil.
+func MarshalMetadata(m map[string]string) interface{} {
+	if len(m) == 0 {
+		return nil
+	}
+	// Marshaling a map of strings cannot fail.
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+// UnmarshalMetadata decodes a metadata column. The storages read NULL as an
+// empty string, for which it returns nil.
+func UnmarshalMetadata(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var m map[string]string
+	err := json.Unmarshal([]byte(s), &m)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode cell metadata %q: %s", s, err)
+	}
+	return m, nil
+}
+
+// Tag is the argument the SQL storages match the metadata column against to
+// find the cells tagged key=value: a JSON object of that one pair.
+func Tag(key string, value string) string {
+	return MarshalMetadata(map[string]string{key: value}).(string)
+}
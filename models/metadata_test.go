@@ -0,0 +1,33 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	if MarshalMetadata(nil) != nil || MarshalMetadata(map[string]string{}) != nil {
+		t.Fatal("expected empty metadata to be stored as NULL")
+	}
+
+	m := map[string]string{"source": "api", "author": `"quoted"`}
+	encoded, ok := MarshalMetadata(m).(string)
+	if !ok {
+		t.Fatal("expected metadata to be encoded as a string")
+	}
+	decoded, err := UnmarshalMetadata(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(Cell{Metadata: m}).Equal(Cell{Metadata: decoded}) {
+		t.Fatalf("expected %v, got %v", m, decoded)
+	}
+
+	decoded, err = UnmarshalMetadata("")
+	if err != nil || decoded != nil {
+		t.Fatalf("expected no metadata, got %v, %v", decoded, err)
+	}
+	_, err = UnmarshalMetadata("not json")
+	if err == nil {
+		t.Fatal("expected an error decoding invalid metadata")
+	}
+}
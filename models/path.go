@@ -0,0 +1,24 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SplitPath splits a dotted path into a JSON body, e.g. "address.city",
+// into its keys. Keys may only hold letters, digits, '_' and '-', so that
+// storages can write a path into SQL as is.
+func SplitPath(path string) ([]string, error) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("invalid path %q: empty key", path)
+		}
+		for _, r := range key {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+				return nil, fmt.Errorf("invalid path %q: key %q may only hold letters, digits, '_' and '-'", path, key)
+			}
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitPath(t *testing.T) {
+	keys, err := SplitPath("address.post-code_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"address", "post-code_2"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("expected %v, got %v", want, keys)
+	}
+
+	for _, path := range []string{"", "a.", ".a", "a b", `a"b`, "a'b", "a%b"} {
+		_, err := SplitPath(path)
+		if err == nil {
+			t.Errorf("expected %q to be rejected", path)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNotPromoted is returned by a partition read filtering on a column that
+// the storage has not promoted.
+var ErrNotPromoted = errors.New("column not promoted")
+
+// CellColumns are the columns of the cell table, which a promoted column
+// cannot be named after.
+var CellColumns = []string{"added_at", "row_key", "column_name", "ref_key", "body", "created_at", "checksum", "schema_version", "metadata", "causation_id", "correlation_id"}
+
+// IsCellColumn reports whether name is that of a column of the cell table.
+func IsCellColumn(name string) bool {
+	for _, column := range CellColumns {
+		if column == name {
+			return true
+		}
+	}
+	return false
+}
+
+// PromotedColumn is a field of cell bodies that the SQL storages keep in a
+// column of its own, generated from the body and indexed, so that partition
+// reads can filter on it.
+type PromotedColumn struct {
+	Name    string // client_id
+	Path    string // client.id, see SplitPath
+	SQLType string // INTEGER
+}
+
+// PromoteColumn returns a column named name holding the value at path in
+// the body of cells, of the given SQL type.
+func PromoteColumn(name string, path string, sqlType string) PromotedColumn {
+	return PromotedColumn{Name: name, Path: path, SQLType: sqlType}
+}
+
+// Validate checks that the name, path and type of c can be written into
+// SQL as is: the name may only hold letters, digits and '_', and may not be
+// that of a column of the cell table, and the type may only hold letters,
+// digits, spaces, parentheses and commas, e.g. "VARCHAR(64)".
+func (c PromotedColumn) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("promoted column has no name")
+	}
+	for i, r := range c.Name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || i > 0 && r >= '0' && r <= '9') {
+			return fmt.Errorf("invalid promoted column name %q", c.Name)
+		}
+	}
+	if IsCellColumn(strings.ToLower(c.Name)) {
+		return fmt.Errorf("promoted column %q clashes with a cell column", c.Name)
+	}
+	if _, err := SplitPath(c.Path); err != nil {
+		return err
+	}
+	if c.SQLType == "" {
+		return fmt.Errorf("promoted column %q has no type", c.Name)
+	}
+	for _, r := range c.SQLType {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == ' ' || r == '(' || r == ')' || r == ',') {
+			return fmt.Errorf("invalid type %q of promoted column %q", c.SQLType, c.Name)
+		}
+	}
+	return nil
+}
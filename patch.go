@@ -0,0 +1,61 @@
+package schemaless
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+)
+
+// PatchCell applies an RFC 7396 JSON merge patch to the latest version of a
+// cell and writes the result as the next version, retrying like
+// GetAndModify if another writer gets there first. A cell that does not
+// exist yet is patched as if it were null. The latest body must be JSON.
+func (ds *DataStore) PatchCell(ctx context.Context, rowKey string, columnKey string, patch []byte) (models.Cell, error) {
+	patchDoc, err := decodeJSON(patch)
+	if err != nil {
+		return models.Cell{}, fmt.Errorf("invalid merge patch: %s", err)
+	}
+
+	return ds.GetAndModify(ctx, rowKey, columnKey, func(old []byte) ([]byte, error) {
+		var target interface{}
+		if old != nil {
+			target, err = decodeJSON(old)
+			if err != nil {
+				return nil, fmt.Errorf("cell %s/%s is not JSON: %s", rowKey, columnKey, err)
+			}
+		}
+		return json.Marshal(mergePatch(target, patchDoc))
+	})
+}
+
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	// Keep numbers as they were written rather than round-tripping them
+	// through float64.
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// mergePatch implements the MergePatch function of RFC 7396, section 2.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+	for name, value := range patchObj {
+		if value == nil {
+			delete(targetObj, name)
+		} else {
+			targetObj[name] = mergePatch(targetObj[name], value)
+		}
+	}
+	return targetObj
+}
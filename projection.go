@@ -0,0 +1,75 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rbastic/go-schemaless/core"
+	"github.com/rbastic/go-schemaless/models"
+	"time"
+)
+
+// PartitionReadProjected is PartitionRead returning, for each cell, only the
+// values at paths in its JSON body (see models.SplitPath), keyed by path. A
+// path the body does not have maps to nil. Storages that implement
+// core.Projector extract the values server-side, so whole bodies are never
+// transferred; for the others, they are extracted here.
+func (ds *DataStore) PartitionReadProjected(ctx context.Context, partitionNumber int, location string, value interface{}, limit int, paths []string) ([]map[string]interface{}, bool, error) {
+	defer ds.observeSlow("PartitionReadProjected", "", time.Now())
+	if len(paths) == 0 {
+		return nil, false, errors.New("no paths to project")
+	}
+	keys := make([][]string, len(paths))
+	for i, path := range paths {
+		var err error
+		keys[i], err = models.SplitPath(path)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	value, err := ds.physicalValue(location, value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	projected := true
+	cells, found, err := ds.source.PartitionReadProjected(ctx, partitionNumber, location, value, limit, paths)
+	if err == core.ErrNotSupported {
+		projected = false
+		cells, found, err = ds.source.PartitionRead(ctx, partitionNumber, location, value, limit)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	rows := make([]map[string]interface{}, len(cells))
+	for i, cell := range cells {
+		doc, err := decodeJSON([]byte(cell.Body))
+		if err != nil {
+			return nil, false, fmt.Errorf("cell %s/%s/%d is not JSON: %s", cell.RowKey, cell.ColumnName, cell.RefKey, err)
+		}
+		if projected {
+			rows[i], _ = doc.(map[string]interface{})
+			continue
+		}
+		row := make(map[string]interface{}, len(paths))
+		for j, path := range paths {
+			row[path] = lookupPath(doc, keys[j])
+		}
+		rows[i] = row
+	}
+	return rows, found, nil
+}
+
+// lookupPath returns the value at keys in doc, or nil.
+func lookupPath(doc interface{}, keys []string) interface{} {
+	for _, key := range keys {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		doc = obj[key]
+	}
+	return doc
+}
@@ -0,0 +1,21 @@
+package schemaless
+
+// WithRecover makes storage calls that panic, e.g. on a driver bug while
+// scanning a malformed row, return an error wrapping core.ErrPanic rather
+// than crash the calling goroutine. The panic is logged with its stack. It
+// applies to the source and target shards, whether set before or after.
+func (ds *DataStore) WithRecover() *DataStore {
+	ds.recoverPanics = true
+	if ds.source != nil {
+		ds.source.WithRecover(ds.logPanic)
+	}
+	if ds.target != nil {
+		ds.target.WithRecover(ds.logPanic)
+	}
+	return ds
+}
+
+// logPanic is the core.PanicFunc of WithRecover.
+func (ds *DataStore) logPanic(op string, recovered interface{}, stack []byte) {
+	ds.logger().Errorw("recovered from storage panic", "op", op, "panic", recovered, "stack", string(stack))
+}
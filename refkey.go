@@ -0,0 +1,38 @@
+package schemaless
+
+import (
+	"sync"
+	"time"
+)
+
+// WithRefKeyFromTime makes PutCell assign a ref key to cells written with a
+// ref key of 0: the current time in milliseconds since the Unix epoch, so
+// that GetCellLatest returns the most recently written version. Writes
+// landing in the same millisecond get successive ref keys instead, so the
+// ref keys a DataStore assigns always increase. Writers in other processes
+// may still pick the same ref key, which fails with models.ErrCellExists.
+func (ds *DataStore) WithRefKeyFromTime() *DataStore {
+	ds.refKeys = &refKeyClock{now: time.Now}
+	return ds
+}
+
+type refKeyClock struct {
+	now func() time.Time
+
+	mu   sync.Mutex
+	last int64
+}
+
+// next returns the current time in milliseconds, or one more than the last
+// ref key it returned if that is not earlier.
+func (c *refKeyClock) next() int64 {
+	refKey := c.now().UnixNano() / int64(time.Millisecond)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if refKey <= c.last {
+		refKey = c.last + 1
+	}
+	c.last = refKey
+	return refKey
+}
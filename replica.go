@@ -0,0 +1,283 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rbastic/go-schemaless/core"
+	"github.com/rbastic/go-schemaless/models"
+	"runtime/debug"
+)
+
+// ErrQuorum is returned when fewer replicas of a shard than its consistency
+// level asks for answered a read or acknowledged a write.
+var ErrQuorum = errors.New("replica quorum not reached")
+
+// Consistency is how many replicas of a shard an operation waits for, see
+// WithReplicaConsistency.
+type Consistency int
+
+const (
+	// ConsistencyQuorum waits for a majority of the replicas. It is the
+	// default.
+	ConsistencyQuorum Consistency = iota
+	// ConsistencyOne waits for a single replica.
+	ConsistencyOne
+	// ConsistencyAll waits for every replica.
+	ConsistencyAll
+)
+
+// replicas returns the number of replicas out of n that c waits for.
+func (c Consistency) replicas(n int) int {
+	switch c {
+	case ConsistencyOne:
+		return 1
+	case ConsistencyAll:
+		return n
+	}
+	return n/2 + 1
+}
+
+// WithShardReplicationFactor keeps every shard on r replicas, e.g. r rqlite
+// clusters. WithSource and WithTarget then take r shards for each logical
+// shard, its replicas next to each other: with r = 3, shards 0 to 2 are the
+// replicas of the first logical shard, which takes the name of the first of
+// them. Their number must be a multiple of r.
+//
+// PutCell writes to every replica and GetCell and GetCellLatest read from
+// them all, each returning once as many replicas as WithReplicaConsistency
+// asks for have answered; the write carries on to the other replicas in the
+// background, even if its context is canceled. A read returns the version with the highest ref
+// key, then created_at, among those answers, so a quorum read sees a quorum
+// write even if some replicas missed it. Replicas are not repaired. A
+// partition read is served by the first replica that answers it without an
+// error. Other operations, which need capabilities such as
+// core.RowReader, fail with core.ErrNotSupported.
+//
+// Call it before WithSource and WithTarget.
+func (ds *DataStore) WithShardReplicationFactor(r int) *DataStore {
+	if r < 1 {
+		panic(fmt.Sprintf("WithShardReplicationFactor: r must be at least 1, got %d", r))
+	}
+	ds.replicationFactor = r
+	return ds
+}
+
+// WithReplicaConsistency sets how many replicas of a shard reads and writes
+// wait for, see WithShardReplicationFactor. Both default to
+// ConsistencyQuorum; reads see the latest write as long as the replicas
+// they wait for and those the write waited for overlap, i.e. their sum is
+// over the replication factor. Call it before WithSource and WithTarget.
+func (ds *DataStore) WithReplicaConsistency(read, write Consistency) *DataStore {
+	ds.readConsistency = read
+	ds.writeConsistency = write
+	return ds
+}
+
+// replicate groups shards into the logical shards of the replication
+// factor, if there is one.
+func (ds *DataStore) replicate(shards []core.Shard) []core.Shard {
+	r := ds.replicationFactor
+	if r <= 1 {
+		return shards
+	}
+	if len(shards)%r != 0 {
+		panic(fmt.Sprintf("replication factor %d does not divide %d shards", r, len(shards)))
+	}
+	logical := make([]core.Shard, 0, len(shards)/r)
+	for i := 0; i < len(shards); i += r {
+		set := &replicaSet{
+			read:    ds.readConsistency.replicas(r),
+			write:   ds.writeConsistency.replicas(r),
+			onPanic: ds.replicaPanic,
+		}
+		for _, shard := range shards[i : i+r] {
+			set.replicas = append(set.replicas, shard.Backend)
+		}
+		logical = append(logical, core.Shard{Name: shards[i].Name, Backend: set})
+	}
+	return logical
+}
+
+// replicaSet is the core.Storage of a logical shard kept on several
+// replicas.
+type replicaSet struct {
+	replicas []core.Storage
+	// read and write are the number of replicas reads and writes wait for
+	read, write int
+	// onPanic returns the core.PanicFunc of WithRecover, or nil if panics
+	// are not recovered. The KVStore cannot recover the panic of a replica,
+	// which runs in a goroutine of its own.
+	onPanic func() core.PanicFunc
+}
+
+// replicaPanic is the onPanic of the replica sets of ds.
+func (ds *DataStore) replicaPanic() core.PanicFunc {
+	if !ds.recoverPanics {
+		return nil
+	}
+	return ds.logPanic
+}
+
+// recoverPanic is deferred by the goroutine of a replica call, with the
+// address of its error, to recover from a panic as WithRecover does.
+func (s *replicaSet) recoverPanic(op string, err *error) {
+	fn := s.onPanic()
+	if fn == nil {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	fn(op, r, debug.Stack())
+	*err = fmt.Errorf("%w in %s: %v", core.ErrPanic, op, r)
+}
+
+// replicaRead is the answer of a replica to a read.
+type replicaRead struct {
+	cell  models.Cell
+	found bool
+	err   error
+}
+
+// newer reports whether a is a later version of a cell than b.
+func newer(a, b models.Cell) bool {
+	if a.RefKey != b.RefKey {
+		return a.RefKey > b.RefKey
+	}
+	switch {
+	case a.CreatedAt == nil:
+		return false
+	case b.CreatedAt == nil:
+		return true
+	}
+	return a.CreatedAt.After(*b.CreatedAt)
+}
+
+// readQuorum runs read on every replica and reconciles the first s.read
+// answers.
+func (s *replicaSet) readQuorum(op string, read func(core.Storage) (models.Cell, bool, error)) (cell models.Cell, found bool, err error) {
+	answers := make(chan replicaRead, len(s.replicas))
+	for _, replica := range s.replicas {
+		go func(replica core.Storage) {
+			var answer replicaRead
+			defer func() { answers <- answer }()
+			defer s.recoverPanic(op, &answer.err)
+			answer.cell, answer.found, answer.err = read(replica)
+		}(replica)
+	}
+
+	var ok, failed int
+	var lastErr error
+	for range s.replicas {
+		answer := <-answers
+		if answer.err != nil {
+			failed++
+			lastErr = answer.err
+			if len(s.replicas)-failed < s.read {
+				break
+			}
+			continue
+		}
+		if answer.found && (!found || newer(answer.cell, cell)) {
+			cell, found = answer.cell, true
+		}
+		ok++
+		if ok == s.read {
+			return cell, found, nil
+		}
+	}
+	return models.Cell{}, false, fmt.Errorf("%w: %d of %d replicas answered: %v", ErrQuorum, ok, s.read, lastErr)
+}
+
+func (s *replicaSet) GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (models.Cell, bool, error) {
+	return s.readQuorum("GetCell", func(replica core.Storage) (models.Cell, bool, error) {
+		return replica.GetCell(ctx, rowKey, columnKey, refKey)
+	})
+}
+
+func (s *replicaSet) GetCellLatest(ctx context.Context, rowKey string, columnKey string) (models.Cell, bool, error) {
+	return s.readQuorum("GetCellLatest", func(replica core.Storage) (models.Cell, bool, error) {
+		return replica.GetCellLatest(ctx, rowKey, columnKey)
+	})
+}
+
+func (s *replicaSet) PartitionRead(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	for _, replica := range s.replicas {
+		cells, found, err = replica.PartitionRead(ctx, partitionNumber, location, value, limit)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// PutCell writes cell to every replica, returning as soon as s.write of them
+// have acknowledged it; the others are written in the background, without
+// the cancellation of ctx. Unless enough replicas wrote it, it fails with
+// models.ErrCellExists if any replica already had a cell at its ref key, as
+// a retry of a write that reached some replicas does.
+func (s *replicaSet) PutCell(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) error {
+	writeCtx := context.WithoutCancel(ctx)
+	errs := make(chan error, len(s.replicas))
+	for _, replica := range s.replicas {
+		go func(replica core.Storage) {
+			var err error
+			defer func() { errs <- err }()
+			defer s.recoverPanic("PutCell", &err)
+			err = replica.PutCell(writeCtx, rowKey, columnKey, refKey, cell)
+		}(replica)
+	}
+
+	var ok int
+	var exists bool
+	var lastErr error
+	for range s.replicas {
+		var err error
+		select {
+		case err = <-errs:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		switch {
+		case err == nil:
+			ok++
+			if ok == s.write {
+				return nil
+			}
+		case errors.Is(err, models.ErrCellExists):
+			exists = true
+		default:
+			lastErr = err
+		}
+	}
+	if exists {
+		return models.ErrCellExists
+	}
+	return fmt.Errorf("%w: %d of %d replicas acknowledged: %v", ErrQuorum, ok, s.write, lastErr)
+}
+
+func (s *replicaSet) ResetConnection(ctx context.Context, key string) error {
+	return s.each(func(replica core.Storage) error { return replica.ResetConnection(ctx, key) })
+}
+
+func (s *replicaSet) Destroy(ctx context.Context) error {
+	return s.each(func(replica core.Storage) error { return replica.Destroy(ctx) })
+}
+
+func (s *replicaSet) Close() error {
+	return s.each(core.Storage.Close)
+}
+
+// each calls fn on every replica, returning the first error.
+func (s *replicaSet) each(fn func(core.Storage) error) error {
+	var first error
+	for _, replica := range s.replicas {
+		err := fn(replica)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
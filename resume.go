@@ -0,0 +1,160 @@
+package schemaless
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+	"strconv"
+	"time"
+)
+
+// resumeTokenVersion is the version of the layout of resume tokens. Bump it
+// whenever a token of the current layout would resume a read elsewhere
+// than where it left off.
+const resumeTokenVersion = 1
+
+// ErrIncompatibleToken is returned for a resume token that was made by an
+// incompatible version of this package, or for a DataStore with another
+// number of partitions, whose partitions hold other rows.
+var ErrIncompatibleToken = errors.New("resume token is incompatible with this DataStore")
+
+// resumeToken is the content of the tokens of PartitionReadResume. Value is
+// the position in Location, as a string: a decimal added_at, a created_at
+// in UTC, or a cursor token.
+type resumeToken struct {
+	Version    int    `json:"n"`
+	Partitions int    `json:"k"`
+	Partition  int    `json:"p"`
+	Location   string `json:"l"`
+	Value      string `json:"a"`
+}
+
+func (t resumeToken) encode() string {
+	b, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ResumeToken returns a token to start reading a partition after value in
+// location with PartitionReadResume, which takes the same values as
+// PartitionReadAt. The token is opaque and self-describing, so that it can
+// be stored, e.g. by an ETL job, and used by another process.
+func (ds *DataStore) ResumeToken(partitionNumber int, location PartitionLocation, value interface{}) (string, error) {
+	partitions := ds.source.Partitions()
+	if partitionNumber < 0 || partitionNumber >= partitions {
+		return "", fmt.Errorf("partition %d out of range [0, %d)", partitionNumber, partitions)
+	}
+
+	t := resumeToken{Version: resumeTokenVersion, Partitions: partitions, Partition: partitionNumber, Location: location.String()}
+	switch v := value.(type) {
+	case int:
+		t.Value = strconv.Itoa(v)
+	case int64:
+		t.Value = strconv.FormatInt(v, 10)
+	case time.Time:
+		t.Value = v.UTC().Format(wallClock)
+	case *time.Time:
+		t.Value = v.UTC().Format(wallClock)
+	case string:
+		t.Value = v
+	default:
+		return "", fmt.Errorf("unrecognized %s value type %T", location, value)
+	}
+
+	switch location {
+	case AddedAt:
+		if _, err := strconv.ParseInt(t.Value, 10, 64); err != nil {
+			return "", fmt.Errorf("added_at must be an integer, got %v", value)
+		}
+	case CreatedAt:
+		if _, err := time.Parse(wallClock, t.Value); err != nil {
+			return "", fmt.Errorf("created_at must be a time, got %v", value)
+		}
+	case Cursor:
+		if _, err := models.DecodeCursor(t.Value); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unrecognized partition location %s", location)
+	}
+	return t.encode(), nil
+}
+
+// decodeResumeToken decodes token, failing with ErrIncompatibleToken if
+// it cannot be resumed by ds.
+func (ds *DataStore) decodeResumeToken(token string) (resumeToken, interface{}, error) {
+	var t resumeToken
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return t, nil, fmt.Errorf("invalid resume token: %s", err)
+	}
+	err = json.Unmarshal(b, &t)
+	if err != nil {
+		return t, nil, fmt.Errorf("invalid resume token: %s", err)
+	}
+	if t.Version != resumeTokenVersion {
+		return t, nil, fmt.Errorf("%w: token version %d, want %d", ErrIncompatibleToken, t.Version, resumeTokenVersion)
+	}
+	if partitions := ds.source.Partitions(); t.Partitions != partitions {
+		return t, nil, fmt.Errorf("%w: token for %d partitions, DataStore has %d", ErrIncompatibleToken, t.Partitions, partitions)
+	}
+	if t.Partition < 0 || t.Partition >= t.Partitions {
+		return t, nil, fmt.Errorf("invalid resume token: partition %d out of range", t.Partition)
+	}
+
+	location, err := ParsePartitionLocation(t.Location)
+	if err != nil {
+		return t, nil, fmt.Errorf("invalid resume token: %s", err)
+	}
+	switch location {
+	case AddedAt:
+		addedAt, err := strconv.ParseInt(t.Value, 10, 64)
+		if err != nil {
+			return t, nil, fmt.Errorf("invalid resume token: %s", err)
+		}
+		return t, addedAt, nil
+	case CreatedAt:
+		createdAt, err := time.Parse(wallClock, t.Value)
+		if err != nil {
+			return t, nil, fmt.Errorf("invalid resume token: %s", err)
+		}
+		return t, createdAt, nil
+	}
+	return t, t.Value, nil
+}
+
+// PartitionReadResume reads at most limit cells of the partition of token
+// after its position, and returns them with the token to resume after
+// them. The token is that given if no cell was read, so a job at the end of
+// a partition can poll with it until new cells arrive.
+//
+// Tokens that paginate by created_at have the caveats of PartitionRead: a
+// cell written with a created_at in the past is never read, and cells
+// sharing the created_at of the last cell of a page may be skipped. Prefer
+// added_at or a cursor for jobs that must see every cell.
+func (ds *DataStore) PartitionReadResume(ctx context.Context, token string, limit int) (cells []models.Cell, next string, err error) {
+	defer ds.observeSlow("PartitionReadResume", "", time.Now())
+	t, value, err := ds.decodeResumeToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	cells, _, err = ds.partitionRead(ctx, t.Partition, t.Location, value, limit)
+	if err != nil || len(cells) == 0 {
+		return cells, token, err
+	}
+
+	last := cells[len(cells)-1]
+	switch t.Location {
+	case "added_at":
+		t.Value = strconv.FormatInt(last.AddedAt, 10)
+	case "created_at":
+		if last.CreatedAt != nil {
+			t.Value = last.CreatedAt.UTC().Format(wallClock)
+		}
+	case "cursor":
+		t.Value = models.CursorAfter(last)
+	}
+	return cells, t.encode(), nil
+}
@@ -0,0 +1,105 @@
+package schemaless
+
+import (
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+)
+
+// WithHashedRowKeys stores every row key behind a prefix of digits hex
+// digits of its hash, e.g. "3fa9:user-1001", so that sequential row keys are
+// spread across the key space of range-partitioned backends instead of
+// piling onto one range. digits is between 1 and 16.
+//
+// The prefix is transparent: row keys passed in are the logical ones, and
+// every cell and row key returned has the prefix stripped. Rows are still
+// placed on shards by their logical row key. PartitionRead by created_at or
+// added_at is unaffected, but a partition read by cursor, which breaks ties
+// by row key, orders rows by their hashed row key, not their logical one.
+//
+// The prefix makes every row key digits+1 bytes longer: a UUID behind 16
+// digits is 53 bytes, which the VARCHAR(64) row_key of the bundled schemas
+// holds. Tables created with an older schema, whose row_key is VARCHAR(36),
+// must be widened first. The Redis storage, which rejects a ':' in a row
+// key, cannot hold them at all.
+//
+// Call it before WithSource and WithTarget, on an empty store: rows written
+// without the prefix become unreachable.
+func (ds *DataStore) WithHashedRowKeys(digits int) *DataStore {
+	if digits < 1 || digits > 16 {
+		panic(fmt.Sprintf("WithHashedRowKeys: digits must be between 1 and 16, got %d", digits))
+	}
+	ds.rowKeyDigits = digits
+	return ds
+}
+
+// physicalKey returns the row key rowKey is stored under.
+func (ds *DataStore) physicalKey(rowKey string) string {
+	if ds.rowKeyDigits == 0 {
+		return rowKey
+	}
+	prefix := hash64([]byte(rowKey)) >> (64 - 4*uint(ds.rowKeyDigits))
+	return fmt.Sprintf("%0*x:%s", ds.rowKeyDigits, prefix, rowKey)
+}
+
+// logicalKey returns the row key stored as rowKey.
+func (ds *DataStore) logicalKey(rowKey string) string {
+	if ds.rowKeyDigits == 0 || len(rowKey) <= ds.rowKeyDigits || rowKey[ds.rowKeyDigits] != ':' {
+		return rowKey
+	}
+	return rowKey[ds.rowKeyDigits+1:]
+}
+
+// logicalCell returns cell with its logical row key.
+func (ds *DataStore) logicalCell(cell models.Cell) models.Cell {
+	cell.RowKey = ds.logicalKey(cell.RowKey)
+	return cell
+}
+
+// logicalCells gives cells their logical row keys, in place.
+func (ds *DataStore) logicalCells(cells []models.Cell) []models.Cell {
+	if ds.rowKeyDigits == 0 {
+		return cells
+	}
+	for i := range cells {
+		cells[i].RowKey = ds.logicalKey(cells[i].RowKey)
+	}
+	return cells
+}
+
+// physicalValue translates the value of a partition read: a cursor token
+// holds the row key of the cell to resume after.
+func (ds *DataStore) physicalValue(location string, value interface{}) (interface{}, error) {
+	token, ok := value.(string)
+	if ds.rowKeyDigits == 0 || location != "cursor" || !ok || token == "" {
+		return value, nil
+	}
+	cursor, err := models.DecodeCursor(token)
+	if err != nil {
+		return nil, err
+	}
+	cursor.RowKey = ds.physicalKey(cursor.RowKey)
+	return cursor.Encode(), nil
+}
+
+// placementKey is the ShardKeyFunc of the shard chooser: rows are placed by
+// the shard key of their logical row key.
+func (ds *DataStore) placementKey() ShardKeyFunc {
+	if ds.rowKeyDigits == 0 {
+		return ds.shardKey
+	}
+	return func(rowKey string) string {
+		rowKey = ds.logicalKey(rowKey)
+		if ds.shardKey != nil {
+			return ds.shardKey(rowKey)
+		}
+		return rowKey
+	}
+}
+
+// logicalKeys gives rowKeys their logical row keys, in place.
+func (ds *DataStore) logicalKeys(rowKeys []string) []string {
+	for i := range rowKeys {
+		rowKeys[i] = ds.logicalKey(rowKeys[i])
+	}
+	return rowKeys
+}
@@ -0,0 +1,18 @@
+package schemaless
+
+// WithObservabilitySampling makes 1 in n calls to the storages log their
+// details, such as the statements they run; the others still log warnings
+// and errors. Calls made with a trace id (see models.WithTraceID) are all
+// logged or all left out together. Slow query warnings are not sampled. It
+// applies to the source and target shards, whether set before or after; see
+// core.KVStore.WithSampling.
+func (ds *DataStore) WithObservabilitySampling(n int) *DataStore {
+	ds.sampleEvery = n
+	if ds.source != nil {
+		ds.source.WithSampling(n)
+	}
+	if ds.target != nil {
+		ds.target.WithSampling(n)
+	}
+	return ds
+}
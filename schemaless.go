@@ -2,11 +2,17 @@ package schemaless
 
 import (
 	"context"
+	"errors"
 	"github.com/dgryski/go-metro"
-	jh "github.com/dgryski/go-shardedkv/choosers/jump"
 	"github.com/rbastic/go-schemaless/core"
+	"github.com/rbastic/go-schemaless/internal/teardown"
 	"github.com/rbastic/go-schemaless/models"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"io"
+	"sort"
 	"sync"
+	"time"
 )
 
 // Storage is a key-value storage backend
@@ -28,6 +34,9 @@ type Storage interface {
 
 	// Cleans up any resources, etc.
 	Destroy(ctx context.Context) error
+
+	// Close is Destroy as an io.Closer. Calling it again does nothing.
+	Close() error
 }
 
 // DataStore is our overall datastore structure, backed by at least one
@@ -36,10 +45,50 @@ type Storage interface {
 type DataStore struct {
 	source *core.KVStore
 	target *core.KVStore
+
+	hotRows   *hotRows
+	batch     *batchWriter
+	slowQuery time.Duration
+	sugar     *zap.SugaredLogger
+	flight    *singleflight.Group
+	// flightScope is the scope of WithSingleflight
+	flightScope func(context.Context) string
+	shardKey    ShardKeyFunc
+	refKeys     *refKeyClock
+	skew        *skewCheck
+	merge       MergeStrategy
+	// rowKeyDigits is the length of the hash prefix of stored row keys
+	rowKeyDigits int
+	// writePolicy picks between appending and replacing, per column
+	writePolicy WritePolicyFunc
+	// schemaVersion is stamped on written cells that carry none
+	schemaVersion int64
+	// auditSink, if set, is told of every mutation
+	auditSink AuditSink
+	// columns, if set, are the only columns that may be written
+	columns map[string]bool
+	// defaultColumn is the column of GetLatest and Put
+	defaultColumn string
+	// blobs, if set, keeps the bodies over blobThreshold bytes
+	blobs         BlobStore
+	blobThreshold int
+	// recoverPanics turns panics of the storages into errors
+	recoverPanics bool
+	// sampleEvery is the n of WithObservabilitySampling
+	sampleEvery int
+	// replicationFactor is the number of replicas of each shard, and the
+	// consistency levels those replicas are read and written at
+	replicationFactor int
+	readConsistency   Consistency
+	writeConsistency  Consistency
 	// we avoid holding the lock during a call to a storage engine, which may block
 	mu sync.Mutex
+
+	closer teardown.Once
 }
 
+var _ Storage = (*DataStore)(nil)
+
 // Chooser maps keys to shards
 type Chooser interface {
 	// SetBuckets sets the list of known buckets from which the chooser should select
@@ -59,15 +108,21 @@ type Shard struct {
 func hash64(b []byte) uint64 { return metro.Hash64(b, 0) }
 
 func (ds *DataStore) WithSource(shards []core.Shard) *DataStore {
-	chooser := jh.New(hash64)
-	kv := core.New(chooser, shards)
+	kv := core.New(&shardChooser{key: ds.placementKey()}, ds.replicate(shards))
+	if ds.recoverPanics {
+		kv.WithRecover(ds.logPanic)
+	}
+	kv.WithSampling(ds.sampleEvery)
 	ds.source = kv
 	return ds
 }
 
 func (ds *DataStore) WithTarget(shards []core.Shard) *DataStore {
-	chooser := jh.New(hash64)
-	kv := core.New(chooser, shards)
+	kv := core.New(&shardChooser{key: ds.placementKey()}, ds.replicate(shards))
+	if ds.recoverPanics {
+		kv.WithRecover(ds.logPanic)
+	}
+	kv.WithSampling(ds.sampleEvery)
 	ds.target = kv
 	return ds
 }
@@ -76,29 +131,758 @@ func New() *DataStore {
 	return &DataStore{}
 }
 
+// WithLogger sets the logger the DataStore itself logs to. It defaults to a
+// zap production logger.
+func (ds *DataStore) WithLogger(sugar *zap.SugaredLogger) *DataStore {
+	ds.sugar = sugar
+	return ds
+}
+
+func (ds *DataStore) logger() *zap.SugaredLogger {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.sugar == nil {
+		logger, err := zap.NewProduction()
+		if err != nil {
+			logger = zap.NewNop()
+		}
+		ds.sugar = logger.Sugar()
+	}
+	return ds.sugar
+}
+
+// WithHotRowThreshold calls fn once for each cell whose number of versions
+// grows past threshold. The count is kept in memory with a fixed-size sketch
+// of the writes made through this DataStore, so it is cheap, may
+// overestimate, and does not include versions written elsewhere. The counts
+// are halved every 65536 writes, so that they reflect recent writes, and fn
+// is called again for a cell that cooled down and grew past threshold anew.
+func (ds *DataStore) WithHotRowThreshold(threshold int64, fn HotRowFunc) *DataStore {
+	ds.hotRows = newHotRows(threshold, fn)
+	return ds
+}
+
+// WithBatchWriter makes PutCell buffer cells in memory and return at once.
+// A background goroutine writes them out every flushInterval, or as soon as
+// maxItems are waiting. Flush and Destroy write whatever is buffered.
+//
+// The cells of a row put with the same context are written in a single
+// PutCells call, if the storage has it, and with the values of that
+// context, e.g. its actor or the tenant of a table resolver. Once
+// 4*maxItems cells are buffered, PutCell waits for a flush to make room, or
+// fails with the error of its context if that is done first.
+//
+// This trades durability for throughput: a buffered cell is lost if the
+// process dies before it is flushed, PutCell no longer reports write errors
+// (the next Flush does), and a cell is not visible to reads until it has
+// been flushed.
+func (ds *DataStore) WithBatchWriter(maxItems int, flushInterval time.Duration) *DataStore {
+	ds.batch = newBatchWriter(maxItems, flushInterval, ds.putBatch)
+	return ds
+}
+
+// WithSchemaVersion stamps version on every cell written through the
+// DataStore whose SchemaVersion is 0, so that an application can tag its
+// writes in one place as its body format evolves.
+func (ds *DataStore) WithSchemaVersion(version int64) *DataStore {
+	ds.schemaVersion = version
+	return ds
+}
+
 func (ds *DataStore) GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
-	return ds.source.GetCell(ctx, rowKey, columnKey, refKey)
+	defer ds.observeSlow("GetCell", rowKey, time.Now())
+	if ds.flight != nil {
+		return ds.getCellShared(ctx, rowKey, columnKey, refKey)
+	}
+	cell, found, err = ds.source.GetCell(ctx, ds.physicalKey(rowKey), columnKey, refKey)
+	cell, err = ds.fetchBlob(ctx, cell, err)
+	return ds.logicalCell(cell), found, err
 }
 
 func (ds *DataStore) GetCellLatest(ctx context.Context, rowKey string, columnKey string) (cell models.Cell, found bool, err error) {
-	return ds.source.GetCellLatest(ctx, rowKey, columnKey)
+	defer ds.observeSlow("GetCellLatest", rowKey, time.Now())
+	if ds.flight != nil {
+		return ds.getCellLatestShared(ctx, rowKey, columnKey)
+	}
+	cell, found, err = ds.source.GetCellLatest(ctx, ds.physicalKey(rowKey), columnKey)
+	cell, err = ds.fetchBlob(ctx, cell, err)
+	return ds.logicalCell(cell), found, err
+}
+
+// GetCellBefore returns the version of a cell with the highest ref key lower
+// than refKey, e.g. the version to roll back to from refKey. refKey itself
+// does not need to exist.
+func (ds *DataStore) GetCellBefore(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	defer ds.observeSlow("GetCellBefore", rowKey, time.Now())
+	cell, found, err = ds.source.GetCellBefore(ctx, ds.physicalKey(rowKey), columnKey, refKey)
+	cell, err = ds.fetchBlob(ctx, cell, err)
+	return ds.logicalCell(cell), found, err
 }
 
+// PartitionRead reads at most limit cells of a shard, in order of location,
+// after value. It takes the location as a string, e.g. "added_at"; prefer
+// PartitionReadAt, which catches a misspelt location at compile time.
+//
+// Page by added_at to read every cell exactly once: a cell written with a
+// created_at in the past sorts before pages already read by created_at. To
+// filter by created_at, see PartitionReadWindow. To include the cells at
+// value, e.g. to start a scan from a value that may hold cells, see
+// models.WithInclusive.
 func (ds *DataStore) PartitionRead(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
-	return ds.source.PartitionRead(ctx, partitionNumber, location, value, limit)
+	defer ds.observeSlow("PartitionRead", "", time.Now())
+	return ds.partitionRead(ctx, partitionNumber, location, value, limit)
+}
+
+// partitionRead reads a partition of the source, translating row keys.
+func (ds *DataStore) partitionRead(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) ([]models.Cell, bool, error) {
+	value, err := ds.physicalValue(location, value)
+	if err != nil {
+		return nil, false, err
+	}
+	cells, found, err := ds.source.PartitionRead(ctx, partitionNumber, location, value, limit)
+	err = ds.fetchBlobs(ctx, cells, err)
+	return ds.logicalCells(cells), found, err
+}
+
+// PartitionReadJSONL is PartitionRead streaming the cells as they are
+// scanned, one Cell.String per line, so that they can be copied to an HTTP
+// response or a file without collecting them first. Import reads the lines
+// back. An error reading the partition is returned by Read once the cells
+// before it have been. Closing the reader early stops the read.
+func (ds *DataStore) PartitionReadJSONL(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) (io.ReadCloser, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	value, err = ds.physicalValue(location, value)
+	if err != nil {
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		defer ds.observeSlow("PartitionReadJSONL", "", time.Now())
+		err := ds.source.PartitionScan(ctx, partitionNumber, location, value, limit, func(cell models.Cell) error {
+			cell, err := ds.fetchBlob(ctx, cell, nil)
+			if err != nil {
+				return err
+			}
+			cell = ds.logicalCell(cell)
+			_, err = io.WriteString(w, cell.String()+"\n")
+			return err
+		})
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+// PartitionReadSchemaVersion is PartitionRead returning only the cells
+// written with schemaVersion, for migrating the cells of an old body format
+// in bulk. It fails with core.ErrNotSupported if the shard's storage cannot
+// filter by schema version.
+func (ds *DataStore) PartitionReadSchemaVersion(ctx context.Context, partitionNumber int, schemaVersion int64, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	defer ds.observeSlow("PartitionReadSchemaVersion", "", time.Now())
+	value, err = ds.physicalValue(location, value)
+	if err != nil {
+		return nil, false, err
+	}
+	cells, found, err = ds.source.PartitionReadSchemaVersion(ctx, partitionNumber, schemaVersion, location, value, limit)
+	err = ds.fetchBlobs(ctx, cells, err)
+	return ds.logicalCells(cells), found, err
+}
+
+// PartitionReadTag is PartitionRead returning only the cells whose metadata
+// holds tagKey=tagValue. It fails with core.ErrNotSupported if the shard's
+// storage cannot filter by tag.
+func (ds *DataStore) PartitionReadTag(ctx context.Context, partitionNumber int, tagKey string, tagValue string, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	defer ds.observeSlow("PartitionReadTag", "", time.Now())
+	value, err = ds.physicalValue(location, value)
+	if err != nil {
+		return nil, false, err
+	}
+	cells, found, err = ds.source.PartitionReadTag(ctx, partitionNumber, tagKey, tagValue, location, value, limit)
+	err = ds.fetchBlobs(ctx, cells, err)
+	return ds.logicalCells(cells), found, err
+}
+
+// PartitionReadWhere is PartitionRead returning only the cells whose
+// promoted column (see models.PromotedColumn) holds columnValue. It fails
+// with core.ErrNotSupported if the shard's storage cannot filter on
+// promoted columns, and models.ErrNotPromoted if it has not promoted column.
+func (ds *DataStore) PartitionReadWhere(ctx context.Context, partitionNumber int, column string, columnValue interface{}, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	defer ds.observeSlow("PartitionReadWhere", "", time.Now())
+	value, err = ds.physicalValue(location, value)
+	if err != nil {
+		return nil, false, err
+	}
+	cells, found, err = ds.source.PartitionReadWhere(ctx, partitionNumber, column, columnValue, location, value, limit)
+	err = ds.fetchBlobs(ctx, cells, err)
+	return ds.logicalCells(cells), found, err
+}
+
+// GetCellRange returns the versions of a cell with a ref key between
+// minRefKey and maxRefKey inclusive, in ref key order, at most limit of them.
+// A maxRefKey of 0 means no upper bound.
+//
+// Versions sharing a ref key, which a shard missing its unique index can
+// hold, are in the order they were added (by AddedAt), so that repeated
+// reads list them alike. FeedRead, GetCellLatest and GetCellBefore break
+// ties the same way, newest first.
+func (ds *DataStore) GetCellRange(ctx context.Context, rowKey string, columnKey string, minRefKey int64, maxRefKey int64, limit int) ([]models.Cell, error) {
+	defer ds.observeSlow("GetCellRange", rowKey, time.Now())
+	cells, err := ds.source.GetCellRange(ctx, ds.physicalKey(rowKey), columnKey, minRefKey, maxRefKey, limit)
+	err = ds.fetchBlobs(ctx, cells, err)
+	return ds.logicalCells(cells), err
+}
+
+// FeedRead returns a page of the versions of every column of rowKey, newest
+// first: those with a ref key lower than beforeRefKey, at most limit of them.
+// A beforeRefKey of 0 reads the first page. Pass nextCursor as beforeRefKey
+// to read the next page; it is 0 once there are no more.
+//
+// Pages are cut by ref key, so a page ends early rather than splitting the
+// versions that share a ref key across columns, unless more than limit of
+// them do.
+func (ds *DataStore) FeedRead(ctx context.Context, rowKey string, beforeRefKey int64, limit int) (cells []models.Cell, nextCursor int64, err error) {
+	defer ds.observeSlow("FeedRead", rowKey, time.Now())
+	// Read one more than asked for, to know if there is a next page.
+	cells, err = ds.source.FeedRead(ctx, ds.physicalKey(rowKey), beforeRefKey, limit+1)
+	err = ds.fetchBlobs(ctx, cells, err)
+	cells = ds.logicalCells(cells)
+	if err != nil || len(cells) <= limit {
+		return cells, 0, err
+	}
+
+	next := cells[limit].RefKey
+	end := limit
+	for end > 0 && cells[end-1].RefKey == next {
+		end--
+	}
+	if end == 0 {
+		end = limit
+	}
+	return cells[:end], cells[end-1].RefKey, nil
+}
+
+// ListColumns returns the names of the columns a row has cells in, sorted.
+// It returns an empty slice for a row with no cells.
+func (ds *DataStore) ListColumns(ctx context.Context, rowKey string) ([]string, error) {
+	columns, err := ds.source.ListColumns(ctx, ds.physicalKey(rowKey))
+	if err != nil {
+		return nil, err
+	}
+	if columns == nil {
+		columns = []string{}
+	}
+	return columns, nil
+}
+
+// CountByColumn returns the number of versions of each column of a row. It
+// returns an empty map for a row with no cells.
+func (ds *DataStore) CountByColumn(ctx context.Context, rowKey string) (map[string]int64, error) {
+	counts, err := ds.source.CountByColumn(ctx, ds.physicalKey(rowKey))
+	if err != nil {
+		return nil, err
+	}
+	if counts == nil {
+		counts = map[string]int64{}
+	}
+	return counts, nil
+}
+
+// Exists reports, for each of keys, whether the column of the row has any
+// cells, without reading them. Every key is in the map returned. It fails
+// with core.ErrNotSupported if a shard's storage cannot check existence.
+func (ds *DataStore) Exists(ctx context.Context, keys []models.CellKey) (map[models.CellKey]bool, error) {
+	defer ds.observeSlow("Exists", "", time.Now())
+	physical := make([]models.CellKey, len(keys))
+	for i, key := range keys {
+		physical[i] = models.CellKey{RowKey: ds.physicalKey(key.RowKey), ColumnName: key.ColumnName}
+	}
+	found, err := ds.source.Exists(ctx, physical)
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[models.CellKey]bool, len(keys))
+	for i, key := range keys {
+		exists[key] = found[physical[i]]
+	}
+	return exists, nil
+}
+
+// GetCellsSnapshot reads the cells of refs so that they all reflect the
+// same committed state, returning those that were found: the reads of each
+// shard run in one read-only transaction, so a write committed while they
+// run is either seen by all of them or by none. Cells on different shards
+// are read in different transactions. It fails with core.ErrNotSupported if
+// a shard's storage cannot read in a transaction.
+func (ds *DataStore) GetCellsSnapshot(ctx context.Context, refs []models.CellRef) (map[models.CellRef]models.Cell, error) {
+	defer ds.observeSlow("GetCellsSnapshot", "", time.Now())
+	physical := make([]models.CellRef, len(refs))
+	for i, ref := range refs {
+		physical[i] = models.CellRef{RowKey: ds.physicalKey(ref.RowKey), ColumnName: ref.ColumnName, RefKey: ref.RefKey}
+	}
+	found, err := ds.source.GetCellsSnapshot(ctx, physical)
+	if err != nil {
+		return nil, err
+	}
+	cells := make(map[models.CellRef]models.Cell, len(found))
+	for i, ref := range refs {
+		cell, ok := found[physical[i]]
+		if !ok {
+			continue
+		}
+		cell, err = ds.fetchBlob(ctx, cell, nil)
+		if err != nil {
+			return nil, err
+		}
+		cells[ref] = ds.logicalCell(cell)
+	}
+	return cells, nil
+}
+
+// DescribeTable returns the columns of the cell table of the shard numbered
+// partitionNumber, e.g. to check whether it has a column an older schema
+// lacks. Columns that a storage renames (see WithSchemaColumnMapping on the
+// SQL storages) are listed under the names of the cell columns they hold. It
+// fails with core.ErrNotSupported if the shard's storage cannot describe its
+// table.
+func (ds *DataStore) DescribeTable(ctx context.Context, partitionNumber int) ([]models.ColumnInfo, error) {
+	defer ds.observeSlow("DescribeTable", "", time.Now())
+	return ds.source.DescribeTable(ctx, partitionNumber)
+}
+
+// PartitionReadLatest is PartitionRead keeping only the latest version of
+// each (row key, column name) among the cells scanned. An older version is
+// only dropped if a newer one falls within the same limit cells; this is not
+// the latest version in the whole shard.
+//
+// Fewer than limit cells may be returned with more to read, and the last of
+// them need not be the last cell scanned, so page with next, the position of
+// the last cell scanned, rather than with the last cell returned. next is nil
+// when nothing was scanned.
+func (ds *DataStore) PartitionReadLatest(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) (cells []models.Cell, next interface{}, found bool, err error) {
+	defer ds.observeSlow("PartitionReadLatest", "", time.Now())
+	cells, found, err = ds.partitionRead(ctx, partitionNumber, location, value, limit)
+	if err != nil || !found || len(cells) == 0 {
+		return cells, nil, found, err
+	}
+	next = partitionPosition(location, cells[len(cells)-1])
+
+	type cellKey struct{ rowKey, columnName string }
+	latest := make(map[cellKey]int64)
+	for _, cell := range cells {
+		key := cellKey{cell.RowKey, cell.ColumnName}
+		if refKey, ok := latest[key]; !ok || cell.RefKey > refKey {
+			latest[key] = cell.RefKey
+		}
+	}
+
+	deduped := cells[:0]
+	for _, cell := range cells {
+		if latest[cellKey{cell.RowKey, cell.ColumnName}] == cell.RefKey {
+			deduped = append(deduped, cell)
+		}
+	}
+	return deduped, next, true, nil
+}
+
+// partitionPosition returns the value a partition read by location resumes
+// from right after cell.
+func partitionPosition(location string, cell models.Cell) interface{} {
+	switch location {
+	case "added_at":
+		return cell.AddedAt
+	case "cursor":
+		return models.CursorAfter(cell)
+	default:
+		return cell.CreatedAt
+	}
+}
+
+// PartitionLatestPerRow returns the n latest versions, by ref key across its
+// columns, of each row of the partition numbered partitionNumber, read in a
+// single scan, e.g. to build a "recent items per user" view. A row with
+// fewer versions returns them all. Rows come in the order of their stored
+// row keys, each newest first, and at most limit cells are returned, so the
+// last row may be cut short. It fails with core.ErrNotSupported if the
+// shard's storage cannot rank versions per row.
+func (ds *DataStore) PartitionLatestPerRow(ctx context.Context, partitionNumber int, n int, limit int) ([]models.Cell, error) {
+	defer ds.observeSlow("PartitionLatestPerRow", "", time.Now())
+	cells, err := ds.source.PartitionLatestPerRow(ctx, partitionNumber, n, limit)
+	err = ds.fetchBlobs(ctx, cells, err)
+	return ds.logicalCells(cells), err
 }
 
 // PutCell
 func (ds *DataStore) PutCell(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) error {
-	return ds.source.PutCell(ctx, rowKey, columnKey, refKey, cell)
+	cell = lineage(ctx, cell)
+	refKey, err := ds.prepareWrite(columnKey, refKey, cell)
+	if err != nil {
+		return err
+	}
+	if ds.batch != nil {
+		cell.RowKey, cell.ColumnName, cell.RefKey = rowKey, columnKey, refKey
+		return ds.batch.add(ctx, cell)
+	}
+	return ds.putCell(ctx, rowKey, columnKey, refKey, cell)
+}
+
+// PutCellIfAbsent is PutCell for writes that may be retried: if a cell is
+// already at (rowKey, columnKey, refKey), it does nothing rather than fail
+// with models.ErrCellExists, whatever the body of that cell. It reports
+// whether it wrote cell. The cell bypasses the batch writer, if there is
+// one, and is always appended, whatever the WritePolicy of its column.
+//
+// Storages implementing core.CellInserter skip the duplicate in the insert
+// itself; for the others, the duplicate is detected from PutCell's error.
+func (ds *DataStore) PutCellIfAbsent(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) (bool, error) {
+	defer ds.observeSlow("PutCellIfAbsent", rowKey, time.Now())
+	refKey, err := ds.prepareWrite(columnKey, refKey, cell)
+	if err != nil {
+		return false, err
+	}
+	if cell.SchemaVersion == 0 {
+		cell.SchemaVersion = ds.schemaVersion
+	}
+	cell = lineage(ctx, cell)
+	cell, err = ds.offloadBlob(ctx, cell)
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := ds.source.PutCellIfAbsent(ctx, ds.physicalKey(rowKey), columnKey, refKey, cell)
+	if err == core.ErrNotSupported {
+		err = ds.source.PutCell(ctx, ds.physicalKey(rowKey), columnKey, refKey, cell)
+		if err == models.ErrCellExists {
+			return false, nil
+		}
+		inserted = err == nil
+	}
+	if err != nil || !inserted {
+		return false, err
+	}
+	ds.audit(ctx, "PutCell", rowKey, columnKey, refKey)
+	if ds.hotRows != nil {
+		ds.hotRows.add(rowKey, columnKey)
+	}
+	return true, nil
+}
+
+// prepareWrite checks cell before it is written to columnKey at refKey, and
+// returns the ref key to write it at.
+func (ds *DataStore) prepareWrite(columnKey string, refKey int64, cell models.Cell) (int64, error) {
+	err := ds.checkColumn(columnKey)
+	if err != nil {
+		return 0, err
+	}
+	if ds.skew != nil {
+		err = ds.skew.check(cell.CreatedAt)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if refKey == 0 && ds.refKeys != nil {
+		refKey = ds.refKeys.next()
+	}
+	return refKey, nil
+}
+
+func (ds *DataStore) putCell(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) error {
+	return ds.writeCell(ctx, "PutCell", rowKey, columnKey, refKey, cell, ds.policy(columnKey) == Replace)
+}
+
+// writeCell writes cell, replacing any cell at the same ref key if replace
+// is set, and records it to the audit sink as op.
+func (ds *DataStore) writeCell(ctx context.Context, op string, rowKey string, columnKey string, refKey int64, cell models.Cell, replace bool) error {
+	defer ds.observeSlow("PutCell", rowKey, time.Now())
+	err := ds.checkColumn(columnKey)
+	if err != nil {
+		return err
+	}
+	if cell.SchemaVersion == 0 {
+		cell.SchemaVersion = ds.schemaVersion
+	}
+	cell = lineage(ctx, cell)
+	cell, err = ds.offloadBlob(ctx, cell)
+	if err != nil {
+		return err
+	}
+	if replace {
+		err = ds.source.ReplaceCell(ctx, ds.physicalKey(rowKey), columnKey, refKey, cell)
+	} else {
+		err = ds.source.PutCell(ctx, ds.physicalKey(rowKey), columnKey, refKey, cell)
+	}
+	if err != nil {
+		return err
+	}
+	ds.audit(ctx, op, rowKey, columnKey, refKey)
+	if ds.hotRows != nil {
+		ds.hotRows.add(rowKey, columnKey)
+	}
+	return nil
+}
+
+// PutRow writes a cell for each column of cells, all at refKey, in a single
+// transaction: if any of them cannot be written, e.g. because its column
+// already has a cell at refKey, none are. The cells bypass the batch writer,
+// if there is one, and are always appended, whatever the WritePolicy of
+// their column. It fails with core.ErrNotSupported if the shard's storage
+// cannot write whole rows.
+func (ds *DataStore) PutRow(ctx context.Context, rowKey string, cells map[string]models.Cell, refKey int64) error {
+	defer ds.observeSlow("PutRow", rowKey, time.Now())
+	if refKey == 0 && ds.refKeys != nil {
+		refKey = ds.refKeys.next()
+	}
+
+	columns := make([]string, 0, len(cells))
+	for columnKey := range cells {
+		columns = append(columns, columnKey)
+	}
+	sort.Strings(columns)
+
+	row := make([]models.Cell, 0, len(cells))
+	for _, columnKey := range columns {
+		cell := cells[columnKey]
+		err := ds.checkColumn(columnKey)
+		if err != nil {
+			return err
+		}
+		if ds.skew != nil {
+			err = ds.skew.check(cell.CreatedAt)
+			if err != nil {
+				return err
+			}
+		}
+		cell.RowKey = rowKey
+		cell.ColumnName = columnKey
+		cell.RefKey = refKey
+		if cell.SchemaVersion == 0 {
+			cell.SchemaVersion = ds.schemaVersion
+		}
+		cell = lineage(ctx, cell)
+		cell, err = ds.offloadBlob(ctx, cell)
+		if err != nil {
+			return err
+		}
+		row = append(row, cell)
+	}
+
+	err := ds.source.PutCells(ctx, ds.physicalKey(rowKey), row, false)
+	if err != nil {
+		return err
+	}
+	for _, columnKey := range columns {
+		ds.audit(ctx, "PutRow", rowKey, columnKey, refKey)
+		if ds.hotRows != nil {
+			ds.hotRows.add(rowKey, columnKey)
+		}
+	}
+	return nil
+}
+
+// getAndModifyRetries bounds how many times GetAndModify retries after
+// losing a race to another writer.
+const getAndModifyRetries = 10
+
+// ErrTooManyConflicts is returned by GetAndModify when every attempt lost a
+// race with a concurrent writer.
+var ErrTooManyConflicts = errors.New("too many conflicting writes")
+
+// GetAndModify reads the latest version of a cell, passes its body to fn,
+// and writes what fn returns as the next version. fn receives nil if the cell
+// does not exist yet.
+//
+// The write is conditional on nobody else having written the next ref key in
+// the meantime: cells are immutable, so a concurrent writer makes PutCell
+// fail with models.ErrCellExists, and we start over from a fresh read. fn may
+// therefore be called more than once. Its write bypasses the batch writer,
+// if there is one.
+func (ds *DataStore) GetAndModify(ctx context.Context, rowKey string, columnKey string, fn func(old []byte) ([]byte, error)) (models.Cell, error) {
+	for i := 0; i < getAndModifyRetries; i++ {
+		latest, found, err := ds.GetCellLatest(ctx, rowKey, columnKey)
+		if err != nil {
+			return models.Cell{}, err
+		}
+
+		var old []byte
+		if found {
+			old = []byte(latest.Body)
+		}
+
+		body, err := fn(old)
+		if err != nil {
+			return models.Cell{}, err
+		}
+
+		cell := models.NewCell(rowKey, columnKey, latest.RefKey+1, string(body))
+		// Always append, whatever the column's WritePolicy: replacing
+		// would overwrite a concurrent writer's version.
+		err = ds.writeCell(ctx, "PutCell", rowKey, columnKey, cell.RefKey, cell, false)
+		if err == models.ErrCellExists {
+			continue
+		}
+		if err != nil {
+			return models.Cell{}, err
+		}
+		return cell, nil
+	}
+	return models.Cell{}, ErrTooManyConflicts
+}
+
+// CopyRow copies every version of every column of srcRowKey to dstRowKey,
+// keeping their ref keys, and returns the number of cells copied. The cells
+// are written to dstRowKey in a single transaction, bypassing the batch
+// writer if there is one.
+//
+// Unless overwrite is set, CopyRow fails with models.ErrRowExists if
+// dstRowKey already has cells. With overwrite, those cells are deleted in the
+// same transaction as the copy is written.
+func (ds *DataStore) CopyRow(ctx context.Context, srcRowKey string, dstRowKey string, overwrite bool) (int64, error) {
+	cells, err := ds.copyRow(ctx, srcRowKey, dstRowKey, overwrite)
+	if err != nil {
+		return 0, err
+	}
+	for _, cell := range cells {
+		ds.audit(ctx, "CopyRow", dstRowKey, cell.ColumnName, cell.RefKey)
+	}
+	return int64(len(cells)), nil
+}
+
+// copyRow is CopyRow without the audit, returning the cells copied.
+func (ds *DataStore) copyRow(ctx context.Context, srcRowKey string, dstRowKey string, overwrite bool) ([]models.Cell, error) {
+	cells, err := ds.source.GetRow(ctx, ds.physicalKey(srcRowKey))
+	if err != nil {
+		return nil, err
+	}
+
+	if !overwrite {
+		existing, err := ds.source.GetRow(ctx, ds.physicalKey(dstRowKey))
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) > 0 {
+			return nil, models.ErrRowExists
+		}
+	}
+
+	err = ds.source.PutCells(ctx, ds.physicalKey(dstRowKey), cells, overwrite)
+	if err != nil {
+		return nil, err
+	}
+	return cells, nil
+}
+
+// MoveRow moves every version of every column of srcRowKey to dstRowKey,
+// keeping their ref keys. It fails with models.ErrRowExists if dstRowKey
+// already has cells.
+//
+// When both row keys are on the same shard, the move is a single
+// transaction. Otherwise the row is copied with CopyRow and then deleted
+// from srcRowKey: if that delete fails, the cells are left under both row
+// keys, and a cell written to srcRowKey while the move is in progress may be
+// lost.
+func (ds *DataStore) MoveRow(ctx context.Context, srcRowKey string, dstRowKey string) error {
+	err := ds.source.MoveRow(ctx, ds.physicalKey(srcRowKey), ds.physicalKey(dstRowKey))
+	if err == core.ErrNotSupported {
+		err = ds.copyAndDeleteRow(ctx, srcRowKey, dstRowKey)
+	}
+	if err != nil {
+		return err
+	}
+	ds.audit(ctx, "MoveRow", srcRowKey, "", 0)
+	ds.audit(ctx, "MoveRow", dstRowKey, "", 0)
+	return nil
+}
+
+// copyAndDeleteRow is MoveRow for storages that cannot move a row in a
+// single transaction.
+func (ds *DataStore) copyAndDeleteRow(ctx context.Context, srcRowKey string, dstRowKey string) error {
+	_, err := ds.copyRow(ctx, srcRowKey, dstRowKey, false)
+	if err != nil {
+		return err
+	}
+	return ds.source.PutCells(ctx, ds.physicalKey(srcRowKey), nil, true)
+}
+
+// DeleteRow deletes every version of every column of rowKey, along with its
+// index entries, and returns the number of cells deleted. The cells are
+// deleted in one transaction, and on every shard holding a copy of the row
+// during a migration. It fails with core.ErrNotSupported if a shard's
+// storage cannot delete whole rows.
+func (ds *DataStore) DeleteRow(ctx context.Context, rowKey string) (int64, error) {
+	defer ds.observeSlow("DeleteRow", rowKey, time.Now())
+	deleted, err := ds.source.DeleteRow(ctx, ds.physicalKey(rowKey))
+	if err != nil {
+		return deleted, err
+	}
+	ds.audit(ctx, "DeleteRow", rowKey, "", 0)
+	return deleted, nil
+}
+
+// LookupByIndex returns the row keys whose value for the named index is
+// value. The storages must be configured with the index.
+func (ds *DataStore) LookupByIndex(ctx context.Context, indexName string, value string) ([]string, error) {
+	rowKeys, err := ds.source.LookupByIndex(ctx, indexName, value)
+	return ds.logicalKeys(rowKeys), err
+}
+
+// Tail returns up to limit cells of a partition added after sinceAddedAt,
+// ordered by added_at, along with the checkpoint to pass as sinceAddedAt on
+// the next call. added_at is a per-shard write sequence, so checkpoints must
+// be kept per partition.
+//
+// Tail can only be as reliable as added_at: a sequence that commits out of
+// order (e.g. concurrent MySQL transactions) can let a poller skip a cell.
+func (ds *DataStore) Tail(ctx context.Context, partitionNumber int, sinceAddedAt int64, limit int) ([]models.Cell, int64, error) {
+	cells, _, err := ds.partitionRead(ctx, partitionNumber, "added_at", sinceAddedAt, limit)
+	if err != nil {
+		return nil, sinceAddedAt, err
+	}
+
+	sort.Slice(cells, func(i, j int) bool {
+		return cells[i].AddedAt < cells[j].AddedAt
+	})
+
+	checkpoint := sinceAddedAt
+	if len(cells) > 0 {
+		checkpoint = cells[len(cells)-1].AddedAt
+	}
+	return cells, checkpoint, nil
 }
 
 // ResetConnection implements Storage.ResetConnection()
 func (ds *DataStore) ResetConnection(ctx context.Context, key string) error {
-	return ds.source.ResetConnection(ctx, key)
+	return ds.source.ResetConnection(ctx, ds.physicalKey(key))
+}
+
+// Flush writes every cell buffered by the batch writer. It returns the
+// first write error since the last Flush, including those of background
+// flushes. Without a batch writer it does nothing.
+func (ds *DataStore) Flush(ctx context.Context) error {
+	if ds.batch == nil {
+		return nil
+	}
+	return ds.batch.flush(ctx)
 }
 
-// Destroy implements Storage.Destroy()
+// Destroy implements Storage.Destroy(). Cells still buffered by the batch
+// writer are flushed first.
 func (ds *DataStore) Destroy(ctx context.Context) error {
-	return ds.source.Destroy(ctx)
+	var flushErr error
+	if ds.batch != nil {
+		flushErr = ds.batch.close(ctx)
+	}
+	err := ds.source.Destroy(ctx)
+	if flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+// Close implements io.Closer. It flushes and destroys the DataStore as
+// Destroy does, and is safe to call more than once.
+func (ds *DataStore) Close() error {
+	return ds.closer.Close(ds.Destroy)
 }
@@ -1,12 +1,32 @@
 package schemaless
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	jh "github.com/dgryski/go-shardedkv/choosers/jump"
 	"github.com/rbastic/go-schemaless/core"
 	"github.com/rbastic/go-schemaless/models"
 	st "github.com/rbastic/go-schemaless/storage/memory"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestShardedkv(t *testing.T) {
@@ -78,3 +98,2977 @@ func TestShardedkv(t *testing.T) {
 	}
 
 }
+
+func TestHotRowThreshold(t *testing.T) {
+	var shards []core.Shard
+	for i := 0; i < 2; i++ {
+		shards = append(shards, core.Shard{Name: "test_shard" + strconv.Itoa(i), Backend: st.New()})
+	}
+
+	var warnings []string
+	kv := New().WithSource(shards).WithHotRowThreshold(5, func(rowKey, columnKey string, versions int64) {
+		warnings = append(warnings, rowKey+"/"+columnKey)
+	})
+	defer kv.Destroy(context.TODO())
+
+	for i := 1; i <= 10; i++ {
+		refKey := int64(i)
+		err := kv.PutCell(context.TODO(), "hot", "BASE", refKey, models.Cell{Body: "value" + strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = kv.PutCell(context.TODO(), "cold"+strconv.Itoa(i), "BASE", 1, models.Cell{Body: "value"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(warnings) != 1 || warnings[0] != "hot/BASE" {
+		t.Fatalf("expected exactly one warning for hot/BASE, got %v", warnings)
+	}
+}
+
+func TestHotRowDecay(t *testing.T) {
+	var warnings []string
+	h := newHotRows(5, func(rowKey, columnKey string, versions int64) {
+		warnings = append(warnings, rowKey)
+	})
+	h.decayEvery = 20
+
+	for i := 0; i < 10; i++ {
+		h.add("hot", "BASE")
+	}
+	if len(warnings) != 1 || len(h.warned) != 1 {
+		t.Fatalf("expected one warning for hot, got %v", warnings)
+	}
+
+	// Other writes halve the count of hot twice, under the threshold.
+	for i := 0; i < 30; i++ {
+		h.add("cold"+strconv.Itoa(i), "BASE")
+	}
+	if len(h.warned) != 0 {
+		t.Fatalf("expected hot to be forgotten once it cooled down, got %v", h.warned)
+	}
+
+	for i := 0; i < 5; i++ {
+		h.add("hot", "BASE")
+	}
+	if len(warnings) != 2 {
+		t.Fatalf("expected a second warning for hot once it heated up again, got %v", warnings)
+	}
+}
+
+func TestGetAndModify(t *testing.T) {
+	var shards []core.Shard
+	for i := 0; i < 2; i++ {
+		shards = append(shards, core.Shard{Name: "test_shard" + strconv.Itoa(i), Backend: st.New()})
+	}
+
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	increment := func(old []byte) ([]byte, error) {
+		n := 0
+		if old != nil {
+			var err error
+			n, err = strconv.Atoi(string(old))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return []byte(strconv.Itoa(n + 1)), nil
+	}
+
+	nWorkers := 8
+	nIncrements := 5
+
+	var wg sync.WaitGroup
+	errs := make(chan error, nWorkers*nIncrements)
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < nIncrements; j++ {
+				for {
+					_, err := kv.GetAndModify(context.TODO(), "counter", "BASE", increment)
+					if err == ErrTooManyConflicts {
+						continue
+					}
+					if err != nil {
+						errs <- err
+					}
+					break
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	v, ok, err := kv.GetCellLatest(context.TODO(), "counter", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected the counter to exist")
+	}
+	if v.Body != strconv.Itoa(nWorkers*nIncrements) {
+		t.Errorf("lost updates: counter is %s, expected %d", v.Body, nWorkers*nIncrements)
+	}
+}
+
+func TestLookupByIndex(t *testing.T) {
+	var shards []core.Shard
+	for i := 0; i < 2; i++ {
+		backend := st.New().WithIndex(models.IndexColumn("by_email", "email"))
+		shards = append(shards, core.Shard{Name: "test_shard" + strconv.Itoa(i), Backend: backend})
+	}
+
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	for i := 0; i < 10; i++ {
+		body := `{"email": "user` + strconv.Itoa(i%2) + `@example.com"}`
+		err := kv.PutCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", 1, models.Cell{Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rowKeys, err := kv.LookupByIndex(context.TODO(), "by_email", "user0@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rowKeys) != 5 {
+		t.Fatalf("expected 5 rows, got %v", rowKeys)
+	}
+
+	// The index follows the latest version of a cell.
+	err = kv.PutCell(context.TODO(), "row0", "BASE", 2, models.Cell{Body: `{"email": "user1@example.com"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rowKeys, err = kv.LookupByIndex(context.TODO(), "by_email", "user0@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rowKeys) != 4 {
+		t.Fatalf("expected 4 rows, got %v", rowKeys)
+	}
+	rowKeys, err = kv.LookupByIndex(context.TODO(), "by_email", "user1@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rowKeys) != 6 || rowKeys[0] != "row0" {
+		t.Fatalf("expected 6 rows starting with row0, got %v", rowKeys)
+	}
+}
+
+func TestTail(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			err := kv.PutCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", 1, models.Cell{Body: "value"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	put(0, 3)
+	cells, checkpoint, err := kv.Tail(context.TODO(), 0, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 3 || cells[0].RowKey != "row0" || cells[2].RowKey != "row2" {
+		t.Fatalf("expected row0..row2, got %v", cells)
+	}
+	if checkpoint != cells[2].AddedAt {
+		t.Fatalf("expected checkpoint %d, got %d", cells[2].AddedAt, checkpoint)
+	}
+
+	put(3, 5)
+	cells, next, err := kv.Tail(context.TODO(), 0, checkpoint, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 2 || cells[0].RowKey != "row3" || cells[1].RowKey != "row4" {
+		t.Fatalf("expected row3..row4, got %v", cells)
+	}
+
+	cells, again, err := kv.Tail(context.TODO(), 0, next, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 0 || again != next {
+		t.Fatalf("expected nothing new at checkpoint %d, got %v at %d", next, cells, again)
+	}
+}
+
+func TestPartitionReadLatest(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	for refKey := int64(1); refKey <= 3; refKey++ {
+		for _, rowKey := range []string{"a", "b"} {
+			err := kv.PutCell(context.TODO(), rowKey, "BASE", refKey, models.Cell{Body: "v" + strconv.FormatInt(refKey, 10)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err := kv.PutCell(context.TODO(), "a", "OTHER", 1, models.Cell{Body: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cells, _, found, err := kv.PartitionReadLatest(context.TODO(), 0, "added_at", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(cells) != 3 {
+		t.Fatalf("expected 3 cells, got %v", cells)
+	}
+	for _, cell := range cells {
+		want := int64(3)
+		if cell.ColumnName == "OTHER" {
+			want = 1
+		}
+		if cell.RefKey != want {
+			t.Errorf("%s/%s: expected ref key %d, got %d", cell.RowKey, cell.ColumnName, want, cell.RefKey)
+		}
+	}
+
+	// A page of 3 scans a/1, b/1 and a/2 and returns only b/1 and a/2, so
+	// paging must go on from a/2, the last cell scanned, not from b/1.
+	latest := make(map[string]int64)
+	var next interface{} = 0
+	for pages := 0; next != nil; pages++ {
+		if pages > 10 {
+			t.Fatal("paging did not end")
+		}
+		cells, next, _, err = kv.PartitionReadLatest(context.TODO(), 0, "added_at", next, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cell := range cells {
+			latest[cell.RowKey+"/"+cell.ColumnName] = cell.RefKey
+		}
+	}
+	want := map[string]int64{"a/BASE": 3, "b/BASE": 3, "a/OTHER": 1}
+	if !reflect.DeepEqual(latest, want) {
+		t.Fatalf("expected %v paging by 3, got %v", want, latest)
+	}
+}
+
+func TestClose(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards).WithBatchWriter(100, time.Hour)
+
+	err := kv.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var closer io.Closer = kv
+	for i := 0; i < 2; i++ {
+		err = closer.Close()
+		if err != nil {
+			t.Fatalf("close %d: %v", i, err)
+		}
+	}
+}
+
+func TestBatchWriter(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards).WithBatchWriter(100, 10*time.Millisecond)
+	defer kv.Destroy(context.TODO())
+
+	err := kv.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, found, err := kv.GetCell(context.TODO(), "row", "BASE", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cell was not flushed after the flush interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// rowWriterStorage counts the PutCells calls of the storage it wraps,
+// which can be held up by gate.
+type rowWriterStorage struct {
+	*st.Storage
+	calls *int64
+	gate  chan struct{}
+}
+
+func (s rowWriterStorage) PutCells(ctx context.Context, rowKey string, cells []models.Cell, replace bool) error {
+	atomic.AddInt64(s.calls, 1)
+	if s.gate != nil {
+		<-s.gate
+	}
+	return s.Storage.PutCells(ctx, rowKey, cells, replace)
+}
+
+func TestBatchWriterGroups(t *testing.T) {
+	memory := st.New()
+	memory.WithTableResolver(func(ctx context.Context) string {
+		if tenant := tenantScope(ctx); tenant != "" {
+			return tenant
+		}
+		return "cell"
+	}, "cell", "cell_tenant")
+	err := memory.CreateTable(context.TODO(), "cell_tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int64
+	shards := []core.Shard{{Name: "test_shard0", Backend: rowWriterStorage{Storage: memory, calls: &calls}}}
+	kv := New().WithSource(shards).WithBatchWriter(100, time.Hour)
+	defer kv.Destroy(context.TODO())
+
+	// The cells of a row put with the same context are written together,
+	// to the table of its tenant.
+	ctx := WithActor(context.WithValue(context.TODO(), tenantKey{}, "cell_tenant"), "alice")
+	for _, column := range []string{"BASE", "PROFILE", "SETTINGS"} {
+		err := kv.PutCell(ctx, "row", column, 1, models.Cell{Body: "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = kv.Flush(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected the 3 cells of the row to be written in one PutCells, got %d calls", calls)
+	}
+	_, found, err := kv.GetCell(ctx, "row", "PROFILE", 1)
+	if err != nil || !found {
+		t.Fatalf("expected the cell in the table of the tenant, got %v, %v", found, err)
+	}
+	_, found, err = kv.GetCell(context.TODO(), "row", "PROFILE", 1)
+	if err != nil || found {
+		t.Fatalf("expected no cell in the default table, got %v, %v", found, err)
+	}
+
+	// Destroying twice does not panic.
+	err = kv.Destroy(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchWriterBackpressure(t *testing.T) {
+	var calls int64
+	gate := make(chan struct{})
+	shards := []core.Shard{{Name: "test_shard0", Backend: rowWriterStorage{Storage: st.New(), calls: &calls, gate: gate}}}
+	kv := New().WithSource(shards).WithBatchWriter(2, time.Hour)
+	defer kv.Destroy(context.TODO())
+	defer close(gate)
+
+	// Two cells of a row kick off a flush, which the gate holds up; the
+	// buffer, which counts the cells being written, takes 4*2 in all before
+	// PutCell has to wait.
+	for i := 0; i < 8; i++ {
+		err := kv.PutCell(context.TODO(), "row", "BASE", int64(i+1), models.Cell{Body: "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			for atomic.LoadInt64(&calls) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Millisecond)
+	defer cancel()
+	err := kv.PutCell(ctx, "row", "BASE", 9, models.Cell{Body: "{}"})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected PutCell to wait for room until its deadline, got %v", err)
+	}
+}
+
+func TestBatchWriterFlush(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards).WithBatchWriter(100, time.Hour)
+	defer kv.Destroy(context.TODO())
+
+	for i := 0; i < 3; i++ {
+		err := kv.PutCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", 1, models.Cell{Body: "value"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A duplicate, whose error only Flush can report.
+	err := kv.PutCell(context.TODO(), "row0", "BASE", 1, models.Cell{Body: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, found, err := kv.GetCell(context.TODO(), "row0", "BASE", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("cell was written before the batch was flushed")
+	}
+
+	err = kv.Flush(context.TODO())
+	if err != models.ErrCellExists {
+		t.Fatalf("expected Flush to report ErrCellExists, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		_, found, err := kv.GetCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatalf("row%d was not written by Flush", i)
+		}
+	}
+}
+
+func TestGetCellRange(t *testing.T) {
+	var shards []core.Shard
+	for i := 0; i < 2; i++ {
+		shards = append(shards, core.Shard{Name: "test_shard" + strconv.Itoa(i), Backend: st.New()})
+	}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	for refKey := int64(1); refKey <= 10; refKey++ {
+		err := kv.PutCell(context.TODO(), "row", "BASE", refKey, models.Cell{Body: strconv.FormatInt(refKey, 10)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cells, err := kv.GetCellRange(context.TODO(), "row", "BASE", 3, 6, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 4 {
+		t.Fatalf("expected ref keys 3..6, got %v", cells)
+	}
+	for i, cell := range cells {
+		if cell.RefKey != int64(3+i) {
+			t.Fatalf("expected ref key %d at %d, got %d", 3+i, i, cell.RefKey)
+		}
+	}
+
+	cells, err = kv.GetCellRange(context.TODO(), "row", "BASE", 8, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 3 || cells[0].RefKey != 8 || cells[2].RefKey != 10 {
+		t.Fatalf("expected ref keys 8..10 with no upper bound, got %v", cells)
+	}
+
+	cells, err = kv.GetCellRange(context.TODO(), "row", "BASE", 1, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 2 || cells[1].RefKey != 2 {
+		t.Fatalf("expected the limit to keep ref keys 1..2, got %v", cells)
+	}
+}
+
+// slowStorage delays every GetCell of the storage it wraps.
+type slowStorage struct {
+	core.Storage
+	delay time.Duration
+}
+
+func (s slowStorage) GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (models.Cell, bool, error) {
+	time.Sleep(s.delay)
+	return s.Storage.GetCell(ctx, rowKey, columnKey, refKey)
+}
+
+func TestSlowQueryThreshold(t *testing.T) {
+	obs, logs := observer.New(zap.WarnLevel)
+	shards := []core.Shard{{Name: "test_shard0", Backend: slowStorage{st.New(), 200 * time.Millisecond}}}
+	kv := New().WithSource(shards).WithLogger(zap.New(obs).Sugar()).WithSlowQueryThreshold(100 * time.Millisecond)
+	defer kv.Destroy(context.TODO())
+
+	err := kv.PutCell(context.TODO(), "secret-row", "BASE", 1, models.Cell{Body: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("expected no warning for a fast PutCell, got %v", logs.All())
+	}
+
+	_, _, err = kv.GetCell(context.TODO(), "secret-row", "BASE", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected one slow query warning, got %v", entries)
+	}
+	fields := entries[0].ContextMap()
+	if fields["op"] != "GetCell" {
+		t.Errorf("expected op GetCell, got %v", fields["op"])
+	}
+	if fields["rowKeyHash"] == "secret-row" {
+		t.Error("row key was logged unsanitized")
+	}
+}
+
+func TestShardFor(t *testing.T) {
+	vectors := []struct {
+		rowKey     string
+		shardCount int
+		shard      int
+	}{
+		{"a", 1, 0},
+		{"a", 2, 0},
+		{"a", 16, 2},
+		{"a", 4096, 949},
+		{"row0", 2, 1},
+		{"row0", 16, 5},
+		{"row0", 4096, 3606},
+		{"6ba7b810-9dad-11d1-80b4-00c04fd430c8", 2, 0},
+		{"6ba7b810-9dad-11d1-80b4-00c04fd430c8", 16, 5},
+		{"6ba7b810-9dad-11d1-80b4-00c04fd430c8", 4096, 921},
+		{"f47ac10b-58cc-4372-a567-0e02b2c3d479", 2, 0},
+		{"f47ac10b-58cc-4372-a567-0e02b2c3d479", 16, 2},
+		{"f47ac10b-58cc-4372-a567-0e02b2c3d479", 4096, 299},
+	}
+	for _, v := range vectors {
+		got := ShardFor(v.rowKey, v.shardCount)
+		if got != v.shard {
+			t.Errorf("ShardFor(%q, %d) = %d, expected %d", v.rowKey, v.shardCount, got, v.shard)
+		}
+	}
+
+	// Placement must not change from go-shardedkv's jump chooser, which
+	// DataStore used before ShardFor existed.
+	var buckets []string
+	for i := 0; i < 16; i++ {
+		buckets = append(buckets, "shard"+strconv.Itoa(i))
+	}
+	chooser := jh.New(hash64)
+	chooser.SetBuckets(buckets)
+	for i := 0; i < 1000; i++ {
+		rowKey := "row" + strconv.Itoa(i)
+		if buckets[ShardFor(rowKey, len(buckets))] != chooser.Choose(rowKey) {
+			t.Fatalf("ShardFor disagrees with the jump chooser for %s", rowKey)
+		}
+	}
+}
+
+// gatedStorage counts GetCellLatest calls and holds each one until release
+// is closed.
+type gatedStorage struct {
+	core.Storage
+	calls   *int64
+	release chan struct{}
+}
+
+func (s gatedStorage) GetCellLatest(ctx context.Context, rowKey string, columnKey string) (models.Cell, bool, error) {
+	atomic.AddInt64(s.calls, 1)
+	<-s.release
+	return s.Storage.GetCellLatest(ctx, rowKey, columnKey)
+}
+
+type tenantKey struct{}
+
+func tenantScope(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+func TestSingleflight(t *testing.T) {
+	var calls int64
+	backend := gatedStorage{st.New(), &calls, make(chan struct{})}
+	shards := []core.Shard{{Name: "test_shard0", Backend: backend}}
+	kv := New().WithSource(shards).WithSingleflight(tenantScope)
+	defer kv.Destroy(context.TODO())
+
+	err := kv.PutCell(context.TODO(), "hot", "BASE", 1, models.Cell{Body: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The readers of a tenant share a call, which a reader of another tenant
+	// arriving while it is in flight does not join.
+	const readers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, readers+1)
+	read := func(tenant string) {
+		defer wg.Done()
+		ctx := context.WithValue(context.TODO(), tenantKey{}, tenant)
+		cell, found, err := kv.GetCellLatest(ctx, "hot", "BASE")
+		if err == nil && (!found || cell.Body != "value") {
+			err = fmt.Errorf("unexpected cell %v (found=%v)", cell, found)
+		}
+		errs <- err
+	}
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go read("tenant_a")
+	}
+
+	// Let the first call reach the storage and the others queue up behind it.
+	for atomic.LoadInt64(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	wg.Add(1)
+	go read("tenant_b")
+	time.Sleep(50 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("expected %d concurrent reads of tenant_a to share one storage call and tenant_b to get its own, got %d calls", readers, calls)
+	}
+}
+
+func TestSingleflightCancel(t *testing.T) {
+	var calls int64
+	backend := gatedStorage{st.New(), &calls, make(chan struct{})}
+	shards := []core.Shard{{Name: "test_shard0", Backend: backend}}
+	kv := New().WithSource(shards).WithSingleflight(tenantScope)
+	defer kv.Destroy(context.TODO())
+
+	err := kv.PutCell(context.TODO(), "hot", "BASE", 1, models.Cell{Body: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	first := make(chan error, 1)
+	go func() {
+		_, _, err := kv.GetCellLatest(ctx, "hot", "BASE")
+		first <- err
+	}()
+	for atomic.LoadInt64(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan error, 1)
+	go func() {
+		cell, found, err := kv.GetCellLatest(context.TODO(), "hot", "BASE")
+		if err == nil && (!found || cell.Body != "value") {
+			err = fmt.Errorf("unexpected cell %v (found=%v)", cell, found)
+		}
+		second <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// The first caller gives up, but the call it started goes on for the
+	// second one.
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("expected the canceled caller to fail with context.Canceled, got %v", err)
+	}
+	close(backend.release)
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected the callers to share one storage call, got %d", calls)
+	}
+}
+
+func TestCopyRow(t *testing.T) {
+	var shards []core.Shard
+	for i := 0; i < 4; i++ {
+		shards = append(shards, core.Shard{Name: "test_shard" + strconv.Itoa(i), Backend: st.New()})
+	}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	// Copy across shards, the usual case.
+	src := "template"
+	dst := "tenant0"
+	for i := 1; ShardFor(dst, len(shards)) == ShardFor(src, len(shards)); i++ {
+		dst = "tenant" + strconv.Itoa(i)
+	}
+
+	for _, column := range []string{"BASE", "PROFILE", "SETTINGS"} {
+		for refKey := int64(1); refKey <= 2; refKey++ {
+			err := kv.PutCell(context.TODO(), src, column, refKey, models.Cell{Body: column + strconv.FormatInt(refKey, 10)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	copied, err := kv.CopyRow(context.TODO(), src, dst, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 6 {
+		t.Fatalf("expected 6 cells copied, got %d", copied)
+	}
+	for _, column := range []string{"BASE", "PROFILE", "SETTINGS"} {
+		for refKey := int64(1); refKey <= 2; refKey++ {
+			cell, found, err := kv.GetCell(context.TODO(), dst, column, refKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found || cell.Body != column+strconv.FormatInt(refKey, 10) {
+				t.Fatalf("expected %s/%d to be copied, got %v (found=%v)", column, refKey, cell, found)
+			}
+		}
+	}
+
+	_, err = kv.CopyRow(context.TODO(), src, dst, false)
+	if err != models.ErrRowExists {
+		t.Fatalf("expected ErrRowExists copying onto a row with data, got %v", err)
+	}
+
+	// With overwrite, cells of dst missing from src are gone afterwards.
+	err = kv.PutCell(context.TODO(), dst, "EXTRA", 1, models.Cell{Body: "extra"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err = kv.CopyRow(context.TODO(), src, dst, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 6 {
+		t.Fatalf("expected 6 cells copied with overwrite, got %d", copied)
+	}
+	_, found, err := kv.GetCellLatest(context.TODO(), dst, "EXTRA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("expected overwrite to delete the cells already under the destination row")
+	}
+}
+
+func TestMoveRow(t *testing.T) {
+	var shards []core.Shard
+	for i := 0; i < 4; i++ {
+		shards = append(shards, core.Shard{Name: "test_shard" + strconv.Itoa(i), Backend: st.New()})
+	}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	// Find a destination on the same shard as the source, and one on another.
+	src := "legacy"
+	var sameShard, otherShard string
+	for i := 0; sameShard == "" || otherShard == ""; i++ {
+		key := "new" + strconv.Itoa(i)
+		if ShardFor(key, len(shards)) == ShardFor(src, len(shards)) {
+			if sameShard == "" {
+				sameShard = key
+			}
+		} else if otherShard == "" {
+			otherShard = key
+		}
+	}
+
+	columns := []string{"BASE", "PROFILE"}
+	for _, column := range columns {
+		for refKey := int64(1); refKey <= 3; refKey++ {
+			err := kv.PutCell(context.TODO(), src, column, refKey, models.Cell{Body: column + strconv.FormatInt(refKey, 10)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	from := src
+	for _, dst := range []string{sameShard, otherShard} {
+		err := kv.MoveRow(context.TODO(), from, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, column := range columns {
+			_, found, err := kv.GetCellLatest(context.TODO(), from, column)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found {
+				t.Fatalf("expected %s/%s to be gone after moving to %s", from, column, dst)
+			}
+			for refKey := int64(1); refKey <= 3; refKey++ {
+				cell, found, err := kv.GetCell(context.TODO(), dst, column, refKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !found || cell.Body != column+strconv.FormatInt(refKey, 10) {
+					t.Fatalf("expected %s/%s/%d to be moved, got %v (found=%v)", dst, column, refKey, cell, found)
+				}
+			}
+		}
+		from = dst
+	}
+
+	// Both paths refuse to move onto a row with cells.
+	for _, key := range []string{src, sameShard} {
+		err := kv.PutCell(context.TODO(), key, "BASE", 1, models.Cell{Body: "taken"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dst := range []string{sameShard, otherShard} {
+		err := kv.MoveRow(context.TODO(), src, dst)
+		if err != models.ErrRowExists {
+			t.Fatalf("expected ErrRowExists moving onto %s, got %v", dst, err)
+		}
+	}
+}
+
+func TestPatchCell(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	steps := []struct {
+		patch string
+		want  string
+	}{
+		// A missing cell is patched as null, so this creates it.
+		{`{"name":"Ada","address":{"city":"London","zip":"N1"}}`, `{"address":{"city":"London","zip":"N1"},"name":"Ada"}`},
+		// Add a field.
+		{`{"email":"ada@example.com"}`, `{"address":{"city":"London","zip":"N1"},"email":"ada@example.com","name":"Ada"}`},
+		// Overwrite a field, and one nested object member.
+		{`{"name":"Ada Lovelace","address":{"city":"Marylebone"}}`, `{"address":{"city":"Marylebone","zip":"N1"},"email":"ada@example.com","name":"Ada Lovelace"}`},
+		// null deletes, nested too; arrays are replaced whole.
+		{`{"email":null,"address":{"zip":null},"tags":[1,2]}`, `{"address":{"city":"Marylebone"},"name":"Ada Lovelace","tags":[1,2]}`},
+	}
+
+	for i, step := range steps {
+		cell, err := kv.PatchCell(context.TODO(), "row", "BASE", []byte(step.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cell.RefKey != int64(i+1) {
+			t.Errorf("step %d: expected ref key %d, got %d", i, i+1, cell.RefKey)
+		}
+		latest, _, err := kv.GetCellLatest(context.TODO(), "row", "BASE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest.Body != step.want {
+			t.Fatalf("step %d: expected %s, got %s", i, step.want, latest.Body)
+		}
+	}
+
+	_, err := kv.PatchCell(context.TODO(), "row", "BASE", []byte(`{"name":`))
+	if err == nil {
+		t.Fatal("expected an error for an invalid patch")
+	}
+}
+
+func TestExists(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}, {Name: "test_shard1", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	for i := 0; i < 4; i++ {
+		err := kv.PutCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", int64(i+1), models.Cell{Body: "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[models.CellKey]bool{
+		{RowKey: "row0", ColumnName: "BASE"}:    true,
+		{RowKey: "row1", ColumnName: "BASE"}:    true,
+		{RowKey: "row3", ColumnName: "BASE"}:    true,
+		{RowKey: "row1", ColumnName: "PROFILE"}: false,
+		{RowKey: "row9", ColumnName: "BASE"}:    false,
+	}
+	var keys []models.CellKey
+	for key := range want {
+		keys = append(keys, key)
+	}
+	exists, err := kv.Exists(context.TODO(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exists, want) {
+		t.Fatalf("expected %v, got %v", want, exists)
+	}
+
+	exists, err = kv.Exists(context.TODO(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exists) != 0 {
+		t.Fatalf("expected no keys, got %v", exists)
+	}
+}
+
+func TestListColumns(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	for _, column := range []string{"SETTINGS", "BASE", "PROFILE", "BASE"} {
+		_, err := kv.GetAndModify(context.TODO(), "row", column, func(old []byte) ([]byte, error) {
+			return []byte("{}"), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := kv.PutCell(context.TODO(), "other", "OTHER", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns, err := kv.ListColumns(context.TODO(), "row")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"BASE", "PROFILE", "SETTINGS"}
+	if len(columns) != len(want) {
+		t.Fatalf("expected %v, got %v", want, columns)
+	}
+	for i := range want {
+		if columns[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, columns)
+		}
+	}
+
+	columns, err = kv.ListColumns(context.TODO(), "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columns == nil || len(columns) != 0 {
+		t.Fatalf("expected an empty slice for an unknown row, got %#v", columns)
+	}
+}
+
+func TestImport(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	var input bytes.Buffer
+	enc := json.NewEncoder(&input)
+	for i := 0; i < 25; i++ {
+		err := enc.Encode(models.NewCell("row"+strconv.Itoa(i), "BASE", 1, `{"n":`+strconv.Itoa(i)+`}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var progress []int64
+	count, err := kv.Import(context.TODO(), bytes.NewReader(input.Bytes()), ImportOptions{
+		BatchSize:  10,
+		OnProgress: func(count int64) { progress = append(progress, count) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 25 {
+		t.Fatalf("expected 25 cells imported, got %d", count)
+	}
+	if fmt.Sprint(progress) != "[10 20 25]" {
+		t.Fatalf("expected progress [10 20 25], got %v", progress)
+	}
+	cell, found, err := kv.GetCell(context.TODO(), "row24", "BASE", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || cell.Body != `{"n":24}` {
+		t.Fatalf("unexpected imported cell %v (found=%v)", cell, found)
+	}
+
+	// Cancelling stops the import before the next batch.
+	kv2 := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: st.New()}})
+	defer kv2.Destroy(context.TODO())
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	count, err = kv2.Import(ctx, bytes.NewReader(input.Bytes()), ImportOptions{
+		BatchSize:  10,
+		OnProgress: func(count int64) { cancel() },
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if count != 10 {
+		t.Fatalf("expected the first batch of 10 to be imported, got %d", count)
+	}
+}
+
+func TestGetCellBefore(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	// Ref keys need not be contiguous.
+	for _, refKey := range []int64{1, 2, 5, 9} {
+		err := kv.PutCell(context.TODO(), "row", "BASE", refKey, models.Cell{Body: strconv.FormatInt(refKey, 10)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := kv.PutCell(context.TODO(), "row", "OTHER", 3, models.Cell{Body: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		refKey int64
+		want   int64
+		found  bool
+	}{
+		{9, 5, true},
+		{5, 2, true},
+		{4, 2, true},
+		{2, 1, true},
+		{100, 9, true},
+		{1, 0, false},
+	}
+	for _, test := range tests {
+		cell, found, err := kv.GetCellBefore(context.TODO(), "row", "BASE", test.refKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != test.found || cell.RefKey != test.want {
+			t.Errorf("before %d: expected ref key %d (found=%v), got %d (found=%v)", test.refKey, test.want, test.found, cell.RefKey, found)
+		}
+		if found && cell.Body != strconv.FormatInt(test.want, 10) {
+			t.Errorf("before %d: unexpected body %s", test.refKey, cell.Body)
+		}
+	}
+}
+
+func TestShardKeyFunc(t *testing.T) {
+	var shards []core.Shard
+	for i := 0; i < 8; i++ {
+		shards = append(shards, core.Shard{Name: "test_shard" + strconv.Itoa(i), Backend: st.New()})
+	}
+
+	// Row keys are "<tenant>/<id>"; keep each tenant on one shard.
+	tenant := func(rowKey string) string {
+		return strings.SplitN(rowKey, "/", 2)[0]
+	}
+	kv := New().WithShardKeyFunc(tenant).WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	// Two row keys that would otherwise be placed apart.
+	first := "acme/0"
+	second := "acme/1"
+	for i := 2; ShardFor(second, len(shards)) == ShardFor(first, len(shards)); i++ {
+		second = "acme/" + strconv.Itoa(i)
+	}
+
+	for _, rowKey := range []string{first, second} {
+		err := kv.PutCell(context.TODO(), rowKey, "BASE", 1, models.Cell{Body: rowKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend := shards[ShardFor("acme", len(shards))].Backend
+	for _, rowKey := range []string{first, second} {
+		cell, found, err := backend.GetCell(context.TODO(), rowKey, "BASE", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || cell.Body != rowKey {
+			t.Fatalf("expected %s on the shard of its tenant, got %v (found=%v)", rowKey, cell, found)
+		}
+		cell, found, err = kv.GetCell(context.TODO(), rowKey, "BASE", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || cell.Body != rowKey {
+			t.Fatalf("expected to read %s back, got %v (found=%v)", rowKey, cell, found)
+		}
+	}
+}
+
+func TestPartitionReadJSONL(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	for i := 0; i < 5; i++ {
+		err := kv.PutCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", 1, models.Cell{Body: `{"n":` + strconv.Itoa(i) + `}`})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := kv.PartitionReadJSONL(context.TODO(), 0, "added_at", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(r)
+	var lines int
+	for scanner.Scan() {
+		var got struct {
+			AddedAt   int64
+			RowKey    string
+			Body      string
+			CreatedAt *string
+		}
+		err = json.Unmarshal(scanner.Bytes(), &got)
+		if err != nil {
+			t.Fatalf("line %d: %s", lines+1, err)
+		}
+		if got.RowKey != "row"+strconv.Itoa(lines) || got.Body != `{"n":`+strconv.Itoa(lines)+`}` || got.AddedAt == 0 || got.CreatedAt == nil {
+			t.Errorf("line %d: unexpected cell %s", lines+1, scanner.Text())
+		}
+		lines++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if lines != 5 {
+		t.Fatalf("expected 5 lines, got %d", lines)
+	}
+	r.Close()
+
+	// Closing the reader before the end stops the scan.
+	r, err = kv.PartitionReadJSONL(context.TODO(), 0, "added_at", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// A failed read surfaces from Read.
+	r, err = kv.PartitionReadJSONL(context.TODO(), 0, "nowhere", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	if err == nil {
+		t.Fatal("expected the error of the partition read")
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	bodies := []string{
+		`{"name":"Smith, \"Jo\"","address":{"city":"Oslo"},"n":1}`,
+		`{"name":"line\nbreak","tags":["a","b"]}`,
+		`not json`,
+	}
+	for i, body := range bodies {
+		err := kv.PutCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", 1, models.Cell{Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := kv.ExportCSV(context.TODO(), 0, &buf, []string{"row_key", "ref_key"}, []string{"name", "address.city", "n", "tags"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"row_key", "ref_key", "name", "address.city", "n", "tags"},
+		{"row0", "1", `Smith, "Jo"`, "Oslo", "1", ""},
+		{"row1", "1", "line\nbreak", "", "", `["a","b"]`},
+		{"row2", "1", "", "", "", ""},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("expected %q, got %q", want, records)
+	}
+
+	err = kv.ExportCSV(context.TODO(), 0, &buf, []string{"checksum"}, nil)
+	if err == nil {
+		t.Fatal("expected an error for a column cells do not carry")
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards).WithSchemaVersion(2)
+	defer kv.Destroy(context.TODO())
+
+	for i, version := range []int64{1, 0, 3, 1, 0} {
+		rowKey := "row" + strconv.Itoa(i)
+		err := kv.PutCell(context.TODO(), rowKey, "BASE", 1, models.Cell{Body: "{}", SchemaVersion: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cell, found, err := kv.GetCell(context.TODO(), "row0", "BASE", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || cell.SchemaVersion != 1 {
+		t.Fatalf("expected schema version 1, got %v", cell)
+	}
+	cell, found, err = kv.GetCellLatest(context.TODO(), "row1", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || cell.SchemaVersion != 2 {
+		t.Fatalf("expected the default schema version 2, got %v", cell)
+	}
+
+	for version, want := range map[int64][]string{1: {"row0", "row3"}, 2: {"row1", "row4"}, 3: {"row2"}, 4: nil} {
+		cells, found, err := kv.PartitionReadSchemaVersion(context.TODO(), 0, version, "added_at", 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != (len(want) > 0) || len(cells) != len(want) {
+			t.Fatalf("version %d: expected %v, got %v", version, want, cells)
+		}
+		for i, cell := range cells {
+			if cell.RowKey != want[i] || cell.SchemaVersion != version {
+				t.Errorf("version %d: expected %s, got %v", version, want[i], cell)
+			}
+		}
+	}
+
+	// The filter applies to a page after the first too.
+	cells, _, err := kv.PartitionReadSchemaVersion(context.TODO(), 0, 1, "added_at", 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 1 || cells[0].RowKey != "row3" {
+		t.Fatalf("expected row3, got %v", cells)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	tags := []map[string]string{
+		{"source": "api", "author": "alice"},
+		nil,
+		{"source": "batch"},
+		{"source": "api"},
+	}
+	for i, metadata := range tags {
+		rowKey := "row" + strconv.Itoa(i)
+		err := kv.PutCell(context.TODO(), rowKey, "BASE", 1, models.Cell{Body: "{}", Metadata: metadata})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cell, found, err := kv.GetCell(context.TODO(), "row0", "BASE", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !cell.Equal(models.Cell{AddedAt: cell.AddedAt, RowKey: "row0", ColumnName: "BASE", RefKey: 1, Body: "{}", CreatedAt: cell.CreatedAt, Metadata: tags[0]}) {
+		t.Fatalf("expected the metadata of row0, got %v", cell)
+	}
+	cell, found, err = kv.GetCellLatest(context.TODO(), "row1", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || cell.Metadata != nil {
+		t.Fatalf("expected no metadata, got %v", cell)
+	}
+
+	for tag, want := range map[[2]string][]string{
+		{"source", "api"}:    {"row0", "row3"},
+		{"source", "batch"}:  {"row2"},
+		{"author", "alice"}:  {"row0"},
+		{"source", "alice"}:  nil,
+		{"missing", "value"}: nil,
+	} {
+		cells, found, err := kv.PartitionReadTag(context.TODO(), 0, tag[0], tag[1], "added_at", 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != (len(want) > 0) || len(cells) != len(want) {
+			t.Fatalf("tag %v: expected %v, got %v", tag, want, cells)
+		}
+		for i, cell := range cells {
+			if cell.RowKey != want[i] || cell.Metadata[tag[0]] != tag[1] {
+				t.Errorf("tag %v: expected %s, got %v", tag, want[i], cell)
+			}
+		}
+	}
+}
+
+func TestRefKeyFromTime(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards).WithRefKeyFromTime()
+	defer kv.Destroy(context.TODO())
+
+	start := time.Now().UnixNano() / int64(time.Millisecond)
+	const writes = 50
+	for i := 0; i < writes; i++ {
+		err := kv.PutCell(context.TODO(), "row", "BASE", 0, models.Cell{Body: strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cells, err := kv.GetCellRange(context.TODO(), "row", "BASE", 1, 0, writes+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != writes {
+		t.Fatalf("expected %d cells, got %d", writes, len(cells))
+	}
+	if cells[0].RefKey < start {
+		t.Errorf("expected a ref key from the current time, got %d before %d", cells[0].RefKey, start)
+	}
+	for i, cell := range cells {
+		// Ref key order must be write order.
+		if cell.Body != strconv.Itoa(i) {
+			t.Fatalf("expected body %d at position %d, got %v", i, i, cell)
+		}
+	}
+
+	latest, _, err := kv.GetCellLatest(context.TODO(), "row", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Body != strconv.Itoa(writes-1) {
+		t.Errorf("expected the last write to be the latest, got %v", latest)
+	}
+
+	// A clock that does not move still yields increasing ref keys.
+	frozen := time.Unix(1600000000, 0)
+	clock := &refKeyClock{now: func() time.Time { return frozen }}
+	want := frozen.UnixNano() / int64(time.Millisecond)
+	for i := int64(0); i < 3; i++ {
+		if got := clock.next(); got != want+i {
+			t.Errorf("expected %d, got %d", want+i, got)
+		}
+	}
+}
+
+func TestWritePolicy(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards).WithWritePolicy(func(columnName string) WritePolicy {
+		if columnName == "STATE" {
+			return Replace
+		}
+		return Append
+	})
+	defer kv.Destroy(context.TODO())
+
+	for _, column := range []string{"STATE", "EVENTS"} {
+		err := kv.PutCell(context.TODO(), "row", column, 1, models.Cell{Body: `{"v":1}`})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// EVENTS appends, so its cells cannot be overwritten.
+	err := kv.PutCell(context.TODO(), "row", "EVENTS", 1, models.Cell{Body: `{"v":2}`})
+	if err != models.ErrCellExists {
+		t.Fatalf("expected ErrCellExists, got %v", err)
+	}
+
+	// STATE replaces the cell in place.
+	err = kv.PutCell(context.TODO(), "row", "STATE", 1, models.Cell{Body: `{"v":2}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for column, want := range map[string]string{"STATE": `{"v":2}`, "EVENTS": `{"v":1}`} {
+		cell, found, err := kv.GetCell(context.TODO(), "row", column, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || cell.Body != want {
+			t.Errorf("expected %s to be %s, got %v", column, want, cell)
+		}
+	}
+
+	cells, err := kv.GetCellRange(context.TODO(), "row", "STATE", 0, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 1 {
+		t.Errorf("expected a single version of STATE, got %v", cells)
+	}
+}
+
+func TestFeedRead(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	for refKey := int64(1); refKey <= 7; refKey++ {
+		err := kv.PutCell(context.TODO(), "feed", "EVENTS", refKey, models.Cell{Body: strconv.FormatInt(refKey, 10)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A second column sharing ref key 5, which must not be split across
+	// pages.
+	err := kv.PutCell(context.TODO(), "feed", "LIKES", 5, models.Cell{Body: "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"EVENTS/7", "EVENTS/6"},
+		{"EVENTS/5", "LIKES/5", "EVENTS/4"},
+		{"EVENTS/3", "EVENTS/2", "EVENTS/1"},
+	}
+	var cursor int64
+	for page, cells := range want {
+		got, next, err := kv.FeedRead(context.TODO(), "feed", cursor, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, cell := range got {
+			keys = append(keys, cell.ColumnName+"/"+cell.Body)
+		}
+		if !reflect.DeepEqual(keys, cells) {
+			t.Fatalf("page %d: expected %v, got %v", page, cells, keys)
+		}
+		if page == len(want)-1 {
+			if next != 0 {
+				t.Errorf("expected no cursor after the last page, got %d", next)
+			}
+			break
+		}
+		if next == 0 {
+			t.Fatalf("page %d: expected a cursor", page)
+		}
+		cursor = next
+	}
+}
+
+func TestMaxClockSkew(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards).WithMaxClockSkew(time.Hour, time.Minute)
+	defer kv.Destroy(context.TODO())
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	kv.skew.now = func() time.Time { return now }
+
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	tests := []struct {
+		createdAt *time.Time
+		rejected  bool
+	}{
+		{nil, false},
+		{at(0), false},
+		{at(-59 * time.Minute), false},
+		{at(30 * time.Second), false},
+		{at(-2 * time.Hour), true},
+		{at(5 * time.Minute), true},
+		{at(24 * time.Hour), true},
+	}
+	for i, test := range tests {
+		err := kv.PutCell(context.TODO(), "row", "BASE", int64(i+1), models.Cell{Body: "{}", CreatedAt: test.createdAt})
+		var skewErr *ClockSkewError
+		if errors.As(err, &skewErr) != test.rejected {
+			t.Errorf("%d: expected rejected=%v, got %v", i, test.rejected, err)
+			continue
+		}
+		if !test.rejected && err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+		if test.rejected && !skewErr.CreatedAt.Equal(*test.createdAt) {
+			t.Errorf("%d: expected the error to carry %s, got %s", i, test.createdAt, skewErr.CreatedAt)
+		}
+	}
+
+	// Rejected cells are not written.
+	_, found, err := kv.GetCell(context.TODO(), "row", "BASE", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("expected a rejected cell not to be written")
+	}
+}
+
+func TestGetCellMerged(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	_, found, err := kv.GetCellMerged(context.TODO(), "profile", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("expected no cell before the first version")
+	}
+
+	patches := []string{
+		`{"name":"ada","address":{"city":"london","zip":"n1"},"tags":["a"]}`,
+		`{"address":{"zip":"nw1"},"age":36}`,
+		`{"tags":["b","c"],"age":null}`,
+		`{"address":{"country":"uk"}}`,
+	}
+	for i, patch := range patches {
+		err := kv.PutCell(context.TODO(), "profile", "BASE", int64(i+1), models.Cell{Body: patch})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		strategy MergeStrategy
+		want     string
+	}{
+		{nil, `{"address":{"city":"london","country":"uk","zip":"nw1"},"name":"ada","tags":["b","c"]}`},
+		{DeepMerge, `{"address":{"city":"london","country":"uk","zip":"nw1"},"name":"ada","tags":["b","c"]}`},
+		{LastWriteWins, patches[len(patches)-1]},
+	}
+	for i, test := range tests {
+		kv.WithMergeStrategy(test.strategy)
+		cell, found, err := kv.GetCellMerged(context.TODO(), "profile", "BASE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatalf("%d: expected a merged cell", i)
+		}
+		if cell.Body != test.want {
+			t.Errorf("%d: expected %s, got %s", i, test.want, cell.Body)
+		}
+		if cell.RefKey != int64(len(patches)) {
+			t.Errorf("%d: expected the ref key of the latest version, got %d", i, cell.RefKey)
+		}
+	}
+
+	err = kv.PutCell(context.TODO(), "profile", "BASE", int64(len(patches)+1), models.Cell{Body: "not json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = kv.GetCellMerged(context.TODO(), "profile", "BASE")
+	if err == nil {
+		t.Error("expected an error merging a body that is not JSON")
+	}
+}
+
+func TestCountByColumn(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	want := map[string]int64{"BASE": 3, "PROFILE": 1, "SETTINGS": 5}
+	for column, versions := range want {
+		for refKey := int64(1); refKey <= versions; refKey++ {
+			err := kv.PutCell(context.TODO(), "row", column, refKey, models.Cell{Body: "{}"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err := kv.PutCell(context.TODO(), "other", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := kv.CountByColumn(context.TODO(), "row")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("expected %v, got %v", want, counts)
+	}
+
+	counts, err = kv.CountByColumn(context.TODO(), "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts == nil || len(counts) != 0 {
+		t.Fatalf("expected an empty map for an unknown row, got %#v", counts)
+	}
+}
+
+func TestPartitionLocation(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	for i := int64(1); i <= 3; i++ {
+		err := kv.PutCell(context.TODO(), "row", "BASE", i, models.Cell{Body: "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	typed, found, err := kv.PartitionReadAt(context.TODO(), 0, AddedAt, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(typed) != 2 {
+		t.Fatalf("expected 2 cells after added_at 1, got %v", typed)
+	}
+
+	// The string form reads the same cells.
+	shim, _, err := kv.PartitionRead(context.TODO(), 0, "added_at", 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shim) != len(typed) {
+		t.Fatalf("expected %v, got %v", typed, shim)
+	}
+	for i := range shim {
+		if !shim[i].Equal(typed[i]) {
+			t.Fatalf("expected %v, got %v", typed, shim)
+		}
+	}
+
+	_, _, err = kv.PartitionReadAt(context.TODO(), 0, PartitionLocation(0), 1, 10)
+	if err == nil {
+		t.Error("expected an error for an invalid location")
+	}
+
+	for _, test := range []struct {
+		s    string
+		want PartitionLocation
+	}{
+		{"created_at", CreatedAt},
+		{"timestamp", CreatedAt},
+		{"added_at", AddedAt},
+		{"cursor", Cursor},
+	} {
+		got, err := ParsePartitionLocation(test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.s, test.want, got)
+		}
+	}
+	_, err = ParsePartitionLocation("addedat")
+	if err == nil {
+		t.Error("expected an error for a misspelt location")
+	}
+	if AddedAt.String() != "added_at" {
+		t.Errorf("expected added_at, got %s", AddedAt)
+	}
+}
+
+// plainStorage hides the optional capabilities of the storage it wraps.
+type plainStorage struct {
+	core.Storage
+}
+
+func TestPartitionReadProjected(t *testing.T) {
+	bodies := []string{
+		`{"name":"ada","address":{"city":"london","zip":"n1"},"active":true,"age":36}`,
+		`{"name":"grace","address":{"zip":"10001"}}`,
+		`{"address":"unknown","active":false}`,
+	}
+	want := []map[string]interface{}{
+		{"name": "ada", "address.city": "london", "active": true},
+		{"name": "grace", "address.city": nil, "active": nil},
+		{"name": nil, "address.city": nil, "active": false},
+	}
+
+	for _, test := range []struct {
+		name    string
+		backend core.Storage
+	}{
+		{"server-side", st.New()},
+		{"client-side", plainStorage{st.New()}},
+	} {
+		kv := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: test.backend}})
+		for i, body := range bodies {
+			err := kv.PutCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", 1, models.Cell{Body: body})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		rows, found, err := kv.PartitionReadProjected(context.TODO(), 0, "added_at", 0, 10, []string{"name", "address.city", "active"})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !found || !reflect.DeepEqual(rows, want) {
+			t.Errorf("%s: expected %v, got %v", test.name, want, rows)
+		}
+
+		_, _, err = kv.PartitionReadProjected(context.TODO(), 0, "added_at", 0, 10, []string{"name'; --"})
+		if err == nil {
+			t.Errorf("%s: expected an error for an invalid path", test.name)
+		}
+		kv.Destroy(context.TODO())
+	}
+}
+
+func TestHashedRowKeys(t *testing.T) {
+	backend := st.New()
+	shards := []core.Shard{{Name: "test_shard0", Backend: backend}}
+	kv := New().WithHashedRowKeys(4).WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	var rowKeys []string
+	for i := 0; i < 16; i++ {
+		rowKey := fmt.Sprintf("user-%04d", i)
+		rowKeys = append(rowKeys, rowKey)
+		err := kv.PutCell(context.TODO(), rowKey, "BASE", 1, models.Cell{Body: "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, rowKey := range rowKeys {
+		cell, found, err := kv.GetCell(context.TODO(), rowKey, "BASE", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || cell.RowKey != rowKey {
+			t.Fatalf("expected cell of %s, got %v (found %v)", rowKey, cell, found)
+		}
+		cell, found, err = kv.GetCellLatest(context.TODO(), rowKey, "BASE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || cell.RowKey != rowKey {
+			t.Fatalf("expected latest cell of %s, got %v (found %v)", rowKey, cell, found)
+		}
+	}
+
+	// The storage holds the hashed row keys, which no longer sort in the
+	// order of the logical ones.
+	stored, _, err := backend.PartitionRead(context.TODO(), 0, "added_at", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(rowKeys) {
+		t.Fatalf("expected %d stored cells, got %d", len(rowKeys), len(stored))
+	}
+	physical := make([]string, len(stored))
+	for i, cell := range stored {
+		if !strings.HasSuffix(cell.RowKey, ":"+rowKeys[i]) || len(cell.RowKey) != len(rowKeys[i])+5 {
+			t.Fatalf("expected a hashed row key for %s, got %s", rowKeys[i], cell.RowKey)
+		}
+		physical[i] = cell.RowKey
+	}
+	if sort.StringsAreSorted(physical) {
+		t.Errorf("expected hashed row keys to be distributed, got %v", physical)
+	}
+
+	cells, found, err := kv.PartitionRead(context.TODO(), 0, "added_at", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(cells) != len(rowKeys) {
+		t.Fatalf("expected %d cells, got %v", len(rowKeys), cells)
+	}
+	for i, cell := range cells {
+		if cell.RowKey != rowKeys[i] {
+			t.Errorf("expected row key %s, got %s", rowKeys[i], cell.RowKey)
+		}
+	}
+}
+
+func TestHashedRowKeysUUID(t *testing.T) {
+	kv := New().WithHashedRowKeys(16).WithSource([]core.Shard{{Name: "test_shard0", Backend: st.New()}})
+	defer kv.Destroy(context.TODO())
+
+	rowKey := uuid.Must(uuid.NewV4()).String()
+	if n := len(kv.physicalKey(rowKey)); n > 64 {
+		t.Fatalf("expected the stored row key to fit VARCHAR(64), got %d bytes", n)
+	}
+	err := kv.PutCell(context.TODO(), rowKey, "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cell, found, err := kv.GetCell(context.TODO(), rowKey, "BASE", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || cell.RowKey != rowKey {
+		t.Fatalf("expected cell of %s, got %v (found %v)", rowKey, cell, found)
+	}
+}
+
+func TestCheckRow(t *testing.T) {
+	backend := st.New()
+	kv := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: backend}})
+	defer kv.Destroy(context.TODO())
+
+	for i := int64(1); i <= 3; i++ {
+		err := kv.PutCell(context.TODO(), "row", "BASE", i, models.Cell{Body: fmt.Sprintf(`{"v":%d}`, i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := kv.PutCell(context.TODO(), "row", "OTHER", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	health, err := kv.CheckRow(context.TODO(), "row", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !health.Healthy() || health.Versions != 3 {
+		t.Fatalf("expected 3 healthy versions, got %+v", health)
+	}
+
+	// A version without a body is not an unparsable one.
+	err = kv.PutCell(context.TODO(), "row", "NULLABLE", 1, models.Cell{NullBody: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	health, err = kv.CheckRow(context.TODO(), "row", "NULLABLE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !health.Healthy() || health.Versions != 1 {
+		t.Fatalf("expected 1 healthy version without a body, got %+v", health)
+	}
+
+	// Cells a bug might have left behind, in a table without its unique
+	// index.
+	for _, stmt := range []string{
+		"DROP INDEX uniqcell_idx",
+		`INSERT INTO cell ( row_key, column_name, ref_key, body, created_at ) VALUES('row', 'BASE', 2, '{"v":"dup"}', datetime('now'))`,
+		`INSERT INTO cell ( row_key, column_name, ref_key, body, created_at ) VALUES('row', 'BASE', 4, '{"v":', datetime('now'))`,
+		`INSERT INTO cell ( row_key, column_name, ref_key, body, created_at ) VALUES('row', 'BASE', 5, '{}', NULL)`,
+		`INSERT INTO cell ( row_key, column_name, ref_key, body, created_at ) VALUES('row', 'OTHER', 1, '{}', datetime('now'))`,
+	} {
+		_, err = backend.Raw().Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	health, err = kv.CheckRow(context.TODO(), "row", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Healthy() || health.Versions != 6 {
+		t.Fatalf("expected 6 unhealthy versions, got %+v", health)
+	}
+	if !reflect.DeepEqual(health.DuplicateRefKeys, []int64{2}) {
+		t.Errorf("expected duplicate ref key 2, got %v", health.DuplicateRefKeys)
+	}
+	if !reflect.DeepEqual(health.MissingCreatedAt, []int64{5}) {
+		t.Errorf("expected ref key 5 to miss created_at, got %v", health.MissingCreatedAt)
+	}
+	if !reflect.DeepEqual(health.UnparsableBodies, []int64{4}) {
+		t.Errorf("expected ref key 4 to be unparsable, got %v", health.UnparsableBodies)
+	}
+
+	moved, err := kv.Repair(context.TODO(), "row", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 {
+		t.Fatalf("expected 1 version moved, got %d", moved)
+	}
+
+	// Only the duplicate moved: the other problems and the other column are
+	// left as they were, and no version was restamped.
+	health, err = kv.CheckRow(context.TODO(), "row", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(health.DuplicateRefKeys) != 0 || health.Versions != 6 {
+		t.Fatalf("expected 6 versions without duplicates after repair, got %+v", health)
+	}
+	if !reflect.DeepEqual(health.MissingCreatedAt, []int64{5}) || !reflect.DeepEqual(health.UnparsableBodies, []int64{4}) {
+		t.Errorf("expected the other problems to be left alone, got %+v", health)
+	}
+	for refKey, body := range map[int64]string{2: `{"v":2}`, 6: `{"v":"dup"}`} {
+		cell, found, err := kv.GetCell(context.TODO(), "row", "BASE", refKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || cell.Body != body {
+			t.Errorf("expected version %d to be %s, got %v", refKey, body, cell)
+		}
+	}
+	health, err = kv.CheckRow(context.TODO(), "row", "OTHER")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(health.DuplicateRefKeys, []int64{1}) {
+		t.Errorf("expected the other column to be left alone, got %+v", health)
+	}
+
+	kv = New().WithSource([]core.Shard{{Name: "test_shard0", Backend: plainStorage{st.New()}}})
+	_, err = kv.Repair(context.TODO(), "row", "BASE")
+	if err != core.ErrNotSupported {
+		t.Errorf("expected core.ErrNotSupported, got %v", err)
+	}
+}
+
+func TestPutRow(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	err := kv.PutRow(context.TODO(), "row", map[string]models.Cell{
+		"BASE":    {Body: `{"name":"ada"}`},
+		"ADDRESS": {Body: `{"city":"london"}`},
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for columnKey, body := range map[string]string{"BASE": `{"name":"ada"}`, "ADDRESS": `{"city":"london"}`} {
+		cell, found, err := kv.GetCell(context.TODO(), "row", columnKey, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || cell.RowKey != "row" || cell.ColumnName != columnKey || cell.Body != body {
+			t.Errorf("expected %s to be %s, got %v (found %v)", columnKey, body, cell, found)
+		}
+	}
+
+	// BASE already has a cell at ref key 1, so nothing is written.
+	err = kv.PutRow(context.TODO(), "row", map[string]models.Cell{
+		"BASE":    {Body: `{"name":"grace"}`},
+		"PROFILE": {Body: `{"age":36}`},
+		"ZIP":     {Body: `{"zip":"n1"}`},
+	}, 1)
+	if err != models.ErrCellExists {
+		t.Fatalf("expected models.ErrCellExists, got %v", err)
+	}
+	columns, err := kv.ListColumns(context.TODO(), "row")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(columns, []string{"ADDRESS", "BASE"}) {
+		t.Errorf("expected the failed row to write nothing, got columns %v", columns)
+	}
+	cell, _, err := kv.GetCell(context.TODO(), "row", "BASE", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cell.Body != `{"name":"ada"}` {
+		t.Errorf("expected BASE to be unchanged, got %s", cell.Body)
+	}
+
+	err = kv.PutRow(context.TODO(), "row", map[string]models.Cell{"BASE": {Body: "{}"}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv = New().WithSource([]core.Shard{{Name: "test_shard0", Backend: plainStorage{st.New()}}})
+	err = kv.PutRow(context.TODO(), "row", map[string]models.Cell{"BASE": {Body: "{}"}}, 1)
+	if err != core.ErrNotSupported {
+		t.Errorf("expected core.ErrNotSupported, got %v", err)
+	}
+}
+
+// laggingStorage is a replica that only sees a write after being read
+// lag times since.
+type laggingStorage struct {
+	*st.Storage
+	lag     int
+	pending int
+}
+
+func (s *laggingStorage) PutCell(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) error {
+	s.pending = s.lag
+	return s.Storage.PutCell(ctx, rowKey, columnKey, refKey, cell)
+}
+
+func (s *laggingStorage) GetCellLatest(ctx context.Context, rowKey string, columnKey string) (models.Cell, bool, error) {
+	cell, found, err := s.Storage.GetCellLatest(ctx, rowKey, columnKey)
+	if s.pending > 0 && found && err == nil {
+		s.pending--
+		return s.Storage.GetCellBefore(ctx, rowKey, columnKey, cell.RefKey)
+	}
+	return cell, found, err
+}
+
+func TestSession(t *testing.T) {
+	backend := &laggingStorage{Storage: st.New(), lag: 3}
+	kv := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: backend}})
+	defer kv.Destroy(context.TODO())
+
+	session := kv.NewSession(time.Second)
+	for i := int64(1); i <= 2; i++ {
+		err := session.Put(context.TODO(), "row", "BASE", i, models.Cell{Body: fmt.Sprintf(`{"v":%d}`, i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cell, found, err := session.Get(context.TODO(), "row", "BASE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || cell.RefKey != i {
+			t.Fatalf("expected the session to read version %d, got %v (found %v)", i, cell, found)
+		}
+	}
+
+	// Outside the session, the lagging read is returned as is.
+	err := kv.PutCell(context.TODO(), "row", "BASE", 3, models.Cell{Body: `{"v":3}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cell, _, err := kv.GetCellLatest(context.TODO(), "row", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cell.RefKey != 2 {
+		t.Errorf("expected a stale read of version 2, got %v", cell)
+	}
+
+	backend.lag = 1000
+	err = session.Put(context.TODO(), "row", "BASE", 4, models.Cell{Body: `{"v":4}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.maxWait = 20 * time.Millisecond
+	_, _, err = session.Get(context.TODO(), "row", "BASE")
+	if err != ErrStaleRead {
+		t.Errorf("expected ErrStaleRead, got %v", err)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	_, found, err := kv.GetCheckpoint(context.TODO(), 0, "etl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("expected no checkpoint before the first SetCheckpoint")
+	}
+
+	for i := int64(1); i <= 5; i++ {
+		err := kv.PutCell(context.TODO(), "row", "BASE", i, models.Cell{Body: "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Tail in pages, saving the checkpoint after each and reloading it
+	// before the next, as a job restarting between pages would.
+	var seen int
+	for {
+		since, _, err := kv.GetCheckpoint(context.TODO(), 0, "etl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cells, checkpoint, err := kv.Tail(context.TODO(), 0, since, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cells) == 0 {
+			break
+		}
+		seen += len(cells)
+		err = kv.SetCheckpoint(context.TODO(), 0, "etl", checkpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seen != 5 {
+		t.Errorf("expected to tail 5 cells, got %d", seen)
+	}
+
+	value, found, err := kv.GetCheckpoint(context.TODO(), 0, "etl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || value != 5 {
+		t.Errorf("expected checkpoint 5, got %d (found %v)", value, found)
+	}
+	_, found, err = kv.GetCheckpoint(context.TODO(), 0, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("expected checkpoints to be kept per job")
+	}
+
+	kv = New().WithSource([]core.Shard{{Name: "test_shard0", Backend: plainStorage{st.New()}}})
+	err = kv.SetCheckpoint(context.TODO(), 0, "etl", 1)
+	if err != core.ErrNotSupported {
+		t.Errorf("expected core.ErrNotSupported, got %v", err)
+	}
+}
+
+func TestCreatedAtAddedAt(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	day := time.Date(2020, 3, 1, 12, 0, 0, 0, time.Local)
+	// Events written out of order, one without a created_at.
+	events := []*time.Time{timePtr(day.Add(2 * time.Hour)), timePtr(day), nil, timePtr(day.Add(time.Hour))}
+	for i, createdAt := range events {
+		err := kv.PutCell(context.TODO(), "row", "BASE", int64(i+1), models.Cell{Body: "{}", CreatedAt: createdAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cells, _, err := kv.PartitionRead(context.TODO(), 0, "added_at", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != len(events) {
+		t.Fatalf("expected %d cells, got %v", len(events), cells)
+	}
+	for i, cell := range cells {
+		// added_at is the write order, whatever the created_at.
+		if cell.RefKey != int64(i+1) || (i > 0 && cell.AddedAt <= cells[i-1].AddedAt) {
+			t.Errorf("expected cells in write order with increasing added_at, got %v", cells)
+		}
+		if cell.CreatedAt == nil {
+			t.Fatalf("expected a created_at on %v", cell)
+		}
+		if events[i] != nil && !cell.CreatedAt.Equal(*events[i]) {
+			t.Errorf("expected created_at %s, got %s", events[i], cell.CreatedAt)
+		}
+	}
+	if cells[2].CreatedAt.Year() < 2026 {
+		t.Errorf("expected a cell written without created_at to be stamped with the write time, got %s", cells[2].CreatedAt)
+	}
+
+	// The window holds the first two hours of the day, read one at a time.
+	var window []int64
+	var after int64
+	for {
+		page, next, err := kv.PartitionReadWindow(context.TODO(), 0, day, day.Add(2*time.Hour), after, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cell := range page {
+			window = append(window, cell.RefKey)
+		}
+		if next == 0 {
+			break
+		}
+		after = next
+	}
+	if !reflect.DeepEqual(window, []int64{2, 4}) {
+		t.Errorf("expected ref keys 2 and 4 in the window, got %v", window)
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestNullBody(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	tests := []struct {
+		column string
+		cell   models.Cell
+	}{
+		{"NULL", models.Cell{NullBody: true}},
+		{"EMPTY", models.Cell{Body: ""}},
+		{"BODY", models.Cell{Body: `{"a":1}`}},
+	}
+	for _, test := range tests {
+		err := kv.PutCell(context.TODO(), "row", test.column, 1, test.cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range tests {
+		cell, found, err := kv.GetCellLatest(context.TODO(), "row", test.column)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || cell.NullBody != test.cell.NullBody || cell.Body != test.cell.Body {
+			t.Errorf("%s: expected body %q (null %v), got %q (null %v)", test.column, test.cell.Body, test.cell.NullBody, cell.Body, cell.NullBody)
+		}
+	}
+
+	cells, _, err := kv.PartitionRead(context.TODO(), 0, "added_at", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cell := range cells {
+		if cell.NullBody != tests[i].cell.NullBody {
+			t.Errorf("%s: expected null %v from PartitionRead, got %v", tests[i].column, tests[i].cell.NullBody, cell.NullBody)
+		}
+		var decoded models.Cell
+		err = json.Unmarshal([]byte(cell.String()), &decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.NullBody != cell.NullBody {
+			t.Errorf("%s: expected String to keep null %v, got %s", tests[i].column, cell.NullBody, cell)
+		}
+	}
+}
+
+func TestDeleteRow(t *testing.T) {
+	backend := st.New().WithIndex(models.IndexColumn("by_email", "email"))
+	kv := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: backend}})
+	defer kv.Destroy(context.TODO())
+
+	for _, rowKey := range []string{"erased", "kept"} {
+		for refKey := int64(1); refKey <= 3; refKey++ {
+			for _, columnKey := range []string{"BASE", "PROFILE"} {
+				err := kv.PutCell(context.TODO(), rowKey, columnKey, refKey, models.Cell{Body: `{"email":"` + rowKey + `@example.com"}`})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	deleted, err := kv.DeleteRow(context.TODO(), "erased")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 6 {
+		t.Errorf("expected 6 cells deleted, got %d", deleted)
+	}
+	columns, err := kv.ListColumns(context.TODO(), "erased")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(columns) != 0 {
+		t.Errorf("expected the row to be wiped, got columns %v", columns)
+	}
+	rowKeys, err := kv.LookupByIndex(context.TODO(), "by_email", "erased@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rowKeys) != 0 {
+		t.Errorf("expected the index entries to be wiped, got %v", rowKeys)
+	}
+
+	counts, err := kv.CountByColumn(context.TODO(), "kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, map[string]int64{"BASE": 3, "PROFILE": 3}) {
+		t.Errorf("expected the other row to keep its cells, got %v", counts)
+	}
+
+	deleted, err = kv.DeleteRow(context.TODO(), "erased")
+	if err != nil || deleted != 0 {
+		t.Errorf("expected deleting a missing row to delete nothing, got %d, %v", deleted, err)
+	}
+
+	plain := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: plainStorage{st.New()}}})
+	defer plain.Destroy(context.TODO())
+	_, err = plain.DeleteRow(context.TODO(), "erased")
+	if err != core.ErrNotSupported {
+		t.Errorf("expected core.ErrNotSupported, got %v", err)
+	}
+}
+
+type auditEntry struct {
+	actor, op, rowKey, columnKey string
+	refKey                       int64
+}
+
+type recordingSink struct {
+	mu      sync.Mutex
+	entries []auditEntry
+}
+
+func (r *recordingSink) Record(ctx context.Context, op string, rowKey string, columnKey string, refKey int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, auditEntry{ActorFromContext(ctx), op, rowKey, columnKey, refKey})
+}
+
+func TestAuditSink(t *testing.T) {
+	sink := &recordingSink{}
+	kv := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: st.New()}}).WithAuditSink(sink)
+	defer kv.Destroy(context.TODO())
+
+	ctx := WithActor(context.TODO(), "alice")
+	err := kv.PutCell(ctx, "row", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A failed write is not recorded.
+	err = kv.PutCell(ctx, "row", "BASE", 1, models.Cell{Body: "{}"})
+	if err != models.ErrCellExists {
+		t.Fatalf("expected models.ErrCellExists, got %v", err)
+	}
+	err = kv.PutRow(context.TODO(), "row", map[string]models.Cell{"ADDRESS": {Body: "{}"}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kv.DeleteRow(WithActor(context.TODO(), "bob"), "row")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []auditEntry{
+		{"alice", "PutCell", "row", "BASE", 1},
+		{"", "PutRow", "row", "ADDRESS", 2},
+		{"bob", "DeleteRow", "row", "", 0},
+	}
+	if !reflect.DeepEqual(sink.entries, expected) {
+		t.Errorf("expected %v, got %v", expected, sink.entries)
+	}
+
+	// Buffered cells keep the actor of the PutCell.
+	sink = &recordingSink{}
+	batched := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: st.New()}}).WithAuditSink(sink).WithBatchWriter(10, time.Hour)
+	defer batched.Destroy(context.TODO())
+	err = batched.PutCell(ctx, "row", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.entries) != 0 {
+		t.Fatalf("expected nothing recorded before the flush, got %v", sink.entries)
+	}
+	err = batched.Flush(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []auditEntry{{"alice", "PutCell", "row", "BASE", 1}}
+	if !reflect.DeepEqual(sink.entries, expected) {
+		t.Errorf("expected %v, got %v", expected, sink.entries)
+	}
+}
+
+func TestAuditRowMutations(t *testing.T) {
+	var shards []core.Shard
+	for i := 0; i < 4; i++ {
+		shards = append(shards, core.Shard{Name: "test_shard" + strconv.Itoa(i), Backend: st.New()})
+	}
+	sink := &recordingSink{}
+	kv := New().WithSource(shards).WithAuditSink(sink)
+	defer kv.Destroy(context.TODO())
+
+	// A move within the shard of "copy", in one transaction, and one to
+	// another shard, copied and then deleted.
+	var sameShard, otherShard string
+	for i := 0; sameShard == "" || otherShard == ""; i++ {
+		key := "moved" + strconv.Itoa(i)
+		if ShardFor(key, len(shards)) == ShardFor("copy", len(shards)) {
+			if sameShard == "" {
+				sameShard = key
+			}
+		} else if otherShard == "" {
+			otherShard = key
+		}
+	}
+
+	err := kv.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithActor(context.TODO(), "alice")
+	_, err = kv.CopyRow(ctx, "row", "copy", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.MoveRow(ctx, "copy", sameShard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.MoveRow(ctx, sameShard, otherShard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kv.Import(ctx, strings.NewReader(`{"RowKey":"imported","ColumnName":"BASE","RefKey":1,"Body":"{}"}`+"\n"), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []auditEntry{
+		{"", "PutCell", "row", "BASE", 1},
+		{"alice", "CopyRow", "copy", "BASE", 1},
+		{"alice", "MoveRow", "copy", "", 0},
+		{"alice", "MoveRow", sameShard, "", 0},
+		{"alice", "MoveRow", sameShard, "", 0},
+		{"alice", "MoveRow", otherShard, "", 0},
+		{"alice", "Import", "imported", "BASE", 1},
+	}
+	if !reflect.DeepEqual(sink.entries, expected) {
+		t.Errorf("expected %v, got %v", expected, sink.entries)
+	}
+
+	backend := st.New()
+	sink = &recordingSink{}
+	repaired := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: backend}}).WithAuditSink(sink)
+	defer repaired.Destroy(context.TODO())
+
+	err = repaired.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing to repair is not recorded.
+	ctx = WithActor(context.TODO(), "bob")
+	_, err = repaired.Repair(ctx, "row", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"DROP INDEX uniqcell_idx",
+		`INSERT INTO cell ( row_key, column_name, ref_key, body, created_at ) VALUES('row', 'BASE', 1, '{}', datetime('now'))`,
+	} {
+		_, err = backend.Raw().Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = repaired.Repair(ctx, "row", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []auditEntry{
+		{"", "PutCell", "row", "BASE", 1},
+		{"bob", "Repair", "row", "BASE", 0},
+	}
+	if !reflect.DeepEqual(sink.entries, expected) {
+		t.Errorf("expected %v, got %v", expected, sink.entries)
+	}
+}
+
+func TestLocateRow(t *testing.T) {
+	var shards []core.Shard
+	backends := make(map[string]*st.Storage)
+	for i := 0; i < 4; i++ {
+		name := "test_shard" + strconv.Itoa(i)
+		backend := st.New()
+		backends[name] = backend
+		shards = append(shards, core.Shard{Name: name, Backend: backend})
+	}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	for i := 0; i < 20; i++ {
+		rowKey := "row" + strconv.Itoa(i)
+		loc := kv.LocateRow(rowKey)
+		if loc.Index < 0 || loc.Index >= len(shards) || shards[loc.Index].Name != loc.Name {
+			t.Fatalf("%s: index %d does not name shard %s", rowKey, loc.Index, loc.Name)
+		}
+
+		err := kv.PutCell(context.TODO(), rowKey, "BASE", 1, models.Cell{Body: "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, backend := range backends {
+			_, found, err := backend.GetCell(context.TODO(), rowKey, "BASE", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != (name == loc.Name) {
+				t.Errorf("%s: located on %s, but found=%v on %s", rowKey, loc.Name, found, name)
+			}
+		}
+	}
+}
+
+func TestPutCellIfAbsent(t *testing.T) {
+	for name, backend := range map[string]core.Storage{"inserter": st.New(), "fallback": plainStorage{st.New()}} {
+		kv := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: backend}})
+		defer kv.Destroy(context.TODO())
+
+		for i, body := range []string{`{"try":1}`, `{"try":2}`} {
+			inserted, err := kv.PutCellIfAbsent(context.TODO(), "row", "BASE", 1, models.Cell{Body: body})
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if inserted != (i == 0) {
+				t.Errorf("%s: write %d: expected inserted=%v, got %v", name, i, i == 0, inserted)
+			}
+		}
+
+		cell, found, err := kv.GetCellLatest(context.TODO(), "row", "BASE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || cell.RefKey != 1 || cell.Body != `{"try":1}` {
+			t.Errorf("%s: expected the first write to stand, got %v (found %v)", name, cell, found)
+		}
+	}
+}
+
+func TestPartitionReadResume(t *testing.T) {
+	backend := st.New()
+	kv := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: backend}})
+	defer kv.Destroy(context.TODO())
+	for i := 1; i <= 5; i++ {
+		err := kv.PutCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", 1, models.Cell{Body: "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, location := range []PartitionLocation{AddedAt, Cursor} {
+		var start interface{} = 0
+		if location == Cursor {
+			start = ""
+		}
+		token, err := kv.ResumeToken(0, location, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cells, token, err := kv.PartitionReadResume(context.TODO(), token, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cells) != 2 {
+			t.Fatalf("%s: expected 2 cells, got %v", location, cells)
+		}
+
+		// The job stops, and another process picks the token up from disk.
+		path := filepath.Join(t.TempDir(), "token")
+		err = ioutil.WriteFile(path, []byte(token), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restarted := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: backend}})
+		rest, next, err := restarted.PartitionReadResume(context.TODO(), string(saved), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rest) != 3 || rest[0].RowKey != "row3" {
+			t.Errorf("%s: expected to resume at row3, got %v", location, rest)
+		}
+
+		// At the end of the partition the token stays put.
+		none, again, err := restarted.PartitionReadResume(context.TODO(), next, 10)
+		if err != nil || len(none) != 0 || again != next {
+			t.Errorf("%s: expected no cells and the same token, got %v, %v", location, none, err)
+		}
+	}
+
+	token, err := kv.ResumeToken(0, AddedAt, int64(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := base64.RawURLEncoding.DecodeString(token)
+	var fields map[string]interface{}
+	json.Unmarshal(b, &fields)
+	fields["n"] = 99
+	b, _ = json.Marshal(fields)
+	_, _, err = kv.PartitionReadResume(context.TODO(), base64.RawURLEncoding.EncodeToString(b), 10)
+	if !errors.Is(err, ErrIncompatibleToken) {
+		t.Errorf("expected ErrIncompatibleToken for another version, got %v", err)
+	}
+
+	resharded := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: backend}, {Name: "test_shard1", Backend: st.New()}})
+	_, _, err = resharded.PartitionReadResume(context.TODO(), token, 10)
+	if !errors.Is(err, ErrIncompatibleToken) {
+		t.Errorf("expected ErrIncompatibleToken for another number of partitions, got %v", err)
+	}
+
+	_, _, err = kv.PartitionReadResume(context.TODO(), "not a token", 10)
+	if err == nil {
+		t.Error("expected an error for a malformed token")
+	}
+}
+
+func TestDefaultColumn(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	err := kv.Put(context.TODO(), "row", 1, models.Cell{Body: "{}"})
+	if err != ErrNoDefaultColumn {
+		t.Fatalf("expected ErrNoDefaultColumn, got %v", err)
+	}
+
+	kv.WithDefaultColumn("data")
+	err = kv.Put(context.TODO(), "row", 1, models.Cell{Body: `{"v":1}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Put(context.TODO(), "row", 2, models.Cell{Body: `{"v":2}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cell, found, err := kv.GetLatest(context.TODO(), "row")
+	if err != nil || !found || cell.Body != `{"v":2}` || cell.ColumnName != "data" {
+		t.Fatalf("expected the latest cell of the default column, got %v found=%v err=%v", cell, found, err)
+	}
+
+	// The explicit variants read the same column.
+	cell, found, err = kv.GetCell(context.TODO(), "row", "data", 1)
+	if err != nil || !found || cell.Body != `{"v":1}` {
+		t.Fatalf("expected the first version through GetCell, got %v found=%v err=%v", cell, found, err)
+	}
+}
+
+func TestColumnAllowlist(t *testing.T) {
+	kv := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: st.New()}}).WithColumnAllowlist([]string{"BASE", "ADDRESS"})
+	defer kv.Destroy(context.TODO())
+
+	err := kv.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatalf("expected BASE to be writable, got %v", err)
+	}
+
+	err = kv.PutCell(context.TODO(), "row", "BSAE", 1, models.Cell{Body: "{}"})
+	var notAllowed *ColumnNotAllowedError
+	if !errors.As(err, &notAllowed) || notAllowed.Column != "BSAE" {
+		t.Fatalf("expected a *ColumnNotAllowedError for BSAE, got %v", err)
+	}
+	err = kv.PutRow(context.TODO(), "row", map[string]models.Cell{"ADDRESS": {Body: "{}"}, "ADRESS": {Body: "{}"}}, 2)
+	if !errors.As(err, &notAllowed) || notAllowed.Column != "ADRESS" {
+		t.Fatalf("expected a *ColumnNotAllowedError for ADRESS, got %v", err)
+	}
+	columns, err := kv.ListColumns(context.TODO(), "row")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(columns, []string{"BASE"}) {
+		t.Errorf("expected only BASE to be written, got %v", columns)
+	}
+
+	// Without an allowlist any column goes.
+	kv.WithColumnAllowlist(nil)
+	err = kv.PutCell(context.TODO(), "row", "DYNAMIC_42", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatalf("expected any column to be writable, got %v", err)
+	}
+}
+
+// mapBlobStore is a BlobStore in memory.
+type mapBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+	puts  int
+}
+
+func (m *mapBlobStore) PutBlob(ctx context.Context, key string, body []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.blobs == nil {
+		m.blobs = make(map[string][]byte)
+	}
+	m.blobs[key] = body
+	m.puts++
+	return nil
+}
+
+func (m *mapBlobStore) GetBlob(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	body, ok := m.blobs[key]
+	if !ok {
+		return nil, fmt.Errorf("no blob %s", key)
+	}
+	return body, nil
+}
+
+func TestBlobStore(t *testing.T) {
+	backend := st.New()
+	blobs := &mapBlobStore{}
+	kv := New().WithSource([]core.Shard{{Name: "test_shard0", Backend: backend}}).WithBlobStore(blobs, 32)
+	defer kv.Destroy(context.TODO())
+
+	small := `{"name": "small"}`
+	large := `{"name": "large", "padding": "` + strings.Repeat("x", 64) + `"}`
+	err := kv.PutCell(context.TODO(), "row", "SMALL", 1, models.Cell{Body: small})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.PutCell(context.TODO(), "row", "LARGE", 1, models.Cell{Body: large, Metadata: map[string]string{"source": "test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobs.puts != 1 {
+		t.Fatalf("expected only the large body to be offloaded, got %d blobs", blobs.puts)
+	}
+
+	// The storage keeps the small body, and only a reference to the large.
+	stored, _, err := backend.GetCellLatest(context.TODO(), "row", "SMALL")
+	if err != nil || stored.Body != small {
+		t.Fatalf("expected the small body inline, got %q err=%v", stored.Body, err)
+	}
+	stored, _, err = backend.GetCellLatest(context.TODO(), "row", "LARGE")
+	if err != nil || stored.Body != "" || stored.Metadata[BlobMetadataKey] == "" {
+		t.Fatalf("expected a reference to the large body, got %v err=%v", stored, err)
+	}
+
+	for column, want := range map[string]string{"SMALL": small, "LARGE": large} {
+		cell, found, err := kv.GetCellLatest(context.TODO(), "row", column)
+		if err != nil || !found {
+			t.Fatalf("expected %s, got found=%v err=%v", column, found, err)
+		}
+		if cell.Body != want {
+			t.Errorf("expected %s to read back as %q, got %q", column, want, cell.Body)
+		}
+	}
+	cell, _, err := kv.GetCell(context.TODO(), "row", "LARGE", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cell.Metadata, map[string]string{"source": "test"}) {
+		t.Errorf("expected the blob key to be hidden from the metadata, got %v", cell.Metadata)
+	}
+
+	cells, _, err := kv.PartitionRead(context.TODO(), 0, "added_at", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 2 || cells[0].Body != small || cells[1].Body != large {
+		t.Errorf("expected both bodies from PartitionRead, got %v", cells)
+	}
+
+	// A body the blob store lost fails the read.
+	blobs.blobs = nil
+	_, _, err = kv.GetCellLatest(context.TODO(), "row", "LARGE")
+	if err == nil {
+		t.Error("expected an error reading a body missing from the blob store")
+	}
+}
+
+func TestShardReplicationFactor(t *testing.T) {
+	var replicas []*st.Storage
+	var shards []core.Shard
+	for i := 0; i < 3; i++ {
+		replica := st.New()
+		replicas = append(replicas, replica)
+		shards = append(shards, core.Shard{Name: "test_shard0_" + strconv.Itoa(i), Backend: replica})
+	}
+	ds := New().WithShardReplicationFactor(3).WithSource(shards)
+	defer ds.Destroy(context.TODO())
+
+	if shard := ds.LocateRow("row"); shard.Index != 0 || shard.Name != "test_shard0_0" {
+		t.Fatalf("expected the logical shard of the first replica, got %+v", shard)
+	}
+	err := ds.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last replica may be written after PutCell returned.
+	for _, replica := range replicas {
+		waitForCell(t, replica, "row", "BASE", 1)
+	}
+
+	// A quorum write that the first replica missed.
+	for _, replica := range replicas[1:] {
+		err = replica.PutCell(context.TODO(), "row", "BASE", 2, models.Cell{Body: "second"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		cell, found, err := ds.GetCellLatest(context.TODO(), "row", "BASE")
+		if err != nil || !found {
+			t.Fatalf("expected a cell, got found=%v err=%v", found, err)
+		}
+		if cell.RefKey != 2 || cell.Body != "second" {
+			t.Fatalf("expected the quorum read to return the latest version, got %d %s", cell.RefKey, cell.Body)
+		}
+	}
+
+	err = ds.PutCell(context.TODO(), "row", "BASE", 2, models.Cell{Body: "again"})
+	if !errors.Is(err, models.ErrCellExists) {
+		t.Fatalf("expected ErrCellExists, got %v", err)
+	}
+}
+
+// waitForCell waits for a cell to reach replica, failing after 5 seconds.
+func waitForCell(t *testing.T, replica core.Storage, rowKey string, columnKey string, refKey int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, found, err := replica.GetCell(context.TODO(), rowKey, columnKey, refKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the replica to have %s/%s/%d", rowKey, columnKey, refKey)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stuckReplica holds its writes until release is closed, and panics on
+// reads and writes if panics is set.
+type stuckReplica struct {
+	*st.Storage
+	release chan struct{}
+	panics  bool
+}
+
+func (s *stuckReplica) PutCell(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) error {
+	if s.panics {
+		panic("replica write")
+	}
+	<-s.release
+	return s.Storage.PutCell(ctx, rowKey, columnKey, refKey, cell)
+}
+
+func (s *stuckReplica) GetCellLatest(ctx context.Context, rowKey string, columnKey string) (models.Cell, bool, error) {
+	if s.panics {
+		panic("replica read")
+	}
+	return s.Storage.GetCellLatest(ctx, rowKey, columnKey)
+}
+
+func TestReplicaQuorumWrite(t *testing.T) {
+	stuck := &stuckReplica{Storage: st.New(), release: make(chan struct{})}
+	shards := []core.Shard{
+		{Name: "test_shard0_0", Backend: st.New()},
+		{Name: "test_shard0_1", Backend: st.New()},
+		{Name: "test_shard0_2", Backend: stuck},
+	}
+	ds := New().WithShardReplicationFactor(3).WithSource(shards)
+	defer ds.Destroy(context.TODO())
+
+	// The write returns once a quorum acknowledged it, and reaches the
+	// stuck replica after its caller is gone.
+	ctx, cancel := context.WithCancel(context.TODO())
+	err := ds.PutCell(ctx, "row", "BASE", 1, models.Cell{Body: "{}"})
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(stuck.release)
+	waitForCell(t, stuck.Storage, "row", "BASE", 1)
+}
+
+func TestReplicaRecover(t *testing.T) {
+	shards := []core.Shard{
+		{Name: "test_shard0_0", Backend: st.New()},
+		{Name: "test_shard0_1", Backend: st.New()},
+		{Name: "test_shard0_2", Backend: &stuckReplica{Storage: st.New(), panics: true}},
+	}
+	ds := New().WithShardReplicationFactor(3).WithReplicaConsistency(ConsistencyAll, ConsistencyQuorum).WithSource(shards).WithRecover()
+	defer ds.Destroy(context.TODO())
+
+	err := ds.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatalf("expected the quorum write to survive the panic of a replica, got %v", err)
+	}
+	_, _, err = ds.GetCellLatest(context.TODO(), "row", "BASE")
+	if !errors.Is(err, ErrQuorum) || !strings.Contains(err.Error(), core.ErrPanic.Error()) {
+		t.Fatalf("expected ErrQuorum for the panic of a replica, got %v", err)
+	}
+}
+
+func TestPartitionLatestPerRow(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	versions := map[string]int{"row_a": 4, "row_b": 1, "row_c": 6}
+	for rowKey, n := range versions {
+		for refKey := 1; refKey <= n; refKey++ {
+			// Versions alternate between two columns of the row.
+			column := "BASE"
+			if refKey%2 == 0 {
+				column = "PROFILE"
+			}
+			err := kv.PutCell(context.TODO(), rowKey, column, int64(refKey), models.Cell{Body: "{}"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	cells, err := kv.PartitionLatestPerRow(context.TODO(), 0, 2, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, cell := range cells {
+		got = append(got, cell.RowKey+"/"+cell.ColumnName+"/"+strconv.FormatInt(cell.RefKey, 10))
+	}
+	want := []string{"row_a/PROFILE/4", "row_a/BASE/3", "row_b/BASE/1", "row_c/PROFILE/6", "row_c/BASE/5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the 2 latest versions per row %v, got %v", want, got)
+	}
+
+	cells, err = kv.PartitionLatestPerRow(context.TODO(), 0, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 3 {
+		t.Fatalf("expected the limit to cap the cells at 3, got %d", len(cells))
+	}
+}
+
+func TestPartitionReadCorrelation(t *testing.T) {
+	shards := []core.Shard{{Name: "test_shard0", Backend: st.New()}}
+	kv := New().WithSource(shards)
+	defer kv.Destroy(context.TODO())
+
+	// An order is placed, which causes it to be paid, all as one request;
+	// another order is placed by another request.
+	ctx := models.WithCorrelationID(context.TODO(), "request-1")
+	err := kv.PutCell(models.WithCausationID(ctx, "command-1"), "order_1", "PLACED", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paid := models.Cell{Body: "{}"}.WithLineage("order_1/PLACED/1", "")
+	err = kv.PutCell(ctx, "order_1", "PAID", 1, paid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := models.Cell{Body: "{}"}.WithLineage("command-2", "request-2")
+	err = kv.PutCell(ctx, "order_2", "PLACED", 1, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cells, found, err := kv.PartitionReadCorrelation(context.TODO(), 0, "request-1", "added_at", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(cells) != 2 {
+		t.Fatalf("expected the 2 cells of request-1, got %v", cells)
+	}
+	want := map[string]string{"PLACED": "command-1", "PAID": "order_1/PLACED/1"}
+	for _, cell := range cells {
+		if cell.RowKey != "order_1" || cell.CorrelationID != "request-1" {
+			t.Fatalf("expected a cell of order_1 correlated to request-1, got %+v", cell)
+		}
+		if cell.CausationID != want[cell.ColumnName] {
+			t.Fatalf("expected %s to be caused by %q, got %q", cell.ColumnName, want[cell.ColumnName], cell.CausationID)
+		}
+	}
+
+	cell, found, err := kv.GetCell(context.TODO(), "order_2", "PLACED", 1)
+	if err != nil || !found {
+		t.Fatalf("expected order_2/PLACED/1, got %v, %v", found, err)
+	}
+	if cell.CausationID != "command-2" || cell.CorrelationID != "request-2" {
+		t.Fatalf("expected the cell's own ids to win over those of the context, got %+v", cell)
+	}
+	if len(cell.Metadata) != 0 {
+		t.Errorf("expected the ids in columns of their own, not the metadata, got %v", cell.Metadata)
+	}
+}
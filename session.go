@@ -0,0 +1,100 @@
+package schemaless
+
+import (
+	"context"
+	"errors"
+	"github.com/rbastic/go-schemaless/models"
+	"sync"
+	"time"
+)
+
+// ErrStaleRead is returned by Session.Get when the storage has not caught
+// up with the session's writes within the session's maximum wait.
+var ErrStaleRead = errors.New("read did not observe the session's writes in time")
+
+const (
+	sessionMinPoll = 5 * time.Millisecond
+	sessionMaxPoll = 100 * time.Millisecond
+)
+
+// Session gives its caller read-your-writes consistency over a DataStore
+// whose reads may lag its writes, e.g. rqlite at a weak or none consistency
+// level, without making every read strong. Each Put records the ref key it
+// wrote as the session's token for that cell, and a Get of the cell waits
+// until the storage returns a version at least that recent.
+//
+// A Session keeps a token for every cell it wrote, so it is meant to live
+// as long as a request or a user session, not for the life of the process.
+// It is safe for concurrent use.
+type Session struct {
+	ds      *DataStore
+	maxWait time.Duration
+
+	mu     sync.Mutex
+	tokens map[sessionKey]int64
+}
+
+type sessionKey struct{ rowKey, columnKey string }
+
+// NewSession returns a Session whose reads wait at most maxWait for the
+// storage to catch up with its writes.
+func (ds *DataStore) NewSession(maxWait time.Duration) *Session {
+	return &Session{ds: ds, maxWait: maxWait, tokens: make(map[sessionKey]int64)}
+}
+
+// Put writes cell like PutCell, bypassing the batch writer if there is one
+// so that the session can read it back, and records refKey as the token of
+// the cell.
+func (s *Session) Put(ctx context.Context, rowKey string, columnKey string, refKey int64, cell models.Cell) error {
+	refKey, err := s.ds.prepareWrite(columnKey, refKey, cell)
+	if err != nil {
+		return err
+	}
+	err = s.ds.putCell(ctx, rowKey, columnKey, refKey, cell)
+	if err != nil {
+		return err
+	}
+
+	key := sessionKey{rowKey, columnKey}
+	s.mu.Lock()
+	if refKey > s.tokens[key] {
+		s.tokens[key] = refKey
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// Get reads the latest version of a cell like GetCellLatest. If the session
+// wrote the cell, Get polls until the version read is at least as recent as
+// the session's write, and fails with ErrStaleRead if that takes longer
+// than the session's maximum wait.
+func (s *Session) Get(ctx context.Context, rowKey string, columnKey string) (models.Cell, bool, error) {
+	s.mu.Lock()
+	token, ok := s.tokens[sessionKey{rowKey, columnKey}]
+	s.mu.Unlock()
+	if !ok {
+		return s.ds.GetCellLatest(ctx, rowKey, columnKey)
+	}
+
+	deadline := time.Now().Add(s.maxWait)
+	poll := sessionMinPoll
+	for {
+		cell, found, err := s.ds.GetCellLatest(ctx, rowKey, columnKey)
+		if err != nil || (found && cell.RefKey >= token) {
+			return cell, found, err
+		}
+		if time.Now().Add(poll).After(deadline) {
+			return models.Cell{}, false, ErrStaleRead
+		}
+
+		select {
+		case <-ctx.Done():
+			return models.Cell{}, false, ctx.Err()
+		case <-time.After(poll):
+		}
+		poll *= 2
+		if poll > sessionMaxPoll {
+			poll = sessionMaxPoll
+		}
+	}
+}
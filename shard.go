@@ -0,0 +1,81 @@
+package schemaless
+
+// ShardFor returns the index of the shard, out of shardCount, that a
+// DataStore places rowKey on. Migration tooling can use it to precompute
+// placement without building a DataStore.
+//
+// The row key is hashed with the 64-bit Metro hash (seed 0) and the hash is
+// mapped to a shard with Jump Consistent Hash (Lamping and Veach, 2014), so
+// growing shardCount by one moves only 1/shardCount of the rows. Uber never
+// published the exact hash of its Schemaless; this is the placement of this
+// package, as it has been since it was written with go-shardedkv's jump
+// chooser.
+func ShardFor(rowKey string, shardCount int) int {
+	return int(jumpHash(hash64([]byte(rowKey)), shardCount))
+}
+
+func jumpHash(key uint64, numBuckets int) int32 {
+	var b int64 = -1
+	var j int64
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int32(b)
+}
+
+// ShardKeyFunc derives the key a row is placed by from its row key, e.g.
+// the tenant id embedded in it. It must be deterministic.
+type ShardKeyFunc func(rowKey string) string
+
+// WithShardKeyFunc places each row on the shard ShardFor(fn(rowKey)) picks,
+// instead of ShardFor(rowKey), so that related rows can be kept together.
+// fn only sees the row key, so all the cells of a row still share a shard.
+//
+// Call it before WithSource and WithTarget. Changing fn for a store that
+// already holds data makes its rows unreachable until they are migrated.
+func (ds *DataStore) WithShardKeyFunc(fn ShardKeyFunc) *DataStore {
+	ds.shardKey = fn
+	return ds
+}
+
+// shardChooser is the core.Chooser of a DataStore, built on ShardFor.
+type shardChooser struct {
+	buckets []string
+	key     ShardKeyFunc
+}
+
+func (c *shardChooser) SetBuckets(buckets []string) error {
+	c.buckets = buckets
+	return nil
+}
+
+func (c *shardChooser) Choose(key string) string {
+	if c.key != nil {
+		key = c.key(key)
+	}
+	return c.buckets[ShardFor(key, len(c.buckets))]
+}
+
+func (c *shardChooser) Buckets() []string {
+	return c.buckets
+}
+
+// ShardInfo is where a row lives.
+type ShardInfo struct {
+	// Index is the position of the shard in the list of shards the
+	// DataStore was given.
+	Index int
+	// Name is the name the shard was given, see core.Shard, which is how
+	// deployments tell its endpoint.
+	Name string
+}
+
+// LocateRow returns the shard rowKey maps to under the current topology,
+// without querying it: the shard PutCell writes the row to, which during a
+// migration is the shard of the new topology.
+func (ds *DataStore) LocateRow(rowKey string) ShardInfo {
+	name, index := ds.source.Locate(ds.physicalKey(rowKey))
+	return ShardInfo{Index: index, Name: name}
+}
@@ -0,0 +1,69 @@
+package schemaless
+
+import (
+	"context"
+	"github.com/rbastic/go-schemaless/models"
+	"golang.org/x/sync/singleflight"
+	"strconv"
+)
+
+// WithSingleflight makes concurrent GetCell calls for the same cell, and
+// concurrent GetCellLatest calls for the same row and column, share a single
+// storage call, as long as scope returns the same for their contexts. scope
+// must capture everything on a context that changes what a read returns,
+// e.g. the tenant a storage's table resolver picks or an rqlite
+// consistency override, or reads of one tenant get the cells of another.
+// Use a scope returning "" only if contexts carry nothing of the kind.
+//
+// The shared call runs under the values of the context of the caller that
+// started it, but is not canceled with it: each caller waits for the result
+// until its own context is done, and only then fails.
+func (ds *DataStore) WithSingleflight(scope func(ctx context.Context) string) *DataStore {
+	if scope == nil {
+		panic("WithSingleflight: scope must not be nil")
+	}
+	ds.flight = &singleflight.Group{}
+	ds.flightScope = scope
+	return ds
+}
+
+type flightResult struct {
+	cell  models.Cell
+	found bool
+}
+
+// coalesce runs fn, or joins a run of it in flight for the same key and
+// scope of ctx. fn gets ctx detached from its cancellation.
+func (ds *DataStore) coalesce(ctx context.Context, key string, fn func(ctx context.Context) (models.Cell, bool, error)) (models.Cell, bool, error) {
+	key = ds.flightScope(ctx) + "\x00" + key
+	shared := context.WithoutCancel(ctx)
+	ch := ds.flight.DoChan(key, func() (interface{}, error) {
+		cell, found, err := fn(shared)
+		return flightResult{cell, found}, err
+	})
+	select {
+	case res := <-ch:
+		v := res.Val.(flightResult)
+		return v.cell, v.found, res.Err
+	case <-ctx.Done():
+		return models.Cell{}, false, ctx.Err()
+	}
+}
+
+func (ds *DataStore) getCellShared(ctx context.Context, rowKey string, columnKey string, refKey int64) (models.Cell, bool, error) {
+	key := "GetCell\x00" + rowKey + "\x00" + columnKey + "\x00" + strconv.FormatInt(refKey, 10)
+	return ds.coalesce(ctx, key, func(ctx context.Context) (models.Cell, bool, error) {
+		cell, found, err := ds.source.GetCell(ctx, ds.physicalKey(rowKey), columnKey, refKey)
+		cell, err = ds.fetchBlob(ctx, cell, err)
+		return ds.logicalCell(cell), found, err
+	})
+}
+
+func (ds *DataStore) getCellLatestShared(ctx context.Context, rowKey string, columnKey string) (models.Cell, bool, error) {
+	key := "GetCellLatest\x00" + rowKey + "\x00" + columnKey
+	return ds.coalesce(ctx, key, func(ctx context.Context) (models.Cell, bool, error) {
+		cell, found, err := ds.source.GetCellLatest(ctx, ds.physicalKey(rowKey), columnKey)
+		cell, err = ds.fetchBlob(ctx, cell, err)
+		return ds.logicalCell(cell), found, err
+	})
+}
@@ -0,0 +1,34 @@
+package schemaless
+
+import (
+	"fmt"
+	"time"
+)
+
+// WithSlowQueryThreshold logs a warning for every storage call that takes
+// longer than d, naming the operation and a hash of the row key, so that the
+// key itself never ends up in the logs. Calls under d are not logged.
+func (ds *DataStore) WithSlowQueryThreshold(d time.Duration) *DataStore {
+	ds.slowQuery = d
+	return ds
+}
+
+// observeSlow is deferred by each storage call with the time it started.
+func (ds *DataStore) observeSlow(op string, rowKey string, start time.Time) {
+	if ds.slowQuery <= 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	if elapsed <= ds.slowQuery {
+		return
+	}
+	ds.logger().Warnw("slow query", "op", op, "rowKeyHash", sanitizeKey(rowKey), "elapsed", elapsed, "threshold", ds.slowQuery)
+}
+
+// sanitizeKey stands in for a row key in logs.
+func sanitizeKey(rowKey string) string {
+	if rowKey == "" {
+		return ""
+	}
+	return fmt.Sprintf("%016x", hash64([]byte(rowKey)))
+}
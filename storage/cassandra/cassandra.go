@@ -0,0 +1,409 @@
+// Package cassandra is a Cassandra/Scylla-backed Schemaless store.
+//
+// The cell table is keyed by ((row_key), column_name, ref_key), so every
+// version of every column of a row lives in a single partition, clustered
+// with the highest ref_key first. See cell.cql for the schema.
+//
+// Cassandra cannot order a table by anything but its partition tokens, so
+// PartitionRead walks the token ring of the cell table a range of
+// token(row_key) at a time, keeping the cells after the location it was
+// given. It reads every row of the table, so it suits small tables and
+// offline jobs, not a feed read on every request.
+package cassandra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gocql/gocql"
+	"github.com/rbastic/go-schemaless/internal/teardown"
+	"github.com/rbastic/go-schemaless/models"
+	"go.uber.org/zap"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Storage is a Cassandra-backed storage.
+type Storage struct {
+	hosts    []string
+	keyspace string
+
+	session *gocql.Session
+	Sugar   *zap.SugaredLogger
+	// logResults enables logging every cell a read returns
+	logResults bool
+	// loggerKey is the context key of a request-scoped logger
+	loggerKey interface{}
+
+	closer teardown.Once
+}
+
+const (
+	timeParseString = "2006-01-02 15:04:05"
+	// This space intentionally left blank for facilitating vimdiff
+	// acrosss storages.
+
+	getCellCQL       = "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell WHERE row_key = ? AND column_name = ? AND ref_key = ? LIMIT 1"
+	getCellLatestCQL = "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell WHERE row_key = ? AND column_name = ? LIMIT 1"
+	// Rows come back in token order, not that of the location: PartitionRead
+	// reads the ring a range at a time and sorts what it finds.
+	getCellsForTokenRangeCQL = "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell WHERE token(row_key) > ? AND token(row_key) <= ?"
+	putCellCQL               = "INSERT INTO cell ( added_at, row_key, column_name, ref_key, body, created_at ) VALUES(?, ?, ?, ?, ?, ?) IF NOT EXISTS"
+	getSequenceCQL           = "SELECT next FROM cell_sequence WHERE name = 'added_at'"
+	initSequenceCQL          = "INSERT INTO cell_sequence ( name, next ) VALUES('added_at', 1) IF NOT EXISTS"
+	claimSequenceCQL         = "UPDATE cell_sequence SET next = ? WHERE name = 'added_at' IF next = ?"
+
+	// scanPageSize is the number of rows PartitionRead fetches at a time.
+	scanPageSize = 1000
+	// tokenRanges is the number of ranges PartitionRead splits the ring of
+	// Murmur3 tokens into, reading one after the other.
+	tokenRanges = 16
+)
+
+// New returns a new cassandra-backed Storage
+func New() *Storage {
+	return &Storage{}
+}
+
+func (s *Storage) WithZap() error {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	sug := logger.Sugar()
+	s.Sugar = sug
+	return nil
+}
+
+func (s *Storage) WithHosts(hosts ...string) *Storage {
+	s.hosts = hosts
+	return s
+}
+
+func (s *Storage) WithKeyspace(keyspace string) *Storage {
+	s.keyspace = keyspace
+	return s
+}
+
+func (s *Storage) Open() error {
+	cluster := gocql.NewCluster(s.hosts...)
+	cluster.Keyspace = s.keyspace
+	// Reads and writes both at QUORUM gives us read-your-writes.
+	cluster.Consistency = gocql.Quorum
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return err
+	}
+	s.session = session
+	return nil
+}
+
+// WithResultLogging logs every cell a read returns, with its body, at Info.
+// It is off by default: a partition read can return thousands of cells, and
+// their bodies may hold personal data. Operations are logged either way.
+func (s *Storage) WithResultLogging(enabled bool) *Storage {
+	s.logResults = enabled
+	return s
+}
+
+// WithContextLogger makes s log to the *zap.SugaredLogger stored in the
+// context of each call under key, so that its logs carry the fields of the
+// request it serves. Calls whose context holds no logger under key log to
+// the logger of s.
+func (s *Storage) WithContextLogger(key interface{}) *Storage {
+	s.loggerKey = key
+	return s
+}
+
+// logger returns the logger of ctx (see WithContextLogger), or else that
+// of s, tagged with the shard that ctx was dispatched to. Calls that
+// sampling left out (see models.WithSampled) only log warnings and errors.
+func (s *Storage) logger(ctx context.Context) *zap.SugaredLogger {
+	sugar := s.Sugar
+	if s.loggerKey != nil {
+		if l, ok := ctx.Value(s.loggerKey).(*zap.SugaredLogger); ok && l != nil {
+			sugar = l
+		}
+	}
+	if sampled, ok := models.SampledFromContext(ctx); ok && !sampled {
+		sugar = sugar.Desugar().WithOptions(zap.IncreaseLevel(zap.WarnLevel)).Sugar()
+	}
+	return sugar.With("shard", models.ShardFromContext(ctx))
+}
+
+// logResult logs a cell a read returned, if result logging is enabled.
+func (s *Storage) logResult(ctx context.Context, msg string, keysAndValues ...interface{}) {
+	if s.logResults {
+		s.logger(ctx).Infow(msg, keysAndValues...)
+	}
+}
+
+func (s *Storage) GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      string
+		resCreatedAt time.Time
+	)
+	s.logger(ctx).Infow("GetCell", "query", getCellCQL, "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey)
+	err = s.session.Query(getCellCQL, rowKey, columnKey, refKey).WithContext(ctx).
+		Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt)
+	if err == gocql.ErrNotFound {
+		return cell, false, nil
+	}
+	if err != nil {
+		return
+	}
+	s.logResult(ctx, "GetCell scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+
+	cell.AddedAt = resAddedAt
+	cell.RowKey = resRowKey
+	cell.ColumnName = resColName
+	cell.RefKey = resRefKey
+	cell.Body = resBody
+	cell.CreatedAt = &resCreatedAt
+
+	return cell, true, nil
+}
+
+// GetCellLatest relies on the clustering order of the cell table (ref_key
+// DESC): the first row of the (row_key, column_name) slice is the latest.
+func (s *Storage) GetCellLatest(ctx context.Context, rowKey, columnKey string) (cell models.Cell, found bool, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      string
+		resCreatedAt time.Time
+	)
+	s.logger(ctx).Infow("GetCellLatest", "query", getCellLatestCQL, "rowKey", rowKey, "columnKey", columnKey)
+	err = s.session.Query(getCellLatestCQL, rowKey, columnKey).WithContext(ctx).
+		Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt)
+	if err == gocql.ErrNotFound {
+		return cell, false, nil
+	}
+	if err != nil {
+		return
+	}
+	s.logResult(ctx, "GetCellLatest scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+
+	cell.AddedAt = resAddedAt
+	cell.RowKey = resRowKey
+	cell.ColumnName = resColName
+	cell.RefKey = resRefKey
+	cell.Body = resBody
+	cell.CreatedAt = &resCreatedAt
+
+	return cell, true, nil
+}
+
+func (s *Storage) PartitionRead(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      string
+		resCreatedAt time.Time
+
+		afterCreatedAt *time.Time
+		afterAddedAt   int64
+	)
+
+	switch location {
+	case "timestamp":
+		fallthrough
+	case "created_at":
+		var t time.Time
+		switch value.(type) {
+		case *time.Time:
+			t = *value.(*time.Time)
+		case time.Time:
+			t = value.(time.Time)
+		case string:
+			t, err = time.ParseInLocation(timeParseString, value.(string), time.UTC)
+			if err != nil {
+				err = fmt.Errorf("PartitionRead could not parse time string:'%v': %s", value, err)
+				return
+			}
+		default:
+			err = fmt.Errorf("PartitionRead had unrecognized type %v", reflect.TypeOf(value))
+			return
+		}
+		afterCreatedAt = &t
+	case "added_at":
+		afterAddedAt, err = models.AddedAtValue(value)
+		if err != nil {
+			return
+		}
+	default:
+		err = errors.New("PartitionRead had unrecognized location " + location)
+		return
+	}
+
+	// Keep the limit lowest cells in location order, trimming as the scan
+	// goes rather than holding the whole table.
+	less := func(a, b models.Cell) bool {
+		if afterCreatedAt != nil && !a.CreatedAt.Equal(*b.CreatedAt) {
+			return a.CreatedAt.Before(*b.CreatedAt)
+		}
+		if a.AddedAt != b.AddedAt {
+			return a.AddedAt < b.AddedAt
+		}
+		if a.RowKey != b.RowKey {
+			return a.RowKey < b.RowKey
+		}
+		if a.ColumnName != b.ColumnName {
+			return a.ColumnName < b.ColumnName
+		}
+		return a.RefKey < b.RefKey
+	}
+	trim := func() {
+		sort.Slice(cells, func(i, j int) bool { return less(cells[i], cells[j]) })
+		if len(cells) > limit {
+			cells = cells[:limit]
+		}
+	}
+
+	// The Storage holds a single shard, as the other storages do, so
+	// partitionNumber only names it: the scan covers its whole ring.
+	for i := 0; i < tokenRanges; i++ {
+		lo, hi := tokenRange(i)
+		s.logger(ctx).Infow("PartitionRead", "query", getCellsForTokenRangeCQL, "from", lo, "to", hi, "location", location, "value", value)
+		iter := s.session.Query(getCellsForTokenRangeCQL, lo, hi).WithContext(ctx).PageSize(scanPageSize).Iter()
+
+		for iter.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt) {
+			after := resAddedAt > afterAddedAt
+			if afterCreatedAt != nil {
+				after = resCreatedAt.After(*afterCreatedAt)
+			}
+			if !after {
+				continue
+			}
+			s.logResult(ctx, "PartitionRead: scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+
+			createdAt := resCreatedAt
+			var cell models.Cell
+			cell.AddedAt = resAddedAt
+			cell.RowKey = resRowKey
+			cell.ColumnName = resColName
+			cell.RefKey = resRefKey
+			cell.Body = resBody
+			cell.CreatedAt = &createdAt
+			cells = append(cells, cell)
+			if len(cells) >= 2*limit+scanPageSize {
+				trim()
+			}
+		}
+
+		err = iter.Close()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	trim()
+
+	return cells, len(cells) > 0, nil
+}
+
+// tokenRange returns the bounds of the i-th of tokenRanges ranges of the
+// Murmur3 token ring, exclusive of lo and inclusive of hi. The ring starts
+// after math.MinInt64, which no row key hashes to.
+func tokenRange(i int) (lo int64, hi int64) {
+	step := uint64(math.MaxUint64) / tokenRanges
+	lo = int64(uint64(1<<63) + uint64(i)*step)
+	if i == tokenRanges-1 {
+		return lo, math.MaxInt64
+	}
+	return lo, int64(uint64(1<<63) + uint64(i+1)*step)
+}
+
+// PutCell writes a cell with a lightweight transaction, so an existing
+// (row_key, column_name, ref_key) is never overwritten. Cassandra has no
+// auto-increment, so added_at comes from the cell_sequence table (see
+// nextAddedAt): it is unique, but, as with concurrent transactions in the
+// SQL storages, cells of different writers may become visible out of
+// added_at order.
+func (s *Storage) PutCell(ctx context.Context, rowKey, columnKey string, refKey int64, cell models.Cell) (err error) {
+	now := time.Now()
+	var addedAt int64
+	addedAt, err = s.nextAddedAt(ctx)
+	if err != nil {
+		return
+	}
+
+	s.logger(ctx).Infow("PutCell", "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey, "Body", cell.Body)
+	existing := make(map[string]interface{})
+	var applied bool
+	applied, err = s.session.Query(putCellCQL, addedAt, rowKey, columnKey, refKey, cell.Body, cell.CreatedAtOr(now)).WithContext(ctx).MapScanCAS(existing)
+	if err != nil {
+		return
+	}
+	if !applied {
+		return models.ErrCellExists
+	}
+	s.logger(ctx).Infof("added_at = %d\n", addedAt)
+	return
+}
+
+// nextAddedAt claims the next added_at from the cell_sequence table with a
+// lightweight transaction. Values are claimed one write at a time, not in
+// blocks per Storage, so that writers hand them out in the order they claim
+// them and Tail and added_at paging do not skip the cells of one writer
+// whose block is behind another's.
+func (s *Storage) nextAddedAt(ctx context.Context) (int64, error) {
+	for {
+		var next int64
+		err := s.session.Query(getSequenceCQL).WithContext(ctx).Scan(&next)
+		if err == gocql.ErrNotFound {
+			_, err = s.session.Query(initSequenceCQL).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		applied, err := s.session.Query(claimSequenceCQL, next+1, next).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+		if err != nil {
+			return 0, err
+		}
+		if applied {
+			return next, nil
+		}
+	}
+}
+
+// ResetConnection does nothing, gocql manages its own connection pool.
+func (s *Storage) ResetConnection(ctx context.Context, key string) error {
+	return nil
+}
+
+// Raw returns the underlying *gocql.Session, nil until Open; queries
+// through it bypass the Storage, see core.Storage.
+func (s *Storage) Raw() *gocql.Session {
+	return s.session
+}
+
+// Destroy flushes the logger and closes the session, giving up once ctx is
+// done.
+func (s *Storage) Destroy(ctx context.Context) error {
+	return teardown.Run(ctx, s.Sugar, func() error {
+		s.session.Close()
+		return nil
+	})
+}
+
+// Close implements io.Closer. It releases the connection as Destroy does,
+// and is safe to call more than once.
+func (s *Storage) Close() error {
+	return s.closer.Close(s.Destroy)
+}
@@ -0,0 +1,36 @@
+package cassandra
+
+import (
+	"github.com/rbastic/go-schemaless/storagetest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCassandra(t *testing.T) {
+	// The keyspace is expected to already contain the table from cell.cql.
+	hosts := os.Getenv("CASSANDRA_HOSTS")
+	if hosts == "" {
+		t.Skip("Please specify CASSANDRA_HOSTS=... to run the Cassandra tests")
+	}
+	keyspace := os.Getenv("KEYSPACE")
+	if keyspace == "" {
+		keyspace = "user0"
+	}
+
+	m := New().WithHosts(strings.Split(hosts, ",")...).
+		WithKeyspace(keyspace)
+
+	err := m.WithZap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Sugar.Sync()
+
+	err = m.Open()
+	if err != nil {
+		t.Skipf("Cassandra is unavailable: %s", err)
+	}
+	storagetest.StorageTest(t, m)
+}
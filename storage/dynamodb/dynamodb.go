@@ -0,0 +1,554 @@
+// Package dynamodb is a DynamoDB-backed Schemaless store.
+//
+// Cells live in a single table with a partition key 'pk' of
+// "row_key#column_name" and a numeric sort key 'sk' holding the ref key, so
+// all versions of a cell are one item collection. Two global secondary
+// indexes, keyed by 'gsi_pk' and sorted by created_at and added_at
+// respectively, serve PartitionRead. 'gsi_pk' spreads the cells over a
+// number of index partitions (see WithIndexShards), which PartitionRead
+// queries and merges. added_at is taken from an atomic counter item of the
+// table, the sequence of the shard. See CreateTable for the expected layout.
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rbastic/go-schemaless/internal/teardown"
+	"github.com/rbastic/go-schemaless/models"
+	"go.uber.org/zap"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Storage is a DynamoDB-backed storage.
+type Storage struct {
+	table    string
+	region   string
+	endpoint string
+	// indexShards is the number of partitions of the secondary indexes
+	indexShards int
+
+	client *dynamodb.Client
+	Sugar  *zap.SugaredLogger
+	// logResults enables logging every cell a read returns
+	logResults bool
+	// loggerKey is the context key of a request-scoped logger
+	loggerKey interface{}
+
+	closer teardown.Once
+}
+
+const (
+	timeParseString = "2006-01-02 15:04:05"
+	defaultTable    = "cell"
+
+	// gsiPartition prefixes the partition key values of both secondary
+	// indexes, "cell#0" to "cell#15" with the default index shards.
+	gsiPartition       = "cell"
+	defaultIndexShards = 16
+	createdAtIndex     = "created_at-index"
+	addedAtIndex       = "added_at-index"
+
+	// sequenceKey is the partition key of the item holding the added_at
+	// sequence. The partition key of a cell always holds a '#', so none
+	// can clash with it.
+	sequenceKey = "sequence"
+
+	// maxItemSize is DynamoDB's hard limit on the size of an item.
+	maxItemSize = 400 * 1024
+)
+
+// ErrBodyTooLarge is returned by PutCell when a cell would not fit within
+// DynamoDB's item size limit.
+var ErrBodyTooLarge = errors.New("cell body exceeds the DynamoDB item size limit")
+
+// New returns a new DynamoDB-backed Storage
+func New() *Storage {
+	return &Storage{table: defaultTable, indexShards: defaultIndexShards}
+}
+
+func (s *Storage) WithZap() error {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	sug := logger.Sugar()
+	s.Sugar = sug
+	return nil
+}
+
+func (s *Storage) WithTable(table string) *Storage {
+	s.table = table
+	return s
+}
+
+func (s *Storage) WithRegion(region string) *Storage {
+	s.region = region
+	return s
+}
+
+// WithIndexShards sets the number of partitions the secondary indexes are
+// spread over, 16 by default, so that index writes do not all land on one
+// partition. PartitionRead queries each of them. It must not change once
+// cells are written; n below 1 is taken as 1.
+func (s *Storage) WithIndexShards(n int) *Storage {
+	if n < 1 {
+		n = 1
+	}
+	s.indexShards = n
+	return s
+}
+
+// WithEndpoint overrides the service endpoint, e.g. for DynamoDB Local.
+func (s *Storage) WithEndpoint(endpoint string) *Storage {
+	s.endpoint = endpoint
+	return s
+}
+
+// Open loads the AWS configuration from the environment and creates the
+// client.
+func (s *Storage) Open() error {
+	var opts []func(*config.LoadOptions) error
+	if s.region != "" {
+		opts = append(opts, config.WithRegion(s.region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return err
+	}
+
+	s.client = dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if s.endpoint != "" {
+			o.BaseEndpoint = aws.String(s.endpoint)
+		}
+	})
+	return nil
+}
+
+// CreateTable creates the cell table and its indexes, for development and
+// testing against DynamoDB Local.
+func (s *Storage) CreateTable(ctx context.Context) error {
+	projection := &types.Projection{ProjectionType: types.ProjectionTypeAll}
+	_, err := s.client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName:   aws.String(s.table),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("pk"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("sk"), AttributeType: types.ScalarAttributeTypeN},
+			{AttributeName: aws.String("gsi_pk"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("created_at"), AttributeType: types.ScalarAttributeTypeN},
+			{AttributeName: aws.String("added_at"), AttributeType: types.ScalarAttributeTypeN},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("pk"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("sk"), KeyType: types.KeyTypeRange},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(createdAtIndex),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("gsi_pk"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("created_at"), KeyType: types.KeyTypeRange},
+				},
+				Projection: projection,
+			},
+			{
+				IndexName: aws.String(addedAtIndex),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("gsi_pk"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("added_at"), KeyType: types.KeyTypeRange},
+				},
+				Projection: projection,
+			},
+		},
+	})
+	return err
+}
+
+func partitionKey(rowKey string, columnKey string) string {
+	return rowKey + "#" + columnKey
+}
+
+// indexPartition returns the partition key value of the secondary index
+// entries of the cell added at addedAt.
+func (s *Storage) indexPartition(addedAt int64) string {
+	return gsiPartition + "#" + strconv.FormatInt(addedAt%int64(s.indexShards), 10)
+}
+
+func numberValue(n int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+func stringValue(str string) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: str}
+}
+
+// itemSize approximates DynamoDB's item size accounting: attribute names
+// plus their values, with numbers costing at most 21 bytes.
+func itemSize(item map[string]types.AttributeValue) int {
+	size := 0
+	for name, v := range item {
+		size += len(name)
+		switch av := v.(type) {
+		case *types.AttributeValueMemberS:
+			size += len(av.Value)
+		case *types.AttributeValueMemberN:
+			size += 21
+		}
+	}
+	return size
+}
+
+func itemToCell(item map[string]types.AttributeValue) (cell models.Cell, err error) {
+	getString := func(name string) string {
+		if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	}
+	getNumber := func(name string) int64 {
+		v, ok := item[name].(*types.AttributeValueMemberN)
+		if !ok {
+			err = fmt.Errorf("item is missing numeric attribute %s", name)
+			return 0
+		}
+		var n int64
+		n, err = strconv.ParseInt(v.Value, 10, 64)
+		return n
+	}
+
+	cell.RowKey = getString("row_key")
+	cell.ColumnName = getString("column_name")
+	cell.Body = getString("body")
+	if cell.RefKey = getNumber("sk"); err != nil {
+		return
+	}
+	if cell.AddedAt = getNumber("added_at"); err != nil {
+		return
+	}
+	createdAt := getNumber("created_at")
+	if err != nil {
+		return
+	}
+	t := time.Unix(createdAt, 0).UTC()
+	cell.CreatedAt = &t
+	return
+}
+
+// WithResultLogging logs every cell a read returns, with its body, at Info.
+// It is off by default: a partition read can return thousands of cells, and
+// their bodies may hold personal data. Operations are logged either way.
+func (s *Storage) WithResultLogging(enabled bool) *Storage {
+	s.logResults = enabled
+	return s
+}
+
+// WithContextLogger makes s log to the *zap.SugaredLogger stored in the
+// context of each call under key, so that its logs carry the fields of the
+// request it serves. Calls whose context holds no logger under key log to
+// the logger of s.
+func (s *Storage) WithContextLogger(key interface{}) *Storage {
+	s.loggerKey = key
+	return s
+}
+
+// logger returns the logger of ctx (see WithContextLogger), or else that
+// of s, tagged with the shard that ctx was dispatched to. Calls that
+// sampling left out (see models.WithSampled) only log warnings and errors.
+func (s *Storage) logger(ctx context.Context) *zap.SugaredLogger {
+	sugar := s.Sugar
+	if s.loggerKey != nil {
+		if l, ok := ctx.Value(s.loggerKey).(*zap.SugaredLogger); ok && l != nil {
+			sugar = l
+		}
+	}
+	if sampled, ok := models.SampledFromContext(ctx); ok && !sampled {
+		sugar = sugar.Desugar().WithOptions(zap.IncreaseLevel(zap.WarnLevel)).Sugar()
+	}
+	return sugar.With("shard", models.ShardFromContext(ctx))
+}
+
+// logResult logs a cell a read returned, if result logging is enabled.
+func (s *Storage) logResult(ctx context.Context, msg string, keysAndValues ...interface{}) {
+	if s.logResults {
+		s.logger(ctx).Infow(msg, keysAndValues...)
+	}
+}
+
+func (s *Storage) GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	s.logger(ctx).Infow("GetCell", "table", s.table, "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey)
+
+	var out *dynamodb.GetItemOutput
+	out, err = s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"pk": stringValue(partitionKey(rowKey, columnKey)),
+			"sk": numberValue(refKey),
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return
+	}
+	if out.Item == nil {
+		return cell, false, nil
+	}
+
+	cell, err = itemToCell(out.Item)
+	if err != nil {
+		return
+	}
+	s.logResult(ctx, "GetCell scanned data", "AddedAt", cell.AddedAt, "RowKey", cell.RowKey, "ColName", cell.ColumnName, "RefKey", cell.RefKey, "Body", cell.Body, "CreatedAt", cell.CreatedAt)
+
+	return cell, true, nil
+}
+
+func (s *Storage) GetCellLatest(ctx context.Context, rowKey, columnKey string) (cell models.Cell, found bool, err error) {
+	s.logger(ctx).Infow("GetCellLatest", "table", s.table, "rowKey", rowKey, "columnKey", columnKey)
+
+	var out *dynamodb.QueryOutput
+	out, err = s.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": stringValue(partitionKey(rowKey, columnKey)),
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(1),
+		ConsistentRead:   aws.Bool(true),
+	})
+	if err != nil {
+		return
+	}
+	if len(out.Items) == 0 {
+		return cell, false, nil
+	}
+
+	cell, err = itemToCell(out.Items[0])
+	if err != nil {
+		return
+	}
+	s.logResult(ctx, "GetCellLatest scanned data", "AddedAt", cell.AddedAt, "RowKey", cell.RowKey, "ColName", cell.ColumnName, "RefKey", cell.RefKey, "Body", cell.Body, "CreatedAt", cell.CreatedAt)
+
+	return cell, true, nil
+}
+
+func (s *Storage) PartitionRead(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	var (
+		indexName      string
+		locationColumn string
+		after          int64
+	)
+
+	switch location {
+	case "timestamp":
+		fallthrough
+	case "created_at":
+		indexName = createdAtIndex
+		locationColumn = "created_at"
+		switch value.(type) {
+		case *time.Time:
+			t := value.(*time.Time)
+			after = t.Unix()
+		case time.Time:
+			t := value.(time.Time)
+			after = t.Unix()
+		case string:
+			var t time.Time
+			t, err = time.ParseInLocation(timeParseString, value.(string), time.UTC)
+			if err != nil {
+				err = fmt.Errorf("PartitionRead could not parse time string:'%v': %s", value, err)
+				return
+			}
+			after = t.Unix()
+		default:
+			err = fmt.Errorf("PartitionRead had unrecognized type %v", reflect.TypeOf(value))
+			return
+		}
+	case "added_at":
+		indexName = addedAtIndex
+		locationColumn = "added_at"
+		after, err = models.AddedAtValue(value)
+		if err != nil {
+			return
+		}
+	default:
+		err = errors.New("PartitionRead had unrecognized location " + location)
+		return
+	}
+
+	s.logger(ctx).Infow("PartitionRead", "table", s.table, "index", indexName, "value", after, "limit", limit)
+
+	// The first limit cells of every index partition hold the first limit
+	// cells of them all.
+	for shard := 0; shard < s.indexShards; shard++ {
+		var items []map[string]types.AttributeValue
+		items, err = s.queryIndex(ctx, indexName, locationColumn, s.indexPartition(int64(shard)), after, limit)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, item := range items {
+			var cell models.Cell
+			cell, err = itemToCell(item)
+			if err != nil {
+				return nil, false, err
+			}
+			cells = append(cells, cell)
+		}
+	}
+
+	sort.Slice(cells, func(i, j int) bool {
+		if locationColumn == "created_at" && !cells[i].CreatedAt.Equal(*cells[j].CreatedAt) {
+			return cells[i].CreatedAt.Before(*cells[j].CreatedAt)
+		}
+		return cells[i].AddedAt < cells[j].AddedAt
+	})
+	if len(cells) > limit {
+		cells = cells[:limit]
+	}
+	for _, cell := range cells {
+		s.logResult(ctx, "PartitionRead: scanned data", "AddedAt", cell.AddedAt, "RowKey", cell.RowKey, "ColName", cell.ColumnName, "RefKey", cell.RefKey, "Body", cell.Body, "CreatedAt", cell.CreatedAt)
+	}
+
+	return cells, len(cells) > 0, nil
+}
+
+// queryIndex returns the first limit items of the partition gsi of index
+// whose locationColumn is after after, following the pages of the Query
+// that DynamoDB cuts at 1MB.
+func (s *Storage) queryIndex(ctx context.Context, indexName string, locationColumn string, gsi string, after int64, limit int) ([]map[string]types.AttributeValue, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		IndexName:              aws.String(indexName),
+		KeyConditionExpression: aws.String("gsi_pk = :gsi AND #loc > :after"),
+		ExpressionAttributeNames: map[string]string{
+			"#loc": locationColumn,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":gsi":   stringValue(gsi),
+			":after": numberValue(after),
+		},
+	}
+
+	var items []map[string]types.AttributeValue
+	for len(items) < limit {
+		input.Limit = aws.Int32(int32(limit - len(items)))
+		out, err := s.client.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, out.Items...)
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+	return items, nil
+}
+
+// nextAddedAt returns the next value of the added_at sequence, incrementing
+// its counter item.
+func (s *Storage) nextAddedAt(ctx context.Context) (int64, error) {
+	out, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"pk": stringValue(sequenceKey),
+			"sk": numberValue(0),
+		},
+		UpdateExpression: aws.String("ADD next_value :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": numberValue(1),
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, err
+	}
+	n, ok := out.Attributes["next_value"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("unexpected sequence value type %v", reflect.TypeOf(out.Attributes["next_value"]))
+	}
+	return strconv.ParseInt(n.Value, 10, 64)
+}
+
+// PutCell writes a cell unless one already exists at (row key, column key,
+// ref key). DynamoDB has no auto-increment, so added_at is taken from the
+// sequence of the table, see nextAddedAt. Cells that would exceed the item
+// size limit are rejected with ErrBodyTooLarge.
+func (s *Storage) PutCell(ctx context.Context, rowKey, columnKey string, refKey int64, cell models.Cell) (err error) {
+	now := time.Now()
+
+	// The size is checked with the widest added_at, before one is taken.
+	item := map[string]types.AttributeValue{
+		"pk":          stringValue(partitionKey(rowKey, columnKey)),
+		"sk":          numberValue(refKey),
+		"gsi_pk":      stringValue(s.indexPartition(int64(s.indexShards - 1))),
+		"row_key":     stringValue(rowKey),
+		"column_name": stringValue(columnKey),
+		"added_at":    numberValue(math.MaxInt64),
+		"created_at":  numberValue(cell.CreatedAtOr(now).Unix()),
+	}
+	// DynamoDB rejects empty string attributes on older deployments.
+	if cell.Body != "" {
+		item["body"] = stringValue(cell.Body)
+	}
+
+	if itemSize(item) > maxItemSize {
+		return ErrBodyTooLarge
+	}
+
+	var addedAt int64
+	addedAt, err = s.nextAddedAt(ctx)
+	if err != nil {
+		return
+	}
+	item["added_at"] = numberValue(addedAt)
+	item["gsi_pk"] = stringValue(s.indexPartition(addedAt))
+
+	s.logger(ctx).Infow("PutCell", "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey, "Body", cell.Body)
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(pk)"),
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return models.ErrCellExists
+	}
+	if err != nil {
+		return
+	}
+	s.logger(ctx).Infof("added_at = %d\n", addedAt)
+	return
+}
+
+// ResetConnection does nothing, the AWS client manages its own connections.
+func (s *Storage) ResetConnection(ctx context.Context, key string) error {
+	return nil
+}
+
+// Raw returns the underlying *dynamodb.Client, nil until Open; requests
+// through it bypass the Storage, see core.Storage.
+func (s *Storage) Raw() *dynamodb.Client {
+	return s.client
+}
+
+// Destroy flushes the logger, giving up once ctx is done. The AWS client has
+// no handle to close.
+func (s *Storage) Destroy(ctx context.Context) error {
+	return teardown.Run(ctx, s.Sugar, nil)
+}
+
+// Close implements io.Closer. It releases the connection as Destroy does,
+// and is safe to call more than once.
+func (s *Storage) Close() error {
+	return s.closer.Close(s.Destroy)
+}
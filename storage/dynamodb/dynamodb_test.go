@@ -0,0 +1,61 @@
+package dynamodb
+
+import (
+	"context"
+	"github.com/rbastic/go-schemaless/models"
+	"github.com/rbastic/go-schemaless/storagetest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStorage(t *testing.T, endpoint string) *Storage {
+	// DynamoDB Local accepts any credentials, but they must be present.
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		t.Setenv("AWS_ACCESS_KEY_ID", "schemaless")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "schemaless")
+	}
+
+	m := New().WithRegion("us-east-1").
+		WithEndpoint(endpoint).
+		WithTable("cell_" + time.Now().Format("20060102150405"))
+
+	err := m.WithZap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestDynamoDB(t *testing.T) {
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("Please specify DYNAMODB_ENDPOINT=... (e.g. http://localhost:8000 for DynamoDB Local)")
+	}
+
+	m := newTestStorage(t, endpoint)
+	err := m.CreateTable(context.TODO())
+	if err != nil {
+		t.Skipf("DynamoDB is unavailable: %s", err)
+	}
+	storagetest.StorageTest(t, m)
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	// Nothing listens here; the oversized cell must be rejected before any
+	// request is made.
+	m := newTestStorage(t, "http://127.0.0.1:1")
+	defer m.Destroy(context.TODO())
+
+	body := strings.Repeat("x", maxItemSize)
+	err := m.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: body})
+	if err != ErrBodyTooLarge {
+		t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+	}
+}
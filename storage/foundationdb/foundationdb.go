@@ -0,0 +1,478 @@
+//go:build foundationdb
+// +build foundationdb
+
+// Package foundationdb is a FoundationDB-backed Schemaless store.
+//
+// Cells are stored under tuple-encoded keys of the form
+// (prefix, "cell", row_key, column_name, ref_key), so the ordered key-value
+// model gives us the latest version of a cell as the last key of a range.
+// Secondary entries under (prefix, "added_at", ...) and
+// (prefix, "created_at", ...) let PartitionRead be served by a range scan.
+//
+// added_at is the commit version of the transaction that wrote a cell,
+// filled in by FoundationDB through a versionstamped key and value, so that
+// writers do not conflict on a shared sequence. Cells committed in the same
+// batch share an added_at; PartitionRead never splits them across pages.
+//
+// This package requires the FoundationDB client library, so it is only built
+// with the 'foundationdb' build tag.
+package foundationdb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rbastic/go-schemaless/internal/teardown"
+	"github.com/rbastic/go-schemaless/models"
+	"go.uber.org/zap"
+	"reflect"
+	"time"
+)
+
+// Storage is a FoundationDB-backed storage.
+type Storage struct {
+	clusterFile string
+	prefix      string
+
+	db      fdb.Database
+	cells   subspace.Subspace
+	addedAt subspace.Subspace
+	created subspace.Subspace
+
+	Sugar *zap.SugaredLogger
+	// logResults enables logging every cell a read returns
+	logResults bool
+	// loggerKey is the context key of a request-scoped logger
+	loggerKey interface{}
+
+	closer teardown.Once
+}
+
+const (
+	apiVersion      = 600
+	defaultPrefix   = "schemaless"
+	timeParseString = "2006-01-02 15:04:05"
+)
+
+// New returns a new FoundationDB-backed Storage
+func New() *Storage {
+	return &Storage{prefix: defaultPrefix}
+}
+
+func (s *Storage) WithZap() error {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	sug := logger.Sugar()
+	s.Sugar = sug
+	return nil
+}
+
+// WithClusterFile sets the cluster file used to connect. If it is left
+// empty, the default cluster file is used.
+func (s *Storage) WithClusterFile(clusterFile string) *Storage {
+	s.clusterFile = clusterFile
+	return s
+}
+
+// WithPrefix sets the tuple prefix that all keys for this store live under.
+// This is how multiple shards can share a single FoundationDB cluster.
+func (s *Storage) WithPrefix(prefix string) *Storage {
+	s.prefix = prefix
+	return s
+}
+
+func (s *Storage) Open() error {
+	err := fdb.APIVersion(apiVersion)
+	if err != nil {
+		return err
+	}
+
+	var db fdb.Database
+	if s.clusterFile == "" {
+		db, err = fdb.OpenDefault()
+	} else {
+		db, err = fdb.OpenDatabase(s.clusterFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	root := subspace.Sub(s.prefix)
+	s.db = db
+	s.cells = root.Sub("cell")
+	s.addedAt = root.Sub("added_at")
+	s.created = root.Sub("created_at")
+	return nil
+}
+
+// packValue encodes everything but the key of a cell, leaving room for the
+// versionstamp of the transaction, which is its added_at.
+func packValue(createdAt int64, body string) ([]byte, error) {
+	return tuple.Tuple{tuple.IncompleteVersionstamp(0), createdAt, body}.PackWithVersionstamp(nil)
+}
+
+// versionOf returns the commit version of a versionstamp, the added_at of
+// the cells written by its transaction.
+func versionOf(vs tuple.Versionstamp) int64 {
+	return int64(binary.BigEndian.Uint64(vs.TransactionVersion[:8]))
+}
+
+// versionstampAt returns the first versionstamp of commit version v.
+func versionstampAt(v int64) tuple.Versionstamp {
+	var vs tuple.Versionstamp
+	binary.BigEndian.PutUint64(vs.TransactionVersion[:8], uint64(v))
+	return vs
+}
+
+func unpackCell(rowKey string, columnKey string, refKey int64, value []byte) (cell models.Cell, err error) {
+	var t tuple.Tuple
+	t, err = tuple.Unpack(value)
+	if err != nil {
+		return
+	}
+	if len(t) != 3 {
+		err = fmt.Errorf("unexpected cell value with %d elements", len(t))
+		return
+	}
+
+	vs, ok := t[0].(tuple.Versionstamp)
+	if !ok {
+		err = fmt.Errorf("unexpected added_at type %v", reflect.TypeOf(t[0]))
+		return
+	}
+	createdAt, ok := t[1].(int64)
+	if !ok {
+		err = fmt.Errorf("unexpected created_at type %v", reflect.TypeOf(t[1]))
+		return
+	}
+	body, ok := t[2].(string)
+	if !ok {
+		err = fmt.Errorf("unexpected body type %v", reflect.TypeOf(t[2]))
+		return
+	}
+
+	created := time.Unix(createdAt, 0).UTC()
+	cell.AddedAt = versionOf(vs)
+	cell.RowKey = rowKey
+	cell.ColumnName = columnKey
+	cell.RefKey = refKey
+	cell.Body = body
+	cell.CreatedAt = &created
+	return
+}
+
+// WithResultLogging logs every cell a read returns, with its body, at Info.
+// It is off by default: a partition read can return thousands of cells, and
+// their bodies may hold personal data. Operations are logged either way.
+func (s *Storage) WithResultLogging(enabled bool) *Storage {
+	s.logResults = enabled
+	return s
+}
+
+// WithContextLogger makes s log to the *zap.SugaredLogger stored in the
+// context of each call under key, so that its logs carry the fields of the
+// request it serves. Calls whose context holds no logger under key log to
+// the logger of s.
+func (s *Storage) WithContextLogger(key interface{}) *Storage {
+	s.loggerKey = key
+	return s
+}
+
+// logger returns the logger of ctx (see WithContextLogger), or else that
+// of s, tagged with the shard that ctx was dispatched to. Calls that
+// sampling left out (see models.WithSampled) only log warnings and errors.
+func (s *Storage) logger(ctx context.Context) *zap.SugaredLogger {
+	sugar := s.Sugar
+	if s.loggerKey != nil {
+		if l, ok := ctx.Value(s.loggerKey).(*zap.SugaredLogger); ok && l != nil {
+			sugar = l
+		}
+	}
+	if sampled, ok := models.SampledFromContext(ctx); ok && !sampled {
+		sugar = sugar.Desugar().WithOptions(zap.IncreaseLevel(zap.WarnLevel)).Sugar()
+	}
+	return sugar.With("shard", models.ShardFromContext(ctx))
+}
+
+// logResult logs a cell a read returned, if result logging is enabled.
+func (s *Storage) logResult(ctx context.Context, msg string, keysAndValues ...interface{}) {
+	if s.logResults {
+		s.logger(ctx).Infow(msg, keysAndValues...)
+	}
+}
+
+func (s *Storage) GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	s.logger(ctx).Infow("GetCell", "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey)
+
+	var value interface{}
+	value, err = s.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+		return rtr.Get(s.cells.Pack(tuple.Tuple{rowKey, columnKey, refKey})).Get()
+	})
+	if err != nil {
+		return
+	}
+
+	b := value.([]byte)
+	if b == nil {
+		return cell, false, nil
+	}
+
+	cell, err = unpackCell(rowKey, columnKey, refKey, b)
+	if err != nil {
+		return
+	}
+	s.logResult(ctx, "GetCell scanned data", "AddedAt", cell.AddedAt, "RowKey", cell.RowKey, "ColName", cell.ColumnName, "RefKey", cell.RefKey, "Body", cell.Body, "CreatedAt", cell.CreatedAt)
+
+	return cell, true, nil
+}
+
+func (s *Storage) GetCellLatest(ctx context.Context, rowKey, columnKey string) (cell models.Cell, found bool, err error) {
+	s.logger(ctx).Infow("GetCellLatest", "rowKey", rowKey, "columnKey", columnKey)
+
+	var value interface{}
+	value, err = s.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+		versions := s.cells.Sub(rowKey, columnKey)
+		return rtr.GetRange(versions, fdb.RangeOptions{Limit: 1, Reverse: true}).GetSliceWithError()
+	})
+	if err != nil {
+		return
+	}
+
+	kvs := value.([]fdb.KeyValue)
+	if len(kvs) == 0 {
+		return cell, false, nil
+	}
+
+	var refKey int64
+	refKey, err = s.refKeyOf(kvs[0].Key)
+	if err != nil {
+		return
+	}
+
+	cell, err = unpackCell(rowKey, columnKey, refKey, kvs[0].Value)
+	if err != nil {
+		return
+	}
+	s.logResult(ctx, "GetCellLatest scanned data", "AddedAt", cell.AddedAt, "RowKey", cell.RowKey, "ColName", cell.ColumnName, "RefKey", cell.RefKey, "Body", cell.Body, "CreatedAt", cell.CreatedAt)
+
+	return cell, true, nil
+}
+
+// refKeyOf extracts the ref key from a packed cell key.
+func (s *Storage) refKeyOf(key fdb.Key) (int64, error) {
+	t, err := s.cells.Unpack(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(t) != 3 {
+		return 0, fmt.Errorf("unexpected cell key with %d elements", len(t))
+	}
+	refKey, ok := t[2].(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected ref_key type %v", reflect.TypeOf(t[2]))
+	}
+	return refKey, nil
+}
+
+func (s *Storage) PartitionRead(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	var (
+		index subspace.Subspace
+		after int64
+		// key returns the first element of the index keys of value v, and
+		// valueOf the value of a cell
+		key     func(v int64) tuple.TupleElement
+		valueOf func(cell models.Cell) int64
+	)
+
+	switch location {
+	case "timestamp":
+		fallthrough
+	case "created_at":
+		index = s.created
+		key = func(v int64) tuple.TupleElement { return v }
+		valueOf = func(cell models.Cell) int64 { return cell.CreatedAt.Unix() }
+		switch value.(type) {
+		case *time.Time:
+			t := value.(*time.Time)
+			after = t.Unix()
+		case time.Time:
+			t := value.(time.Time)
+			after = t.Unix()
+		case string:
+			var t time.Time
+			t, err = time.ParseInLocation(timeParseString, value.(string), time.UTC)
+			if err != nil {
+				err = fmt.Errorf("PartitionRead could not parse time string:'%v': %s", value, err)
+				return
+			}
+			after = t.Unix()
+		default:
+			err = fmt.Errorf("PartitionRead had unrecognized type %v", reflect.TypeOf(value))
+			return
+		}
+	case "added_at":
+		index = s.addedAt
+		key = func(v int64) tuple.TupleElement { return versionstampAt(v) }
+		valueOf = func(cell models.Cell) int64 { return cell.AddedAt }
+		after, err = models.AddedAtValue(value)
+		if err != nil {
+			return
+		}
+	default:
+		err = errors.New("PartitionRead had unrecognized location " + location)
+		return
+	}
+
+	s.logger(ctx).Infow("PartitionRead", "location", location, "value", value, "limit", limit)
+
+	var res interface{}
+	res, err = s.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+		_, end := index.FDBRangeKeys()
+		// Index keys are (value, row_key, column_name, ref_key), so the
+		// first key strictly after 'after' starts at after+1.
+		scan := fdb.KeyRange{Begin: index.Pack(tuple.Tuple{key(after + 1)}), End: end}
+		kvs, err := rtr.GetRange(scan, fdb.RangeOptions{Limit: limit}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+		cells, err := s.indexedCells(rtr, index, kvs)
+		if err != nil || len(kvs) < limit {
+			return cells, err
+		}
+
+		// The next page starts after the value of the last cell, so the
+		// cells that share it must all be on this one.
+		last := kvs[len(kvs)-1].Key
+		rest := fdb.KeyRange{
+			Begin: append(fdb.Key(append([]byte(nil), last...)), 0x00),
+			End:   index.Pack(tuple.Tuple{key(valueOf(cells[len(cells)-1]) + 1)}),
+		}
+		kvs, err = rtr.GetRange(rest, fdb.RangeOptions{}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+		more, err := s.indexedCells(rtr, index, kvs)
+		if err != nil {
+			return nil, err
+		}
+		return append(cells, more...), nil
+	})
+	if err != nil {
+		return
+	}
+
+	cells = res.([]models.Cell)
+	for _, cell := range cells {
+		s.logResult(ctx, "PartitionRead: scanned data", "AddedAt", cell.AddedAt, "RowKey", cell.RowKey, "ColName", cell.ColumnName, "RefKey", cell.RefKey, "Body", cell.Body, "CreatedAt", cell.CreatedAt)
+	}
+
+	return cells, len(cells) > 0, nil
+}
+
+// indexedCells returns the cells the entries kvs of index point to.
+func (s *Storage) indexedCells(rtr fdb.ReadTransaction, index subspace.Subspace, kvs []fdb.KeyValue) ([]models.Cell, error) {
+	var cells []models.Cell
+	for _, kv := range kvs {
+		t, err := index.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(t) != 4 {
+			return nil, fmt.Errorf("unexpected index key with %d elements", len(t))
+		}
+		rowKey, _ := t[1].(string)
+		columnKey, _ := t[2].(string)
+		refKey, _ := t[3].(int64)
+
+		b, err := rtr.Get(s.cells.Pack(tuple.Tuple{rowKey, columnKey, refKey})).Get()
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			return nil, fmt.Errorf("dangling index entry for %s/%s/%d", rowKey, columnKey, refKey)
+		}
+		cell, err := unpackCell(rowKey, columnKey, refKey, b)
+		if err != nil {
+			return nil, err
+		}
+		cells = append(cells, cell)
+	}
+	return cells, nil
+}
+
+func (s *Storage) PutCell(ctx context.Context, rowKey, columnKey string, refKey int64, cell models.Cell) (err error) {
+	s.logger(ctx).Infow("PutCell", "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey, "Body", cell.Body)
+
+	var res interface{}
+	res, err = s.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+		key := s.cells.Pack(tuple.Tuple{rowKey, columnKey, refKey})
+		existing, err := tr.Get(key).Get()
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			// Mirror the unique (row_key, column_name, ref_key) index of
+			// the SQL storages: cells are immutable.
+			return nil, models.ErrCellExists
+		}
+
+		// added_at is the versionstamp FoundationDB gives the transaction
+		// when it commits.
+		createdAt := cell.CreatedAtOr(time.Now()).Unix()
+		value, err := packValue(createdAt, cell.Body)
+		if err != nil {
+			return nil, err
+		}
+		addedAtKey, err := s.addedAt.PackWithVersionstamp(tuple.Tuple{tuple.IncompleteVersionstamp(0), rowKey, columnKey, refKey})
+		if err != nil {
+			return nil, err
+		}
+		tr.SetVersionstampedValue(key, value)
+		tr.SetVersionstampedKey(addedAtKey, nil)
+		tr.Set(s.created.Pack(tuple.Tuple{createdAt, rowKey, columnKey, refKey}), nil)
+		return tr.GetVersionstamp(), nil
+	})
+	if err != nil {
+		return
+	}
+
+	var stamp fdb.Key
+	stamp, err = res.(fdb.FutureKey).Get()
+	if err != nil {
+		return
+	}
+	var vs tuple.Versionstamp
+	copy(vs.TransactionVersion[:], stamp)
+	s.logger(ctx).Infof("added_at = %d\n", versionOf(vs))
+	return
+}
+
+// ResetConnection does nothing, the FoundationDB client manages its own
+// connections.
+func (s *Storage) ResetConnection(ctx context.Context, key string) error {
+	return nil
+}
+
+// Raw returns the underlying fdb.Database, the zero one until Open;
+// transactions through it bypass the Storage, see core.Storage.
+func (s *Storage) Raw() fdb.Database {
+	return s.db
+}
+
+// Destroy flushes the logger, giving up once ctx is done. The FoundationDB
+// client has no handle to close.
+func (s *Storage) Destroy(ctx context.Context) error {
+	return teardown.Run(ctx, s.Sugar, nil)
+}
+
+// Close implements io.Closer. It releases the connection as Destroy does,
+// and is safe to call more than once.
+func (s *Storage) Close() error {
+	return s.closer.Close(s.Destroy)
+}
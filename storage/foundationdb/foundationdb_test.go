@@ -0,0 +1,30 @@
+//go:build foundationdb
+// +build foundationdb
+
+package foundationdb
+
+import (
+	"github.com/rbastic/go-schemaless/storagetest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFoundationDB(t *testing.T) {
+	// FDB_CLUSTER_FILE is also honoured by the client library itself.
+	clusterFile := os.Getenv("FDB_CLUSTER_FILE")
+
+	m := New().WithClusterFile(clusterFile).
+		WithPrefix("storagetest-" + time.Now().Format("20060102150405"))
+
+	err := m.WithZap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Open()
+	if err != nil {
+		t.Skipf("FoundationDB is unavailable: %s", err)
+	}
+	storagetest.StorageTest(t, m)
+}
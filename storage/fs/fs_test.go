@@ -1,10 +1,16 @@
 package fs
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
 	"github.com/rbastic/go-schemaless/storagetest"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestFS(t *testing.T) {
@@ -21,3 +27,94 @@ func TestFS(t *testing.T) {
 	// cleanup
 	os.RemoveAll(dir)
 }
+
+func TestPoolOptions(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "schemaless-fs-pool")
+	if err != nil {
+		t.Skipf("Unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := New(dir).WithMaxOpenConns(3).WithMaxIdleConns(1).WithConnMaxLifetime(time.Millisecond)
+	defer m.Destroy(context.TODO())
+
+	if got := m.store.Stats().MaxOpenConnections; got != 3 {
+		t.Fatalf("expected 3 max open connections, got %d", got)
+	}
+
+	// Of three connections released at once, the pool keeps one.
+	var conns []*sql.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := m.store.Conn(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	stats := m.store.Stats()
+	if stats.Idle != 1 || stats.MaxIdleClosed != 2 {
+		t.Fatalf("expected 1 idle connection and 2 closed, got %+v", stats)
+	}
+
+	// The idle connection has expired by the time it is next wanted.
+	time.Sleep(10 * time.Millisecond)
+	conn, err := m.store.Conn(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := m.store.Stats().MaxLifetimeClosed; got == 0 {
+		t.Fatal("expected an expired connection to be closed")
+	}
+}
+
+func TestBusyRetry(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "schemaless-fs-busy")
+	if err != nil {
+		t.Skipf("Unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := New(dir).WithMaxOpenConns(8)
+	defer m.Destroy(context.TODO())
+
+	// MoveRow reads before it writes, so concurrent moves find the database
+	// locked without waiting for the busy timeout.
+	const writers, rows = 8, 20
+	errs := make(chan error, writers*rows)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rows; i++ {
+				rowKey := fmt.Sprintf("row_%d_%d", w, i)
+				err := m.PutCell(context.TODO(), rowKey, "BASE", 1, models.Cell{Body: "{}"})
+				if err == nil {
+					err = m.MoveRow(context.TODO(), rowKey, rowKey+"_moved")
+				}
+				if err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("expected the writes to retry while the database is locked, got %v", err)
+	}
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < rows; i++ {
+			rowKey := fmt.Sprintf("row_%d_%d_moved", w, i)
+			_, found, err := m.GetCell(context.TODO(), rowKey, "BASE", 1)
+			if err != nil || !found {
+				t.Fatalf("expected %s/BASE/1, got %v, %v", rowKey, found, err)
+			}
+		}
+	}
+}
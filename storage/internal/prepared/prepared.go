@@ -0,0 +1,66 @@
+// Package prepared keeps the prepared statements of a SQL storage, so that
+// a hot statement is parsed by the database once per table rather than on
+// every call.
+package prepared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// Cache holds statements prepared from a template, see package query, for
+// each table. The zero value is ready to use, and safe for concurrent use.
+type Cache struct {
+	mu    sync.Mutex
+	stmts map[key]*sql.Stmt
+}
+
+type key struct{ template, table string }
+
+// Stmt returns template for table, prepared on db the first time it is
+// asked for.
+func (c *Cache) Stmt(ctx context.Context, db *sql.DB, template string, table string) (*sql.Stmt, error) {
+	k := key{template, table}
+	c.mu.Lock()
+	stmt, ok := c.stmts[k]
+	c.mu.Unlock()
+	if ok {
+		return stmt, nil
+	}
+
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(template, table))
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.stmts[k]; ok {
+		// Another caller prepared it first.
+		stmt.Close()
+		return existing, nil
+	}
+	if c.stmts == nil {
+		c.stmts = make(map[key]*sql.Stmt)
+	}
+	c.stmts[k] = stmt
+	return stmt, nil
+}
+
+// Close closes every statement, returning the first error. The cache may
+// be used again afterwards.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var first error
+	for k, stmt := range c.stmts {
+		err := stmt.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+		delete(c.stmts, k)
+	}
+	return first
+}
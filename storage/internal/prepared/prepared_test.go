@@ -0,0 +1,66 @@
+package prepared
+
+import (
+	"context"
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	for _, stmt := range []string{
+		"CREATE TABLE a ( v INTEGER )",
+		"CREATE TABLE b ( v INTEGER )",
+		"INSERT INTO a VALUES (1)",
+		"INSERT INTO b VALUES (2)",
+	} {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var c Cache
+	const template = "SELECT v FROM %s"
+	for _, test := range []struct {
+		table string
+		want  int64
+	}{{"a", 1}, {"b", 2}, {"a", 1}} {
+		stmt, err := c.Stmt(context.TODO(), db, template, test.table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got int64
+		err = stmt.QueryRow().Scan(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("table %s: expected %d, got %d", test.table, test.want, got)
+		}
+	}
+
+	first, _ := c.Stmt(context.TODO(), db, template, "a")
+	again, _ := c.Stmt(context.TODO(), db, template, "a")
+	if first != again {
+		t.Error("expected the statement to be prepared once")
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.stmts) != 0 {
+		t.Errorf("expected Close to drop the statements, %d left", len(c.stmts))
+	}
+	_, err = c.Stmt(context.TODO(), db, template, "b")
+	if err != nil {
+		t.Errorf("expected the cache to be usable after Close, got %v", err)
+	}
+}
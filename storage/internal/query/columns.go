@@ -0,0 +1,223 @@
+package query
+
+import (
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+	"strconv"
+	"strings"
+)
+
+// Columns renames the columns of the cell table in statements, for a table
+// that predates the storage and names them differently, e.g. "rk" for
+// row_key. It also leaves out the optional columns such a table may lack,
+// see Detect. The zero Columns renames nothing.
+type Columns struct {
+	names map[string]string
+	// missing are the optional columns the table lacks
+	missing map[string]bool
+}
+
+// optionalColumns are the columns added to the cell table after its first
+// version, by what reads stand in for them in a table that lacks them: the
+// value of a cell written without one.
+var optionalColumns = map[string]string{
+	"checksum":       "NULL",
+	"schema_version": "0",
+	"metadata":       "NULL",
+	"causation_id":   "NULL",
+	"correlation_id": "NULL",
+}
+
+// Detect returns c for a table with the columns present, as listed by
+// DescribeTable: the optional columns it lacks read as a cell written
+// without them does, and are left out of inserts (see Insert).
+func (c Columns) Detect(present []models.ColumnInfo) Columns {
+	has := make(map[string]bool, len(present))
+	for _, column := range present {
+		has[column.Name] = true
+	}
+	c.missing = nil
+	for column := range optionalColumns {
+		if has[column] {
+			continue
+		}
+		if c.missing == nil {
+			c.missing = make(map[string]bool)
+		}
+		c.missing[column] = true
+	}
+	return c
+}
+
+// NewColumns returns the Columns renaming each cell column in mapping to
+// the name it maps to. Names may only hold letters, digits and '_', and no
+// two columns may end up with the same name.
+func NewColumns(mapping map[string]string) (Columns, error) {
+	for column, name := range mapping {
+		if !models.IsCellColumn(column) {
+			return Columns{}, fmt.Errorf("cannot map %q: not a column of the cell table", column)
+		}
+		if !isIdentifier(name) {
+			return Columns{}, fmt.Errorf("cannot map %s to %q: invalid column name", column, name)
+		}
+	}
+	taken := make(map[string]string)
+	for _, column := range models.CellColumns {
+		name, ok := mapping[column]
+		if !ok {
+			name = column
+		}
+		if other, ok := taken[strings.ToLower(name)]; ok {
+			return Columns{}, fmt.Errorf("cannot name both %s and %s %q", other, column, name)
+		}
+		taken[strings.ToLower(name)] = column
+	}
+	names := make(map[string]string, len(mapping))
+	for column, name := range mapping {
+		names[column] = name
+	}
+	return Columns{names: names}, nil
+}
+
+func isIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Rename returns statement with every cell column that c maps renamed.
+// Words in quotes, e.g. JSON paths, are left as they are. Optional columns
+// the table lacks are replaced by their value, except in CREATE and ALTER
+// statements.
+func (c Columns) Rename(statement string) string {
+	if len(c.names) == 0 && len(c.missing) == 0 {
+		return statement
+	}
+	missing := c.missing
+	if strings.HasPrefix(statement, "CREATE ") || strings.HasPrefix(statement, "ALTER ") {
+		missing = nil
+	}
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(statement); {
+		ch := statement[i]
+		if ch == '\'' {
+			quoted = !quoted
+		}
+		if quoted || !isWordByte(ch) {
+			b.WriteByte(ch)
+			i++
+			continue
+		}
+		j := i
+		for j < len(statement) && isWordByte(statement[j]) {
+			j++
+		}
+		word := statement[i:j]
+		if missing[word] {
+			word = optionalColumns[word]
+		} else if name, ok := c.names[word]; ok {
+			word = name
+		}
+		b.WriteString(word)
+		i = j
+	}
+	return b.String()
+}
+
+// Insert returns the INSERT statement, renamed, along with args, its
+// arguments, with the optional columns the table lacks left out, along with
+// their values. The statement must list its columns and then its values, one
+// for each column holding one placeholder, e.g. PutCell; args are in the
+// order of the columns.
+func (c Columns) Insert(statement string, args ...interface{}) (string, []interface{}) {
+	if len(c.missing) == 0 {
+		return c.Rename(statement), args
+	}
+	columnsStart := strings.Index(statement, "(")
+	columnsEnd := strings.Index(statement, ")")
+	valuesStart := strings.Index(statement, "VALUES(")
+	if columnsStart < 0 || columnsEnd < columnsStart || valuesStart < columnsEnd {
+		return c.Rename(statement), args
+	}
+	valuesStart += len("VALUES(")
+	values, valuesEnd := splitValues(statement[valuesStart:])
+	columns := strings.Split(statement[columnsStart+1:columnsEnd], ",")
+	if len(values) != len(columns) || len(args) != len(columns) {
+		return c.Rename(statement), args
+	}
+
+	var keptColumns, keptValues []string
+	var keptArgs []interface{}
+	for i, column := range columns {
+		if c.missing[strings.TrimSpace(column)] {
+			continue
+		}
+		keptColumns = append(keptColumns, column)
+		keptValues = append(keptValues, renumber(values[i], len(keptArgs)+1))
+		keptArgs = append(keptArgs, args[i])
+	}
+	statement = statement[:columnsStart+1] + strings.Join(keptColumns, ",") + statement[columnsEnd:valuesStart] + strings.Join(keptValues, ",") + statement[valuesStart+valuesEnd:]
+	return c.Rename(statement), keptArgs
+}
+
+// splitValues splits the values of an INSERT, from after "VALUES(", at the
+// commas outside parentheses and quotes, and returns them with the offset of
+// the parenthesis closing them.
+func splitValues(s string) ([]string, int) {
+	var values []string
+	depth, start := 0, 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '\'':
+			quoted = !quoted
+		case quoted:
+		case ch == '(':
+			depth++
+		case ch == ',' && depth == 0:
+			values = append(values, s[start:i])
+			start = i + 1
+		case ch == ')' && depth == 0:
+			return append(values, s[start:i]), i
+		case ch == ')':
+			depth--
+		}
+	}
+	return nil, len(s)
+}
+
+// renumber returns value with its numbered placeholder, e.g. Postgres' $3,
+// numbered n.
+func renumber(value string, n int) string {
+	i := strings.Index(value, "$")
+	if i < 0 {
+		return value
+	}
+	j := i + 1
+	for j < len(value) && value[j] >= '0' && value[j] <= '9' {
+		j++
+	}
+	return value[:i+1] + strconv.Itoa(n) + value[j:]
+}
+
+// Logical returns the cell column that c renames to name, or name itself if
+// c renames none to it.
+func (c Columns) Logical(name string) string {
+	for column, renamed := range c.names {
+		if strings.EqualFold(renamed, name) {
+			return column
+		}
+	}
+	return name
+}
+
+func isWordByte(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_'
+}
@@ -0,0 +1,500 @@
+// Package query generates the SQL that the SQL storages run against the cell
+// table, so that their statements only differ where their dialects do.
+//
+// Statements are fmt templates: %[1]s is the table name, which the storages
+// resolve per operation, and any further verbs are documented on the
+// statement.
+package query
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeFormat is how created_at is written. Storages keep created_at as a
+// wall clock time in UTC, as their column default does, so that it means
+// the same instant whatever the time zone of the writer or the reader.
+const TimeFormat = "2006-01-02 15:04:05"
+
+// CreatedAt returns the created_at argument of PutCell for a cell: NULL, so
+// that the column default stamps the write time, if the cell has none.
+func CreatedAt(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(TimeFormat)
+}
+
+// Time scans a created_at. A value that is not a time, e.g. an empty
+// string left by an import, scans as a nil Time rather than failing the
+// read, so that the rest of the cell is still returned. SQLite hands back
+// such a value as the zero time, which is treated the same way.
+type Time struct {
+	Time *time.Time
+}
+
+// timeFormats are the formats a driver may leave a created_at in: SQLite
+// returns a DATETIME it cannot parse itself as a string.
+var timeFormats = []string{TimeFormat, time.RFC3339Nano, "2006-01-02 15:04:05.999999999-07:00"}
+
+// Scan implements sql.Scanner.
+func (t *Time) Scan(src interface{}) error {
+	t.Time = nil
+	var s string
+	switch v := src.(type) {
+	case time.Time:
+		if !v.IsZero() {
+			t.Time = &v
+		}
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return nil
+	}
+	for _, format := range timeFormats {
+		parsed, err := time.Parse(format, strings.TrimSpace(s))
+		if err == nil {
+			t.Time = &parsed
+			return nil
+		}
+	}
+	return nil
+}
+
+// UTC returns the scanned created_at in UTC, or nil if there was none.
+// Drivers label a DATETIME without a zone as UTC already, but one written
+// with an offset comes back in that offset.
+func (t Time) UTC() *time.Time {
+	if t.Time == nil {
+		return nil
+	}
+	utc := t.Time.UTC()
+	return &utc
+}
+
+// TimeArg returns the argument of a partition read after value in the
+// created_at column: a time.Time or *time.Time is formatted in UTC, as
+// created_at is stored, and anything else is passed as is.
+func TimeArg(value interface{}) interface{} {
+	switch t := value.(type) {
+	case time.Time:
+		return t.UTC().Format(TimeFormat)
+	case *time.Time:
+		if t != nil {
+			return t.UTC().Format(TimeFormat)
+		}
+	}
+	return value
+}
+
+// ID returns the causation_id or correlation_id argument of PutCell for a
+// cell: NULL for a cell without one.
+func ID(id string) interface{} {
+	if id == "" {
+		return nil
+	}
+	return id
+}
+
+// Body returns the body argument of PutCell for a cell: NULL for a cell
+// with a NullBody.
+func Body(cell models.Cell) interface{} {
+	if cell.NullBody {
+		return nil
+	}
+	return cell.Body
+}
+
+// Querier runs queries against the database or within a transaction; both
+// *sql.DB and *sql.Tx implement it.
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Dialect describes how a storage's SQL differs from the others.
+type Dialect struct {
+	// Name identifies the dialect in tests and logs.
+	Name string
+	// Placeholder returns the placeholder of the n-th argument, counting
+	// from 1.
+	Placeholder func(n int) string
+	// Checksum is set if the cell table has a checksum column.
+	Checksum bool
+	// HasTag returns the condition that the metadata column holds the tag
+	// in the argument at placeholder, a JSON object of one key and value
+	// (see models.Tag).
+	HasTag func(placeholder string) string
+	// Extract returns the JSON value at keys in the body column, or NULL.
+	Extract func(keys []string) string
+	// Object is the function that builds a JSON object from alternating
+	// keys and values.
+	Object string
+	// Now is the default of the created_at column.
+	Now string
+	// OnConflictIgnore turns an INSERT whose row would break a unique
+	// index into one that inserts nothing.
+	OnConflictIgnore string
+	// Generated returns the clause that generates a promoted column of
+	// sqlType from the value at keys in the body column.
+	Generated func(keys []string, sqlType string) string
+	// HasColumn counts the columns of the table named by the first
+	// argument that are named by the second, generated columns included.
+	HasColumn string
+	// DescribeTable reads the name, type and whether it is NOT NULL of each
+	// column of the table named by the argument, in order, generated
+	// columns included.
+	DescribeTable string
+	// ForUpdate locks the rows a SELECT reads until the end of its
+	// transaction, in a database that needs to be told to.
+	ForUpdate string
+}
+
+var (
+	// SQLite is the dialect of the memory and fs storages.
+	SQLite = Dialect{Name: "sqlite", Placeholder: question, Checksum: true, HasTag: sqliteHasTag, Extract: sqliteExtract, Object: "json_object", Now: "datetime('now')", OnConflictIgnore: " ON CONFLICT DO NOTHING", Generated: sqliteGenerated, HasColumn: "SELECT COUNT(*) FROM pragma_table_xinfo(?) WHERE name = ?", DescribeTable: "SELECT name, type, \"notnull\" FROM pragma_table_xinfo(?) ORDER BY cid"}
+	// MySQL has no checksum column: its JSON type normalizes bodies.
+	MySQL = Dialect{Name: "mysql", Placeholder: question, HasTag: mysqlHasTag, Extract: mysqlExtract, Object: "JSON_OBJECT", Now: "UTC_TIMESTAMP()", OnConflictIgnore: " ON DUPLICATE KEY UPDATE row_key = row_key", Generated: mysqlGenerated, HasColumn: "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?", DescribeTable: "SELECT column_name, column_type, is_nullable = 'NO' FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? ORDER BY ordinal_position", ForUpdate: " FOR UPDATE"}
+	// Postgres numbers its placeholders.
+	Postgres = Dialect{Name: "postgres", Placeholder: dollar, Checksum: true, HasTag: postgresHasTag, Extract: postgresExtract, Object: "json_build_object", Now: "(CURRENT_TIMESTAMP AT TIME ZONE 'UTC')", OnConflictIgnore: " ON CONFLICT DO NOTHING", Generated: postgresGenerated, HasColumn: "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2", DescribeTable: "SELECT column_name, data_type, is_nullable = 'NO' FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 ORDER BY ordinal_position", ForUpdate: " FOR UPDATE"}
+)
+
+func question(n int) string { return "?" }
+
+func dollar(n int) string { return "$" + strconv.Itoa(n) }
+
+func sqliteHasTag(placeholder string) string {
+	return "EXISTS (SELECT 1 FROM json_each(metadata) AS m, json_each(" + placeholder + ") AS t WHERE m.key = t.key AND m.value = t.value)"
+}
+
+func mysqlHasTag(placeholder string) string {
+	return "JSON_CONTAINS(metadata, " + placeholder + ")"
+}
+
+func postgresHasTag(placeholder string) string {
+	return "metadata::jsonb @> " + placeholder + "::jsonb"
+}
+
+// jsonPath is the SQL/JSON path of keys, which models.SplitPath has checked
+// need no escaping.
+func jsonPath(keys []string) string {
+	return `'$."` + strings.Join(keys, `"."`) + `"'`
+}
+
+// sqliteExtract uses ->, which keeps JSON types, where json_extract would
+// turn true into 1. It needs SQLite 3.38.
+func sqliteExtract(keys []string) string {
+	return "body -> " + jsonPath(keys)
+}
+
+func mysqlExtract(keys []string) string {
+	return "JSON_EXTRACT(body, " + jsonPath(keys) + ")"
+}
+
+func postgresExtract(keys []string) string {
+	return "body::jsonb #> '{" + strings.Join(keys, ",") + "}'"
+}
+
+// SQLite can only add a generated column that is VIRTUAL, but an index on
+// it stores its values all the same.
+func sqliteGenerated(keys []string, sqlType string) string {
+	return "GENERATED ALWAYS AS (json_extract(body, " + jsonPath(keys) + ")) VIRTUAL"
+}
+
+func mysqlGenerated(keys []string, sqlType string) string {
+	return "GENERATED ALWAYS AS (JSON_UNQUOTE(JSON_EXTRACT(body, " + jsonPath(keys) + "))) STORED"
+}
+
+// Postgres does not convert text to the column's type by itself.
+func postgresGenerated(keys []string, sqlType string) string {
+	return "GENERATED ALWAYS AS ((body::jsonb #>> '{" + strings.Join(keys, ",") + "}')::" + sqlType + ") STORED"
+}
+
+// Cond compares Column to the next argument with Op. If Expr is set, the
+// condition is instead whatever Expr returns for the placeholder of the
+// argument.
+type Cond struct {
+	Column string
+	Op     string
+	Expr   func(placeholder string) string
+}
+
+// Eq is the condition Column = argument.
+func Eq(column string) Cond {
+	return Cond{Column: column, Op: "="}
+}
+
+// Select reads whole cells. Its conditions are ANDed, and take one argument
+// each, in order.
+type Select struct {
+	Where   []Cond
+	OrderBy string
+	Limit   string
+}
+
+// cellColumns are the columns every read scans, in order.
+func (d Dialect) cellColumns() string {
+	// Cells written before the column existed have no checksum.
+	return d.columns("body", "COALESCE(checksum, -1)")
+}
+
+// columns are cellColumns reading body and checksum from the given
+// expressions.
+func (d Dialect) columns(body string, checksum string) string {
+	columns := "added_at, row_key, column_name, ref_key, " + body + ", created_at"
+	if d.Checksum {
+		columns += ", " + checksum
+	}
+	// Cells without metadata or lineage read back as ''.
+	return columns + ", schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '')"
+}
+
+// Select renders s.
+func (d Dialect) Select(s Select) string {
+	var b strings.Builder
+	b.WriteString("SELECT ")
+	b.WriteString(d.cellColumns())
+	b.WriteString(" FROM %[1]s")
+	for i, cond := range s.Where {
+		if i == 0 {
+			b.WriteString(" WHERE ")
+		} else {
+			b.WriteString(" AND ")
+		}
+		if cond.Expr != nil {
+			b.WriteString(cond.Expr(d.Placeholder(i + 1)))
+			continue
+		}
+		b.WriteString(cond.Column + " " + cond.Op + " " + d.Placeholder(i+1))
+	}
+	if s.OrderBy != "" {
+		b.WriteString(" ORDER BY " + s.OrderBy)
+	}
+	if s.Limit != "" {
+		b.WriteString(" LIMIT " + s.Limit)
+	}
+	return b.String()
+}
+
+// GetCell reads a cell by (row_key, column_name, ref_key). It asks for two
+// rows so that a duplicate can be detected.
+func (d Dialect) GetCell() string {
+	return d.Select(Select{
+		Where: []Cond{Eq("row_key"), Eq("column_name"), Eq("ref_key")},
+		Limit: "2",
+	})
+}
+
+// GetCellLatest reads the version of (row_key, column_name) with the highest
+// ref_key, the last written of them if several share it.
+func (d Dialect) GetCellLatest() string {
+	return d.Select(Select{
+		Where:   []Cond{Eq("row_key"), Eq("column_name")},
+		OrderBy: "ref_key DESC, added_at DESC",
+		Limit:   "1",
+	})
+}
+
+// Exists reads which of n (row_key, column_name) pairs, given as 2n
+// arguments, have cells, without reading the cells.
+func (d Dialect) Exists(n int) string {
+	var b strings.Builder
+	b.WriteString("SELECT DISTINCT row_key, column_name FROM %[1]s WHERE ")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(" OR ")
+		}
+		b.WriteString("( row_key = " + d.Placeholder(2*i+1) + " AND column_name = " + d.Placeholder(2*i+2) + " )")
+	}
+	return b.String()
+}
+
+// PartitionRead reads the cells after the argument in the location column
+// %[2]s, at most %[3]d of them.
+func (d Dialect) PartitionRead() string {
+	return d.Select(Select{
+		Where:   []Cond{{Column: "%[2]s", Op: ">"}},
+		OrderBy: "%[2]s",
+		Limit:   "%[3]d",
+	})
+}
+
+// Inclusive returns the partition read statement with its lower bound on the
+// location column %[2]s inclusive, ">=" in place of ">"; see
+// models.WithInclusive.
+func Inclusive(statement string) string {
+	return strings.Replace(statement, "%[2]s > ", "%[2]s >= ", 1)
+}
+
+// PartitionReadSchemaVersion is PartitionRead keeping only the cells whose
+// schema_version is the second argument.
+func (d Dialect) PartitionReadSchemaVersion() string {
+	return d.Select(Select{
+		Where:   []Cond{{Column: "%[2]s", Op: ">"}, Eq("schema_version")},
+		OrderBy: "%[2]s",
+		Limit:   "%[3]d",
+	})
+}
+
+// PartitionReadTag is PartitionRead keeping only the cells whose metadata
+// holds the tag in the second argument.
+func (d Dialect) PartitionReadTag() string {
+	return d.Select(Select{
+		Where:   []Cond{{Column: "%[2]s", Op: ">"}, {Expr: d.HasTag}},
+		OrderBy: "%[2]s",
+		Limit:   "%[3]d",
+	})
+}
+
+// PartitionReadCorrelation is PartitionRead keeping only the cells whose
+// correlation_id is the second argument.
+func (d Dialect) PartitionReadCorrelation() string {
+	return d.Select(Select{
+		Where:   []Cond{{Column: "%[2]s", Op: ">"}, Eq("correlation_id")},
+		OrderBy: "%[2]s",
+		Limit:   "%[3]d",
+	})
+}
+
+// PartitionReadWhere is PartitionRead keeping only the cells whose promoted
+// column is the second argument. column must have been validated, see
+// models.PromotedColumn.
+func (d Dialect) PartitionReadWhere(column string) string {
+	return d.Select(Select{
+		Where:   []Cond{{Column: "%[2]s", Op: ">"}, Eq(column)},
+		OrderBy: "%[2]s",
+		Limit:   "%[3]d",
+	})
+}
+
+// FeedRead reads the versions of every column of row_key with a ref_key
+// below the second argument, newest first, at most %[2]d of them. Versions
+// sharing a ref_key and column are in added_at order, newest first.
+func (d Dialect) FeedRead() string {
+	return d.Select(Select{
+		Where:   []Cond{Eq("row_key"), {Column: "ref_key", Op: "<"}},
+		OrderBy: "ref_key DESC, column_name, added_at DESC",
+		Limit:   "%[2]d",
+	})
+}
+
+// PartitionLatestPerRow reads the latest versions of each row, at most as
+// many as the argument, by descending ref_key across its columns, the last
+// written first among versions sharing one. Rows are in row_key order, and
+// at most %[2]d cells are read.
+func (d Dialect) PartitionLatestPerRow() string {
+	return "SELECT " + d.cellColumns() + " FROM ( SELECT *, ROW_NUMBER() OVER ( PARTITION BY row_key ORDER BY ref_key DESC, added_at DESC ) AS row_rank FROM %[1]s ) AS ranked WHERE row_rank <= " + d.Placeholder(1) + " ORDER BY row_key, row_rank LIMIT %[2]d"
+}
+
+// ReadVersions reads the ref_key and added_at of every version of
+// (row_key, column_name), in ref_key and then added_at order, locking them.
+func (d Dialect) ReadVersions() string {
+	return "SELECT ref_key, added_at FROM %[1]s WHERE row_key = " + d.Placeholder(1) + " AND column_name = " + d.Placeholder(2) + " ORDER BY ref_key, added_at" + d.ForUpdate
+}
+
+// SetRefKey sets the ref_key of the version added at the second argument to
+// the first, leaving the rest of it alone.
+func (d Dialect) SetRefKey() string {
+	return "UPDATE %[1]s SET ref_key = " + d.Placeholder(1) + " WHERE added_at = " + d.Placeholder(2)
+}
+
+// Version is the ref key and added_at of a version of a cell, as read by
+// ReadVersions.
+type Version struct {
+	RefKey  int64
+	AddedAt int64
+}
+
+// Resequence takes the versions of a cell in ReadVersions order and returns
+// those that share a ref key with one added before them, each with the ref
+// key it moves to: the ones after the highest, in the order they were added.
+func Resequence(versions []Version) []Version {
+	var moved []Version
+	for i := 1; i < len(versions); i++ {
+		if versions[i].RefKey == versions[i-1].RefKey {
+			moved = append(moved, versions[i])
+		}
+	}
+	sort.SliceStable(moved, func(i, j int) bool {
+		return moved[i].AddedAt < moved[j].AddedAt
+	})
+	for i := range moved {
+		moved[i].RefKey = versions[len(versions)-1].RefKey + int64(i) + 1
+	}
+	return moved
+}
+
+// PutCell inserts a cell: row_key, column_name, ref_key, body, checksum if
+// the dialect has one, schema_version, metadata, causation_id and
+// correlation_id, see ID, and created_at, see CreatedAt.
+func (d Dialect) PutCell() string {
+	columns := []string{"row_key", "column_name", "ref_key", "body"}
+	if d.Checksum {
+		columns = append(columns, "checksum")
+	}
+	columns = append(columns, "schema_version", "metadata", "causation_id", "correlation_id", "created_at")
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = d.Placeholder(i + 1)
+	}
+	// A cell written without a created_at is stamped with the write time.
+	placeholders[len(columns)-1] = "COALESCE(" + placeholders[len(columns)-1] + ", " + d.Now + ")"
+	return "INSERT INTO %[1]s ( " + strings.Join(columns, ", ") + " ) VALUES(" + strings.Join(placeholders, ", ") + ")"
+}
+
+// PutCellIfAbsent is PutCell inserting nothing, rather than failing, if
+// the cell already exists. It affects one row if it inserts the cell and
+// none if it does not.
+func (d Dialect) PutCellIfAbsent() string {
+	return d.PutCell() + d.OnConflictIgnore
+}
+
+// Project rewrites statement, a read of whole cells, to read in place of
+// each body a JSON object mapping each of paths (see models.SplitPath) to
+// the value at that path in the body, null if there is none. The checksum
+// is of the whole body, so it reads back as -1 and is not checked.
+func (d Dialect) Project(statement string, paths []string) (string, error) {
+	if len(paths) == 0 {
+		return "", fmt.Errorf("no paths to project")
+	}
+	prefix := "SELECT " + d.cellColumns() + " "
+	if !strings.HasPrefix(statement, prefix) {
+		return "", fmt.Errorf("cannot project %q", statement)
+	}
+
+	pairs := make([]string, len(paths))
+	for i, path := range paths {
+		keys, err := models.SplitPath(path)
+		if err != nil {
+			return "", err
+		}
+		pairs[i] = "'" + path + "', " + d.Extract(keys)
+	}
+	body := d.Object + "(" + strings.Join(pairs, ", ") + ")"
+	return "SELECT " + d.columns(body, "-1") + " " + statement[len(prefix):], nil
+}
+
+// PromoteColumn returns the statements that add col to the table %[1]s,
+// generated from the body so that every write populates it, and index it.
+func (d Dialect) PromoteColumn(col models.PromotedColumn) ([]string, error) {
+	err := col.Validate()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := models.SplitPath(col.Path)
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"ALTER TABLE %[1]s ADD COLUMN " + col.Name + " " + col.SQLType + " " + d.Generated(keys, col.SQLType),
+		"CREATE INDEX %[1]s_" + col.Name + "_idx ON %[1]s ( " + col.Name + " )",
+	}, nil
+}
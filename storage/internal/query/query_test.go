@@ -0,0 +1,216 @@
+package query
+
+import (
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+	"reflect"
+	"testing"
+)
+
+func TestStatements(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		name    string
+		sql     string
+		want    string
+	}{
+		{SQLite, "GetCell", SQLite.GetCell(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE row_key = ? AND column_name = ? AND ref_key = ? LIMIT 2"},
+		{MySQL, "GetCell", MySQL.GetCell(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE row_key = ? AND column_name = ? AND ref_key = ? LIMIT 2"},
+		{Postgres, "GetCell", Postgres.GetCell(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE row_key = $1 AND column_name = $2 AND ref_key = $3 LIMIT 2"},
+
+		{SQLite, "GetCellLatest", SQLite.GetCellLatest(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE row_key = ? AND column_name = ? ORDER BY ref_key DESC, added_at DESC LIMIT 1"},
+		{MySQL, "GetCellLatest", MySQL.GetCellLatest(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE row_key = ? AND column_name = ? ORDER BY ref_key DESC, added_at DESC LIMIT 1"},
+		{Postgres, "GetCellLatest", Postgres.GetCellLatest(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE row_key = $1 AND column_name = $2 ORDER BY ref_key DESC, added_at DESC LIMIT 1"},
+
+		{SQLite, "PartitionRead", SQLite.PartitionRead(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > ? ORDER BY %[2]s LIMIT %[3]d"},
+		{MySQL, "PartitionRead", MySQL.PartitionRead(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > ? ORDER BY %[2]s LIMIT %[3]d"},
+		{Postgres, "PartitionRead", Postgres.PartitionRead(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > $1 ORDER BY %[2]s LIMIT %[3]d"},
+		{SQLite, "Inclusive", Inclusive(SQLite.PartitionRead()), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s >= ? ORDER BY %[2]s LIMIT %[3]d"},
+		{Postgres, "Inclusive", Inclusive(Postgres.PartitionReadTag()), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s >= $1 AND metadata::jsonb @> $2::jsonb ORDER BY %[2]s LIMIT %[3]d"},
+
+		{SQLite, "PartitionReadSchemaVersion", SQLite.PartitionReadSchemaVersion(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > ? AND schema_version = ? ORDER BY %[2]s LIMIT %[3]d"},
+		{MySQL, "PartitionReadSchemaVersion", MySQL.PartitionReadSchemaVersion(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > ? AND schema_version = ? ORDER BY %[2]s LIMIT %[3]d"},
+		{Postgres, "PartitionReadSchemaVersion", Postgres.PartitionReadSchemaVersion(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > $1 AND schema_version = $2 ORDER BY %[2]s LIMIT %[3]d"},
+
+		{SQLite, "PartitionReadTag", SQLite.PartitionReadTag(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > ? AND EXISTS (SELECT 1 FROM json_each(metadata) AS m, json_each(?) AS t WHERE m.key = t.key AND m.value = t.value) ORDER BY %[2]s LIMIT %[3]d"},
+		{MySQL, "PartitionReadTag", MySQL.PartitionReadTag(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > ? AND JSON_CONTAINS(metadata, ?) ORDER BY %[2]s LIMIT %[3]d"},
+		{Postgres, "PartitionReadTag", Postgres.PartitionReadTag(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > $1 AND metadata::jsonb @> $2::jsonb ORDER BY %[2]s LIMIT %[3]d"},
+		{SQLite, "PartitionReadCorrelation", SQLite.PartitionReadCorrelation(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > ? AND correlation_id = ? ORDER BY %[2]s LIMIT %[3]d"},
+		{MySQL, "PartitionReadCorrelation", MySQL.PartitionReadCorrelation(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > ? AND correlation_id = ? ORDER BY %[2]s LIMIT %[3]d"},
+		{Postgres, "PartitionReadCorrelation", Postgres.PartitionReadCorrelation(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > $1 AND correlation_id = $2 ORDER BY %[2]s LIMIT %[3]d"},
+		{SQLite, "PartitionReadWhere", SQLite.PartitionReadWhere("client_id"), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > ? AND client_id = ? ORDER BY %[2]s LIMIT %[3]d"},
+		{MySQL, "PartitionReadWhere", MySQL.PartitionReadWhere("client_id"), "SELECT added_at, row_key, column_name, ref_key, body, created_at, schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > ? AND client_id = ? ORDER BY %[2]s LIMIT %[3]d"},
+		{Postgres, "PartitionReadWhere", Postgres.PartitionReadWhere("client_id"), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > $1 AND client_id = $2 ORDER BY %[2]s LIMIT %[3]d"},
+
+		{SQLite, "FeedRead", SQLite.FeedRead(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE row_key = ? AND ref_key < ? ORDER BY ref_key DESC, column_name, added_at DESC LIMIT %[2]d"},
+		{MySQL, "FeedRead", MySQL.FeedRead(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE row_key = ? AND ref_key < ? ORDER BY ref_key DESC, column_name, added_at DESC LIMIT %[2]d"},
+		{Postgres, "FeedRead", Postgres.FeedRead(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE row_key = $1 AND ref_key < $2 ORDER BY ref_key DESC, column_name, added_at DESC LIMIT %[2]d"},
+
+		{SQLite, "PartitionLatestPerRow", SQLite.PartitionLatestPerRow(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM ( SELECT *, ROW_NUMBER() OVER ( PARTITION BY row_key ORDER BY ref_key DESC, added_at DESC ) AS row_rank FROM %[1]s ) AS ranked WHERE row_rank <= ? ORDER BY row_key, row_rank LIMIT %[2]d"},
+		{Postgres, "PartitionLatestPerRow", Postgres.PartitionLatestPerRow(), "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM ( SELECT *, ROW_NUMBER() OVER ( PARTITION BY row_key ORDER BY ref_key DESC, added_at DESC ) AS row_rank FROM %[1]s ) AS ranked WHERE row_rank <= $1 ORDER BY row_key, row_rank LIMIT %[2]d"},
+
+		{SQLite, "Exists", SQLite.Exists(2), "SELECT DISTINCT row_key, column_name FROM %[1]s WHERE ( row_key = ? AND column_name = ? ) OR ( row_key = ? AND column_name = ? )"},
+		{Postgres, "Exists", Postgres.Exists(2), "SELECT DISTINCT row_key, column_name FROM %[1]s WHERE ( row_key = $1 AND column_name = $2 ) OR ( row_key = $3 AND column_name = $4 )"},
+
+		{SQLite, "PutCell", SQLite.PutCell(), "INSERT INTO %[1]s ( row_key, column_name, ref_key, body, checksum, schema_version, metadata, causation_id, correlation_id, created_at ) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(?, datetime('now')))"},
+		{MySQL, "PutCell", MySQL.PutCell(), "INSERT INTO %[1]s ( row_key, column_name, ref_key, body, schema_version, metadata, causation_id, correlation_id, created_at ) VALUES(?, ?, ?, ?, ?, ?, ?, ?, COALESCE(?, UTC_TIMESTAMP()))"},
+		{Postgres, "PutCell", Postgres.PutCell(), "INSERT INTO %[1]s ( row_key, column_name, ref_key, body, checksum, schema_version, metadata, causation_id, correlation_id, created_at ) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, COALESCE($10, (CURRENT_TIMESTAMP AT TIME ZONE 'UTC')))"},
+		{SQLite, "PutCellIfAbsent", SQLite.PutCellIfAbsent(), "INSERT INTO %[1]s ( row_key, column_name, ref_key, body, checksum, schema_version, metadata, causation_id, correlation_id, created_at ) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(?, datetime('now'))) ON CONFLICT DO NOTHING"},
+		{MySQL, "PutCellIfAbsent", MySQL.PutCellIfAbsent(), "INSERT INTO %[1]s ( row_key, column_name, ref_key, body, schema_version, metadata, causation_id, correlation_id, created_at ) VALUES(?, ?, ?, ?, ?, ?, ?, ?, COALESCE(?, UTC_TIMESTAMP())) ON DUPLICATE KEY UPDATE row_key = row_key"},
+		{Postgres, "PutCellIfAbsent", Postgres.PutCellIfAbsent(), "INSERT INTO %[1]s ( row_key, column_name, ref_key, body, checksum, schema_version, metadata, causation_id, correlation_id, created_at ) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, COALESCE($10, (CURRENT_TIMESTAMP AT TIME ZONE 'UTC'))) ON CONFLICT DO NOTHING"},
+
+		{SQLite, "ReadVersions", SQLite.ReadVersions(), "SELECT ref_key, added_at FROM %[1]s WHERE row_key = ? AND column_name = ? ORDER BY ref_key, added_at"},
+		{MySQL, "ReadVersions", MySQL.ReadVersions(), "SELECT ref_key, added_at FROM %[1]s WHERE row_key = ? AND column_name = ? ORDER BY ref_key, added_at FOR UPDATE"},
+		{Postgres, "ReadVersions", Postgres.ReadVersions(), "SELECT ref_key, added_at FROM %[1]s WHERE row_key = $1 AND column_name = $2 ORDER BY ref_key, added_at FOR UPDATE"},
+		{SQLite, "SetRefKey", SQLite.SetRefKey(), "UPDATE %[1]s SET ref_key = ? WHERE added_at = ?"},
+		{Postgres, "SetRefKey", Postgres.SetRefKey(), "UPDATE %[1]s SET ref_key = $1 WHERE added_at = $2"},
+	}
+	for _, test := range tests {
+		if test.sql != test.want {
+			t.Errorf("%s %s:\n got: %s\nwant: %s", test.dialect.Name, test.name, test.sql, test.want)
+		}
+	}
+}
+
+func TestResequence(t *testing.T) {
+	// Ref key 2 is held three times and 4 twice; the extra versions move
+	// past 4 in the order they were added.
+	versions := []Version{{1, 1}, {2, 2}, {2, 5}, {2, 7}, {3, 3}, {4, 4}, {4, 6}}
+	want := []Version{{5, 5}, {6, 6}, {7, 7}}
+	if got := Resequence(versions); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if got := Resequence(versions[:2]); len(got) != 0 {
+		t.Fatalf("expected nothing to move, got %v", got)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	got := fmt.Sprintf(Postgres.PartitionRead(), "cell", "added_at", 10)
+	want := "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM cell WHERE added_at > $1 ORDER BY added_at LIMIT 10"
+	if got != want {
+		t.Errorf("got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestProject(t *testing.T) {
+	paths := []string{"name", "address.city"}
+	tests := []struct {
+		dialect Dialect
+		want    string
+	}{
+		{SQLite, `SELECT added_at, row_key, column_name, ref_key, json_object('name', body -> '$."name"', 'address.city', body -> '$."address"."city"'), created_at, -1, schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > ? ORDER BY %[2]s LIMIT %[3]d`},
+		{MySQL, `SELECT added_at, row_key, column_name, ref_key, JSON_OBJECT('name', JSON_EXTRACT(body, '$."name"'), 'address.city', JSON_EXTRACT(body, '$."address"."city"')), created_at, schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > ? ORDER BY %[2]s LIMIT %[3]d`},
+		{Postgres, `SELECT added_at, row_key, column_name, ref_key, json_build_object('name', body::jsonb #> '{name}', 'address.city', body::jsonb #> '{address,city}'), created_at, -1, schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > $1 ORDER BY %[2]s LIMIT %[3]d`},
+	}
+	for _, test := range tests {
+		got, err := test.dialect.Project(test.dialect.PartitionRead(), paths)
+		if err != nil {
+			t.Fatalf("%s: %v", test.dialect.Name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s:\n got: %s\nwant: %s", test.dialect.Name, got, test.want)
+		}
+	}
+
+	for _, bad := range [][]string{nil, {"name'"}, {"a..b"}} {
+		_, err := SQLite.Project(SQLite.PartitionRead(), bad)
+		if err == nil {
+			t.Errorf("expected an error projecting %q", bad)
+		}
+	}
+	_, err := SQLite.Project("SELECT 1", paths)
+	if err == nil {
+		t.Error("expected an error projecting a statement that does not read cells")
+	}
+}
+
+func TestPromoteColumn(t *testing.T) {
+	col := models.PromoteColumn("client_id", "client.id", "INTEGER")
+	tests := []struct {
+		dialect Dialect
+		want    string
+	}{
+		{SQLite, `ALTER TABLE %[1]s ADD COLUMN client_id INTEGER GENERATED ALWAYS AS (json_extract(body, '$."client"."id"')) VIRTUAL`},
+		{MySQL, `ALTER TABLE %[1]s ADD COLUMN client_id INTEGER GENERATED ALWAYS AS (JSON_UNQUOTE(JSON_EXTRACT(body, '$."client"."id"'))) STORED`},
+		{Postgres, `ALTER TABLE %[1]s ADD COLUMN client_id INTEGER GENERATED ALWAYS AS ((body::jsonb #>> '{client,id}')::INTEGER) STORED`},
+	}
+	for _, test := range tests {
+		got, err := test.dialect.PromoteColumn(col)
+		if err != nil {
+			t.Fatalf("%s: %v", test.dialect.Name, err)
+		}
+		want := []string{test.want, "CREATE INDEX %[1]s_client_id_idx ON %[1]s ( client_id )"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\n got: %q\nwant: %q", test.dialect.Name, got, want)
+		}
+	}
+
+	for _, bad := range []models.PromotedColumn{
+		models.PromoteColumn("", "client.id", "INTEGER"),
+		models.PromoteColumn("client id", "client.id", "INTEGER"),
+		models.PromoteColumn("1client", "client.id", "INTEGER"),
+		models.PromoteColumn("Body", "client.id", "INTEGER"),
+		models.PromoteColumn("client_id", "client'id", "INTEGER"),
+		models.PromoteColumn("client_id", "client.id", ""),
+		models.PromoteColumn("client_id", "client.id", "INTEGER; DROP TABLE cell"),
+	} {
+		_, err := SQLite.PromoteColumn(bad)
+		if err == nil {
+			t.Errorf("expected an error promoting %+v", bad)
+		}
+	}
+}
+
+func TestColumnsRename(t *testing.T) {
+	columns, err := NewColumns(map[string]string{"row_key": "rk", "body": "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statement, err := SQLite.Project(SQLite.GetCell(), []string{"body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := columns.Rename(statement)
+	want := `SELECT added_at, rk, column_name, ref_key, json_object('body', data -> '$."body"'), created_at, -1, schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE rk = ? AND column_name = ? AND ref_key = ? LIMIT 2`
+	if got != want {
+		t.Errorf("got: %s\nwant: %s", got, want)
+	}
+
+	if got := (Columns{}).Rename(statement); got != statement {
+		t.Errorf("expected the zero Columns to rename nothing, got %s", got)
+	}
+}
+
+func TestColumnsDetect(t *testing.T) {
+	// A table from before checksum, metadata and the lineage columns.
+	columns := Columns{}.Detect([]models.ColumnInfo{{Name: "added_at"}, {Name: "row_key"}, {Name: "column_name"}, {Name: "ref_key"}, {Name: "body"}, {Name: "created_at"}, {Name: "schema_version"}})
+
+	got := columns.Rename(SQLite.GetCell())
+	want := "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(NULL, -1), schema_version, COALESCE(NULL, ''), COALESCE(NULL, ''), COALESCE(NULL, '') FROM %[1]s WHERE row_key = ? AND column_name = ? AND ref_key = ? LIMIT 2"
+	if got != want {
+		t.Errorf("got: %s\nwant: %s", got, want)
+	}
+
+	statement, args := columns.Insert(Postgres.PutCellIfAbsent(), "row", "BASE", 1, "{}", 42, 2, "{}", "command-1", "request-1", nil)
+	want = "INSERT INTO %[1]s ( row_key, column_name, ref_key, body, schema_version, created_at ) VALUES($1, $2, $3, $4, $5, COALESCE($6, (CURRENT_TIMESTAMP AT TIME ZONE 'UTC'))) ON CONFLICT DO NOTHING"
+	if statement != want {
+		t.Errorf("got: %s\nwant: %s", statement, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"row", "BASE", 1, "{}", 2, nil}) {
+		t.Errorf("expected the checksum, metadata and lineage arguments left out, got %v", args)
+	}
+
+	// CREATE statements keep every column.
+	create := "CREATE TABLE %s ( checksum INTEGER, metadata TEXT )"
+	if got := columns.Rename(create); got != create {
+		t.Errorf("expected %s unchanged, got %s", create, got)
+	}
+
+	// A table with every column leaves statements alone.
+	full := Columns{}.Detect([]models.ColumnInfo{{Name: "checksum"}, {Name: "schema_version"}, {Name: "metadata"}, {Name: "causation_id"}, {Name: "correlation_id"}})
+	statement, args = full.Insert(SQLite.PutCell(), "row", "BASE", 1, "{}", 42, 2, "{}", "command-1", "request-1", nil)
+	if statement != SQLite.PutCell() || len(args) != 10 {
+		t.Errorf("expected PutCell unchanged, got %s with %d arguments", statement, len(args))
+	}
+}
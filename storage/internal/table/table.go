@@ -0,0 +1,52 @@
+// Package table resolves which table a SQL storage operation runs against.
+package table
+
+import (
+	"context"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+)
+
+// Default is the table used when no resolver is configured.
+const Default = "cell"
+
+// Resolver picks a table per operation from the request context. Table
+// names end up in SQL text, so only names on the allowlist are accepted.
+type Resolver struct {
+	fn      func(ctx context.Context) string
+	allowed map[string]struct{}
+}
+
+// NewResolver returns a Resolver that calls fn and accepts only the tables
+// in allowed.
+func NewResolver(fn func(ctx context.Context) string, allowed ...string) *Resolver {
+	r := &Resolver{fn: fn, allowed: make(map[string]struct{})}
+	for _, name := range allowed {
+		r.allowed[name] = struct{}{}
+	}
+	return r
+}
+
+// Resolve returns the table for ctx. A nil Resolver always returns Default.
+func (r *Resolver) Resolve(ctx context.Context) (string, error) {
+	if r == nil {
+		return Default, nil
+	}
+	name := r.fn(ctx)
+	if _, ok := r.allowed[name]; !ok {
+		return "", fmt.Errorf("%w: %q", models.ErrTableNotAllowed, name)
+	}
+	return name, nil
+}
+
+// Index returns the name of the secondary index table that goes with the
+// cell table name.
+func Index(name string) string {
+	return name + "_index"
+}
+
+// Checkpoint returns the name of the checkpoint table that goes with the
+// cell table name.
+func Checkpoint(name string) string {
+	return name + "_checkpoint"
+}
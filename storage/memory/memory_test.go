@@ -1,11 +1,830 @@
 package memory
 
 import (
+	"context"
+	"errors"
+	"github.com/rbastic/go-schemaless"
+	"github.com/rbastic/go-schemaless/core"
+	"github.com/rbastic/go-schemaless/models"
 	"github.com/rbastic/go-schemaless/storagetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMemory(t *testing.T) {
 	m := New()
 	storagetest.StorageTest(t, m)
 }
+
+func TestGetCellDuplicate(t *testing.T) {
+	m := New()
+	defer m.Destroy(context.TODO())
+
+	// Simulate a shard whose unique index was never created.
+	err := exec(m.store, "DROP INDEX uniqcell_idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second"} {
+		err = m.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, found, err := m.GetCell(context.TODO(), "row", "BASE", 1)
+	if err != models.ErrDuplicateCell {
+		t.Fatalf("expected ErrDuplicateCell, got found=%v err=%v", found, err)
+	}
+}
+
+type tenantKey struct{}
+
+func TestTableResolver(t *testing.T) {
+	m := New().WithTableResolver(func(ctx context.Context) string {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		return tenant
+	}, "tenant_a", "tenant_b")
+	defer m.Destroy(context.TODO())
+
+	for _, name := range []string{"tenant_a", "tenant_b"} {
+		err := m.CreateTable(context.TODO(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctxA := context.WithValue(context.TODO(), tenantKey{}, "tenant_a")
+	ctxB := context.WithValue(context.TODO(), tenantKey{}, "tenant_b")
+
+	err := m.PutCell(ctxA, "row", "BASE", 1, models.Cell{Body: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same cell can be written once per tenant.
+	err = m.PutCell(ctxB, "row", "BASE", 1, models.Cell{Body: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ctx, want := range map[context.Context]string{ctxA: "a", ctxB: "b"} {
+		cell, found, err := m.GetCellLatest(ctx, "row", "BASE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || cell.Body != want {
+			t.Fatalf("expected body %q, got found=%v body=%q", want, found, cell.Body)
+		}
+	}
+
+	_, _, err = m.GetCell(context.TODO(), "row", "BASE", 1)
+	if !errors.Is(err, models.ErrTableNotAllowed) {
+		t.Fatalf("expected ErrTableNotAllowed without a tenant, got %v", err)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	m := New()
+	defer m.Destroy(context.TODO())
+
+	err := m.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: `{"a": 1}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = exec(m.store, `UPDATE cell SET body = '{"a": 2}'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = m.GetCell(context.TODO(), "row", "BASE", 1)
+	if !errors.Is(err, models.ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch after tampering, got %v", err)
+	}
+	_, _, err = m.PartitionRead(context.TODO(), 0, "added_at", 0, 10)
+	if !errors.Is(err, models.ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch from PartitionRead, got %v", err)
+	}
+
+	// Rows written before checksums existed are not verified.
+	err = exec(m.store, "UPDATE cell SET checksum = NULL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cell, found, err := m.GetCellLatest(context.TODO(), "row", "BASE")
+	if err != nil || !found || cell.Body != `{"a": 2}` {
+		t.Fatalf("expected unverified legacy cell, got %v %v %v", cell, found, err)
+	}
+}
+
+func TestPartitionReadCursor(t *testing.T) {
+	m := New()
+	defer m.Destroy(context.TODO())
+
+	// Cells written within the same second share a created_at, so page
+	// boundaries fall inside a group of identical timestamps.
+	for i := 0; i < 5; i++ {
+		for refKey := int64(1); refKey <= 2; refKey++ {
+			err := m.PutCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", refKey, models.Cell{Body: "value"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	seen := make(map[string]int)
+	token := ""
+	for page := 0; page < 10; page++ {
+		cells, found, err := m.PartitionRead(context.TODO(), 0, "cursor", token, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			break
+		}
+		for _, cell := range cells {
+			seen[cell.RowKey+"/"+strconv.FormatInt(cell.RefKey, 10)]++
+		}
+		token = models.CursorAfter(cells[len(cells)-1])
+	}
+
+	if len(seen) != 10 {
+		t.Fatalf("expected 10 distinct cells, got %d: %v", len(seen), seen)
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("%s was visited %d times", key, n)
+		}
+	}
+
+	_, _, err := m.PartitionRead(context.TODO(), 0, "cursor", "not a cursor", 3)
+	if err == nil {
+		t.Fatal("expected an error for an invalid cursor")
+	}
+}
+
+func TestPartitionReadInclusive(t *testing.T) {
+	m := New()
+	defer m.Destroy(context.TODO())
+
+	for i := 0; i < 3; i++ {
+		err := m.PutCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", 1, models.Cell{Body: "value"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The cells are added at 1, 2 and 3.
+	cells, _, err := m.PartitionRead(context.TODO(), 0, "added_at", 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 1 || cells[0].AddedAt != 3 {
+		t.Fatalf("expected only the cell added at 3 by default, got %v", cells)
+	}
+
+	ctx := models.WithInclusive(context.TODO(), true)
+	cells, _, err = m.PartitionRead(ctx, 0, "added_at", 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 2 || cells[0].AddedAt != 2 || cells[1].AddedAt != 3 {
+		t.Fatalf("expected the cells added at 2 and 3 when inclusive, got %v", cells)
+	}
+
+	// Cursors resume after the cell they name either way.
+	cells, _, err = m.PartitionRead(ctx, 0, "cursor", models.CursorAfter(cells[0]), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 1 || cells[0].AddedAt != 3 {
+		t.Fatalf("expected only the cell after the cursor, got %v", cells)
+	}
+}
+
+func TestLogShard(t *testing.T) {
+	zcore, logs := observer.New(zap.InfoLevel)
+	m := New()
+	m.sugar = zap.New(zcore).Sugar()
+	ds := schemaless.New().WithSource([]core.Shard{{Name: "shard7", Backend: m}})
+	defer ds.Destroy(context.TODO())
+
+	err := ds.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ds.GetCellLatest(context.TODO(), "row", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if logs.Len() == 0 {
+		t.Fatal("expected log entries")
+	}
+	for _, entry := range logs.All() {
+		if shard, ok := entry.ContextMap()["shard"]; !ok || shard != "shard7" {
+			t.Errorf("%q: expected shard shard7, got %v", entry.Message, entry.ContextMap())
+		}
+	}
+}
+
+func TestResultLogging(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		zcore, logs := observer.New(zap.InfoLevel)
+		m := New().WithResultLogging(enabled)
+		m.sugar = zap.New(zcore).Sugar()
+
+		for i := int64(1); i <= 3; i++ {
+			err := m.PutCell(context.TODO(), "row", "BASE", i, models.Cell{Body: "{}"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		cells, _, err := m.PartitionRead(context.TODO(), 0, "added_at", 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = m.GetCellLatest(context.TODO(), "row", "BASE")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results := logs.FilterMessageSnippet("scanned data").Len()
+		if !enabled && results != 0 {
+			t.Errorf("expected no result logs when disabled, got %d", results)
+		}
+		if enabled && results != len(cells)+1 {
+			t.Errorf("expected %d result logs when enabled, got %d", len(cells)+1, results)
+		}
+		if logs.FilterMessage("PartitionRead").Len() == 0 {
+			t.Errorf("enabled=%v: expected PartitionRead itself to still be logged", enabled)
+		}
+		m.Destroy(context.TODO())
+	}
+}
+
+func TestClose(t *testing.T) {
+	var closer io.Closer = New()
+	for i := 0; i < 2; i++ {
+		err := closer.Close()
+		if err != nil {
+			t.Fatalf("close %d: %v", i, err)
+		}
+	}
+}
+
+type loggerKey struct{}
+
+func TestContextLogger(t *testing.T) {
+	storeCore, storeLogs := observer.New(zap.InfoLevel)
+	reqCore, reqLogs := observer.New(zap.InfoLevel)
+	m := New().WithContextLogger(loggerKey{})
+	m.sugar = zap.New(storeCore).Sugar()
+	defer m.Destroy(context.TODO())
+
+	ctx := context.WithValue(context.TODO(), loggerKey{}, zap.New(reqCore).Sugar().With("request", "r1"))
+	err := m.PutCell(ctx, "row", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = m.PartitionRead(ctx, 0, "added_at", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads := reqLogs.FilterMessage("PartitionRead").All()
+	if len(reads) == 0 {
+		t.Fatal("expected PartitionRead to log to the context logger")
+	}
+	if reads[0].ContextMap()["request"] != "r1" {
+		t.Errorf("expected the request field, got %v", reads[0].ContextMap())
+	}
+	if storeLogs.Len() != 0 {
+		t.Errorf("expected nothing logged to the store logger, got %d logs", storeLogs.Len())
+	}
+
+	// Without a logger in the context, the store logger is used.
+	_, err = m.GetRow(context.TODO(), "row")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storeLogs.FilterMessage("GetRow").Len() == 0 {
+		t.Error("expected GetRow to fall back to the store logger")
+	}
+	if reqLogs.FilterMessage("GetRow").Len() != 0 {
+		t.Error("expected GetRow not to log to the context logger")
+	}
+}
+
+func TestSampledLogging(t *testing.T) {
+	zcore, logs := observer.New(zap.InfoLevel)
+	m := New()
+	m.sugar = zap.New(zcore).Sugar()
+	defer m.Destroy(context.TODO())
+
+	_, _, err := m.PartitionRead(models.WithSampled(context.TODO(), false), 0, "added_at", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("expected an unsampled call to log nothing at Info, got %d logs", logs.Len())
+	}
+	_, _, err = m.PartitionRead(models.WithSampled(context.TODO(), true), 0, "added_at", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs.FilterMessage("PartitionRead").Len() == 0 {
+		t.Fatal("expected a sampled call to log")
+	}
+}
+
+func BenchmarkGetCellLatest(b *testing.B) {
+	m := New()
+	defer m.Destroy(context.TODO())
+	for i := int64(1); i <= 10; i++ {
+		err := m.PutCell(context.TODO(), "row", "BASE", i, models.Cell{Body: "{}"})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, found, err := m.GetCellLatest(context.TODO(), "row", "BASE")
+		if err != nil || !found {
+			b.Fatalf("found=%v err=%v", found, err)
+		}
+	}
+}
+
+func TestCreatedAtUTC(t *testing.T) {
+	// Neither the writer's zone nor the process's should shift the instant.
+	local := time.Local
+	time.Local = time.FixedZone("JST", 9*60*60)
+	defer func() { time.Local = local }()
+
+	m := New()
+	defer m.Destroy(context.TODO())
+
+	newYork := time.FixedZone("EST", -5*60*60)
+	written := time.Date(2020, 3, 1, 7, 0, 0, 0, newYork)
+	err := m.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: "{}", CreatedAt: &written})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cell, found, err := m.GetCell(context.TODO(), "row", "BASE", 1)
+	if err != nil || !found {
+		t.Fatalf("expected the cell, got found=%v err=%v", found, err)
+	}
+	if !cell.CreatedAt.Equal(written) || cell.CreatedAt.Location() != time.UTC {
+		t.Errorf("expected created_at %s in UTC, got %s", written.UTC(), cell.CreatedAt)
+	}
+
+	for _, after := range []interface{}{written.Add(-time.Second), written.Add(-time.Second).In(newYork), "2020-03-01 11:59:59"} {
+		cells, _, err := m.PartitionRead(context.TODO(), 0, "created_at", after, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cells) != 1 {
+			t.Errorf("expected the cell after %v, got %v", after, cells)
+		}
+	}
+	cells, _, err := m.PartitionRead(context.TODO(), 0, "created_at", written, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 0 {
+		t.Errorf("expected no cell after %s, got %v", written, cells)
+	}
+}
+
+func TestGetCellLatestUnparsableCreatedAt(t *testing.T) {
+	m := New()
+	defer m.Destroy(context.TODO())
+
+	err := m.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: `{"a": 1}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = exec(m.store, "UPDATE cell SET created_at = ''")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cell, found, err := m.GetCellLatest(context.TODO(), "row", "BASE")
+	if err != nil || !found {
+		t.Fatalf("expected the cell despite its created_at, got found=%v err=%v", found, err)
+	}
+	if cell.Body != `{"a": 1}` {
+		t.Errorf("expected the body, got %q", cell.Body)
+	}
+	if cell.CreatedAt != nil {
+		t.Errorf("expected a nil CreatedAt, got %s", cell.CreatedAt)
+	}
+}
+
+func TestPromotedColumn(t *testing.T) {
+	m := New()
+	ds := schemaless.New().WithSource([]core.Shard{{Name: "shard0", Backend: m}})
+	defer ds.Destroy(context.TODO())
+
+	err := m.PromoteColumns(context.TODO(), models.PromoteColumn("client_id", "client.id", "INTEGER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Promoting a column again leaves it as it is.
+	err = m.PromoteColumns(context.TODO(), models.PromoteColumn("client_id", "client.id", "INTEGER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 6; i++ {
+		body := `{"client": {"id": ` + strconv.Itoa(i%2) + `}}`
+		err = ds.PutCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", 1, models.Cell{Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ds.PutCell(context.TODO(), "row6", "BASE", 1, models.Cell{Body: `{"other": 1}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cells, found, err := ds.PartitionReadWhere(context.TODO(), 0, "client_id", 1, "added_at", 0, 10)
+	if err != nil || !found {
+		t.Fatalf("expected cells, got found=%v err=%v", found, err)
+	}
+	var rowKeys []string
+	for _, cell := range cells {
+		rowKeys = append(rowKeys, cell.RowKey)
+	}
+	if want := "row1 row3 row5"; strings.Join(rowKeys, " ") != want {
+		t.Errorf("expected %s, got %v", want, rowKeys)
+	}
+
+	// Filtering pages through a cursor too.
+	cells, _, err = ds.PartitionReadWhere(context.TODO(), 0, "client_id", 0, "cursor", "", 2)
+	if err != nil || len(cells) != 2 {
+		t.Fatalf("expected a page of 2 cells, got %v err=%v", cells, err)
+	}
+	cells, _, err = ds.PartitionReadWhere(context.TODO(), 0, "client_id", 0, "cursor", models.CursorAfter(cells[1]), 2)
+	if err != nil || len(cells) != 1 || cells[0].RowKey != "row4" {
+		t.Fatalf("expected row4 on the last page, got %v err=%v", cells, err)
+	}
+
+	_, _, err = ds.PartitionReadWhere(context.TODO(), 0, "body", "{}", "added_at", 0, 10)
+	if !errors.Is(err, models.ErrNotPromoted) {
+		t.Errorf("expected ErrNotPromoted, got %v", err)
+	}
+}
+
+func TestContinueOnError(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		m := New().WithContinueOnError(enabled)
+		defer m.Destroy(context.TODO())
+
+		for i := 0; i < 5; i++ {
+			err := m.PutCell(context.TODO(), "row"+strconv.Itoa(i), "BASE", 1, models.Cell{Body: "{}"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// row1 no longer scans, and row3 no longer matches its checksum.
+		err := exec(m.store, "UPDATE cell SET ref_key = 'one' WHERE row_key = 'row1'")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = exec(m.store, `UPDATE cell SET body = '{"a": 1}' WHERE row_key = 'row3'`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cells, _, err := m.PartitionRead(context.TODO(), 0, "added_at", 0, 10)
+		if !enabled {
+			if err == nil || len(cells) != 1 {
+				t.Errorf("expected the read to stop at row1, got %v err=%v", cells, err)
+			}
+			continue
+		}
+
+		var rowKeys []string
+		for _, cell := range cells {
+			rowKeys = append(rowKeys, cell.RowKey)
+		}
+		if want := "row0 row2 row4"; strings.Join(rowKeys, " ") != want {
+			t.Errorf("expected %s, got %v", want, rowKeys)
+		}
+		var scanErrs models.ScanErrors
+		if !errors.As(err, &scanErrs) || len(scanErrs) != 2 {
+			t.Fatalf("expected 2 scan errors, got %v", err)
+		}
+		if !errors.Is(err, models.ErrChecksumMismatch) {
+			t.Errorf("expected the checksum mismatch of row3 among %v", err)
+		}
+	}
+}
+
+// legacyTableSQL is a cell table whose columns are named differently.
+const legacyTableSQL = "CREATE TABLE cell ( added_at INTEGER PRIMARY KEY AUTOINCREMENT, rk VARCHAR(36) NOT NULL, col VARCHAR(64) NOT NULL, ver INTEGER NOT NULL, data JSON, created_at DATETIME DEFAULT (datetime('now')), checksum INTEGER, schema_version INTEGER NOT NULL DEFAULT 0, metadata TEXT, causation_id VARCHAR(64), correlation_id VARCHAR(64))"
+
+func TestSchemaColumnMapping(t *testing.T) {
+	newLegacy := func() *Storage {
+		m := New()
+		err := exec(m.store, "DROP TABLE cell")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = exec(m.store, legacyTableSQL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err = m.WithSchemaColumnMapping(map[string]string{"row_key": "rk", "column_name": "col", "ref_key": "ver", "body": "data"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = createIndex(context.TODO(), m.store, "cell", m.columns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	storagetest.StorageTest(t, newLegacy())
+
+	m := newLegacy()
+	defer m.Destroy(context.TODO())
+	err := m.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: `{"a": 1}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rowKey, body string
+	err = m.store.QueryRow("SELECT rk, data FROM cell WHERE col = 'BASE' AND ver = 1").Scan(&rowKey, &body)
+	if err != nil || rowKey != "row" || body != `{"a": 1}` {
+		t.Fatalf("expected the cell in the legacy columns, got %q %q err=%v", rowKey, body, err)
+	}
+
+	// The renamed columns are described under the names of the cell columns.
+	columns, err := m.DescribeTable(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(columns) < 5 || columns[1].Name != "row_key" || columns[4].Name != "body" {
+		t.Fatalf("expected the legacy columns under their cell column names, got %v", columns)
+	}
+
+	for _, bad := range []map[string]string{
+		{"key": "rk"},
+		{"row_key": "rk; DROP TABLE cell"},
+		{"row_key": "col", "column_name": "col"},
+		{"row_key": "body"},
+	} {
+		_, err = New().WithSchemaColumnMapping(bad)
+		if err == nil {
+			t.Errorf("expected an error mapping %v", bad)
+		}
+	}
+}
+
+func TestDescribeTable(t *testing.T) {
+	m := New()
+	defer m.Destroy(context.TODO())
+
+	columns, err := m.DescribeTable(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.ColumnInfo{
+		{Name: "added_at", Type: "INTEGER"},
+		{Name: "row_key", Type: "VARCHAR(64)", NotNull: true},
+		{Name: "column_name", Type: "VARCHAR(64)", NotNull: true},
+		{Name: "ref_key", Type: "INTEGER", NotNull: true},
+		{Name: "body", Type: "JSON"},
+		{Name: "created_at", Type: "DATETIME"},
+		{Name: "checksum", Type: "INTEGER"},
+		{Name: "schema_version", Type: "INTEGER", NotNull: true},
+		{Name: "metadata", Type: "TEXT"},
+		{Name: "causation_id", Type: "VARCHAR(64)"},
+		{Name: "correlation_id", Type: "VARCHAR(64)"},
+	}
+	if !reflect.DeepEqual(columns, want) {
+		t.Fatalf("expected %v, got %v", want, columns)
+	}
+
+	// A promoted column is described along with the others.
+	err = m.PromoteColumns(context.TODO(), models.PromoteColumn("client_id", "client.id", "INTEGER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns, err = m.DescribeTable(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(columns) != len(want)+1 || columns[len(want)].Name != "client_id" {
+		t.Fatalf("expected client_id after the cell columns, got %v", columns)
+	}
+}
+
+// oldTableSQL is a cell table from before checksum, schema_version,
+// metadata, causation_id and correlation_id.
+const oldTableSQL = "CREATE TABLE cell ( added_at INTEGER PRIMARY KEY AUTOINCREMENT, row_key VARCHAR(36) NOT NULL, column_name VARCHAR(64) NOT NULL, ref_key INTEGER NOT NULL, body JSON, created_at DATETIME DEFAULT (datetime('now')))"
+
+func TestDetectedColumns(t *testing.T) {
+	old := New()
+	defer old.Destroy(context.TODO())
+	err := exec(old.store, "DROP TABLE cell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = exec(old.store, oldTableSQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cell := models.Cell{Body: `{"a": 1}`, SchemaVersion: 2, Metadata: map[string]string{"source": "test"}, CorrelationID: "request-1"}
+	err = old.PutCell(context.TODO(), "row", "BASE", 1, cell)
+	if err == nil {
+		t.Fatal("expected writing the missing columns to fail before detection")
+	}
+
+	for _, m := range []*Storage{old, New()} {
+		m, err = m.WithDetectedColumns(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.PutCell(context.TODO(), "row", "BASE", 1, cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = m.PutCellIfAbsent(context.TODO(), "row", "BASE", 2, cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, found, err := m.GetCell(context.TODO(), "row", "BASE", 1)
+		if err != nil || !found || got.Body != cell.Body {
+			t.Fatalf("expected the cell back, got %v found=%v err=%v", got, found, err)
+		}
+		if m == old {
+			if got.SchemaVersion != 0 || got.Metadata != nil || got.CorrelationID != "" {
+				t.Errorf("expected no schema version, metadata or correlation id from the old table, got %v", got)
+			}
+		} else if got.SchemaVersion != 2 || got.Metadata["source"] != "test" || got.CorrelationID != "request-1" {
+			t.Errorf("expected the schema version, metadata and correlation id from the new table, got %v", got)
+		}
+
+		cells, _, err := m.PartitionRead(context.TODO(), 0, "added_at", 0, 10)
+		if err != nil || len(cells) != 2 {
+			t.Fatalf("expected 2 cells, got %d err=%v", len(cells), err)
+		}
+		cells, _, err = m.PartitionReadSchemaVersion(context.TODO(), 0, 0, "added_at", 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m == old && len(cells) != 2 || m != old && len(cells) != 0 {
+			t.Errorf("expected the cells of the old table at schema version 0, got %d", len(cells))
+		}
+		cells, _, err = m.PartitionReadCorrelation(context.TODO(), 0, "request-1", "added_at", 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m == old && len(cells) != 0 || m != old && len(cells) != 2 {
+			t.Errorf("expected the cells of request-1 in the new table only, got %d", len(cells))
+		}
+		m.Destroy(context.TODO())
+	}
+}
+
+func TestVersionTies(t *testing.T) {
+	m := New()
+	defer m.Destroy(context.TODO())
+
+	// Simulate a shard whose unique index was never created.
+	err := exec(m.store, "DROP INDEX uniqcell_idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second", "third"} {
+		err = m.PutCell(context.TODO(), "row", "BASE", 1, models.Cell{Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bodies := func(cells []models.Cell) string {
+		var b []string
+		for _, cell := range cells {
+			b = append(b, cell.Body)
+		}
+		return strings.Join(b, " ")
+	}
+	for i := 0; i < 5; i++ {
+		cells, err := m.GetCellRange(context.TODO(), "row", "BASE", 1, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bodies(cells); got != "first second third" {
+			t.Fatalf("expected GetCellRange in the order added, got %s", got)
+		}
+		cells, err = m.FeedRead(context.TODO(), "row", math.MaxInt64, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bodies(cells); got != "third second first" {
+			t.Fatalf("expected FeedRead newest first, got %s", got)
+		}
+		cell, _, err := m.GetCellLatest(context.TODO(), "row", "BASE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cell.Body != "third" {
+			t.Fatalf("expected the latest to be the last added, got %s", cell.Body)
+		}
+	}
+}
+
+func TestGetCellsSnapshot(t *testing.T) {
+	m := New()
+	defer m.Destroy(context.TODO())
+
+	// The writer rewrites both cells in each of its transactions, so reads
+	// sharing a snapshot always see them with the same body.
+	write := func(i int) error {
+		body := strconv.Itoa(i)
+		return m.PutCells(context.TODO(), "row", []models.Cell{
+			{ColumnName: "BASE", RefKey: 1, Body: body},
+			{ColumnName: "PROFILE", RefKey: 1, Body: body},
+		}, true)
+	}
+	err := write(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			err := write(i)
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	base := models.CellRef{RowKey: "row", ColumnName: "BASE", RefKey: 1}
+	profile := models.CellRef{RowKey: "row", ColumnName: "PROFILE", RefKey: 1}
+	missing := models.CellRef{RowKey: "row", ColumnName: "SETTINGS", RefKey: 1}
+	for i := 0; i < 200; i++ {
+		cells, err := m.GetCellsSnapshot(context.TODO(), []models.CellRef{base, profile, missing})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cells) != 2 {
+			t.Fatalf("expected both cells and not the missing one, got %v", cells)
+		}
+		if cells[base].Body != cells[profile].Body {
+			t.Fatalf("expected one snapshot, got bodies %s and %s", cells[base].Body, cells[profile].Body)
+		}
+	}
+	close(stop)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRaw(t *testing.T) {
+	m := New()
+	defer m.Destroy(context.TODO())
+
+	for refKey := int64(1); refKey <= 3; refKey++ {
+		err := m.PutCell(context.TODO(), "row_raw", "BASE", refKey, models.Cell{Body: `{"n":` + strconv.FormatInt(refKey, 10) + `}`})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A query the Storage does not offer: the sum of a body field.
+	var sum int64
+	err := m.Raw().QueryRowContext(context.TODO(), "SELECT SUM(json_extract(body, '$.n')) FROM cell WHERE row_key = ?", "row_raw").Scan(&sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 6 {
+		t.Fatalf("expected the raw query to sum to 6, got %d", sum)
+	}
+}
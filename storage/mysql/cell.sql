@@ -1,16 +1,42 @@
 DROP TABLE IF EXISTS cell;
+DROP TABLE IF EXISTS cell_index;
+DROP TABLE IF EXISTS cell_checkpoint;
 
 SHOW WARNINGS;
 
 CREATE TABLE cell
 (
 	added_at      INTEGER PRIMARY KEY AUTO_INCREMENT,
-	row_key		  VARCHAR(36) NOT NULL,
+	row_key		  VARCHAR(64) NOT NULL,
 	column_name	  VARCHAR(64) NOT NULL,
 	ref_key		  INTEGER NOT NULL,
 	body		  JSON,
-	created_at    DATETIME DEFAULT CURRENT_TIMESTAMP,
+	created_at    DATETIME DEFAULT (UTC_TIMESTAMP()),
+	schema_version INTEGER NOT NULL DEFAULT 0,
+	metadata      JSON,
+	causation_id  VARCHAR(64),
+	correlation_id VARCHAR(64),
 	UNIQUE `cell_idx`(`row_key`, `column_name`, `ref_key`)
 ) ENGINE=InnoDB;
 
 SHOW WARNINGS;
+
+CREATE TABLE cell_index
+(
+	index_name    VARCHAR(64) NOT NULL,
+	value         VARCHAR(255) NOT NULL,
+	row_key       VARCHAR(64) NOT NULL,
+	column_name   VARCHAR(64) NOT NULL,
+	PRIMARY KEY (`index_name`, `row_key`, `column_name`),
+	INDEX `cell_index_value_idx`(`index_name`, `value`)
+) ENGINE=InnoDB;
+
+SHOW WARNINGS;
+
+CREATE TABLE cell_checkpoint
+(
+	job_name      VARCHAR(128) NOT NULL PRIMARY KEY,
+	value         BIGINT NOT NULL
+) ENGINE=InnoDB;
+
+SHOW WARNINGS;
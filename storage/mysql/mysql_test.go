@@ -4,6 +4,7 @@ import (
 	"github.com/rbastic/go-schemaless/storagetest"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestMySQL(t *testing.T) {
@@ -51,3 +52,21 @@ func TestMySQL(t *testing.T) {
 	}
 	storagetest.StorageTest(t, m)
 }
+
+func TestPoolOptions(t *testing.T) {
+	// Opening does not connect, so no server is needed.
+	m := New().WithHost("localhost").WithPort("3306").WithMaxOpenConns(5)
+	err := m.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.store.Close()
+	m.WithMaxIdleConns(2).WithConnMaxLifetime(time.Minute)
+
+	if got := m.store.Stats().MaxOpenConnections; got != 5 {
+		t.Fatalf("expected the setting made before Open to apply, got %d max open connections", got)
+	}
+	if len(m.pool) != 3 {
+		t.Fatalf("expected 3 pool settings, got %d", len(m.pool))
+	}
+}
@@ -1,15 +1,39 @@
 DROP TABLE IF EXISTS cell;
+DROP TABLE IF EXISTS cell_index;
+DROP TABLE IF EXISTS cell_checkpoint;
 
 CREATE SEQUENCE cell_added_at_seq;
 
 CREATE TABLE cell
 (
 	added_at          INTEGER DEFAULT NEXTVAL ('cell_added_at_seq'),
-	row_key		  VARCHAR(36) NOT NULL,
+	row_key		  VARCHAR(64) NOT NULL,
 	column_name	  VARCHAR(64) NOT NULL,
 	ref_key		  INTEGER NOT NULL,
 	body		  JSON,
-	created_at        TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	created_at        TIMESTAMP DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'UTC'),
+	checksum          BIGINT,
+	schema_version    INTEGER NOT NULL DEFAULT 0,
+	metadata          TEXT,
+	causation_id      VARCHAR(64),
+	correlation_id    VARCHAR(64)
 );
 
 CREATE UNIQUE INDEX CELL_IDX ON CELL ( row_key, column_name, ref_key ASC );
+
+CREATE TABLE cell_index
+(
+	index_name        VARCHAR(64) NOT NULL,
+	value             VARCHAR(255) NOT NULL,
+	row_key		  VARCHAR(64) NOT NULL,
+	column_name	  VARCHAR(64) NOT NULL,
+	PRIMARY KEY ( index_name, row_key, column_name )
+);
+
+CREATE INDEX CELL_INDEX_VALUE_IDX ON CELL_INDEX ( index_name, value );
+
+CREATE TABLE cell_checkpoint
+(
+	job_name          VARCHAR(128) NOT NULL PRIMARY KEY,
+	value             BIGINT NOT NULL
+);
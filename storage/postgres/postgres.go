@@ -6,30 +6,86 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/rbastic/go-schemaless/internal/teardown"
 	"github.com/rbastic/go-schemaless/models"
+	"github.com/rbastic/go-schemaless/storage/internal/prepared"
+	"github.com/rbastic/go-schemaless/storage/internal/query"
+	"github.com/rbastic/go-schemaless/storage/internal/table"
 	"go.uber.org/zap"
+	"math"
+	"strings"
 	"time"
 )
 
 // Storage is a Postgres-backed storage.
 type Storage struct {
-	store *sql.DB
-	sugar *zap.SugaredLogger
+	store   *sql.DB
+	tables  *table.Resolver
+	sugar   *zap.SugaredLogger
+	indexes []models.Index
+	// promoted are the columns PromoteColumns added
+	promoted []models.PromotedColumn
+	// logResults enables logging every cell a read returns
+	logResults bool
+	// continueOnError makes partition reads skip rows that fail to scan
+	continueOnError bool
+	// columns renames the columns of the cell table, see
+	// WithSchemaColumnMapping
+	columns query.Columns
+	// loggerKey is the context key of a request-scoped logger
+	loggerKey interface{}
+	// stmts are the prepared statements of the hot read path
+	stmts prepared.Cache
+
+	closer teardown.Once
 }
 
 const (
 	driver = "postgres"
+	// uniqueViolation is the SQLSTATE of a unique constraint violation.
+	uniqueViolation = "23505"
 	// dsnFormat string parameters: username, password, host, port, database.
 	// parseTime is for parsing and handling *time.Time properly
 	dsnFormat = "postgres://%s:%s@%s/%s?sslmode=disable"
 	// TODO(rbastic): Not sure if this is useful or needed but I might as well
 	// include it.
 	//dsnFormat			=  "postgres://%s:%s@%s/%s?sslmode=disable&default_transaction_isolation=repeatable+read'
-	getCellSQL          = "SELECT added_at, row_key, column_name, ref_key, body,created_at FROM cell WHERE row_key = $1 AND column_name = $2 AND ref_key = $3 LIMIT 1"
-	getCellLatestSQL    = "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell WHERE row_key = $1 AND column_name = $2 ORDER BY ref_key DESC LIMIT 1"
-	getCellsForShardSQL = "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell WHERE %s > $1 LIMIT %d"
-	putCellSQL          = "INSERT INTO cell ( row_key, column_name, ref_key, body ) VALUES($1, $2, $3, $4)"
+	getCellBeforeSQL            = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %s WHERE row_key = $1 AND column_name = $2 AND ref_key < $3 ORDER BY ref_key DESC, added_at DESC LIMIT 1"
+	getCellsAfterSQL            = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE ( created_at, row_key, column_name, ref_key ) > ( $1, $2, $3, $4 ) ORDER BY created_at, row_key, column_name, ref_key LIMIT %[2]d"
+	getCellsAfterVersionSQL     = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE ( created_at, row_key, column_name, ref_key ) > ( $1, $2, $3, $4 ) AND schema_version = $5 ORDER BY created_at, row_key, column_name, ref_key LIMIT %[2]d"
+	getCellsAfterTagSQL         = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE ( created_at, row_key, column_name, ref_key ) > ( $1, $2, $3, $4 ) AND metadata::jsonb @> $5::jsonb ORDER BY created_at, row_key, column_name, ref_key LIMIT %[2]d"
+	getCellsAfterCorrelationSQL = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE ( created_at, row_key, column_name, ref_key ) > ( $1, $2, $3, $4 ) AND correlation_id = $5 ORDER BY created_at, row_key, column_name, ref_key LIMIT %[2]d"
+	getCellsAfterWhereSQL       = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE ( created_at, row_key, column_name, ref_key ) > ( $1, $2, $3, $4 ) AND %[3]s = $5 ORDER BY created_at, row_key, column_name, ref_key LIMIT %[2]d"
+	getCellRangeSQL             = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE row_key = $1 AND column_name = $2 AND ref_key BETWEEN $3 AND $4 ORDER BY ref_key, added_at LIMIT %[2]d"
+	getRowSQL                   = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %s WHERE row_key = $1 ORDER BY column_name, ref_key, added_at"
+	deleteRowSQL                = "DELETE FROM %s WHERE row_key = $1"
+	deleteCellSQL               = "DELETE FROM %s WHERE row_key = $1 AND column_name = $2 AND ref_key = $3"
+	existsRowSQL                = "SELECT 1 FROM %s WHERE row_key = $1 LIMIT 1"
+	moveRowSQL                  = "UPDATE %s SET row_key = $1 WHERE row_key = $2"
+	deleteIndexSQL              = "DELETE FROM %s WHERE index_name = $1 AND row_key = $2 AND column_name = $3"
+	putIndexSQL                 = "INSERT INTO %s ( index_name, value, row_key, column_name ) VALUES($1, $2, $3, $4)"
+	lookupIndexSQL              = "SELECT DISTINCT row_key FROM %s WHERE index_name = $1 AND value = $2"
+	listColumnsSQL              = "SELECT DISTINCT column_name FROM %s WHERE row_key = $1 ORDER BY column_name"
+	countByColumnSQL            = "SELECT column_name, COUNT(*) FROM %s WHERE row_key = $1 GROUP BY column_name"
+	setCheckpointSQL            = "INSERT INTO %s ( job_name, value ) VALUES($1, $2) ON CONFLICT ( job_name ) DO UPDATE SET value = EXCLUDED.value"
+	getCheckpointSQL            = "SELECT value FROM %s WHERE job_name = $1"
+)
+
+// The statements every SQL storage shares are generated, see package query.
+var (
+	getCellSQL                = query.Postgres.GetCell()
+	getCellLatestSQL          = query.Postgres.GetCellLatest()
+	getCellsForShardSQL       = query.Postgres.PartitionRead()
+	putCellSQL                = query.Postgres.PutCell()
+	putCellIfAbsentSQL        = query.Postgres.PutCellIfAbsent()
+	getCellsForVersionSQL     = query.Postgres.PartitionReadSchemaVersion()
+	getCellsForTagSQL         = query.Postgres.PartitionReadTag()
+	getCellsForCorrelationSQL = query.Postgres.PartitionReadCorrelation()
+	feedReadSQL               = query.Postgres.FeedRead()
+	latestPerRowSQL           = query.Postgres.PartitionLatestPerRow()
+	readVersionsSQL           = query.Postgres.ReadVersions()
+	setRefKeySQL              = query.Postgres.SetRefKey()
 )
 
 func exec(db *sql.DB, sqlStr string) error {
@@ -40,6 +96,26 @@ func exec(db *sql.DB, sqlStr string) error {
 	return nil
 }
 
+// promoteColumn adds col to the table called name, unless it has it already.
+func promoteColumn(ctx context.Context, db *sql.DB, name string, col models.PromotedColumn, columns query.Columns) error {
+	stmts, err := query.Postgres.PromoteColumn(col)
+	if err != nil {
+		return err
+	}
+	var n int
+	err = db.QueryRowContext(ctx, query.Postgres.HasColumn, name, col.Name).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	for _, stmt := range stmts {
+		err = exec(db, fmt.Sprintf(columns.Rename(stmt), name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // New returns a new postgres-backed Storage
 func New(user, pass, host, port, database string) *Storage {
 	// TODO(rbastic): We do not Sprintf() the port.
@@ -62,18 +138,179 @@ func New(user, pass, host, port, database string) *Storage {
 	}
 }
 
+// WithIndex maintains idx on every PutCell, in the same transaction as the
+// cell itself. The index points a value at the row that most recently wrote
+// it. The cell_index table must exist, see cell.sql.
+func (s *Storage) WithIndex(idx models.Index) *Storage {
+	s.indexes = append(s.indexes, idx)
+	return s
+}
+
+// WithTableResolver makes every operation run against the table fn returns
+// for its context, which must be one of allowed. The tables, and their
+// <table>_index tables if indexes are configured, must exist; see cell.sql.
+func (s *Storage) WithTableResolver(fn func(ctx context.Context) string, allowed ...string) *Storage {
+	s.tables = table.NewResolver(fn, allowed...)
+	return s
+}
+
+// WithMaxOpenConns limits the connections the pool opens to the database,
+// see sql.DB.SetMaxOpenConns.
+func (s *Storage) WithMaxOpenConns(n int) *Storage {
+	s.store.SetMaxOpenConns(n)
+	return s
+}
+
+// WithMaxIdleConns limits the idle connections the pool keeps, see
+// sql.DB.SetMaxIdleConns.
+func (s *Storage) WithMaxIdleConns(n int) *Storage {
+	s.store.SetMaxIdleConns(n)
+	return s
+}
+
+// WithConnMaxLifetime closes connections once they have been open for d,
+// see sql.DB.SetConnMaxLifetime.
+func (s *Storage) WithConnMaxLifetime(d time.Duration) *Storage {
+	s.store.SetConnMaxLifetime(d)
+	return s
+}
+
+// PromoteColumns adds cols to the cell table ctx resolves to, generated from
+// the body and indexed, so that every write populates them and
+// PartitionReadWhere can filter on them. Columns the table already has are
+// left as they are, so it is safe to call on every start.
+func (s *Storage) PromoteColumns(ctx context.Context, cols ...models.PromotedColumn) error {
+	tableName, err := s.tables.Resolve(ctx)
+	if err != nil {
+		return err
+	}
+	for _, col := range cols {
+		err = promoteColumn(ctx, s.store, tableName, col, s.columns)
+		if err != nil {
+			return err
+		}
+		if !s.isPromoted(col.Name) {
+			s.promoted = append(s.promoted, col)
+		}
+	}
+	return nil
+}
+
+// isPromoted reports whether PromoteColumns added a column called name.
+func (s *Storage) isPromoted(name string) bool {
+	for _, col := range s.promoted {
+		if col.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WithSchemaColumnMapping makes s use a cell table whose columns are named
+// differently, e.g. a legacy table with "rk" for row_key: mapping maps the
+// name of each column that differs to its name in the table. The names of
+// the index and checkpoint tables' columns do not change.
+func (s *Storage) WithSchemaColumnMapping(mapping map[string]string) (*Storage, error) {
+	columns, err := query.NewColumns(mapping)
+	if err != nil {
+		return nil, err
+	}
+	s.columns = columns
+	return s, nil
+}
+
+// WithDetectedColumns reads the columns of the cell table with DescribeTable,
+// and leaves the optional columns it lacks (checksum, schema_version,
+// metadata, causation_id and correlation_id) out of every statement, for a table that predates them and has
+// not been migrated yet. Cells are then written without them and read back
+// as cells written without them. The columns found are kept until it is
+// called again, e.g. once the table has been migrated. Call it after
+// WithSchemaColumnMapping.
+func (s *Storage) WithDetectedColumns(ctx context.Context) (*Storage, error) {
+	columns, err := s.DescribeTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.columns = s.columns.Detect(columns)
+	return s, nil
+}
+
+// WithContinueOnError makes partition reads skip the rows that fail to scan,
+// e.g. for a checksum mismatch, rather than stop at the first. The cells
+// read are returned along with a models.ScanErrors holding the error of
+// every row skipped. It is off by default.
+func (s *Storage) WithContinueOnError(enabled bool) *Storage {
+	s.continueOnError = enabled
+	return s
+}
+
+// WithResultLogging logs every cell a read returns, with its body, at Info.
+// It is off by default: a partition read can return thousands of cells, and
+// their bodies may hold personal data. Operations are logged either way.
+func (s *Storage) WithResultLogging(enabled bool) *Storage {
+	s.logResults = enabled
+	return s
+}
+
+// WithContextLogger makes s log to the *zap.SugaredLogger stored in the
+// context of each call under key, so that its logs carry the fields of the
+// request it serves. Calls whose context holds no logger under key log to
+// the logger of s.
+func (s *Storage) WithContextLogger(key interface{}) *Storage {
+	s.loggerKey = key
+	return s
+}
+
+// logger returns the logger of ctx (see WithContextLogger), or else that
+// of s, tagged with the shard that ctx was dispatched to. Calls that
+// sampling left out (see models.WithSampled) only log warnings and errors.
+func (s *Storage) logger(ctx context.Context) *zap.SugaredLogger {
+	sugar := s.sugar
+	if s.loggerKey != nil {
+		if l, ok := ctx.Value(s.loggerKey).(*zap.SugaredLogger); ok && l != nil {
+			sugar = l
+		}
+	}
+	if sampled, ok := models.SampledFromContext(ctx); ok && !sampled {
+		sugar = sugar.Desugar().WithOptions(zap.IncreaseLevel(zap.WarnLevel)).Sugar()
+	}
+	return sugar.With("shard", models.ShardFromContext(ctx))
+}
+
+// logResult logs a cell a read returned, if result logging is enabled.
+func (s *Storage) logResult(ctx context.Context, msg string, keysAndValues ...interface{}) {
+	if s.logResults {
+		s.logger(ctx).Infow(msg, keysAndValues...)
+	}
+}
+
 func (s *Storage) GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	return s.getCell(ctx, s.store, tableName, rowKey, columnKey, refKey)
+}
+
+// getCell is GetCell through q, the database or a transaction.
+func (s *Storage) getCell(ctx context.Context, q query.Querier, tableName string, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
 	var (
 		resAddedAt   int64
 		resRowKey    string
 		resColName   string
 		resRefKey    int64
-		resBody      string
-		resCreatedAt *time.Time
+		resBody      sql.NullString
+		resCreatedAt query.Time
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
 		rows         *sql.Rows
 	)
-	s.sugar.Infow("GetCell", "query", getCellSQL, "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey)
-	rows, err = s.store.QueryContext(ctx, getCellSQL, rowKey, columnKey, refKey)
+	s.logger(ctx).Infow("GetCell", "query", getCellSQL, "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey)
+	rows, err = q.QueryContext(ctx, fmt.Sprintf(s.columns.Rename(getCellSQL), tableName), rowKey, columnKey, refKey)
 	if err != nil {
 		return
 	}
@@ -81,18 +318,33 @@ func (s *Storage) GetCell(ctx context.Context, rowKey string, columnKey string,
 
 	found = false
 	for rows.Next() {
-		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt)
+		if found {
+			// getCellSQL asks for a second row only to detect this.
+			err = models.ErrDuplicateCell
+			return
+		}
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
 		if err != nil {
 			return
 		}
-		s.sugar.Infow("GetCell scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+		s.logResult(ctx, "GetCell scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody.String, "CreatedAt", resCreatedAt.Time)
 
 		cell.AddedAt = resAddedAt
 		cell.RowKey = resRowKey
 		cell.ColumnName = resColName
 		cell.RefKey = resRefKey
-		cell.Body = resBody
-		cell.CreatedAt = resCreatedAt
+		cell.Body, cell.NullBody = resBody.String, !resBody.Valid
+		cell.CreatedAt = resCreatedAt.UTC()
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			return
+		}
 		found = true
 	}
 
@@ -104,18 +356,128 @@ func (s *Storage) GetCell(ctx context.Context, rowKey string, columnKey string,
 	return cell, found, nil
 }
 
+// GetCellsSnapshot implements core.SnapshotReader
+func (s *Storage) GetCellsSnapshot(ctx context.Context, refs []models.CellRef) (cells map[models.CellRef]models.Cell, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	var tx *sql.Tx
+	tx, err = s.store.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return
+	}
+	// Nothing is written, so the transaction is only rolled back.
+	defer tx.Rollback()
+
+	cells = make(map[models.CellRef]models.Cell, len(refs))
+	for _, ref := range refs {
+		var (
+			cell  models.Cell
+			found bool
+		)
+		cell, found, err = s.getCell(ctx, tx, tableName, ref.RowKey, ref.ColumnName, ref.RefKey)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			cells[ref] = cell
+		}
+	}
+	return cells, nil
+}
+
 func (s *Storage) GetCellLatest(ctx context.Context, rowKey, columnKey string) (cell models.Cell, found bool, err error) {
 	var (
 		resAddedAt   int64
 		resRowKey    string
 		resColName   string
 		resRefKey    int64
-		resBody      string
-		resCreatedAt *time.Time
+		resBody      sql.NullString
+		resCreatedAt query.Time
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
+		rows         *sql.Rows
+	)
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	var stmt *sql.Stmt
+	stmt, err = s.stmts.Stmt(ctx, s.store, s.columns.Rename(getCellLatestSQL), tableName)
+	if err != nil {
+		return
+	}
+	rows, err = stmt.QueryContext(ctx, rowKey, columnKey)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	found = false
+	for rows.Next() {
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
+		if err != nil {
+			return
+		}
+		s.logResult(ctx, "GetCellLatest scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody.String, "CreatedAt", resCreatedAt.Time)
+
+		cell.AddedAt = resAddedAt
+		cell.RowKey = resRowKey
+		cell.ColumnName = resColName
+		cell.RefKey = resRefKey
+		cell.Body, cell.NullBody = resBody.String, !resBody.Valid
+		cell.CreatedAt = resCreatedAt.UTC()
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			return
+		}
+		found = true
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	return cell, found, nil
+}
+
+// GetCellBefore implements core.PreviousReader
+func (s *Storage) GetCellBefore(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      sql.NullString
+		resCreatedAt query.Time
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
 		rows         *sql.Rows
 	)
-	s.sugar.Infow("GetCellLatest", "query", getCellSQL, "rowKey", rowKey, "columnKey", columnKey)
-	rows, err = s.store.QueryContext(ctx, getCellLatestSQL, rowKey, columnKey)
+	s.logger(ctx).Infow("GetCellBefore", "query", getCellBeforeSQL, "rowKey", rowKey, "columnKey", columnKey)
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	rows, err = s.store.QueryContext(ctx, fmt.Sprintf(s.columns.Rename(getCellBeforeSQL), tableName), rowKey, columnKey, refKey)
 	if err != nil {
 		return
 	}
@@ -123,18 +485,28 @@ func (s *Storage) GetCellLatest(ctx context.Context, rowKey, columnKey string) (
 
 	found = false
 	for rows.Next() {
-		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt)
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
 		if err != nil {
 			return
 		}
-		s.sugar.Infow("GetCellLatest scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+		s.logResult(ctx, "GetCellBefore scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody.String, "CreatedAt", resCreatedAt.Time)
 
 		cell.AddedAt = resAddedAt
 		cell.RowKey = resRowKey
 		cell.ColumnName = resColName
 		cell.RefKey = resRefKey
-		cell.Body = resBody
-		cell.CreatedAt = resCreatedAt
+		cell.Body, cell.NullBody = resBody.String, !resBody.Valid
+		cell.CreatedAt = resCreatedAt.UTC()
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			return
+		}
 		found = true
 	}
 
@@ -147,16 +519,81 @@ func (s *Storage) GetCellLatest(ctx context.Context, rowKey, columnKey string) (
 }
 
 func (s *Storage) PartitionRead(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	return s.partitionRead(ctx, location, value, limit, getCellsForShardSQL, getCellsAfterSQL)
+}
+
+// PartitionReadSchemaVersion implements core.SchemaVersionReader.
+func (s *Storage) PartitionReadSchemaVersion(ctx context.Context, partitionNumber int, schemaVersion int64, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	return s.partitionRead(ctx, location, value, limit, getCellsForVersionSQL, getCellsAfterVersionSQL, schemaVersion)
+}
+
+// PartitionScan implements core.PartitionScanner.
+func (s *Storage) PartitionScan(ctx context.Context, partitionNumber int, location string, value interface{}, limit int, fn func(models.Cell) error) error {
+	return s.scanPartition(ctx, location, value, limit, fn, getCellsForShardSQL, getCellsAfterSQL)
+}
+
+// PartitionReadTag implements core.TagReader.
+func (s *Storage) PartitionReadTag(ctx context.Context, partitionNumber int, tagKey string, tagValue string, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	return s.partitionRead(ctx, location, value, limit, getCellsForTagSQL, getCellsAfterTagSQL, models.Tag(tagKey, tagValue))
+}
+
+// PartitionReadCorrelation implements core.CorrelationReader.
+func (s *Storage) PartitionReadCorrelation(ctx context.Context, partitionNumber int, correlationID string, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	return s.partitionRead(ctx, location, value, limit, getCellsForCorrelationSQL, getCellsAfterCorrelationSQL, correlationID)
+}
+
+// PartitionReadWhere implements core.ColumnFilter.
+func (s *Storage) PartitionReadWhere(ctx context.Context, partitionNumber int, column string, columnValue interface{}, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	if !s.isPromoted(column) {
+		return nil, false, fmt.Errorf("%w: %s", models.ErrNotPromoted, column)
+	}
+	return s.partitionRead(ctx, location, value, limit, query.Postgres.PartitionReadWhere(column), strings.Replace(getCellsAfterWhereSQL, "%[3]s", column, 1), columnValue)
+}
+
+// PartitionReadProjected implements core.Projector.
+func (s *Storage) PartitionReadProjected(ctx context.Context, partitionNumber int, location string, value interface{}, limit int, paths []string) (cells []models.Cell, found bool, err error) {
+	var forShardSQL, afterSQL string
+	forShardSQL, err = query.Postgres.Project(getCellsForShardSQL, paths)
+	if err != nil {
+		return
+	}
+	afterSQL, err = query.Postgres.Project(getCellsAfterSQL, paths)
+	if err != nil {
+		return
+	}
+	return s.partitionRead(ctx, location, value, limit, forShardSQL, afterSQL)
+}
+
+// partitionRead collects the cells scanPartition reads. forShardSQL and
+// afterSQL take the arguments in filter after those of the location.
+func (s *Storage) partitionRead(ctx context.Context, location string, value interface{}, limit int, forShardSQL string, afterSQL string, filter ...interface{}) (cells []models.Cell, found bool, err error) {
+	err = s.scanPartition(ctx, location, value, limit, func(cell models.Cell) error {
+		cells = append(cells, cell)
+		return nil
+	}, forShardSQL, afterSQL, filter...)
+	return cells, len(cells) > 0, err
+}
+
+// scanPartition reads the cells after value in location with forShardSQL, or
+// afterSQL for a cursor, passing each to fn as it is scanned. It stops at the
+// first error fn returns.
+func (s *Storage) scanPartition(ctx context.Context, location string, value interface{}, limit int, fn func(models.Cell) error, forShardSQL string, afterSQL string, filter ...interface{}) (err error) {
 
 	var (
 		resAddedAt   int64
 		resRowKey    string
 		resColName   string
 		resRefKey    int64
-		resBody      string
-		resCreatedAt *time.Time
+		resBody      sql.NullString
+		resCreatedAt query.Time
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
 
 		locationColumn string
+		cursor         models.Cursor
 	)
 
 	switch location {
@@ -166,38 +603,94 @@ func (s *Storage) PartitionRead(ctx context.Context, partitionNumber int, locati
 		locationColumn = "created_at"
 	case "added_at":
 		locationColumn = "added_at"
+		value, err = models.AddedAtValue(value)
+		if err != nil {
+			return
+		}
+	case "cursor":
+		token, ok := value.(string)
+		if !ok {
+			err = fmt.Errorf("PartitionRead had unrecognized cursor type %T", value)
+			return
+		}
+		cursor, err = models.DecodeCursor(token)
+		if err != nil {
+			return
+		}
 	default:
 		err = errors.New("Unrecognized location " + location)
 		return
 	}
 
-	sqlStr := fmt.Sprintf(getCellsForShardSQL, locationColumn, limit)
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	if models.InclusiveFromContext(ctx) {
+		forShardSQL = query.Inclusive(forShardSQL)
+	}
+	sqlStr := fmt.Sprintf(s.columns.Rename(forShardSQL), tableName, locationColumn, limit)
+	args := []interface{}{value}
+	if locationColumn == "created_at" {
+		args = []interface{}{query.TimeArg(value)}
+	}
+	if location == "cursor" {
+		sqlStr = fmt.Sprintf(s.columns.Rename(afterSQL), tableName, limit)
+		args = []interface{}{cursor.CreatedAt, cursor.RowKey, cursor.ColumnName, cursor.RefKey}
+	}
+	args = append(args, filter...)
 
 	var rows *sql.Rows
-	s.sugar.Infow("PartitionRead", "query", sqlStr, "value", value)
-	rows, err = s.store.QueryContext(ctx, sqlStr, value)
+	s.logger(ctx).Infow("PartitionRead", "query", sqlStr, "value", value)
+	rows, err = s.store.QueryContext(ctx, sqlStr, args...)
 	if err != nil {
 		return
 	}
 	defer rows.Close()
 
-	found = false
+	// A row that fails to scan stops the read, unless s continues on error.
+	var scanErrs models.ScanErrors
 	for rows.Next() {
-		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt)
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
 		if err != nil {
-			return
+			if !s.continueOnError {
+				return
+			}
+			scanErrs = append(scanErrs, err)
+			continue
 		}
-		s.sugar.Infow("PartitionRead: scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+		s.logResult(ctx, "PartitionRead: scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody.String, "CreatedAt", resCreatedAt.Time)
 
 		var cell models.Cell
 		cell.AddedAt = resAddedAt
 		cell.RowKey = resRowKey
 		cell.ColumnName = resColName
 		cell.RefKey = resRefKey
-		cell.Body = resBody
-		cell.CreatedAt = resCreatedAt
-		cells = append(cells, cell)
-		found = true
+		cell.Body, cell.NullBody = resBody.String, !resBody.Valid
+		cell.CreatedAt = resCreatedAt.UTC()
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			if !s.continueOnError {
+				return
+			}
+			scanErrs = append(scanErrs, err)
+			continue
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			if !s.continueOnError {
+				return
+			}
+			scanErrs = append(scanErrs, err)
+			continue
+		}
+		err = fn(cell)
+		if err != nil {
+			return
+		}
 	}
 
 	err = rows.Err()
@@ -205,46 +698,852 @@ func (s *Storage) PartitionRead(ctx context.Context, partitionNumber int, locati
 		return
 	}
 
-	return cells, found, nil
+	if len(scanErrs) > 0 {
+		return scanErrs
+	}
+	return nil
 }
 
-func (s *Storage) PutCell(ctx context.Context, rowKey, columnKey string, refKey int64, cell models.Cell) (err error) {
-	var stmt *sql.Stmt
-	stmt, err = s.store.PrepareContext(ctx, putCellSQL)
+// GetCellRange returns the versions of a cell with a ref key between
+// minRefKey and maxRefKey inclusive, in ref key order. A maxRefKey of 0 means
+// no upper bound.
+func (s *Storage) GetCellRange(ctx context.Context, rowKey string, columnKey string, minRefKey int64, maxRefKey int64, limit int) (cells []models.Cell, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      sql.NullString
+		resCreatedAt query.Time
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
+	)
+
+	if maxRefKey == 0 {
+		maxRefKey = math.MaxInt64
+	}
+
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
 	if err != nil {
 		return
 	}
-	var res sql.Result
-	s.sugar.Infow("PutCell", "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey, "Body", cell.Body)
-	res, err = stmt.Exec(rowKey, columnKey, refKey, cell.Body)
+	var rows *sql.Rows
+	s.logger(ctx).Infow("GetCellRange", "query", getCellRangeSQL, "rowKey", rowKey, "columnKey", columnKey, "minRefKey", minRefKey, "maxRefKey", maxRefKey)
+	rows, err = s.store.QueryContext(ctx, fmt.Sprintf(s.columns.Rename(getCellRangeSQL), tableName, limit), rowKey, columnKey, minRefKey, maxRefKey)
 	if err != nil {
 		return
 	}
-	var lastID int64
-	/*
-		lastID, err = res.LastInsertId()
+	defer rows.Close()
+
+	for rows.Next() {
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
 		if err != nil {
 			return
 		}
-	*/
-	var rowCnt int64
-	rowCnt, err = res.RowsAffected()
-	if err != nil {
-		return
+		s.logResult(ctx, "GetCellRange scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody.String, "CreatedAt", resCreatedAt.Time)
+
+		var cell models.Cell
+		cell.AddedAt = resAddedAt
+		cell.RowKey = resRowKey
+		cell.ColumnName = resColName
+		cell.RefKey = resRefKey
+		cell.Body, cell.NullBody = resBody.String, !resBody.Valid
+		cell.CreatedAt = resCreatedAt.UTC()
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			return
+		}
+		cells = append(cells, cell)
 	}
-	// TODO(rbastic): Should we side-affect the cell and record the AddedAt?
-	s.sugar.Infof("ID = %d, affected = %d\n", lastID, rowCnt)
+
+	err = rows.Err()
 	return
 }
 
-// ResetConnection does not destroy the store for in-memory stores.
-func (s *Storage) ResetConnection(ctx context.Context, key string) error {
-	return nil
-}
+// FeedRead implements core.FeedReader
+func (s *Storage) FeedRead(ctx context.Context, rowKey string, beforeRefKey int64, limit int) (cells []models.Cell, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      sql.NullString
+		resCreatedAt query.Time
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
+	)
 
-// Destroy closes the in-memory store, and is a completely destructive operation.
-func (s *Storage) Destroy(ctx context.Context) error {
-	// TODO(rbastic): What do if there's an error in Sync()?
-	s.sugar.Sync()
-	return s.store.Close()
+	if beforeRefKey == 0 {
+		beforeRefKey = math.MaxInt64
+	}
+
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	var rows *sql.Rows
+	s.logger(ctx).Infow("FeedRead", "query", feedReadSQL, "rowKey", rowKey, "beforeRefKey", beforeRefKey)
+	rows, err = s.store.QueryContext(ctx, fmt.Sprintf(s.columns.Rename(feedReadSQL), tableName, limit), rowKey, beforeRefKey)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
+		if err != nil {
+			return
+		}
+		s.logResult(ctx, "FeedRead scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody.String, "CreatedAt", resCreatedAt.Time)
+
+		var cell models.Cell
+		cell.AddedAt = resAddedAt
+		cell.RowKey = resRowKey
+		cell.ColumnName = resColName
+		cell.RefKey = resRefKey
+		cell.Body, cell.NullBody = resBody.String, !resBody.Valid
+		cell.CreatedAt = resCreatedAt.UTC()
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			return
+		}
+		cells = append(cells, cell)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// PartitionLatestPerRow implements core.LatestPerRowReader
+func (s *Storage) PartitionLatestPerRow(ctx context.Context, partitionNumber int, n int, limit int) (cells []models.Cell, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      sql.NullString
+		resCreatedAt query.Time
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
+	)
+
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	var rows *sql.Rows
+	s.logger(ctx).Infow("PartitionLatestPerRow", "query", latestPerRowSQL, "n", n, "limit", limit)
+	rows, err = s.store.QueryContext(ctx, fmt.Sprintf(s.columns.Rename(latestPerRowSQL), tableName, limit), n)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
+		if err != nil {
+			return
+		}
+		s.logResult(ctx, "PartitionLatestPerRow scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody.String, "CreatedAt", resCreatedAt.Time)
+
+		var cell models.Cell
+		cell.AddedAt = resAddedAt
+		cell.RowKey = resRowKey
+		cell.ColumnName = resColName
+		cell.RefKey = resRefKey
+		cell.Body, cell.NullBody = resBody.String, !resBody.Valid
+		cell.CreatedAt = resCreatedAt.UTC()
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			return
+		}
+		cells = append(cells, cell)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (s *Storage) PutCell(ctx context.Context, rowKey, columnKey string, refKey int64, cell models.Cell) (err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	if len(s.indexes) > 0 {
+		return s.putCellIndexed(ctx, tableName, rowKey, columnKey, refKey, cell)
+	}
+
+	insertSQL, args := s.columns.Insert(putCellSQL, rowKey, columnKey, refKey, query.Body(cell), models.Checksum(cell.Body), cell.SchemaVersion, models.MarshalMetadata(cell.Metadata), query.ID(cell.CausationID), query.ID(cell.CorrelationID), query.CreatedAt(cell.CreatedAt))
+	var stmt *sql.Stmt
+	stmt, err = s.store.PrepareContext(ctx, fmt.Sprintf(insertSQL, tableName))
+	if err != nil {
+		return
+	}
+	var res sql.Result
+	s.logger(ctx).Infow("PutCell", "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey, "Body", cell.Body)
+	res, err = stmt.Exec(args...)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		return models.ErrCellExists
+	}
+	if err != nil {
+		return
+	}
+	var lastID int64
+	/*
+		lastID, err = res.LastInsertId()
+		if err != nil {
+			return
+		}
+	*/
+	var rowCnt int64
+	rowCnt, err = res.RowsAffected()
+	if err != nil {
+		return
+	}
+	// TODO(rbastic): Should we side-affect the cell and record the AddedAt?
+	s.logger(ctx).Infof("ID = %d, affected = %d\n", lastID, rowCnt)
+	return
+}
+
+// putCellIndexed writes the cell and its index entries in one transaction.
+func (s *Storage) putCellIndexed(ctx context.Context, tableName string, rowKey, columnKey string, refKey int64, cell models.Cell) (err error) {
+	var tx *sql.Tx
+	tx, err = s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	insertSQL, args := s.columns.Insert(putCellSQL, rowKey, columnKey, refKey, query.Body(cell), models.Checksum(cell.Body), cell.SchemaVersion, models.MarshalMetadata(cell.Metadata), query.ID(cell.CausationID), query.ID(cell.CorrelationID), query.CreatedAt(cell.CreatedAt))
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(insertSQL, tableName), args...)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		err = models.ErrCellExists
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	err = s.putIndexEntries(ctx, tx, tableName, rowKey, columnKey, cell.Body)
+	if err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// PutCellIfAbsent implements core.CellInserter. The cell and its index
+// entries are written in one transaction, and neither if the cell exists.
+func (s *Storage) PutCellIfAbsent(ctx context.Context, rowKey, columnKey string, refKey int64, cell models.Cell) (inserted bool, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	var tx *sql.Tx
+	tx, err = s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	s.logger(ctx).Infow("PutCellIfAbsent", "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey, "Body", cell.Body)
+	var res sql.Result
+	insertSQL, args := s.columns.Insert(putCellIfAbsentSQL, rowKey, columnKey, refKey, query.Body(cell), models.Checksum(cell.Body), cell.SchemaVersion, models.MarshalMetadata(cell.Metadata), query.ID(cell.CausationID), query.ID(cell.CorrelationID), query.CreatedAt(cell.CreatedAt))
+	res, err = tx.ExecContext(ctx, fmt.Sprintf(insertSQL, tableName), args...)
+	if err != nil {
+		return
+	}
+	var rowCnt int64
+	rowCnt, err = res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if rowCnt > 0 {
+		err = s.putIndexEntries(ctx, tx, tableName, rowKey, columnKey, cell.Body)
+		if err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	return rowCnt > 0, nil
+}
+
+// putIndexEntries points every index covering columnKey at rowKey, for a
+// cell with the given body just written in tx.
+func (s *Storage) putIndexEntries(ctx context.Context, tx *sql.Tx, tableName string, rowKey, columnKey string, body string) error {
+	for _, idx := range s.indexes {
+		if !idx.Covers(columnKey) {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(deleteIndexSQL, table.Index(tableName)), idx.Name, rowKey, columnKey)
+		if err != nil {
+			return err
+		}
+		value, ok := idx.Value(body)
+		if !ok {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(putIndexSQL, table.Index(tableName)), idx.Name, value, rowKey, columnKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRow implements core.RowReader
+func (s *Storage) GetRow(ctx context.Context, rowKey string) (cells []models.Cell, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      sql.NullString
+		resCreatedAt query.Time
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
+	)
+
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	var rows *sql.Rows
+	s.logger(ctx).Infow("GetRow", "query", getRowSQL, "rowKey", rowKey)
+	rows, err = s.store.QueryContext(ctx, fmt.Sprintf(s.columns.Rename(getRowSQL), tableName), rowKey)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
+		if err != nil {
+			return
+		}
+		s.logResult(ctx, "GetRow scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody.String, "CreatedAt", resCreatedAt.Time)
+
+		var cell models.Cell
+		cell.AddedAt = resAddedAt
+		cell.RowKey = resRowKey
+		cell.ColumnName = resColName
+		cell.RefKey = resRefKey
+		cell.Body, cell.NullBody = resBody.String, !resBody.Valid
+		cell.CreatedAt = resCreatedAt.UTC()
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			return
+		}
+		cells = append(cells, cell)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// PutCells implements core.RowWriter
+func (s *Storage) PutCells(ctx context.Context, rowKey string, cells []models.Cell, replace bool) (err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	var tx *sql.Tx
+	tx, err = s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if replace {
+		s.logger(ctx).Infow("PutCells: deleting row", "rowKey", rowKey)
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(s.columns.Rename(deleteRowSQL), tableName), rowKey)
+		if err != nil {
+			return
+		}
+		if len(s.indexes) > 0 {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf(deleteRowSQL, table.Index(tableName)), rowKey)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	for _, cell := range cells {
+		s.logger(ctx).Infow("PutCells", "rowKey", rowKey, "columnKey", cell.ColumnName, "refKey", cell.RefKey, "Body", cell.Body)
+		insertSQL, args := s.columns.Insert(putCellSQL, rowKey, cell.ColumnName, cell.RefKey, query.Body(cell), models.Checksum(cell.Body), cell.SchemaVersion, models.MarshalMetadata(cell.Metadata), query.ID(cell.CausationID), query.ID(cell.CorrelationID), query.CreatedAt(cell.CreatedAt))
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(insertSQL, tableName), args...)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+			err = models.ErrCellExists
+			return
+		}
+		if err != nil {
+			return
+		}
+		err = s.putIndexEntries(ctx, tx, tableName, rowKey, cell.ColumnName, cell.Body)
+		if err != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceCell implements core.CellReplacer
+func (s *Storage) ReplaceCell(ctx context.Context, rowKey, columnKey string, refKey int64, cell models.Cell) (err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	var tx *sql.Tx
+	tx, err = s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	s.logger(ctx).Infow("ReplaceCell", "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey, "Body", cell.Body)
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(s.columns.Rename(deleteCellSQL), tableName), rowKey, columnKey, refKey)
+	if err != nil {
+		return
+	}
+	insertSQL, args := s.columns.Insert(putCellSQL, rowKey, columnKey, refKey, query.Body(cell), models.Checksum(cell.Body), cell.SchemaVersion, models.MarshalMetadata(cell.Metadata), query.ID(cell.CausationID), query.ID(cell.CorrelationID), query.CreatedAt(cell.CreatedAt))
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(insertSQL, tableName), args...)
+	if err != nil {
+		return
+	}
+	err = s.putIndexEntries(ctx, tx, tableName, rowKey, columnKey, cell.Body)
+	if err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// MoveRow implements core.RowMover
+func (s *Storage) MoveRow(ctx context.Context, srcRowKey string, dstRowKey string) (err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	var tx *sql.Tx
+	tx, err = s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	s.logger(ctx).Infow("MoveRow", "srcRowKey", srcRowKey, "dstRowKey", dstRowKey)
+	var exists int
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(s.columns.Rename(existsRowSQL), tableName), dstRowKey).Scan(&exists)
+	if err == nil {
+		err = models.ErrRowExists
+		return
+	}
+	if err != sql.ErrNoRows {
+		return
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(s.columns.Rename(moveRowSQL), tableName), dstRowKey, srcRowKey)
+	if err != nil {
+		return
+	}
+	if len(s.indexes) > 0 {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(moveRowSQL, table.Index(tableName)), dstRowKey, srcRowKey)
+		if err != nil {
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+// ResequenceCell implements core.CellResequencer
+func (s *Storage) ResequenceCell(ctx context.Context, rowKey string, columnKey string) (moved int, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	var tx *sql.Tx
+	tx, err = s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	s.logger(ctx).Infow("ResequenceCell", "rowKey", rowKey, "columnKey", columnKey)
+	var versions []query.Version
+	versions, err = readVersions(ctx, tx, fmt.Sprintf(s.columns.Rename(readVersionsSQL), tableName), rowKey, columnKey)
+	if err != nil {
+		return
+	}
+	for _, v := range query.Resequence(versions) {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(s.columns.Rename(setRefKeySQL), tableName), v.RefKey, v.AddedAt)
+		if err != nil {
+			return
+		}
+		moved++
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
+
+func readVersions(ctx context.Context, tx *sql.Tx, stmt string, rowKey string, columnKey string) (versions []query.Version, err error) {
+	var rows *sql.Rows
+	rows, err = tx.QueryContext(ctx, stmt, rowKey, columnKey)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v query.Version
+		err = rows.Scan(&v.RefKey, &v.AddedAt)
+		if err != nil {
+			return
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// DeleteRow implements core.RowDeleter
+func (s *Storage) DeleteRow(ctx context.Context, rowKey string) (deleted int64, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	var tx *sql.Tx
+	tx, err = s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	s.logger(ctx).Infow("DeleteRow", "rowKey", rowKey)
+	var res sql.Result
+	res, err = tx.ExecContext(ctx, fmt.Sprintf(s.columns.Rename(deleteRowSQL), tableName), rowKey)
+	if err != nil {
+		return
+	}
+	deleted, err = res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if len(s.indexes) > 0 {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(deleteRowSQL, table.Index(tableName)), rowKey)
+		if err != nil {
+			return
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// LookupByIndex implements core.Indexer
+func (s *Storage) LookupByIndex(ctx context.Context, indexName string, value string) (rowKeys []string, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	var rows *sql.Rows
+	rows, err = s.store.QueryContext(ctx, fmt.Sprintf(lookupIndexSQL, table.Index(tableName)), indexName, value)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rowKey string
+		err = rows.Scan(&rowKey)
+		if err != nil {
+			return
+		}
+		rowKeys = append(rowKeys, rowKey)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// ListColumns implements core.ColumnLister
+func (s *Storage) ListColumns(ctx context.Context, rowKey string) (columns []string, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	var rows *sql.Rows
+	s.logger(ctx).Infow("ListColumns", "query", listColumnsSQL, "rowKey", rowKey)
+	rows, err = s.store.QueryContext(ctx, fmt.Sprintf(s.columns.Rename(listColumnsSQL), tableName), rowKey)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var column string
+		err = rows.Scan(&column)
+		if err != nil {
+			return
+		}
+		columns = append(columns, column)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// Exists implements core.ExistenceChecker
+func (s *Storage) Exists(ctx context.Context, keys []models.CellKey) (exists map[models.CellKey]bool, err error) {
+	exists = make(map[models.CellKey]bool, len(keys))
+	for _, key := range keys {
+		exists[key] = false
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	args := make([]interface{}, 0, 2*len(keys))
+	for _, key := range keys {
+		args = append(args, key.RowKey, key.ColumnName)
+	}
+
+	var rows *sql.Rows
+	s.logger(ctx).Infow("Exists", "keys", len(keys))
+	rows, err = s.store.QueryContext(ctx, fmt.Sprintf(s.columns.Rename(query.Postgres.Exists(len(keys))), tableName), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key models.CellKey
+		err = rows.Scan(&key.RowKey, &key.ColumnName)
+		if err != nil {
+			return
+		}
+		exists[key] = true
+	}
+
+	err = rows.Err()
+	return
+}
+
+// DescribeTable implements core.TableDescriber
+func (s *Storage) DescribeTable(ctx context.Context) (columns []models.ColumnInfo, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	var rows *sql.Rows
+	s.logger(ctx).Infow("DescribeTable", "table", tableName)
+	rows, err = s.store.QueryContext(ctx, query.Postgres.DescribeTable, tableName)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var column models.ColumnInfo
+		err = rows.Scan(&column.Name, &column.Type, &column.NotNull)
+		if err != nil {
+			return
+		}
+		column.Name = s.columns.Logical(column.Name)
+		columns = append(columns, column)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// CountByColumn implements core.ColumnCounter
+func (s *Storage) CountByColumn(ctx context.Context, rowKey string) (counts map[string]int64, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	var rows *sql.Rows
+	s.logger(ctx).Infow("CountByColumn", "query", countByColumnSQL, "rowKey", rowKey)
+	rows, err = s.store.QueryContext(ctx, fmt.Sprintf(s.columns.Rename(countByColumnSQL), tableName), rowKey)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	counts = make(map[string]int64)
+	for rows.Next() {
+		var (
+			column string
+			count  int64
+		)
+		err = rows.Scan(&column, &count)
+		if err != nil {
+			return
+		}
+		counts[column] = count
+	}
+
+	err = rows.Err()
+	return
+}
+
+// SetCheckpoint implements core.Checkpointer
+func (s *Storage) SetCheckpoint(ctx context.Context, jobName string, value int64) (err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	s.logger(ctx).Infow("SetCheckpoint", "query", setCheckpointSQL, "jobName", jobName, "value", value)
+	_, err = s.store.ExecContext(ctx, fmt.Sprintf(setCheckpointSQL, table.Checkpoint(tableName)), jobName, value)
+	return
+}
+
+// GetCheckpoint implements core.Checkpointer
+func (s *Storage) GetCheckpoint(ctx context.Context, jobName string) (value int64, found bool, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	s.logger(ctx).Infow("GetCheckpoint", "query", getCheckpointSQL, "jobName", jobName)
+	err = s.store.QueryRowContext(ctx, fmt.Sprintf(getCheckpointSQL, table.Checkpoint(tableName)), jobName).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return
+	}
+	return value, true, nil
+}
+
+// ResetConnection does not destroy the store for in-memory stores.
+func (s *Storage) ResetConnection(ctx context.Context, key string) error {
+	return nil
+}
+
+// Raw returns the underlying *sql.DB; queries through it bypass the
+// Storage, see core.Storage.
+func (s *Storage) Raw() *sql.DB {
+	return s.store
+}
+
+// Destroy closes the in-memory store, and is a completely destructive operation.
+func (s *Storage) Destroy(ctx context.Context) error {
+	return teardown.Run(ctx, s.sugar, func() error {
+		s.stmts.Close()
+		return s.store.Close()
+	})
+}
+
+// Close implements io.Closer. It releases the connection as Destroy does,
+// and is safe to call more than once.
+func (s *Storage) Close() error {
+	return s.closer.Close(s.Destroy)
 }
@@ -29,3 +29,13 @@ func TestPostgres(t *testing.T) {
 	m := New(user, pass, host, "", db)
 	storagetest.StorageTest(t, m)
 }
+
+func TestPoolOptions(t *testing.T) {
+	// Opening does not connect, so no server is needed.
+	m := New("user", "pass", "localhost", "", "db").WithMaxOpenConns(4)
+	defer m.store.Close()
+
+	if got := m.store.Stats().MaxOpenConnections; got != 4 {
+		t.Fatalf("expected 4 max open connections, got %d", got)
+	}
+}
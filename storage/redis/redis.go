@@ -0,0 +1,413 @@
+// Package redis is a Redis-backed Schemaless store, intended for short-lived
+// cells.
+//
+// Every version of a cell is a hash holding its body, added_at and
+// created_at. The versions of a (row key, column name) pair are members of a
+// sorted set scored by ref key, so the latest version is the top of that set.
+// Two further sorted sets, scored by added_at and created_at, serve
+// PartitionRead. With a TTL, a third one scored by expiry time lets every
+// write trim the entries of expired versions from those indexes.
+//
+// The storage needs a standalone Redis server, optionally with replicas, not
+// Redis Cluster: every write updates the indexes shared by all the rows of
+// the Storage in the same script as the row's own keys, which a cluster
+// rejects with CROSSSLOT whatever hash tags the keys carry. Shards can share
+// a server, each under its own prefix (see WithPrefix).
+//
+// Durability is whatever the Redis server is configured for: with the
+// default RDB snapshots, acknowledged writes can be lost on a crash, and
+// there is no replication guarantee on failover. Cells can also be given a
+// TTL, after which Redis expires them. Do not use this storage for data you
+// cannot afford to lose.
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rbastic/go-schemaless/internal/teardown"
+	"github.com/rbastic/go-schemaless/models"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage is a Redis-backed storage.
+type Storage struct {
+	addr   string
+	prefix string
+	ttl    time.Duration
+
+	client *redis.Client
+	Sugar  *zap.SugaredLogger
+	// logResults enables logging every cell a read returns
+	logResults bool
+	// loggerKey is the context key of a request-scoped logger
+	loggerKey interface{}
+
+	closer teardown.Once
+}
+
+const (
+	timeParseString = "2006-01-02 15:04:05"
+	defaultPrefix   = "schemaless"
+	// trimBatch is the most expired versions a write drops from the
+	// indexes, bounding the time the script blocks the server.
+	trimBatch = 100
+)
+
+// putCellScript writes a version hash and indexes it, refusing to overwrite
+// an existing version. Running it as a script keeps the write atomic. It
+// then drops up to trimBatch expired versions from the indexes, so that
+// they do not grow forever with a TTL.
+//
+// KEYS: version hash, versions zset, added_at zset, created_at zset, sequence,
+// expiry zset
+// ARGV: row key, column name, ref key, body, created_at, ttl in milliseconds,
+// now in milliseconds, trimBatch
+var putCellScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return -1
+end
+local addedAt = redis.call('INCR', KEYS[5])
+redis.call('HSET', KEYS[1], 'row_key', ARGV[1], 'column_name', ARGV[2], 'ref_key', ARGV[3], 'body', ARGV[4], 'added_at', addedAt, 'created_at', ARGV[5])
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[3])
+redis.call('ZADD', KEYS[3], addedAt, KEYS[1])
+redis.call('ZADD', KEYS[4], ARGV[5], KEYS[1])
+local ttl = tonumber(ARGV[6])
+local now = tonumber(ARGV[7])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+	redis.call('PEXPIRE', KEYS[2], ttl)
+	redis.call('ZADD', KEYS[6], now + ttl, KEYS[1])
+end
+local expired = redis.call('ZRANGEBYSCORE', KEYS[6], '-inf', now, 'LIMIT', 0, tonumber(ARGV[8]))
+if #expired > 0 then
+	redis.call('ZREM', KEYS[3], unpack(expired))
+	redis.call('ZREM', KEYS[4], unpack(expired))
+	redis.call('ZREM', KEYS[6], unpack(expired))
+end
+return addedAt
+`)
+
+// New returns a new redis-backed Storage
+func New() *Storage {
+	return &Storage{prefix: defaultPrefix}
+}
+
+func (s *Storage) WithZap() error {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	sug := logger.Sugar()
+	s.Sugar = sug
+	return nil
+}
+
+func (s *Storage) WithAddr(addr string) *Storage {
+	s.addr = addr
+	return s
+}
+
+// WithPrefix sets the prefix of every key this store writes, so that several
+// shards can share a Redis server.
+func (s *Storage) WithPrefix(prefix string) *Storage {
+	s.prefix = prefix
+	return s
+}
+
+// WithTTL makes every cell written expire after ttl. Zero, the default,
+// keeps cells until they are evicted or deleted. Expired cells are dropped
+// from the PartitionRead indexes by later writes, as of the clock of the
+// writer, or by PartitionRead when it finds them gone.
+func (s *Storage) WithTTL(ttl time.Duration) *Storage {
+	s.ttl = ttl
+	return s
+}
+
+func (s *Storage) Open() error {
+	client := redis.NewClient(&redis.Options{Addr: s.addr})
+	err := client.Ping(context.TODO()).Err()
+	if err != nil {
+		client.Close()
+		return err
+	}
+	s.client = client
+	return nil
+}
+
+func (s *Storage) versionKey(rowKey string, columnKey string, refKey int64) string {
+	return s.prefix + ":cell:" + rowKey + ":" + columnKey + ":" + strconv.FormatInt(refKey, 10)
+}
+
+func (s *Storage) versionsKey(rowKey string, columnKey string) string {
+	return s.prefix + ":versions:" + rowKey + ":" + columnKey
+}
+
+func (s *Storage) indexKey(location string) string {
+	return s.prefix + ":" + location
+}
+
+func (s *Storage) sequenceKey() string {
+	return s.prefix + ":seq"
+}
+
+func (s *Storage) expiryKey() string {
+	return s.prefix + ":expiry"
+}
+
+func hashToCell(h map[string]string) (cell models.Cell, err error) {
+	cell.RowKey = h["row_key"]
+	cell.ColumnName = h["column_name"]
+	cell.Body = h["body"]
+	cell.RefKey, err = strconv.ParseInt(h["ref_key"], 10, 64)
+	if err != nil {
+		return
+	}
+	cell.AddedAt, err = strconv.ParseInt(h["added_at"], 10, 64)
+	if err != nil {
+		return
+	}
+	var createdAt int64
+	createdAt, err = strconv.ParseInt(h["created_at"], 10, 64)
+	if err != nil {
+		return
+	}
+	t := time.Unix(createdAt, 0).UTC()
+	cell.CreatedAt = &t
+	return
+}
+
+// WithResultLogging logs every cell a read returns, with its body, at Info.
+// It is off by default: a partition read can return thousands of cells, and
+// their bodies may hold personal data. Operations are logged either way.
+func (s *Storage) WithResultLogging(enabled bool) *Storage {
+	s.logResults = enabled
+	return s
+}
+
+// WithContextLogger makes s log to the *zap.SugaredLogger stored in the
+// context of each call under key, so that its logs carry the fields of the
+// request it serves. Calls whose context holds no logger under key log to
+// the logger of s.
+func (s *Storage) WithContextLogger(key interface{}) *Storage {
+	s.loggerKey = key
+	return s
+}
+
+// logger returns the logger of ctx (see WithContextLogger), or else that
+// of s, tagged with the shard that ctx was dispatched to. Calls that
+// sampling left out (see models.WithSampled) only log warnings and errors.
+func (s *Storage) logger(ctx context.Context) *zap.SugaredLogger {
+	sugar := s.Sugar
+	if s.loggerKey != nil {
+		if l, ok := ctx.Value(s.loggerKey).(*zap.SugaredLogger); ok && l != nil {
+			sugar = l
+		}
+	}
+	if sampled, ok := models.SampledFromContext(ctx); ok && !sampled {
+		sugar = sugar.Desugar().WithOptions(zap.IncreaseLevel(zap.WarnLevel)).Sugar()
+	}
+	return sugar.With("shard", models.ShardFromContext(ctx))
+}
+
+// logResult logs a cell a read returned, if result logging is enabled.
+func (s *Storage) logResult(ctx context.Context, msg string, keysAndValues ...interface{}) {
+	if s.logResults {
+		s.logger(ctx).Infow(msg, keysAndValues...)
+	}
+}
+
+func (s *Storage) GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	key := s.versionKey(rowKey, columnKey, refKey)
+	s.logger(ctx).Infow("GetCell", "key", key, "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey)
+
+	var h map[string]string
+	h, err = s.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return
+	}
+	if len(h) == 0 {
+		return cell, false, nil
+	}
+
+	cell, err = hashToCell(h)
+	if err != nil {
+		return
+	}
+	s.logResult(ctx, "GetCell scanned data", "AddedAt", cell.AddedAt, "RowKey", cell.RowKey, "ColName", cell.ColumnName, "RefKey", cell.RefKey, "Body", cell.Body, "CreatedAt", cell.CreatedAt)
+
+	return cell, true, nil
+}
+
+// GetCellLatest takes the highest ref key from the versions set. Versions
+// whose hash has already expired are pruned from the set as they are found.
+func (s *Storage) GetCellLatest(ctx context.Context, rowKey, columnKey string) (cell models.Cell, found bool, err error) {
+	versions := s.versionsKey(rowKey, columnKey)
+	s.logger(ctx).Infow("GetCellLatest", "key", versions, "rowKey", rowKey, "columnKey", columnKey)
+
+	for {
+		var members []string
+		members, err = s.client.ZRevRange(ctx, versions, 0, 0).Result()
+		if err != nil {
+			return
+		}
+		if len(members) == 0 {
+			return cell, false, nil
+		}
+
+		var refKey int64
+		refKey, err = strconv.ParseInt(members[0], 10, 64)
+		if err != nil {
+			return
+		}
+
+		cell, found, err = s.GetCell(ctx, rowKey, columnKey, refKey)
+		if err != nil || found {
+			return
+		}
+
+		err = s.client.ZRem(ctx, versions, members[0]).Err()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Storage) PartitionRead(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	var (
+		locationColumn string
+		after          int64
+	)
+
+	switch location {
+	case "timestamp":
+		fallthrough
+	case "created_at":
+		locationColumn = "created_at"
+		switch value.(type) {
+		case *time.Time:
+			t := value.(*time.Time)
+			after = t.Unix()
+		case time.Time:
+			t := value.(time.Time)
+			after = t.Unix()
+		case string:
+			var t time.Time
+			t, err = time.ParseInLocation(timeParseString, value.(string), time.UTC)
+			if err != nil {
+				err = fmt.Errorf("PartitionRead could not parse time string:'%v': %s", value, err)
+				return
+			}
+			after = t.Unix()
+		default:
+			err = fmt.Errorf("PartitionRead had unrecognized type %v", reflect.TypeOf(value))
+			return
+		}
+	case "added_at":
+		locationColumn = "added_at"
+		after, err = models.AddedAtValue(value)
+		if err != nil {
+			return
+		}
+	default:
+		err = errors.New("PartitionRead had unrecognized location " + location)
+		return
+	}
+
+	index := s.indexKey(locationColumn)
+	s.logger(ctx).Infow("PartitionRead", "key", index, "value", after, "limit", limit)
+
+	var keys []string
+	keys, err = s.client.ZRangeByScore(ctx, index, &redis.ZRangeBy{
+		Min:   "(" + strconv.FormatInt(after, 10),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return
+	}
+
+	found = false
+	for _, key := range keys {
+		var h map[string]string
+		h, err = s.client.HGetAll(ctx, key).Result()
+		if err != nil {
+			return
+		}
+		if len(h) == 0 {
+			// Expired; drop it from the index.
+			err = s.client.ZRem(ctx, index, key).Err()
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		var cell models.Cell
+		cell, err = hashToCell(h)
+		if err != nil {
+			return
+		}
+		s.logResult(ctx, "PartitionRead: scanned data", "AddedAt", cell.AddedAt, "RowKey", cell.RowKey, "ColName", cell.ColumnName, "RefKey", cell.RefKey, "Body", cell.Body, "CreatedAt", cell.CreatedAt)
+		cells = append(cells, cell)
+		found = true
+	}
+
+	return cells, found, nil
+}
+
+func (s *Storage) PutCell(ctx context.Context, rowKey, columnKey string, refKey int64, cell models.Cell) (err error) {
+	// ':' separates the parts of our keys.
+	if strings.Contains(rowKey, ":") || strings.Contains(columnKey, ":") {
+		return fmt.Errorf("row key and column key may not contain ':'")
+	}
+
+	s.logger(ctx).Infow("PutCell", "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey, "Body", cell.Body)
+
+	keys := []string{
+		s.versionKey(rowKey, columnKey, refKey),
+		s.versionsKey(rowKey, columnKey),
+		s.indexKey("added_at"),
+		s.indexKey("created_at"),
+		s.sequenceKey(),
+		s.expiryKey(),
+	}
+	var addedAt int64
+	addedAt, err = putCellScript.Run(ctx, s.client, keys, rowKey, columnKey, refKey, cell.Body, cell.CreatedAtOr(time.Now()).Unix(), s.ttl.Milliseconds(), time.Now().UnixMilli(), trimBatch).Int64()
+	if err != nil {
+		return
+	}
+	if addedAt < 0 {
+		return models.ErrCellExists
+	}
+	s.logger(ctx).Infof("added_at = %d\n", addedAt)
+	return
+}
+
+// ResetConnection does nothing, go-redis manages its own connection pool.
+func (s *Storage) ResetConnection(ctx context.Context, key string) error {
+	return nil
+}
+
+// Raw returns the underlying *redis.Client, nil until Open; commands
+// through it bypass the Storage, see core.Storage.
+func (s *Storage) Raw() *redis.Client {
+	return s.client
+}
+
+// Destroy flushes the logger and closes the client, giving up once ctx is
+// done.
+func (s *Storage) Destroy(ctx context.Context) error {
+	return teardown.Run(ctx, s.Sugar, s.client.Close)
+}
+
+// Close implements io.Closer. It releases the connection as Destroy does,
+// and is safe to call more than once.
+func (s *Storage) Close() error {
+	return s.closer.Close(s.Destroy)
+}
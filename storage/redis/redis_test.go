@@ -0,0 +1,91 @@
+package redis
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/rbastic/go-schemaless/models"
+	"github.com/rbastic/go-schemaless/storagetest"
+	"testing"
+	"time"
+)
+
+func newTestStorage(t *testing.T, addr string) *Storage {
+	m := New().WithAddr(addr)
+
+	err := m.WithZap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	m := newTestStorage(t, mr.Addr())
+	storagetest.StorageTest(t, m)
+}
+
+func TestRedisTTL(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	m := newTestStorage(t, mr.Addr()).WithTTL(time.Minute)
+	defer m.Destroy(context.TODO())
+
+	err := m.PutCell(context.TODO(), "ephemeral", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok, err := m.GetCellLatest(context.TODO(), "ephemeral", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected the cell before its TTL elapsed")
+	}
+
+	mr.FastForward(2 * time.Minute)
+
+	_, ok, err = m.GetCellLatest(context.TODO(), "ephemeral", "BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected the cell to have expired")
+	}
+}
+
+func TestRedisTTLTrimsIndexes(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	m := newTestStorage(t, mr.Addr()).WithTTL(time.Millisecond)
+	defer m.Destroy(context.TODO())
+
+	err := m.PutCell(context.TODO(), "ephemeral", "BASE", 1, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// The next write drops the expired version from the indexes.
+	err = m.PutCell(context.TODO(), "ephemeral", "BASE", 2, models.Cell{Body: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{m.indexKey("added_at"), m.indexKey("created_at")} {
+		members, err := m.Raw().ZRange(context.TODO(), key, 0, -1).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := m.versionKey("ephemeral", "BASE", 2)
+		if len(members) != 1 || members[0] != expected {
+			t.Errorf("expected %s to hold only %s, got %v", key, expected, members)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package rqlite
+
+import (
+	"context"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+	"go.uber.org/zap"
+	"os"
+	"strings"
+	"testing"
+)
+
+// The benchmarks run against the rqlite node at $RQLITE_URL, e.g.
+//
+//	RQLITE_URL=http://localhost:4001 go test -run '^$' -bench . ./storage/rqlite
+//
+// Each one starts from an empty cell_bench table. Logging is disabled so it
+// does not dominate the numbers.
+
+const benchTable = "cell_bench"
+
+func newBenchStorage(b *testing.B) *Storage {
+	rawURL := os.Getenv("RQLITE_URL")
+	if rawURL == "" {
+		b.Skip("Please specify RQLITE_URL=... (e.g. http://localhost:4001)")
+	}
+
+	s, err := NewWithConfig(Config{URL: rawURL, TableName: benchTable, Logger: zap.NewNop().Sugar()})
+	if err != nil {
+		b.Skipf("rqlite is unavailable: %s", err)
+	}
+	_, err = s.store.conn.Write([]string{
+		"DROP TABLE IF EXISTS " + benchTable,
+		"CREATE TABLE " + benchTable + " ( added_at INTEGER PRIMARY KEY AUTOINCREMENT, row_key VARCHAR(36) NOT NULL, column_name VARCHAR(64) NOT NULL, ref_key INTEGER NOT NULL, body TEXT, created_at DATETIME DEFAULT (datetime('now','localtime')), checksum INTEGER, schema_version INTEGER NOT NULL DEFAULT 0, metadata TEXT, causation_id VARCHAR(64), correlation_id VARCHAR(64))",
+		"CREATE UNIQUE INDEX uniq" + benchTable + "_idx ON " + benchTable + " ( row_key, column_name, ref_key )",
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { s.Destroy(context.TODO()) })
+	return s
+}
+
+func benchBody() string {
+	return `{"payload":"` + strings.Repeat("x", 256) + `"}`
+}
+
+// fillBench writes one cell to each of n rows.
+func fillBench(b *testing.B, s *Storage, n int) {
+	body := benchBody()
+	for i := 0; i < n; i++ {
+		err := s.PutCell(context.TODO(), fmt.Sprintf("row%d", i), "BASE", 1, models.Cell{Body: body})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPutCell(b *testing.B) {
+	s := newBenchStorage(b)
+	body := benchBody()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := s.PutCell(context.TODO(), fmt.Sprintf("row%d", i), "BASE", 1, models.Cell{Body: body})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetCell(b *testing.B) {
+	const rows = 1000
+	s := newBenchStorage(b)
+	fillBench(b, s, rows)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, found, err := s.GetCell(context.TODO(), fmt.Sprintf("row%d", i%rows), "BASE", 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !found {
+			b.Fatal("cell not found")
+		}
+	}
+}
+
+func BenchmarkPartitionRead(b *testing.B) {
+	const (
+		rows  = 1000
+		limit = 100
+	)
+	s := newBenchStorage(b)
+	fillBench(b, s, rows)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Page through the whole table, limit cells at a time.
+		after := int64((i * limit) % rows)
+		cells, _, err := s.PartitionRead(context.TODO(), 0, "added_at", after, limit)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(cells) != limit {
+			b.Fatalf("expected %d cells, got %d", limit, len(cells))
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package rqlite
+
+import (
+	"errors"
+	"github.com/rqlite/gorqlite"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned, without contacting the cluster, while the
+// circuit breaker is open. See WithCircuitBreaker.
+var ErrCircuitOpen = errors.New("rqlite circuit breaker is open")
+
+// CircuitState is the state of the circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets every request through. It is also the state of a
+	// Storage without a circuit breaker.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails every request with ErrCircuitOpen.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe request through, whose outcome
+	// closes or reopens the circuit.
+	CircuitHalfOpen
+)
+
+func (c CircuitState) String() string {
+	switch c {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// WithCircuitBreaker stops sending requests to the cluster once
+// failureThreshold of them in a row have failed: every operation then fails
+// fast with ErrCircuitOpen. After cooldown, one request is let through as a
+// probe. If it succeeds the circuit closes again; if not, it stays open for
+// another cooldown. It may be called before or after WithURL.
+func (s *Storage) WithCircuitBreaker(failureThreshold int, cooldown time.Duration) *Storage {
+	s.breaker = &breaker{threshold: failureThreshold, cooldown: cooldown, now: time.Now}
+	if s.store != nil {
+		s.store.guard(s.breaker)
+	}
+	return s
+}
+
+// BreakerState returns the state of the circuit breaker, for dashboards.
+func (s *Storage) BreakerState() CircuitState {
+	if s.breaker == nil {
+		return CircuitClosed
+	}
+	return s.breaker.current()
+}
+
+// LastError returns the last error a request to the cluster failed with,
+// or nil. It is only tracked with a circuit breaker.
+func (s *Storage) LastError() error {
+	if s.breaker == nil {
+		return nil
+	}
+	s.breaker.mu.Lock()
+	defer s.breaker.mu.Unlock()
+	return s.breaker.lastErr
+}
+
+// guard sends the requests of r's connections through b, instead of any
+// breaker they went through before.
+func (r *rqliteDB) guard(b *breaker) {
+	r.breaker = b
+	if r.conn != nil {
+		r.conn = &breakerConn{conn: unguarded(r.conn), breaker: b}
+	}
+	if r.weak != nil {
+		r.weak = &breakerConn{conn: unguarded(r.weak), breaker: b}
+	}
+	for level, conn := range r.levels {
+		r.levels[level] = &breakerConn{conn: unguarded(conn), breaker: b}
+	}
+}
+
+// unguarded returns conn without its breaker, if it has one.
+func unguarded(conn connection) connection {
+	if guarded, ok := conn.(*breakerConn); ok {
+		return guarded.conn
+	}
+	return conn
+}
+
+// answered reports whether err, the error of a request whose statements
+// failed with errs, is only that of failed statements, e.g. a duplicate
+// key or bad SQL: the cluster answered, so it counts as a success. gorqlite
+// reports a request that did not get an answer with the same error for the
+// request and its result.
+func answered(err error, errs ...error) bool {
+	if err == nil {
+		return true
+	}
+	for _, e := range errs {
+		if e != nil && e != err {
+			return true
+		}
+	}
+	return false
+}
+
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	lastErr  error
+}
+
+// current returns the state, reporting an open circuit whose cooldown has
+// passed as half-open.
+func (b *breaker) current() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+// allow returns ErrCircuitOpen if a request may not be sent. Otherwise the
+// caller must report its outcome with done.
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = CircuitHalfOpen
+		return nil
+	case CircuitHalfOpen:
+		// A probe is already in flight.
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// done reports the outcome of a request allow let through. err is nil if
+// the cluster answered it, even with statement errors.
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+
+	b.lastErr = err
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		b.state = CircuitOpen
+		b.openedAt = b.now()
+	}
+}
+
+// breakerConn is a connection guarded by a breaker.
+type breakerConn struct {
+	conn    connection
+	breaker *breaker
+}
+
+func (c *breakerConn) QueryOne(sqlStatement string) (gorqlite.QueryResult, error) {
+	err := c.breaker.allow()
+	if err != nil {
+		return gorqlite.QueryResult{}, err
+	}
+	rows, err := c.conn.QueryOne(sqlStatement)
+	if answered(err, rows.Err) {
+		c.breaker.done(nil)
+	} else {
+		c.breaker.done(err)
+	}
+	return rows, err
+}
+
+func (c *breakerConn) Write(sqlStatements []string) ([]gorqlite.WriteResult, error) {
+	err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	results, err := c.conn.Write(sqlStatements)
+	errs := make([]error, len(results))
+	for i, result := range results {
+		errs[i] = result.Err
+	}
+	if answered(err, errs...) {
+		c.breaker.done(nil)
+	} else {
+		c.breaker.done(err)
+	}
+	return results, err
+}
+
+func (c *breakerConn) Close() {
+	c.conn.Close()
+}
@@ -1,6 +1,9 @@
 DROP TABLE IF EXISTS cell;
 
-CREATE TABLE cell ( added_at INTEGER PRIMARY KEY AUTOINCREMENT, row_key VARCHAR(36) NOT NULL, column_name VARCHAR(64) NOT NULL, ref_key INTEGER NOT NULL, body JSON, created_at DATETIME DEFAULT (datetime('now','localtime'))); 
+CREATE TABLE cell ( added_at INTEGER PRIMARY KEY AUTOINCREMENT, row_key VARCHAR(64) NOT NULL, column_name VARCHAR(64) NOT NULL, ref_key INTEGER NOT NULL, body JSON, created_at DATETIME DEFAULT (datetime('now')), checksum INTEGER, schema_version INTEGER NOT NULL DEFAULT 0, metadata TEXT, causation_id VARCHAR(64), correlation_id VARCHAR(64)); 
 CREATE UNIQUE INDEX IF NOT EXISTS uniqcell_idx ON cell ( row_key, column_name, ref_key );
+CREATE TABLE IF NOT EXISTS cell_index ( index_name VARCHAR(64) NOT NULL, value VARCHAR(255) NOT NULL, row_key VARCHAR(64) NOT NULL, column_name VARCHAR(64) NOT NULL, PRIMARY KEY ( index_name, row_key, column_name ) );
+CREATE INDEX IF NOT EXISTS cell_index_value_idx ON cell_index ( index_name, value );
 
 
+CREATE TABLE IF NOT EXISTS cell_checkpoint ( job_name VARCHAR(128) NOT NULL PRIMARY KEY, value INTEGER NOT NULL );
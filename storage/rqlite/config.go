@@ -0,0 +1,167 @@
+package rqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rbastic/go-schemaless/storage/internal/table"
+	"go.uber.org/zap"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidConfig is wrapped by every error Config.Validate returns.
+var ErrInvalidConfig = errors.New("invalid rqlite config")
+
+// Config holds everything needed to build a Storage in one place, for
+// setups driven by a configuration file. The zero value of every field but
+// URL picks the same default as the fluent builder.
+type Config struct {
+	// URL of any node of the cluster, http(s)://[user:pass@]host[:port].
+	// The port defaults to 4001, see NormalizeURL.
+	URL string
+	// Consistency is the read consistency level: "none", "weak" or
+	// "strong". Empty means gorqlite's default, "weak".
+	Consistency string
+	// TableName is the cell table. Empty means "cell".
+	TableName string
+	// Logger defaults to a zap production logger.
+	Logger *zap.SugaredLogger
+	// Timeout bounds each HTTP request to the cluster. It is rounded up to
+	// whole seconds. Zero means gorqlite's default.
+	Timeout time.Duration
+	// ConnectTimeout bounds the initial connection to the cluster, see
+	// WithConnectTimeout. Zero means no bound.
+	ConnectTimeout time.Duration
+	// UserAgent is sent with every request, see WithUserAgent. Empty
+	// leaves the User-Agent alone.
+	UserAgent string
+	// Compression asks for gzip-compressed responses, see WithCompression.
+	Compression bool
+	// ConsistencyFallback retries point reads at weak consistency when the
+	// leader is unavailable, see WithConsistencyFallback.
+	ConsistencyFallback bool
+	// BreakerThreshold, if positive, adds a circuit breaker that opens after
+	// that many failed requests in a row, see WithCircuitBreaker.
+	BreakerThreshold int
+	// BreakerCooldown is how long the circuit breaker stays open.
+	BreakerCooldown time.Duration
+	// CreateSchemaOnStart creates the tables on connecting, see
+	// WithCreateSchemaOnStart.
+	CreateSchemaOnStart bool
+	// MaxStatementsPerRequest bounds the requests of PutCellBatch, see
+	// WithMaxStatementsPerRequest. Zero means 500.
+	MaxStatementsPerRequest int
+}
+
+var tableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Validate checks every field of cfg.
+func (cfg Config) Validate() error {
+	_, err := NormalizeURL(cfg.URL)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, err)
+	}
+
+	switch cfg.Consistency {
+	case "", "none", "weak", "strong":
+	default:
+		return fmt.Errorf("%w: Consistency must be none, weak or strong, got %q", ErrInvalidConfig, cfg.Consistency)
+	}
+
+	if cfg.TableName != "" && !tableNameRegexp.MatchString(cfg.TableName) {
+		return fmt.Errorf("%w: TableName %q is not a valid identifier", ErrInvalidConfig, cfg.TableName)
+	}
+
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("%w: Timeout must not be negative, got %s", ErrInvalidConfig, cfg.Timeout)
+	}
+	if cfg.ConnectTimeout < 0 {
+		return fmt.Errorf("%w: ConnectTimeout must not be negative, got %s", ErrInvalidConfig, cfg.ConnectTimeout)
+	}
+	if cfg.BreakerThreshold < 0 || cfg.BreakerCooldown < 0 {
+		return fmt.Errorf("%w: BreakerThreshold and BreakerCooldown must not be negative", ErrInvalidConfig)
+	}
+	if cfg.MaxStatementsPerRequest < 0 {
+		return fmt.Errorf("%w: MaxStatementsPerRequest must not be negative, got %d", ErrInvalidConfig, cfg.MaxStatementsPerRequest)
+	}
+	return nil
+}
+
+// connectURL returns cfg.URL, normalized (see NormalizeURL), with the
+// consistency level and timeout added as the query parameters gorqlite
+// understands.
+func (cfg Config) connectURL() string {
+	normalized, _ := NormalizeURL(cfg.URL)
+	u, _ := url.Parse(normalized)
+	q := u.Query()
+	if cfg.Consistency != "" {
+		q.Set("level", cfg.Consistency)
+	}
+	if cfg.Timeout > 0 {
+		q.Set("timeout", strconv.Itoa(int(math.Ceil(cfg.Timeout.Seconds()))))
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// NewWithConfig validates cfg and returns a Storage connected to it.
+func NewWithConfig(cfg Config) (*Storage, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	s := New()
+	if cfg.Logger != nil {
+		s.Sugar = cfg.Logger
+	} else {
+		logger, err := zap.NewProduction()
+		if err != nil {
+			return nil, err
+		}
+		s.Sugar = logger.Sugar()
+	}
+
+	if cfg.TableName != "" {
+		name := cfg.TableName
+		s.tables = table.NewResolver(func(ctx context.Context) string { return name }, name)
+	}
+
+	if cfg.UserAgent != "" {
+		setUserAgent(cfg.UserAgent)
+	}
+	if cfg.Compression {
+		s.WithCompression(true)
+	}
+	s.maxStatements = cfg.MaxStatementsPerRequest
+
+	s.store = newRqlite()
+	err = s.store.open(cfg.connectURL(), cfg.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ConsistencyFallback {
+		s.fallback = true
+		err = s.store.openWeak(cfg.connectURL(), cfg.ConnectTimeout)
+		if err != nil {
+			s.store.conn.Close()
+			return nil, err
+		}
+	}
+	if cfg.BreakerThreshold > 0 {
+		s.WithCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	}
+	if cfg.CreateSchemaOnStart {
+		s.schemaOnStart = true
+		err = s.CreateSchema(context.Background())
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
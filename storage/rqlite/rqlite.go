@@ -3,13 +3,22 @@ package rqlite
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/rbastic/go-schemaless/internal/teardown"
 	"github.com/rbastic/go-schemaless/models"
+	"github.com/rbastic/go-schemaless/storage/internal/query"
+	"github.com/rbastic/go-schemaless/storage/internal/table"
 	"github.com/rqlite/gorqlite"
 	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,42 +26,276 @@ const (
 	timeParseString = "2006-01-02T15:04:05Z"
 )
 
+// parseCreatedAt parses a created_at read back from rqlite. A value that does
+// not parse, e.g. an empty string, gives a nil time rather than an error so
+// that the rest of the cell is still returned.
+func parseCreatedAt(s string) *time.Time {
+	t, err := time.Parse(timeParseString, strings.TrimSpace(s))
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// connection is the part of *gorqlite.Connection we use.
+type connection interface {
+	QueryOne(sqlStatement string) (gorqlite.QueryResult, error)
+	Write(sqlStatements []string) ([]gorqlite.WriteResult, error)
+	Close()
+}
+
 type rqliteDB struct {
-	conn  *gorqlite.Connection
+	conn connection
+	// weak, if set, reads at weak consistency; see WithConsistencyFallback.
+	weak  connection
 	Sugar *zap.SugaredLogger
+
+	// url and timeout are what conn was opened with, for the connections
+	// at other consistency levels; see WithConsistencyContext.
+	url     string
+	timeout time.Duration
+	breaker *breaker
+	mu      sync.Mutex
+	levels  map[string]connection
 }
 
 func newRqlite() *rqliteDB {
 	return &rqliteDB{}
 }
 
-func (r *rqliteDB) WithOpen(url string) *rqliteDB {
-	store, err := gorqlite.Open(url)
+func (r *rqliteDB) WithOpen(url string, timeout time.Duration) *rqliteDB {
+	err := r.open(url, timeout)
 	if err != nil {
 		panic(err)
 	}
-	r.conn = &store
 	return r
 }
 
+func (r *rqliteDB) open(url string, timeout time.Duration) error {
+	conn, err := connect(url, timeout)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.url, r.timeout = url, timeout
+	return nil
+}
+
+// openWeak opens the second connection to url that reads at weak
+// consistency.
+func (r *rqliteDB) openWeak(rawURL string, timeout time.Duration) error {
+	levelURL, err := withLevel(rawURL, "weak")
+	if err != nil {
+		return err
+	}
+	conn, err := connect(levelURL, timeout)
+	if err != nil {
+		return err
+	}
+	r.weak = conn
+	return nil
+}
+
+// withLevel returns rawURL reading at the given consistency level.
+func withLevel(rawURL string, level string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("level", level)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// at returns the connection that reads at level, connecting to the cluster
+// the first time level is asked for.
+func (r *rqliteDB) at(level string) (connection, error) {
+	switch level {
+	case "none", "weak", "strong":
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidConsistency, level)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conn, ok := r.levels[level]; ok {
+		return conn, nil
+	}
+	levelURL, err := withLevel(r.url, level)
+	if err != nil {
+		return nil, err
+	}
+	var conn connection
+	conn, err = connect(levelURL, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if r.breaker != nil {
+		conn = &breakerConn{conn: conn, breaker: r.breaker}
+	}
+	if r.levels == nil {
+		r.levels = make(map[string]connection)
+	}
+	r.levels[level] = conn
+	return conn, nil
+}
+
+// close closes every connection of r.
+func (r *rqliteDB) close() {
+	r.conn.Close()
+	if r.weak != nil {
+		r.weak.Close()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for level, conn := range r.levels {
+		conn.Close()
+		delete(r.levels, level)
+	}
+}
+
+// connect connects to url, giving up with ErrConnectTimeout after timeout if
+// it is positive. gorqlite cannot cancel a connection attempt, so one that
+// times out carries on in the background and is closed if it ever succeeds.
+func connect(url string, timeout time.Duration) (*gorqlite.Connection, error) {
+	if timeout <= 0 {
+		return dial(url)
+	}
+
+	type result struct {
+		conn *gorqlite.Connection
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial(url)
+		done <- result{conn, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.conn, res.err
+	case <-timer.C:
+		go func() {
+			res := <-done
+			if res.err == nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("%w after %s", ErrConnectTimeout, timeout)
+	}
+}
+
+func dial(url string) (*gorqlite.Connection, error) {
+	store, err := gorqlite.Open(url)
+	if err != nil {
+		return nil, err
+	}
+	// PutCell may write index entries alongside the cell; they must
+	// commit or fail together.
+	err = store.SetExecutionWithTransaction(true)
+	if err != nil {
+		return nil, err
+	}
+	return &store, nil
+}
+
 func (r *rqliteDB) WithSugar(z *zap.SugaredLogger) *rqliteDB {
 	r.Sugar = z
 	return r
 }
 
+// ErrConnectTimeout is returned when connecting to the cluster takes longer
+// than the connect timeout.
+var ErrConnectTimeout = errors.New("timed out connecting to rqlite")
+
+// ErrInvalidConsistency is returned by a read whose context asks for a
+// consistency level other than "none", "weak" or "strong".
+var ErrInvalidConsistency = errors.New("invalid rqlite consistency level")
+
+type consistencyKey struct{}
+
+// WithConsistencyContext returns a copy of ctx whose reads run at level,
+// one of "none", "weak" or "strong", instead of the level the storage was
+// opened with. It lets a caller make a critical read strong, or a cheap one
+// weak, without keeping a Storage for each level.
+//
+// The override applies to GetCell, GetCellLatest and GetCheckpoint. Each
+// level is read through a connection of its own, opened by the first read
+// that asks for it.
+func WithConsistencyContext(ctx context.Context, level string) context.Context {
+	return context.WithValue(ctx, consistencyKey{}, level)
+}
+
 // Storage is a rqlite-backed storage.
 type Storage struct {
-	store *rqliteDB
-	Sugar *zap.SugaredLogger
+	store          *rqliteDB
+	tables         *table.Resolver
+	Sugar          *zap.SugaredLogger
+	indexes        []models.Index
+	connectTimeout time.Duration
+	fallback       bool
+	breaker        *breaker
+	// logResults enables logging every cell a read returns
+	logResults bool
+	// continueOnError makes partition reads skip rows that fail to scan
+	continueOnError bool
+	// columns renames the columns of the cell table, see
+	// WithSchemaColumnMapping
+	columns query.Columns
+	// loggerKey is the context key of a request-scoped logger
+	loggerKey interface{}
+	// schemaOnStart creates the tables on connecting, see
+	// WithCreateSchemaOnStart
+	schemaOnStart bool
+	// maxStatements bounds the statements of each request of
+	// PutCellBatch, see WithMaxStatementsPerRequest
+	maxStatements int
+
+	closer teardown.Once
 }
 
 const (
 	// This space intentionally left blank for facilitating vimdiff
 	// acrosss storages.
-	getCellSQL          = "SELECT added_at, row_key, column_name, ref_key, body,created_at FROM cell WHERE row_key = '%s' AND column_name = '%s' AND ref_key = %d LIMIT 1"
-	getCellLatestSQL    = "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell WHERE row_key = '%s' AND column_name = '%s' ORDER BY ref_key DESC LIMIT 1"
-	getCellsForShardSQL = "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell WHERE %s > '%s' LIMIT %d"
-	putCellSQL          = "INSERT INTO cell ( row_key, column_name, ref_key, body ) VALUES('%s', '%s', %d, '%s')"
+	getCellSQL                  = "SELECT added_at, row_key, column_name, ref_key, body,created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %s WHERE row_key = '%s' AND column_name = '%s' AND ref_key = %d LIMIT 2"
+	getCellLatestSQL            = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %s WHERE row_key = '%s' AND column_name = '%s' ORDER BY ref_key DESC, added_at DESC LIMIT 1"
+	getCellBeforeSQL            = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %s WHERE row_key = '%s' AND column_name = '%s' AND ref_key < %d ORDER BY ref_key DESC, added_at DESC LIMIT 1"
+	getCellsForShardSQL         = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > '%[3]s' ORDER BY %[2]s LIMIT %[4]d"
+	getCellsForVersionSQL       = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > '%[3]s' AND schema_version = %[5]d ORDER BY %[2]s LIMIT %[4]d"
+	getCellsForTagSQL           = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > '%[3]s' AND EXISTS (SELECT 1 FROM json_each(metadata) AS m, json_each('%[5]s') AS t WHERE m.key = t.key AND m.value = t.value) ORDER BY %[2]s LIMIT %[4]d"
+	getCellsForCorrelationSQL   = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE %[2]s > '%[3]s' AND correlation_id = '%[5]s' ORDER BY %[2]s LIMIT %[4]d"
+	getCellsAfterSQL            = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE ( created_at, row_key, column_name, ref_key ) > ( '%[2]s', '%[3]s', '%[4]s', %[5]d ) ORDER BY created_at, row_key, column_name, ref_key LIMIT %[6]d"
+	getCellsAfterVersionSQL     = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE ( created_at, row_key, column_name, ref_key ) > ( '%[2]s', '%[3]s', '%[4]s', %[5]d ) AND schema_version = %[7]d ORDER BY created_at, row_key, column_name, ref_key LIMIT %[6]d"
+	getCellsAfterTagSQL         = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE ( created_at, row_key, column_name, ref_key ) > ( '%[2]s', '%[3]s', '%[4]s', %[5]d ) AND EXISTS (SELECT 1 FROM json_each(metadata) AS m, json_each('%[7]s') AS t WHERE m.key = t.key AND m.value = t.value) ORDER BY created_at, row_key, column_name, ref_key LIMIT %[6]d"
+	getCellsAfterCorrelationSQL = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE ( created_at, row_key, column_name, ref_key ) > ( '%[2]s', '%[3]s', '%[4]s', %[5]d ) AND correlation_id = '%[7]s' ORDER BY created_at, row_key, column_name, ref_key LIMIT %[6]d"
+	getCellRangeSQL             = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE row_key = '%[2]s' AND column_name = '%[3]s' AND ref_key BETWEEN %[4]d AND %[5]d ORDER BY ref_key, added_at LIMIT %[6]d"
+	feedReadSQL                 = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %[1]s WHERE row_key = '%[2]s' AND ref_key < %[3]d ORDER BY ref_key DESC, column_name, added_at DESC LIMIT %[4]d"
+	latestPerRowSQL             = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM ( SELECT *, ROW_NUMBER() OVER ( PARTITION BY row_key ORDER BY ref_key DESC, added_at DESC ) AS row_rank FROM %[1]s ) AS ranked WHERE row_rank <= %[2]d ORDER BY row_key, row_rank LIMIT %[3]d"
+	getRowSQL                   = "SELECT added_at, row_key, column_name, ref_key, body, created_at, COALESCE(checksum, -1), schema_version, COALESCE(metadata, ''), COALESCE(causation_id, ''), COALESCE(correlation_id, '') FROM %s WHERE row_key = '%s' ORDER BY column_name, ref_key, added_at"
+	putCellSQL                  = "INSERT INTO %s ( row_key, column_name, ref_key, body, checksum, schema_version, metadata, causation_id, correlation_id, created_at ) VALUES('%s', '%s', %d, '%s', %d, %d, %s, %s, %s, COALESCE(%s, datetime('now')))"
+	deleteRowSQL                = "DELETE FROM %s WHERE row_key = '%s'"
+	deleteCellSQL               = "DELETE FROM %s WHERE row_key = '%s' AND column_name = '%s' AND ref_key = %d"
+	existsRowSQL                = "SELECT 1 FROM %s WHERE row_key = '%s' LIMIT 1"
+	moveRowSQL                  = "UPDATE %s SET row_key = '%s' WHERE row_key = '%s'"
+	deleteIndexSQL              = "DELETE FROM %s WHERE index_name = '%s' AND row_key = '%s' AND column_name = '%s'"
+	putIndexSQL                 = "INSERT INTO %s ( index_name, value, row_key, column_name ) VALUES('%s', '%s', '%s', '%s')"
+	lookupIndexSQL              = "SELECT DISTINCT row_key FROM %s WHERE index_name = '%s' AND value = '%s'"
+	listColumnsSQL              = "SELECT DISTINCT column_name FROM %s WHERE row_key = '%s' ORDER BY column_name"
+	existsSQL                   = "SELECT DISTINCT row_key, column_name FROM %s WHERE %s"
+	existsKeySQL                = "( row_key = '%s' AND column_name = '%s' )"
+	describeTableSQL            = "SELECT name, type, \"notnull\" FROM pragma_table_xinfo('%s') ORDER BY cid"
+	countByColumnSQL            = "SELECT column_name, COUNT(*) FROM %s WHERE row_key = '%s' GROUP BY column_name"
+	setCheckpointSQL            = "INSERT INTO %s ( job_name, value ) VALUES('%s', %d) ON CONFLICT ( job_name ) DO UPDATE SET value = excluded.value"
+	getCheckpointSQL            = "SELECT value FROM %s WHERE job_name = '%s'"
+	createTableSQL              = "CREATE TABLE IF NOT EXISTS %s ( added_at INTEGER PRIMARY KEY AUTOINCREMENT, row_key VARCHAR(64) NOT NULL, column_name VARCHAR(64) NOT NULL, ref_key INTEGER NOT NULL, body TEXT, created_at DATETIME DEFAULT (datetime('now')), checksum INTEGER, schema_version INTEGER NOT NULL DEFAULT 0, metadata TEXT, causation_id VARCHAR(64), correlation_id VARCHAR(64))"
+	createIndexSQL              = "CREATE UNIQUE INDEX IF NOT EXISTS uniq%[1]s_idx ON %[1]s ( row_key, column_name, ref_key )"
+	createIndexTableSQL         = "CREATE TABLE IF NOT EXISTS %s ( index_name VARCHAR(64) NOT NULL, value VARCHAR(255) NOT NULL, row_key VARCHAR(64) NOT NULL, column_name VARCHAR(64) NOT NULL, PRIMARY KEY ( index_name, row_key, column_name ) )"
+	createValueIndexSQL         = "CREATE INDEX IF NOT EXISTS %[1]s_value_idx ON %[1]s ( index_name, value )"
+	createCheckpointSQL         = "CREATE TABLE IF NOT EXISTS %s ( job_name VARCHAR(128) NOT NULL PRIMARY KEY, value INTEGER NOT NULL )"
 )
 
 // New returns a new rqlite--backed Storage. scheme is http/https. level is
@@ -71,8 +314,197 @@ func (s *Storage) WithZap() *Storage {
 	return s
 }
 
-func (s *Storage) WithURL(url string) *Storage {
-	s.store = newRqlite().WithOpen(url)
+// WithURL connects to the node at rawURL, normalized by NormalizeURL. It
+// panics if rawURL is invalid, before trying to connect, or if connecting
+// fails; use NewWithConfig to get the error instead.
+func (s *Storage) WithURL(rawURL string) *Storage {
+	normalized, err := NormalizeURL(rawURL)
+	if err != nil {
+		panic(err)
+	}
+	s.store = newRqlite().WithOpen(normalized, s.connectTimeout)
+	if s.fallback {
+		err = s.store.openWeak(normalized, s.connectTimeout)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if s.breaker != nil {
+		s.store.guard(s.breaker)
+	}
+	if s.schemaOnStart {
+		err = s.CreateSchema(context.Background())
+		if err != nil {
+			panic(err)
+		}
+	}
+	return s
+}
+
+// WithCreateSchemaOnStart makes connecting to the cluster create the tables
+// with CreateSchema, so that a new cluster needs no separate setup step.
+// Call it, and WithTableResolver or WithSchemaColumnMapping, before WithURL,
+// which panics if the tables cannot be created; NewWithConfig returns the
+// error instead.
+func (s *Storage) WithCreateSchemaOnStart(enabled bool) *Storage {
+	s.schemaOnStart = enabled
+	return s
+}
+
+// CreateSchema creates the cell table, with its index and checkpoint tables,
+// that a context without a table resolves to, unless they exist already.
+// It is the same schema as cell.sql, but leaves existing tables alone.
+func (s *Storage) CreateSchema(ctx context.Context) error {
+	tblName, err := s.tables.Resolve(ctx)
+	if err != nil {
+		return err
+	}
+	indexName, checkpointName := table.Index(tblName), table.Checkpoint(tblName)
+	_, err = s.store.conn.Write([]string{
+		fmt.Sprintf(s.columns.Rename(createTableSQL), tblName),
+		fmt.Sprintf(s.columns.Rename(createIndexSQL), tblName),
+		fmt.Sprintf(createIndexTableSQL, indexName),
+		fmt.Sprintf(createValueIndexSQL, indexName),
+		fmt.Sprintf(createCheckpointSQL, checkpointName),
+	})
+	return err
+}
+
+// WithConsistencyFallback makes GetCell and GetCellLatest retry a read that
+// failed for want of a leader, as happens during an election, at weak
+// consistency, logging a warning. A weak read is served by whichever node
+// receives it, so it may miss the latest writes. Writes are never retried.
+// Call it before WithURL, which opens a second connection for these reads.
+func (s *Storage) WithConsistencyFallback(enabled bool) *Storage {
+	s.fallback = enabled
+	return s
+}
+
+// leaderUnavailable are fragments of the errors rqlite and gorqlite return
+// when a read needing the leader cannot reach one.
+var leaderUnavailable = []string{"not leader", "leadership lost", "no leader", "tried all peers"}
+
+func isLeaderUnavailable(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, fragment := range leaderUnavailable {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryOne runs a read at the consistency level of ctx, falling back to weak
+// consistency if the leader is unavailable and WithConsistencyFallback is on.
+func (s *Storage) queryOne(ctx context.Context, op string, querySQL string) (gorqlite.QueryResult, error) {
+	conn := s.store.conn
+	if level, ok := ctx.Value(consistencyKey{}).(string); ok {
+		var err error
+		conn, err = s.store.at(level)
+		if err != nil {
+			return gorqlite.QueryResult{}, err
+		}
+	}
+	rows, err := conn.QueryOne(querySQL)
+	if err == nil || s.store.weak == nil || !isLeaderUnavailable(err) {
+		return rows, err
+	}
+	s.logger(ctx).Warnw("leader unavailable, downgrading read to weak consistency", "op", op, "error", err)
+	return s.store.weak.QueryOne(querySQL)
+}
+
+// WithConnectTimeout bounds how long WithURL waits for the cluster to answer
+// before panicking with ErrConnectTimeout. Call it before WithURL; for an
+// error instead of a panic, use NewWithConfig and Config.ConnectTimeout.
+// Zero, the default, waits as long as gorqlite does.
+func (s *Storage) WithConnectTimeout(d time.Duration) *Storage {
+	s.connectTimeout = d
+	return s
+}
+
+// WithInsecureSkipVerify turns TLS certificate verification off (or back
+// on), for testing against a cluster with a self-signed certificate. Call it
+// after WithZap and before WithURL.
+//
+// gorqlite sends its requests through http.DefaultTransport and offers no way
+// to pass our own, so this changes the setting for every client in the
+// process that uses the default transport. Never enable it in production.
+func (s *Storage) WithInsecureSkipVerify(skip bool) *Storage {
+	transport := baseTransport()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.InsecureSkipVerify = skip
+	if skip {
+		s.Sugar.Warnw("TLS CERTIFICATE VERIFICATION IS DISABLED: connections to rqlite, and every other HTTPS request made through http.DefaultTransport, can be intercepted. Do not use this in production.")
+	}
+	return s
+}
+
+// WithUserAgent sends userAgent as the User-Agent of the requests to the
+// cluster, so that rqlite's access logs can tell clients apart. Call it
+// before WithURL.
+//
+// As with WithInsecureSkipVerify, gorqlite leaves us no transport of our
+// own: this wraps http.DefaultTransport, so every request made through it
+// that does not set a User-Agent of its own gets userAgent too.
+func (s *Storage) WithUserAgent(userAgent string) *Storage {
+	setUserAgent(userAgent)
+	return s
+}
+
+// WithCompression makes the requests to the cluster ask for gzip-compressed
+// responses, and decodes them, which cuts the bandwidth of large partition
+// reads to a fraction. Call it before WithURL.
+//
+// gorqlite sets no Accept-Encoding of its own, so the *http.Transport under
+// http.DefaultTransport negotiates gzip as long as its DisableCompression is
+// unset, as it is by default; this clears (or sets) it. As with
+// WithInsecureSkipVerify, that applies to every client in the process that
+// uses the default transport.
+func (s *Storage) WithCompression(enabled bool) *Storage {
+	baseTransport().DisableCompression = !enabled
+	return s
+}
+
+// userAgentTransport sets a User-Agent on the requests that carry none.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		// A RoundTripper must not modify the request it is given.
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.base.RoundTrip(req)
+}
+
+func setUserAgent(userAgent string) {
+	if t, ok := http.DefaultTransport.(*userAgentTransport); ok {
+		t.userAgent = userAgent
+		return
+	}
+	http.DefaultTransport = &userAgentTransport{base: http.DefaultTransport, userAgent: userAgent}
+}
+
+// baseTransport returns the *http.Transport under http.DefaultTransport,
+// unwrapping the one WithUserAgent installs.
+func baseTransport() *http.Transport {
+	rt := http.DefaultTransport
+	if t, ok := rt.(*userAgentTransport); ok {
+		rt = t.base
+	}
+	return rt.(*http.Transport)
+}
+
+// WithIndex maintains idx on every PutCell, in the same transaction as the
+// cell itself. The index points a value at the row that most recently wrote
+// it. The cell_index table must exist, see cell.sql.
+func (s *Storage) WithIndex(idx models.Index) *Storage {
+	s.indexes = append(s.indexes, idx)
 	return s
 }
 
@@ -81,6 +513,120 @@ func quoteString(s string) string {
 	return quoted
 }
 
+// metadataSQL renders m as the value of the metadata column.
+func metadataSQL(m map[string]string) string {
+	encoded, ok := models.MarshalMetadata(m).(string)
+	if !ok {
+		return "NULL"
+	}
+	return "'" + quoteString(encoded) + "'"
+}
+
+// idSQL renders id as the value of the causation_id or correlation_id
+// column, NULL for none.
+func idSQL(id string) string {
+	if id == "" {
+		return "NULL"
+	}
+	return "'" + quoteString(id) + "'"
+}
+
+// createdAtSQL renders t as the created_at of a new cell, NULL for the
+// column default.
+func createdAtSQL(t *time.Time) string {
+	createdAt, ok := query.CreatedAt(t).(string)
+	if !ok {
+		return "NULL"
+	}
+	return "'" + createdAt + "'"
+}
+
+// WithTableResolver makes every operation run against the table fn returns
+// for its context, which must be one of allowed. The tables, and their
+// <table>_index tables if indexes are configured, must exist; see cell.sql.
+func (s *Storage) WithTableResolver(fn func(ctx context.Context) string, allowed ...string) *Storage {
+	s.tables = table.NewResolver(fn, allowed...)
+	return s
+}
+
+// WithSchemaColumnMapping makes s use a cell table whose columns are named
+// differently, e.g. a legacy table with "rk" for row_key: mapping maps the
+// name of each column that differs to its name in the table. The names of
+// the index and checkpoint tables' columns do not change.
+func (s *Storage) WithSchemaColumnMapping(mapping map[string]string) (*Storage, error) {
+	columns, err := query.NewColumns(mapping)
+	if err != nil {
+		return nil, err
+	}
+	s.columns = columns
+	return s, nil
+}
+
+// WithDetectedColumns reads the columns of the cell table with DescribeTable,
+// and leaves the optional columns it lacks (checksum, schema_version,
+// metadata, causation_id and correlation_id) out of every statement, for a
+// table that predates them and has not been migrated yet. Cells are then
+// written without them and read back as cells written without them. The
+// columns found are kept until it is called again, e.g. once the table has
+// been migrated. Call it after WithSchemaColumnMapping.
+func (s *Storage) WithDetectedColumns(ctx context.Context) (*Storage, error) {
+	columns, err := s.DescribeTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.columns = s.columns.Detect(columns)
+	return s, nil
+}
+
+// WithContinueOnError makes partition reads skip the rows that fail to scan,
+// e.g. for a checksum mismatch, rather than stop at the first. The cells
+// read are returned along with a models.ScanErrors holding the error of
+// every row skipped. It is off by default.
+func (s *Storage) WithContinueOnError(enabled bool) *Storage {
+	s.continueOnError = enabled
+	return s
+}
+
+// WithResultLogging logs every cell a read returns, with its body, at Info.
+// It is off by default: a partition read can return thousands of cells, and
+// their bodies may hold personal data. Operations are logged either way.
+func (s *Storage) WithResultLogging(enabled bool) *Storage {
+	s.logResults = enabled
+	return s
+}
+
+// WithContextLogger makes s log to the *zap.SugaredLogger stored in the
+// context of each call under key, so that its logs carry the fields of the
+// request it serves. Calls whose context holds no logger under key log to
+// the logger of s.
+func (s *Storage) WithContextLogger(key interface{}) *Storage {
+	s.loggerKey = key
+	return s
+}
+
+// logger returns the logger of ctx (see WithContextLogger), or else that
+// of s, tagged with the shard that ctx was dispatched to. Calls that
+// sampling left out (see models.WithSampled) only log warnings and errors.
+func (s *Storage) logger(ctx context.Context) *zap.SugaredLogger {
+	sugar := s.Sugar
+	if s.loggerKey != nil {
+		if l, ok := ctx.Value(s.loggerKey).(*zap.SugaredLogger); ok && l != nil {
+			sugar = l
+		}
+	}
+	if sampled, ok := models.SampledFromContext(ctx); ok && !sampled {
+		sugar = sugar.Desugar().WithOptions(zap.IncreaseLevel(zap.WarnLevel)).Sugar()
+	}
+	return sugar.With("shard", models.ShardFromContext(ctx))
+}
+
+// logResult logs a cell a read returned, if result logging is enabled.
+func (s *Storage) logResult(ctx context.Context, msg string, keysAndValues ...interface{}) {
+	if s.logResults {
+		s.logger(ctx).Infow(msg, keysAndValues...)
+	}
+}
+
 func (s *Storage) GetCell(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
 	var (
 		resAddedAt   int64
@@ -89,37 +635,57 @@ func (s *Storage) GetCell(ctx context.Context, rowKey string, columnKey string,
 		resRefKey    int64
 		resBody      string
 		resCreatedAt string
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
 	)
 
-	s.Sugar.Infow("GetCell", "querySQL before", getCellSQL, "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey)
-	querySQL := fmt.Sprintf(getCellSQL, quoteString(rowKey), quoteString(columnKey), refKey)
-	s.Sugar.Infow("GetCell", "querySQL after", querySQL)
+	s.logger(ctx).Infow("GetCell", "querySQL before", getCellSQL, "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey)
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	querySQL := fmt.Sprintf(s.columns.Rename(getCellSQL), tableName, quoteString(rowKey), quoteString(columnKey), refKey)
+	s.logger(ctx).Infow("GetCell", "querySQL after", querySQL)
 
-	rows, err := s.store.conn.QueryOne(querySQL)
+	rows, err := s.queryOne(ctx, "GetCell", querySQL)
 	if err != nil {
 		return
 	}
 
 	found = false
 	for rows.Next() {
-		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt)
+		if found {
+			// getCellSQL asks for a second row only to detect this.
+			err = models.ErrDuplicateCell
+			return
+		}
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
 		if err != nil {
 			return
 		}
-		s.Sugar.Infow("GetCell scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+		s.logResult(ctx, "GetCell scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
 
 		cell.AddedAt = resAddedAt
 		cell.RowKey = resRowKey
 		cell.ColumnName = resColName
 		cell.RefKey = resRefKey
 		cell.Body = resBody
-		var t time.Time
-		t, err = time.Parse(timeParseString, resCreatedAt)
+		cell.CreatedAt = parseCreatedAt(resCreatedAt)
+		s.logResult(ctx, "GetCell: parsing time", "resCreatedAt", resCreatedAt, "time result", cell.CreatedAt)
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
 		if err != nil {
 			return
 		}
-		s.Sugar.Infow("GetCell: parsing time", "resCreatedAt", resCreatedAt, "time result", t)
-		cell.CreatedAt = &t
 		found = true
 	}
 
@@ -134,36 +700,111 @@ func (s *Storage) GetCellLatest(ctx context.Context, rowKey, columnKey string) (
 		resRefKey    int64
 		resBody      string
 		resCreatedAt string
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
+		rows         gorqlite.QueryResult
+	)
+
+	s.logger(ctx).Infow("GetCellLatest", "querySQL before", getCellSQL, "rowKey", rowKey, "columnKey", columnKey)
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	querySQL := fmt.Sprintf(s.columns.Rename(getCellLatestSQL), tableName, quoteString(rowKey), quoteString(columnKey))
+	s.logger(ctx).Infow("GetCellLatest", "querySQL after", querySQL)
+	rows, err = s.queryOne(ctx, "GetCellLatest", querySQL)
+	if err != nil {
+		return
+	}
+	found = false
+	for rows.Next() {
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
+		if err != nil {
+			return
+		}
+		s.logResult(ctx, "GetCellLatest scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+
+		cell.AddedAt = resAddedAt
+		cell.RowKey = resRowKey
+		cell.ColumnName = resColName
+		cell.RefKey = resRefKey
+		cell.Body = resBody
+		cell.CreatedAt = parseCreatedAt(resCreatedAt)
+		s.logResult(ctx, "GetCellLatest: parsing time", "resCreatedAt", resCreatedAt, "time result", cell.CreatedAt)
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			return
+		}
+		found = true
+	}
+
+	return cell, found, nil
+}
+
+// GetCellBefore implements core.PreviousReader
+func (s *Storage) GetCellBefore(ctx context.Context, rowKey string, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      string
+		resCreatedAt string
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
 		rows         gorqlite.QueryResult
 	)
 
-	s.Sugar.Infow("GetCellLatest", "querySQL before", getCellSQL, "rowKey", rowKey, "columnKey", columnKey)
-	querySQL := fmt.Sprintf(getCellLatestSQL, quoteString(rowKey), quoteString(columnKey))
-	s.Sugar.Infow("GetCellLatest", "querySQL after", querySQL)
+	s.logger(ctx).Infow("GetCellBefore", "querySQL before", getCellBeforeSQL, "rowKey", rowKey, "columnKey", columnKey)
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	querySQL := fmt.Sprintf(s.columns.Rename(getCellBeforeSQL), tableName, quoteString(rowKey), quoteString(columnKey), refKey)
+	s.logger(ctx).Infow("GetCellBefore", "querySQL after", querySQL)
 	rows, err = s.store.conn.QueryOne(querySQL)
 	if err != nil {
 		return
 	}
 	found = false
 	for rows.Next() {
-		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt)
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
 		if err != nil {
 			return
 		}
-		s.Sugar.Infow("GetCellLatest scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+		s.logResult(ctx, "GetCellBefore scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
 
 		cell.AddedAt = resAddedAt
 		cell.RowKey = resRowKey
 		cell.ColumnName = resColName
 		cell.RefKey = resRefKey
 		cell.Body = resBody
-		var t time.Time
-		t, err = time.Parse(timeParseString, resCreatedAt)
-		s.Sugar.Infow("GetCellLatest: parsing time", "resCreatedAt", resCreatedAt, "time result", t)
+		cell.CreatedAt = parseCreatedAt(resCreatedAt)
+		s.logResult(ctx, "GetCellBefore: parsing time", "resCreatedAt", resCreatedAt, "time result", cell.CreatedAt)
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
 		if err != nil {
 			return
 		}
-		cell.CreatedAt = &t
 		found = true
 	}
 
@@ -171,6 +812,44 @@ func (s *Storage) GetCellLatest(ctx context.Context, rowKey, columnKey string) (
 }
 
 func (s *Storage) PartitionRead(ctx context.Context, partitionNumber int, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	return s.partitionRead(ctx, location, value, limit, getCellsForShardSQL, getCellsAfterSQL)
+}
+
+// PartitionReadSchemaVersion implements core.SchemaVersionReader.
+func (s *Storage) PartitionReadSchemaVersion(ctx context.Context, partitionNumber int, schemaVersion int64, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	return s.partitionRead(ctx, location, value, limit, getCellsForVersionSQL, getCellsAfterVersionSQL, schemaVersion)
+}
+
+// PartitionScan implements core.PartitionScanner.
+func (s *Storage) PartitionScan(ctx context.Context, partitionNumber int, location string, value interface{}, limit int, fn func(models.Cell) error) error {
+	return s.scanPartition(ctx, location, value, limit, fn, getCellsForShardSQL, getCellsAfterSQL)
+}
+
+// PartitionReadTag implements core.TagReader.
+func (s *Storage) PartitionReadTag(ctx context.Context, partitionNumber int, tagKey string, tagValue string, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	return s.partitionRead(ctx, location, value, limit, getCellsForTagSQL, getCellsAfterTagSQL, quoteString(models.Tag(tagKey, tagValue)))
+}
+
+// PartitionReadCorrelation implements core.CorrelationReader.
+func (s *Storage) PartitionReadCorrelation(ctx context.Context, partitionNumber int, correlationID string, location string, value interface{}, limit int) (cells []models.Cell, found bool, err error) {
+	return s.partitionRead(ctx, location, value, limit, getCellsForCorrelationSQL, getCellsAfterCorrelationSQL, quoteString(correlationID))
+}
+
+// partitionRead collects the cells scanPartition reads. forShardSQL and
+// afterSQL are formatted with the values in filter after those of the
+// location.
+func (s *Storage) partitionRead(ctx context.Context, location string, value interface{}, limit int, forShardSQL string, afterSQL string, filter ...interface{}) (cells []models.Cell, found bool, err error) {
+	err = s.scanPartition(ctx, location, value, limit, func(cell models.Cell) error {
+		cells = append(cells, cell)
+		return nil
+	}, forShardSQL, afterSQL, filter...)
+	return cells, len(cells) > 0, err
+}
+
+// scanPartition reads the cells after value in location with forShardSQL, or
+// afterSQL for a cursor, passing each to fn as it is scanned. It stops at the
+// first error fn returns.
+func (s *Storage) scanPartition(ctx context.Context, location string, value interface{}, limit int, fn func(models.Cell) error, forShardSQL string, afterSQL string, filter ...interface{}) (err error) {
 
 	var (
 		resAddedAt     int64
@@ -179,8 +858,14 @@ func (s *Storage) PartitionRead(ctx context.Context, partitionNumber int, locati
 		resRefKey      int64
 		resBody        string
 		resCreatedAt   string
+		resChecksum    int64
+		resVersion     int64
+		resMeta        string
+		resCauseID     string
+		resCorrelID    string
 		locationColumn string
 		valueStr       string
+		cursor         models.Cursor
 	)
 
 	switch location {
@@ -191,14 +876,14 @@ func (s *Storage) PartitionRead(ctx context.Context, partitionNumber int, locati
 		switch value.(type) {
 		case *time.Time:
 			t := value.(*time.Time)
-			valueStr = t.Format(timeParseString)
+			valueStr = t.UTC().Format(timeParseString)
 			if valueStr == "" {
 				err = fmt.Errorf("PartitionRead had empty value after formatting *time.Time:'%v'", t)
 				return
 			}
 		case time.Time:
 			t := value.(time.Time)
-			valueStr = t.Format(timeParseString)
+			valueStr = t.UTC().Format(timeParseString)
 			if valueStr == "" {
 				err = fmt.Errorf("PartitionRead had empty value after formatting time.Time:'%v'", t)
 				return
@@ -216,31 +901,59 @@ func (s *Storage) PartitionRead(ctx context.Context, partitionNumber int, locati
 		}
 	case "added_at":
 		locationColumn = "added_at"
-		valueStr = fmt.Sprintf("%d", value)
+		var addedAt int64
+		addedAt, err = models.AddedAtValue(value)
+		if err != nil {
+			return
+		}
+		valueStr = strconv.FormatInt(addedAt, 10)
+	case "cursor":
+		token, ok := value.(string)
+		if !ok {
+			err = fmt.Errorf("PartitionRead had unrecognized cursor type %T", value)
+			return
+		}
+		cursor, err = models.DecodeCursor(token)
+		if err != nil {
+			return
+		}
 	default:
 		err = errors.New("PartitionRead had unrecognized location " + location)
 		return
 	}
 
-	sqlStr := fmt.Sprintf(getCellsForShardSQL, locationColumn, valueStr, limit)
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	if models.InclusiveFromContext(ctx) {
+		forShardSQL = query.Inclusive(forShardSQL)
+	}
+	sqlStr := fmt.Sprintf(s.columns.Rename(forShardSQL), append([]interface{}{tableName, locationColumn, valueStr, limit}, filter...)...)
+	if location == "cursor" {
+		sqlStr = fmt.Sprintf(s.columns.Rename(afterSQL), append([]interface{}{tableName, quoteString(cursor.CreatedAt), quoteString(cursor.RowKey), quoteString(cursor.ColumnName), cursor.RefKey, limit}, filter...)...)
+	}
 
-	var rows []gorqlite.QueryResult
-	s.Sugar.Infow("PartitionRead", "query", sqlStr, "valueStr", valueStr)
-	stmts := make([]string, 1)
-	stmts[0] = sqlStr
-	rows, err = s.store.conn.Query(stmts)
+	s.logger(ctx).Infow("PartitionRead", "query", sqlStr, "valueStr", valueStr)
+	var rows gorqlite.QueryResult
+	rows, err = s.store.conn.QueryOne(sqlStr)
 	if err != nil {
 		return
 	}
 
-	found = false
-	for _, row := range rows {
-		row.Next()
-		err = row.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt)
+	// A row that fails to scan stops the read, unless s continues on error.
+	var scanErrs models.ScanErrors
+	for rows.Next() {
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
 		if err != nil {
-			return
+			if !s.continueOnError {
+				return
+			}
+			scanErrs = append(scanErrs, err)
+			continue
 		}
-		s.Sugar.Infow("PartitionRead: scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+		s.logResult(ctx, "PartitionRead: scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
 
 		var cell models.Cell
 		cell.AddedAt = resAddedAt
@@ -248,44 +961,721 @@ func (s *Storage) PartitionRead(ctx context.Context, partitionNumber int, locati
 		cell.ColumnName = resColName
 		cell.RefKey = resRefKey
 		cell.Body = resBody
-		var t time.Time
-
-		t, err = time.Parse(timeParseString, resCreatedAt)
+		cell.CreatedAt = parseCreatedAt(resCreatedAt)
+		s.logResult(ctx, "PartitionRead: parsing time", "resCreatedAt", resCreatedAt, "time result", cell.CreatedAt)
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			if !s.continueOnError {
+				return
+			}
+			scanErrs = append(scanErrs, err)
+			continue
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			if !s.continueOnError {
+				return
+			}
+			scanErrs = append(scanErrs, err)
+			continue
+		}
+		err = fn(cell)
 		if err != nil {
 			return
 		}
-		s.Sugar.Infow("PartitionRead: parsing time", "resCreatedAt", resCreatedAt, "time result", t)
-		cell.CreatedAt = &t
-		cells = append(cells, cell)
-		found = true
 	}
 
-	return cells, found, nil
-}
+	if len(scanErrs) > 0 {
+		return scanErrs
+	}
+	return nil
+}
+
+// GetCellRange returns the versions of a cell with a ref key between
+// minRefKey and maxRefKey inclusive, in ref key order. A maxRefKey of 0 means
+// no upper bound.
+func (s *Storage) GetCellRange(ctx context.Context, rowKey string, columnKey string, minRefKey int64, maxRefKey int64, limit int) (cells []models.Cell, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      string
+		resCreatedAt string
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
+	)
+
+	if maxRefKey == 0 {
+		maxRefKey = math.MaxInt64
+	}
+
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	querySQL := fmt.Sprintf(s.columns.Rename(getCellRangeSQL), tableName, quoteString(rowKey), quoteString(columnKey), minRefKey, maxRefKey, limit)
+	s.logger(ctx).Infow("GetCellRange", "querySQL", querySQL)
+
+	var rows gorqlite.QueryResult
+	rows, err = s.store.conn.QueryOne(querySQL)
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
+		if err != nil {
+			return
+		}
+		s.logResult(ctx, "GetCellRange scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+
+		var cell models.Cell
+		cell.AddedAt = resAddedAt
+		cell.RowKey = resRowKey
+		cell.ColumnName = resColName
+		cell.RefKey = resRefKey
+		cell.Body = resBody
+		cell.CreatedAt = parseCreatedAt(resCreatedAt)
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			return
+		}
+		cells = append(cells, cell)
+	}
+	return
+}
+
+// FeedRead implements core.FeedReader
+func (s *Storage) FeedRead(ctx context.Context, rowKey string, beforeRefKey int64, limit int) (cells []models.Cell, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      string
+		resCreatedAt string
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
+	)
+
+	if beforeRefKey == 0 {
+		beforeRefKey = math.MaxInt64
+	}
+
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	querySQL := fmt.Sprintf(s.columns.Rename(feedReadSQL), tableName, quoteString(rowKey), beforeRefKey, limit)
+	s.logger(ctx).Infow("FeedRead", "querySQL", querySQL)
+
+	var rows gorqlite.QueryResult
+	rows, err = s.store.conn.QueryOne(querySQL)
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
+		if err != nil {
+			return
+		}
+		s.logResult(ctx, "FeedRead scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+
+		var cell models.Cell
+		cell.AddedAt = resAddedAt
+		cell.RowKey = resRowKey
+		cell.ColumnName = resColName
+		cell.RefKey = resRefKey
+		cell.Body = resBody
+		cell.CreatedAt = parseCreatedAt(resCreatedAt)
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			return
+		}
+		cells = append(cells, cell)
+	}
+	return
+}
+
+// PartitionLatestPerRow implements core.LatestPerRowReader
+func (s *Storage) PartitionLatestPerRow(ctx context.Context, partitionNumber int, n int, limit int) (cells []models.Cell, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      string
+		resCreatedAt string
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
+	)
+
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	querySQL := fmt.Sprintf(s.columns.Rename(latestPerRowSQL), tableName, n, limit)
+	s.logger(ctx).Infow("PartitionLatestPerRow", "querySQL", querySQL)
+
+	var rows gorqlite.QueryResult
+	rows, err = s.store.conn.QueryOne(querySQL)
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
+		if err != nil {
+			return
+		}
+		s.logResult(ctx, "PartitionLatestPerRow scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+
+		var cell models.Cell
+		cell.AddedAt = resAddedAt
+		cell.RowKey = resRowKey
+		cell.ColumnName = resColName
+		cell.RefKey = resRefKey
+		cell.Body = resBody
+		cell.CreatedAt = parseCreatedAt(resCreatedAt)
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			return
+		}
+		cells = append(cells, cell)
+	}
+	return
+}
 
 func (s *Storage) PutCell(ctx context.Context, rowKey, columnKey string, refKey int64, cell models.Cell) (err error) {
-	s.Sugar.Infow("PutCell", "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey, "Body", cell.Body)
+	s.logger(ctx).Infow("PutCell", "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey, "Body", cell.Body)
 
-	insertSQL := fmt.Sprintf(putCellSQL, quoteString(rowKey), quoteString(columnKey), refKey, quoteString(string(cell.Body)))
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	insertSQL := s.putCellStatement(tableName, rowKey, columnKey, refKey, cell)
 
-	s.Sugar.Infow("PutCell", "insertSQL", insertSQL)
+	s.logger(ctx).Infow("PutCell", "insertSQL", insertSQL)
 
 	stmts := make([]string, 1)
 	stmts[0] = insertSQL
+	stmts = append(stmts, s.indexStatements(tableName, rowKey, columnKey, cell.Body)...)
 
-	var results []gorqlite.WriteResult
+	return s.write(stmts)
+}
+
+// putCellStatement returns the INSERT of cell at (rowKey, columnKey, refKey)
+// into tableName, without the optional columns the table lacks.
+func (s *Storage) putCellStatement(tableName string, rowKey string, columnKey string, refKey int64, cell models.Cell) string {
+	insertSQL, args := s.columns.Insert(putCellSQL, quoteString(rowKey), quoteString(columnKey), refKey, quoteString(cell.Body), models.Checksum(cell.Body), cell.SchemaVersion, metadataSQL(cell.Metadata), idSQL(cell.CausationID), idSQL(cell.CorrelationID), createdAtSQL(cell.CreatedAt))
+	return fmt.Sprintf(insertSQL, append([]interface{}{tableName}, args...)...)
+}
+
+// indexStatements returns the statements pointing every index covering
+// columnKey at rowKey, for a cell with the given body.
+func (s *Storage) indexStatements(tableName string, rowKey, columnKey string, body string) []string {
+	var stmts []string
+	for _, idx := range s.indexes {
+		if !idx.Covers(columnKey) {
+			continue
+		}
+		stmts = append(stmts, fmt.Sprintf(deleteIndexSQL, table.Index(tableName), quoteString(idx.Name), quoteString(rowKey), quoteString(columnKey)))
+		value, ok := idx.Value(body)
+		if !ok {
+			continue
+		}
+		stmts = append(stmts, fmt.Sprintf(putIndexSQL, table.Index(tableName), quoteString(idx.Name), quoteString(value), quoteString(rowKey), quoteString(columnKey)))
+	}
+	return stmts
+}
+
+// write runs stmts in one transaction.
+func (s *Storage) write(stmts []string) (err error) {
+	_, err = s.writeResults(stmts)
+	return
+}
+
+// writeResults is write returning the result of each statement. gorqlite
+// fails the whole write when any statement does, so the errors of the
+// statements are looked at first: a duplicate cell fails with
+// models.ErrCellExists, whatever the error of the write.
+func (s *Storage) writeResults(stmts []string) (results []gorqlite.WriteResult, err error) {
 	results, err = s.store.conn.Write(stmts)
+	for _, v := range results {
+		if v.Err != nil {
+			if strings.Contains(v.Err.Error(), "UNIQUE constraint failed") {
+				return nil, models.ErrCellExists
+			}
+			return nil, v.Err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// GetRow implements core.RowReader
+func (s *Storage) GetRow(ctx context.Context, rowKey string) (cells []models.Cell, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    string
+		resColName   string
+		resRefKey    int64
+		resBody      string
+		resCreatedAt string
+		resChecksum  int64
+		resVersion   int64
+		resMeta      string
+		resCauseID   string
+		resCorrelID  string
+	)
+
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
 	if err != nil {
 		return
 	}
+	querySQL := fmt.Sprintf(s.columns.Rename(getRowSQL), tableName, quoteString(rowKey))
+	s.logger(ctx).Infow("GetRow", "querySQL", querySQL)
 
-	for _, v := range results {
-		//fmt.Printf("for result %d, %d rows were affected\n",n,v.RowsAffected)
-		//fmt.Printf("last insert id was %d\n", v.LastInsertID)
-		if v.Err != nil {
-			//fmt.Printf("   we have this error: %s\n",v.Err.Error())
-			return v.Err
+	var rows gorqlite.QueryResult
+	rows, err = s.store.conn.QueryOne(querySQL)
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt, &resChecksum, &resVersion, &resMeta, &resCauseID, &resCorrelID)
+		if err != nil {
+			return
 		}
+		s.logResult(ctx, "GetRow scanned data", "AddedAt", resAddedAt, "RowKey", resRowKey, "ColName", resColName, "RefKey", resRefKey, "Body", resBody, "CreatedAt", resCreatedAt)
+
+		var cell models.Cell
+		cell.AddedAt = resAddedAt
+		cell.RowKey = resRowKey
+		cell.ColumnName = resColName
+		cell.RefKey = resRefKey
+		cell.Body = resBody
+		cell.CreatedAt = parseCreatedAt(resCreatedAt)
+		cell.SchemaVersion = resVersion
+		cell.CausationID, cell.CorrelationID = resCauseID, resCorrelID
+		cell.Metadata, err = models.UnmarshalMetadata(resMeta)
+		if err != nil {
+			return
+		}
+		err = models.VerifyChecksum(cell, resChecksum)
+		if err != nil {
+			return
+		}
+		cells = append(cells, cell)
+	}
+	return
+}
+
+// PutCells implements core.RowWriter. Like PutCell, it relies on the
+// connection executing each batch of statements in a transaction.
+func (s *Storage) PutCells(ctx context.Context, rowKey string, cells []models.Cell, replace bool) (err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	var stmts []string
+	if replace {
+		stmts = append(stmts, fmt.Sprintf(s.columns.Rename(deleteRowSQL), tableName, quoteString(rowKey)))
+		if len(s.indexes) > 0 {
+			stmts = append(stmts, fmt.Sprintf(deleteRowSQL, table.Index(tableName), quoteString(rowKey)))
+		}
+	}
+	for _, cell := range cells {
+		stmts = append(stmts, s.putCellStatement(tableName, rowKey, cell.ColumnName, cell.RefKey, cell))
+		stmts = append(stmts, s.indexStatements(tableName, rowKey, cell.ColumnName, cell.Body)...)
+	}
+	if len(stmts) == 0 {
+		return
+	}
+
+	s.logger(ctx).Infow("PutCells", "stmts", stmts)
+	return s.write(stmts)
+}
+
+// defaultMaxStatements is the number of statements PutCellBatch sends per
+// request unless WithMaxStatementsPerRequest says otherwise.
+const defaultMaxStatements = 500
+
+// WithMaxStatementsPerRequest makes PutCellBatch send at most n statements
+// per request, so that a large batch stays under the request size the
+// cluster accepts. It defaults to 500. A cell and its index statements always
+// go in the same request, so one with more than n of them makes a larger
+// request on its own.
+func (s *Storage) WithMaxStatementsPerRequest(n int) *Storage {
+	s.maxStatements = n
+	return s
+}
+
+// PutCellBatch writes cells, each at its own RowKey, ColumnName and RefKey,
+// in as many requests as WithMaxStatementsPerRequest calls for, and returns
+// how many of them were written. Each request is a transaction, so the
+// cells are written a request at a time: an error stops the batch, and the
+// cells of the requests before it stay written.
+//
+// PutCellBatch does not start a request once less time is left before the
+// deadline of ctx than the previous request took, and fails with an error
+// wrapping context.DeadlineExceeded, so that the caller can retry the rest
+// of cells in time.
+func (s *Storage) PutCellBatch(ctx context.Context, cells []models.Cell) (applied int, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	max := s.maxStatements
+	if max <= 0 {
+		max = defaultMaxStatements
+	}
+
+	var (
+		stmts   []string
+		pending int
+		took    time.Duration
+	)
+	flush := func() error {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < took {
+			return fmt.Errorf("%w: %d of %d cells written before the deadline", context.DeadlineExceeded, applied, len(cells))
+		}
+		s.logger(ctx).Infow("PutCellBatch", "cells", pending, "stmts", len(stmts))
+		start := time.Now()
+		err = s.write(stmts)
+		took = time.Since(start)
+		if err != nil {
+			return err
+		}
+		applied += pending
+		stmts, pending = stmts[:0], 0
+		return nil
+	}
+
+	for _, cell := range cells {
+		cellStmts := append([]string{
+			s.putCellStatement(tableName, cell.RowKey, cell.ColumnName, cell.RefKey, cell),
+		}, s.indexStatements(tableName, cell.RowKey, cell.ColumnName, cell.Body)...)
+		if pending > 0 && len(stmts)+len(cellStmts) > max {
+			err = flush()
+			if err != nil {
+				return
+			}
+		}
+		stmts = append(stmts, cellStmts...)
+		pending++
+	}
+	if pending > 0 {
+		err = flush()
+	}
+	return
+}
+
+// DeleteRow implements core.RowDeleter. Like PutCells, it relies on the
+// connection executing its statements in a transaction.
+func (s *Storage) DeleteRow(ctx context.Context, rowKey string) (deleted int64, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	stmts := []string{fmt.Sprintf(s.columns.Rename(deleteRowSQL), tableName, quoteString(rowKey))}
+	if len(s.indexes) > 0 {
+		stmts = append(stmts, fmt.Sprintf(deleteRowSQL, table.Index(tableName), quoteString(rowKey)))
+	}
+
+	s.logger(ctx).Infow("DeleteRow", "stmts", stmts)
+	var results []gorqlite.WriteResult
+	results, err = s.writeResults(stmts)
+	if err != nil || len(results) == 0 {
+		return
+	}
+	return results[0].RowsAffected, nil
+}
+
+// ReplaceCell implements core.CellReplacer
+func (s *Storage) ReplaceCell(ctx context.Context, rowKey, columnKey string, refKey int64, cell models.Cell) (err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	stmts := []string{
+		fmt.Sprintf(s.columns.Rename(deleteCellSQL), tableName, quoteString(rowKey), quoteString(columnKey), refKey),
+		s.putCellStatement(tableName, rowKey, columnKey, refKey, cell),
+	}
+	stmts = append(stmts, s.indexStatements(tableName, rowKey, columnKey, cell.Body)...)
+
+	s.logger(ctx).Infow("ReplaceCell", "stmts", stmts)
+	return s.write(stmts)
+}
+
+// MoveRow implements core.RowMover. The updates run in one transaction,
+// but the check that dstRowKey is free runs before it, so a cell written to
+// dstRowKey in between is not detected.
+func (s *Storage) MoveRow(ctx context.Context, srcRowKey string, dstRowKey string) (err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+
+	querySQL := fmt.Sprintf(s.columns.Rename(existsRowSQL), tableName, quoteString(dstRowKey))
+	s.logger(ctx).Infow("MoveRow", "querySQL", querySQL)
+	var rows gorqlite.QueryResult
+	rows, err = s.store.conn.QueryOne(querySQL)
+	if err != nil {
+		return
+	}
+	if rows.Next() {
+		return models.ErrRowExists
+	}
+
+	stmts := []string{fmt.Sprintf(s.columns.Rename(moveRowSQL), tableName, quoteString(dstRowKey), quoteString(srcRowKey))}
+	if len(s.indexes) > 0 {
+		stmts = append(stmts, fmt.Sprintf(moveRowSQL, table.Index(tableName), quoteString(dstRowKey), quoteString(srcRowKey)))
+	}
+	s.logger(ctx).Infow("MoveRow", "stmts", stmts)
+	return s.write(stmts)
+}
+
+// LookupByIndex implements core.Indexer
+func (s *Storage) LookupByIndex(ctx context.Context, indexName string, value string) (rowKeys []string, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	querySQL := fmt.Sprintf(lookupIndexSQL, table.Index(tableName), quoteString(indexName), quoteString(value))
+	s.logger(ctx).Infow("LookupByIndex", "querySQL", querySQL)
+
+	var rows gorqlite.QueryResult
+	rows, err = s.store.conn.QueryOne(querySQL)
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		var rowKey string
+		err = rows.Scan(&rowKey)
+		if err != nil {
+			return
+		}
+		rowKeys = append(rowKeys, rowKey)
+	}
+	return
+}
+
+// ListColumns implements core.ColumnLister
+func (s *Storage) ListColumns(ctx context.Context, rowKey string) (columns []string, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	querySQL := fmt.Sprintf(s.columns.Rename(listColumnsSQL), tableName, quoteString(rowKey))
+	s.logger(ctx).Infow("ListColumns", "querySQL", querySQL)
+
+	var rows gorqlite.QueryResult
+	rows, err = s.store.conn.QueryOne(querySQL)
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		var column string
+		err = rows.Scan(&column)
+		if err != nil {
+			return
+		}
+		columns = append(columns, column)
+	}
+	return
+}
+
+// Exists implements core.ExistenceChecker
+func (s *Storage) Exists(ctx context.Context, keys []models.CellKey) (exists map[models.CellKey]bool, err error) {
+	exists = make(map[models.CellKey]bool, len(keys))
+	for _, key := range keys {
+		exists[key] = false
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	conds := make([]string, len(keys))
+	for i, key := range keys {
+		conds[i] = fmt.Sprintf(s.columns.Rename(existsKeySQL), quoteString(key.RowKey), quoteString(key.ColumnName))
+	}
+	querySQL := fmt.Sprintf(s.columns.Rename(existsSQL), tableName, strings.Join(conds, " OR "))
+	s.logger(ctx).Infow("Exists", "keys", len(keys))
+
+	var rows gorqlite.QueryResult
+	rows, err = s.store.conn.QueryOne(querySQL)
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		var key models.CellKey
+		err = rows.Scan(&key.RowKey, &key.ColumnName)
+		if err != nil {
+			return
+		}
+		exists[key] = true
+	}
+	return
+}
+
+// DescribeTable implements core.TableDescriber
+func (s *Storage) DescribeTable(ctx context.Context) (columns []models.ColumnInfo, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	querySQL := fmt.Sprintf(describeTableSQL, tableName)
+	s.logger(ctx).Infow("DescribeTable", "querySQL", querySQL)
+
+	var rows gorqlite.QueryResult
+	rows, err = s.store.conn.QueryOne(querySQL)
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		var (
+			column  models.ColumnInfo
+			notNull int64
+		)
+		err = rows.Scan(&column.Name, &column.Type, &notNull)
+		if err != nil {
+			return
+		}
+		column.Name = s.columns.Logical(column.Name)
+		column.NotNull = notNull != 0
+		columns = append(columns, column)
+	}
+	return
+}
+
+// CountByColumn implements core.ColumnCounter
+func (s *Storage) CountByColumn(ctx context.Context, rowKey string) (counts map[string]int64, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	querySQL := fmt.Sprintf(s.columns.Rename(countByColumnSQL), tableName, quoteString(rowKey))
+	s.logger(ctx).Infow("CountByColumn", "querySQL", querySQL)
+
+	var rows gorqlite.QueryResult
+	rows, err = s.store.conn.QueryOne(querySQL)
+	if err != nil {
+		return
+	}
+
+	counts = make(map[string]int64)
+	for rows.Next() {
+		var (
+			column string
+			count  int64
+		)
+		err = rows.Scan(&column, &count)
+		if err != nil {
+			return
+		}
+		counts[column] = count
+	}
+	return
+}
+
+// SetCheckpoint implements core.Checkpointer
+func (s *Storage) SetCheckpoint(ctx context.Context, jobName string, value int64) (err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	insertSQL := fmt.Sprintf(setCheckpointSQL, table.Checkpoint(tableName), quoteString(jobName), value)
+	s.logger(ctx).Infow("SetCheckpoint", "insertSQL", insertSQL)
+
+	return s.write([]string{insertSQL})
+}
+
+// GetCheckpoint implements core.Checkpointer
+func (s *Storage) GetCheckpoint(ctx context.Context, jobName string) (value int64, found bool, err error) {
+	var tableName string
+	tableName, err = s.tables.Resolve(ctx)
+	if err != nil {
+		return
+	}
+	querySQL := fmt.Sprintf(getCheckpointSQL, table.Checkpoint(tableName), quoteString(jobName))
+	s.logger(ctx).Infow("GetCheckpoint", "querySQL", querySQL)
+
+	var rows gorqlite.QueryResult
+	rows, err = s.queryOne(ctx, "GetCheckpoint", querySQL)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		err = rows.Scan(&value)
+		if err != nil {
+			return
+		}
+		found = true
 	}
 	return
 }
@@ -295,11 +1685,26 @@ func (s *Storage) ResetConnection(ctx context.Context, key string) error {
 	return nil
 }
 
+// Raw returns the underlying *gorqlite.Connection, nil before WithURL;
+// statements through it bypass the Storage, see core.Storage.
+func (s *Storage) Raw() *gorqlite.Connection {
+	if s.store == nil {
+		return nil
+	}
+	raw, _ := unguarded(s.store.conn).(*gorqlite.Connection)
+	return raw
+}
+
 // Destroy closes the in-memory store, and is a completely destructive operation.
 func (s *Storage) Destroy(ctx context.Context) error {
-	// TODO(rbastic): What do if there's an error in Sync()?
-	s.Sugar.Sync()
+	return teardown.Run(ctx, s.Sugar, func() error {
+		s.store.close()
+		return nil
+	})
+}
 
-	s.store.conn.Close()
-	return nil
+// Close implements io.Closer. It releases the connection as Destroy does,
+// and is safe to call more than once.
+func (s *Storage) Close() error {
+	return s.closer.Close(s.Destroy)
 }
@@ -0,0 +1,64 @@
+package rqlite
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidURL is wrapped by every error NormalizeURL returns.
+var ErrInvalidURL = errors.New("invalid rqlite URL")
+
+// defaultPort is the HTTP port of an rqlite node, which a URL without one
+// is given.
+const defaultPort = "4001"
+
+// NormalizeURL checks that rawURL names a node of a cluster, as
+// http(s)://[user:pass@]host[:port][?query], and returns it with the scheme
+// and host in lower case and the port defaulting to 4001. The query, e.g.
+// level=strong, is kept as is. It is what WithURL and NewWithConfig connect
+// to, so that a typo fails early with an error saying what is wrong with the
+// URL rather than with one from deep inside gorqlite.
+func NormalizeURL(rawURL string) (string, error) {
+	if rawURL == "" {
+		return "", fmt.Errorf("%w: empty URL", ErrInvalidURL)
+	}
+	if !strings.Contains(rawURL, "://") {
+		return "", fmt.Errorf("%w: %q has no scheme, e.g. http://%s", ErrInvalidURL, rawURL, rawURL)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%w: scheme must be http or https, got %q", ErrInvalidURL, u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return "", fmt.Errorf("%w: %q has no host", ErrInvalidURL, rawURL)
+	}
+	port := u.Port()
+	if port == "" {
+		if strings.HasSuffix(u.Host, ":") {
+			return "", fmt.Errorf("%w: %q has an empty port", ErrInvalidURL, rawURL)
+		}
+		port = defaultPort
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("%w: port must be a number from 1 to 65535, got %q", ErrInvalidURL, port)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return "", fmt.Errorf("%w: %q has a path, %q; rqlite serves its API at the root", ErrInvalidURL, rawURL, u.Path)
+	}
+	if u.Fragment != "" {
+		return "", fmt.Errorf("%w: %q has a fragment", ErrInvalidURL, rawURL)
+	}
+
+	u.Host = net.JoinHostPort(host, strconv.Itoa(n))
+	u.Path = ""
+	return u.String(), nil
+}
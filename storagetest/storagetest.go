@@ -2,6 +2,8 @@ package storagetest
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/rbastic/go-schemaless"
 	"github.com/rbastic/go-schemaless/models"
 	"github.com/satori/go.uuid"
@@ -41,7 +43,8 @@ func runPuts(t *testing.T, storage schemaless.Storage) string {
 
 // StorageTest is a simple sanity check for a schemaless Storage backend
 func StorageTest(t *testing.T, storage schemaless.Storage) {
-	startTime := time.Now().Format(sqlDateFormat)
+	// A created_at given as a string is a wall clock time in UTC.
+	startTime := time.Now().UTC().Format(sqlDateFormat)
 
 	time.Sleep(time.Second * 1)
 
@@ -72,6 +75,11 @@ func StorageTest(t *testing.T, storage schemaless.Storage) {
 		t.Errorf("GetCell failed when retrieving an old value: body:%s ok=%v\n", string(v.Body), ok)
 	}
 
+	err = storage.PutCell(context.TODO(), cellID, baseCol, 1, models.Cell{Body: testString2})
+	if err != models.ErrCellExists {
+		t.Errorf("overwriting an existing cell: expected ErrCellExists, got err=%v\n", err)
+	}
+
 	var cells []models.Cell
 	cells, ok, err = storage.PartitionRead(context.TODO(), 0, "timestamp", startTime, 5)
 	if err != nil {
@@ -85,6 +93,34 @@ func StorageTest(t *testing.T, storage schemaless.Storage) {
 		t.Fatal("we have an obvious problem")
 	}
 
+	cells, ok, err = storage.PartitionRead(context.TODO(), 0, "added_at", int64(0), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || len(cells) == 0 {
+		t.Fatal("expected cells after added_at 0, response was:", cells)
+	}
+
+	_, _, err = storage.PartitionRead(context.TODO(), 0, "added_at", "0", 5)
+	if !errors.Is(err, models.ErrLocationValueType) {
+		t.Errorf("reading after a string added_at: expected ErrLocationValueType, got err=%v\n", err)
+	}
+
+	// A row key as long as a UUID behind the longest prefix of
+	// WithHashedRowKeys must fit.
+	hashedID := fmt.Sprintf("%016x-%s", uint64(1<<64-1), uuid.Must(uuid.NewV4()).String())
+	err = storage.PutCell(context.TODO(), hashedID, baseCol, 1, models.Cell{Body: testString})
+	if err != nil {
+		t.Fatalf("putting a cell of a %d byte row key: %v", len(hashedID), err)
+	}
+	v, ok, err = storage.GetCell(context.TODO(), hashedID, baseCol, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || v.RowKey != hashedID {
+		t.Errorf("getting a cell of a %d byte row key: v=%v ok=%v\n", len(hashedID), v, ok)
+	}
+
 	err = storage.ResetConnection(context.TODO(), otherCellID)
 	if err != nil {
 		t.Errorf("failed resetting connection for key: err=%v\n", err)
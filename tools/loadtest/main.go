@@ -0,0 +1,176 @@
+// Command loadtest drives a mix of PutCell, GetCell and PartitionRead calls
+// at an rqlite node from concurrent workers for a fixed time, then prints
+// the p50/p95/p99 latency and throughput of each operation.
+//
+// The cell table must already exist, see storage/rqlite/cell.sql. Row keys
+// are prefixed with the start time of the run, so runs can be repeated
+// against the same table.
+//
+//	loadtest -url http://localhost:4001 -concurrency 16 -writes 0.2 -scans 0.05
+//
+// Without -url or $RQLITE_URL it does nothing.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/rbastic/go-schemaless/models"
+	"github.com/rbastic/go-schemaless/storage/rqlite"
+	"go.uber.org/zap"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type op int
+
+const (
+	opPutCell op = iota
+	opGetCell
+	opPartitionRead
+	numOps
+)
+
+var opNames = [numOps]string{"PutCell", "GetCell", "PartitionRead"}
+
+// latencies are the durations one worker observed, by operation.
+type latencies [numOps][]time.Duration
+
+func main() {
+	urlPtr := flag.String("url", os.Getenv("RQLITE_URL"), "the rqlite node to load, defaults to $RQLITE_URL")
+	tablePtr := flag.String("table", "cell", "the cell table")
+	concurrencyPtr := flag.Int("concurrency", 8, "the number of concurrent workers")
+	durationPtr := flag.Duration("duration", 10*time.Second, "how long to run for")
+	writesPtr := flag.Float64("writes", 0.2, "the fraction of operations that are PutCell")
+	scansPtr := flag.Float64("scans", 0.05, "the fraction of operations that are PartitionRead")
+	bodySizePtr := flag.Int("body", 256, "the size of each cell body in bytes")
+	rowsPtr := flag.Int("rows", 1000, "the number of rows written before the run, for GetCell to read")
+	limitPtr := flag.Int("limit", 100, "the PartitionRead limit")
+
+	flag.Parse()
+
+	if *urlPtr == "" {
+		fmt.Println("No rqlite configured, set -url or RQLITE_URL. Skipping.")
+		return
+	}
+	if *writesPtr < 0 || *scansPtr < 0 || *writesPtr+*scansPtr > 1 {
+		fmt.Fprintln(os.Stderr, "-writes and -scans must be fractions that sum to at most 1")
+		os.Exit(2)
+	}
+	if *concurrencyPtr < 1 || *rowsPtr < 1 {
+		fmt.Fprintln(os.Stderr, "-concurrency and -rows must be positive")
+		os.Exit(2)
+	}
+
+	s, err := rqlite.NewWithConfig(rqlite.Config{URL: *urlPtr, TableName: *tablePtr, Logger: zap.NewNop().Sugar()})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer s.Destroy(context.TODO())
+
+	prefix := fmt.Sprintf("lt%d-", time.Now().Unix())
+	body := `{"payload":"` + strings.Repeat("x", *bodySizePtr) + `"}`
+
+	fmt.Printf("Writing %d rows...\n", *rowsPtr)
+	for i := 0; i < *rowsPtr; i++ {
+		err = s.PutCell(context.TODO(), fmt.Sprintf("%s%d", prefix, i), "BASE", 1, models.Cell{Body: body})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("Running %d workers for %s...\n", *concurrencyPtr, *durationPtr)
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		all     latencies
+		errs    int64
+		nextRef int64 = 1
+	)
+	deadline := time.Now().Add(*durationPtr)
+	start := time.Now()
+	for w := 0; w < *concurrencyPtr; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			var mine latencies
+			for time.Now().Before(deadline) {
+				rowKey := fmt.Sprintf("%s%d", prefix, rng.Intn(*rowsPtr))
+
+				var o op
+				switch f := rng.Float64(); {
+				case f < *writesPtr:
+					o = opPutCell
+				case f < *writesPtr+*scansPtr:
+					o = opPartitionRead
+				default:
+					o = opGetCell
+				}
+
+				t := time.Now()
+				var err error
+				switch o {
+				case opPutCell:
+					refKey := atomic.AddInt64(&nextRef, 1)
+					err = s.PutCell(context.TODO(), rowKey, "BASE", refKey, models.Cell{Body: body})
+				case opGetCell:
+					_, _, err = s.GetCell(context.TODO(), rowKey, "BASE", 1)
+				case opPartitionRead:
+					_, _, err = s.PartitionRead(context.TODO(), 0, "added_at", rng.Intn(*rowsPtr), *limitPtr)
+				}
+				if err != nil {
+					atomic.AddInt64(&errs, 1)
+					continue
+				}
+				mine[o] = append(mine[o], time.Since(t))
+			}
+
+			mu.Lock()
+			for o := range mine {
+				all[o] = append(all[o], mine[o]...)
+			}
+			mu.Unlock()
+		}(time.Now().UnixNano() + int64(w))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report(all, elapsed, errs)
+}
+
+func report(all latencies, elapsed time.Duration, errs int64) {
+	fmt.Printf("\n%-14s %10s %12s %12s %12s %12s\n", "op", "count", "ops/s", "p50", "p95", "p99")
+	var total int
+	for o, durations := range all {
+		total += len(durations)
+		if len(durations) == 0 {
+			continue
+		}
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		fmt.Printf("%-14s %10d %12.1f %12s %12s %12s\n", opNames[o], len(durations),
+			float64(len(durations))/elapsed.Seconds(),
+			percentile(durations, 50), percentile(durations, 95), percentile(durations, 99))
+	}
+	fmt.Printf("%-14s %10d %12.1f\n", "total", total, float64(total)/elapsed.Seconds())
+	if errs > 0 {
+		fmt.Printf("\n%d operations failed\n", errs)
+	}
+}
+
+// percentile returns the p-th percentile of sorted, by the nearest-rank
+// method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1].Round(time.Microsecond)
+}
@@ -0,0 +1,58 @@
+package schemaless
+
+import (
+	"context"
+	"github.com/rbastic/go-schemaless/models"
+	"sort"
+	"time"
+)
+
+// windowPageSize is how many cells PartitionReadWindow reads per query.
+const windowPageSize = 1000
+
+// wallClock is how created_at is compared: storages keep it as a wall clock
+// time in UTC.
+const wallClock = "2006-01-02 15:04:05"
+
+// PartitionReadWindow reads the cells of a partition whose created_at is in
+// [from, to), paging by added_at: it returns at most limit of them added
+// after afterAddedAt, in added_at order, along with the afterAddedAt of the
+// next page, which is 0 once the partition has been read to the end.
+//
+// Paging by added_at is stable, where paging by created_at is not: a cell
+// written with a created_at in the past would sort before a page already
+// read. The window is applied to the cells read, so a narrow window over a
+// large partition scans much more than it returns.
+func (ds *DataStore) PartitionReadWindow(ctx context.Context, partitionNumber int, from time.Time, to time.Time, afterAddedAt int64, limit int) (cells []models.Cell, next int64, err error) {
+	defer ds.observeSlow("PartitionReadWindow", "", time.Now())
+	start := from.UTC().Format(wallClock)
+	end := to.UTC().Format(wallClock)
+
+	for {
+		page, _, err := ds.partitionRead(ctx, partitionNumber, "added_at", afterAddedAt, windowPageSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		sort.Slice(page, func(i, j int) bool {
+			return page[i].AddedAt < page[j].AddedAt
+		})
+
+		for _, cell := range page {
+			afterAddedAt = cell.AddedAt
+			if cell.CreatedAt == nil {
+				continue
+			}
+			createdAt := cell.CreatedAt.UTC().Format(wallClock)
+			if createdAt < start || createdAt >= end {
+				continue
+			}
+			cells = append(cells, cell)
+			if len(cells) == limit {
+				return cells, afterAddedAt, nil
+			}
+		}
+		if len(page) < windowPageSize {
+			return cells, 0, nil
+		}
+	}
+}
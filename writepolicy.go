@@ -0,0 +1,33 @@
+package schemaless
+
+// WritePolicy decides what PutCell does when a column already has a cell at
+// the ref key being written.
+type WritePolicy int
+
+const (
+	// Append keeps cells immutable: writing an existing ref key fails with
+	// models.ErrCellExists. It is the default.
+	Append WritePolicy = iota
+	// Replace overwrites the cell at that ref key, if there is one. The
+	// storage has to implement core.CellReplacer.
+	Replace
+)
+
+// WritePolicyFunc returns the WritePolicy of a column.
+type WritePolicyFunc func(columnName string) WritePolicy
+
+// WithWritePolicy makes PutCell, and the cells it batches or imports, ask fn
+// how to write each column. Columns fn returns Replace for are upserted;
+// every other column is appended to as usual. GetAndModify always appends,
+// since it relies on losing to a concurrent writer.
+func (ds *DataStore) WithWritePolicy(fn WritePolicyFunc) *DataStore {
+	ds.writePolicy = fn
+	return ds
+}
+
+func (ds *DataStore) policy(columnName string) WritePolicy {
+	if ds.writePolicy == nil {
+		return Append
+	}
+	return ds.writePolicy(columnName)
+}